@@ -0,0 +1,97 @@
+// Package apikey contains long-lived API keys that users can create for service accounts and
+// automated jobs as an alternative to auth server tokens.
+package apikey
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Prefix is the prefix of every API key, which distinguishes API keys from auth server
+	// tokens.
+	Prefix = "bsk_"
+	// MaxNameLength is the maximum length of an API key's name in bytes.
+	MaxNameLength = 100
+	// MaxNodes is the maximum number of nodes to which an API key may be restricted.
+	MaxNodes = 1000
+	// MaxLifetime is the maximum time an API key may be used before it expires.
+	MaxLifetime = 365 * 24 * time.Hour
+)
+
+// Scope is the set of operations an API key permits.
+type Scope string
+
+const (
+	// ScopeRead denotes an API key may only be used to read data.
+	ScopeRead Scope = "read"
+	// ScopeWrite denotes an API key may be used for any operation its user may perform, other
+	// than managing API keys.
+	ScopeWrite Scope = "write"
+)
+
+// Key is an API key. The key itself is only available when the key is created.
+type Key struct {
+	// ID is the ID of the key.
+	ID uuid.UUID
+	// User is the account name of the user that created the key and on whose behalf it acts.
+	User string
+	// Name is the name of the key. It may be empty.
+	Name string
+	// Scope is the scope of the key.
+	Scope Scope
+	// Nodes, if not empty, are the only nodes the key may be used to access.
+	Nodes []uuid.UUID
+	// Created is the time the key was created.
+	Created time.Time
+	// Expires is the time the key expires.
+	Expires time.Time
+}
+
+// AllowsNode returns whether the key may be used to access the given node.
+func (k *Key) AllowsNode(id uuid.UUID) bool {
+	if len(k.Nodes) < 1 {
+		return true
+	}
+	for _, n := range k.Nodes {
+		if n == id {
+			return true
+		}
+	}
+	return false
+}
+
+// NoKeyError is returned when an API key doesn't exist.
+type NoKeyError string
+
+// NewNoKeyError creates a new NoKeyError.
+func NewNoKeyError(err string) *NoKeyError {
+	e := NoKeyError(err)
+	return &e
+}
+
+func (e *NoKeyError) Error() string {
+	return string(*e)
+}
+
+// Store stores API keys. Only hashes of the keys are stored.
+type Store interface {
+	// CreateKey creates a new API key for a user, returning the key's metadata and the key
+	// itself, which cannot be retrieved again. The key expires after lifetime, which may be at
+	// most MaxLifetime.
+	CreateKey(user string, name string, scope Scope, nodes []uuid.UUID, lifetime time.Duration,
+	) (*Key, string, error)
+	// GetKey gets an API key's metadata given the key. Returns NoKeyError if the key does not
+	// exist or has expired.
+	GetKey(key string) (*Key, error)
+	// GetKeys gets the metadata for a user's unexpired keys, ordered by creation time.
+	GetKeys(user string) ([]*Key, error)
+	// DeleteKey deletes one of a user's keys. Returns NoKeyError if the user has no such key.
+	DeleteKey(user string, id uuid.UUID) error
+	// DeleteKeys deletes all of a user's keys, including expired keys.
+	DeleteKeys(user string) error
+	// RenameUser transfers all of a user's keys, including expired keys, to the user's new
+	// account name.
+	RenameUser(user string, newUser string) error
+}
@@ -0,0 +1,26 @@
+package apikey
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowsNode(t *testing.T) {
+	n1 := uuid.New()
+	n2 := uuid.New()
+
+	k := &Key{}
+	assert.True(t, k.AllowsNode(n1), "expected node allowed")
+	k = &Key{Nodes: []uuid.UUID{}}
+	assert.True(t, k.AllowsNode(n1), "expected node allowed")
+
+	k = &Key{Nodes: []uuid.UUID{n1}}
+	assert.True(t, k.AllowsNode(n1), "expected node allowed")
+	assert.False(t, k.AllowsNode(n2), "expected node disallowed")
+}
+
+func TestNoKeyError(t *testing.T) {
+	assert.Equal(t, "foo", NewNoKeyError("foo").Error(), "incorrect error")
+}
@@ -0,0 +1,284 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/kbase/blobstore/core/values"
+	bserr "github.com/kbase/blobstore/errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	colKeys        = "apikeys"
+	keyKeysID      = "id"
+	keyKeysHash    = "hash"
+	keyKeysUser    = "user"
+	keyKeysName    = "name"
+	keyKeysScope   = "scope"
+	keyKeysNodes   = "nodes"
+	keyKeysCreated = "time"
+	keyKeysExpires = "expires"
+
+	// 256 bits of randomness.
+	keyBytes = 32
+)
+
+// MongoStore is an API key store using Mongo as the underlying database.
+type MongoStore struct {
+	db  *mongo.Database
+	now func() time.Time
+}
+
+// NewMongoStore creates a new API key store given a MongoDB database for storing keys.
+func NewMongoStore(db *mongo.Database) (*MongoStore, error) {
+	if db == nil {
+		return nil, errors.New("db cannot be nil")
+	}
+	col := db.Collection(colKeys)
+	for _, k := range []string{keyKeysID, keyKeysHash} {
+		if err := addIndex(col, k, true); err != nil {
+			return nil, err
+		}
+	}
+	if err := addIndex(col, keyKeysUser, false); err != nil {
+		return nil, err // hard to test
+	}
+	return &MongoStore{db: db, now: time.Now}, nil
+}
+
+func addIndex(col *mongo.Collection, key string, unique bool) error {
+	mdl := mongo.IndexModel{
+		Keys:    map[string]int{key: 1},
+		Options: &options.IndexOptions{Unique: &unique}}
+	_, err := col.Indexes().CreateOne(context.Background(), mdl, nil)
+	if err != nil {
+		return errors.New("mongo create index: " + err.Error())
+	}
+	return nil
+}
+
+// hashes are not salted since the keys are random and long enough that brute forcing them
+// is impossible.
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateKey creates a new API key for a user, returning the key's metadata and the key
+// itself, which cannot be retrieved again. The key expires after lifetime, which may be at
+// most MaxLifetime.
+func (s *MongoStore) CreateKey(
+	user string,
+	name string,
+	scope Scope,
+	nodes []uuid.UUID,
+	lifetime time.Duration,
+) (*Key, string, error) {
+	user = strings.TrimSpace(user)
+	if user == "" {
+		return nil, "", bserr.WhiteSpaceError("user")
+	}
+	name = strings.TrimSpace(name)
+	if len(name) > MaxNameLength {
+		return nil, "", values.NewIllegalInputError(
+			fmt.Sprintf("API key name is > %d bytes", MaxNameLength))
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return nil, "", values.NewIllegalInputError(
+				"API key name contains control characters")
+		}
+	}
+	if scope != ScopeRead && scope != ScopeWrite {
+		return nil, "", values.NewIllegalInputError(fmt.Sprintf(
+			"API key scope must be %s or %s", ScopeRead, ScopeWrite))
+	}
+	if len(nodes) > MaxNodes {
+		return nil, "", values.NewIllegalInputError(fmt.Sprintf(
+			"API keys may be restricted to at most %d nodes", MaxNodes))
+	}
+	if lifetime <= 0 || lifetime > MaxLifetime {
+		return nil, "", values.NewIllegalInputError(fmt.Sprintf(
+			"API key lifetime must be > 0 and at most %d days", MaxLifetime/(24*time.Hour)))
+	}
+	b := make([]byte, keyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", errors.New("generate API key: " + err.Error()) // dunno how to test
+	}
+	secret := Prefix + base64.RawURLEncoding.EncodeToString(b)
+	nodestrs := []string{}
+	nodeids := []uuid.UUID{}
+	seen := map[uuid.UUID]bool{}
+	for _, n := range nodes {
+		if !seen[n] {
+			seen[n] = true
+			nodestrs = append(nodestrs, n.String())
+			nodeids = append(nodeids, n)
+		}
+	}
+	// mongo only stores milliseconds
+	created := s.now().UTC().Truncate(time.Millisecond)
+	key := &Key{
+		ID:      uuid.New(),
+		User:    user,
+		Name:    name,
+		Scope:   scope,
+		Nodes:   nodeids,
+		Created: created,
+		Expires: created.Add(lifetime).Truncate(time.Millisecond),
+	}
+	doc := map[string]interface{}{
+		keyKeysID:      key.ID.String(),
+		keyKeysHash:    hashKey(secret),
+		keyKeysUser:    key.User,
+		keyKeysName:    key.Name,
+		keyKeysScope:   string(key.Scope),
+		keyKeysNodes:   nodestrs,
+		keyKeysCreated: key.Created,
+		keyKeysExpires: key.Expires,
+	}
+	_, err := s.db.Collection(colKeys).InsertOne(nil, doc)
+	if err != nil {
+		// a duplicate key is astronomically unlikely
+		return nil, "", errors.New("mongo create API key: " + err.Error()) // dunno how to test
+	}
+	return key, secret, nil
+}
+
+// GetKey gets an API key's metadata given the key. Returns NoKeyError if the key does not
+// exist or has expired.
+func (s *MongoStore) GetKey(key string) (*Key, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, bserr.WhiteSpaceError("key")
+	}
+	var doc map[string]interface{}
+	err := s.db.Collection(colKeys).FindOne(nil, map[string]interface{}{
+		keyKeysHash: hashKey(key), keyKeysExpires: s.unexpired()}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, NewNoKeyError("No such API key")
+	}
+	if err != nil {
+		return nil, errors.New("mongo get API key: " + err.Error()) // dunno how to test
+	}
+	return toKey(doc), nil
+}
+
+// GetKeys gets the metadata for a user's unexpired keys, ordered by creation time.
+func (s *MongoStore) GetKeys(user string) ([]*Key, error) {
+	user = strings.TrimSpace(user)
+	if user == "" {
+		return nil, bserr.WhiteSpaceError("user")
+	}
+	opts := options.Find().SetSort(map[string]int{keyKeysCreated: 1})
+	cur, err := s.db.Collection(colKeys).Find(nil, map[string]interface{}{
+		keyKeysUser: user, keyKeysExpires: s.unexpired()}, opts)
+	if err != nil {
+		return nil, errors.New("mongo get API keys: " + err.Error()) // dunno how to test
+	}
+	defer cur.Close(context.Background())
+	keys := []*Key{}
+	for cur.Next(context.Background()) {
+		var doc map[string]interface{}
+		if err := cur.Decode(&doc); err != nil {
+			// dunno how to test this
+			return nil, errors.New("mongo decode API key: " + err.Error())
+		}
+		keys = append(keys, toKey(doc))
+	}
+	if err := cur.Err(); err != nil {
+		return nil, errors.New("mongo iterate API keys: " + err.Error()) // or this
+	}
+	return keys, nil
+}
+
+// DeleteKey deletes one of a user's keys. Returns NoKeyError if the user has no such key.
+func (s *MongoStore) DeleteKey(user string, id uuid.UUID) error {
+	user = strings.TrimSpace(user)
+	if user == "" {
+		return bserr.WhiteSpaceError("user")
+	}
+	res, err := s.db.Collection(colKeys).DeleteOne(
+		nil, map[string]string{keyKeysID: id.String(), keyKeysUser: user})
+	if err != nil {
+		return errors.New("mongo delete API key: " + err.Error()) // dunno how to test
+	}
+	if res.DeletedCount < 1 {
+		return NewNoKeyError("No such API key: " + id.String())
+	}
+	return nil
+}
+
+// DeleteKeys deletes all of a user's keys, including expired keys.
+func (s *MongoStore) DeleteKeys(user string) error {
+	user = strings.TrimSpace(user)
+	if user == "" {
+		return bserr.WhiteSpaceError("user")
+	}
+	_, err := s.db.Collection(colKeys).DeleteMany(nil, map[string]string{keyKeysUser: user})
+	if err != nil {
+		return errors.New("mongo delete API keys: " + err.Error()) // dunno how to test
+	}
+	return nil
+}
+
+// RenameUser transfers all of a user's keys, including expired keys, to the user's new
+// account name.
+func (s *MongoStore) RenameUser(user string, newUser string) error {
+	user = strings.TrimSpace(user)
+	if user == "" {
+		return bserr.WhiteSpaceError("user")
+	}
+	newUser = strings.TrimSpace(newUser)
+	if newUser == "" {
+		return bserr.WhiteSpaceError("newUser")
+	}
+	_, err := s.db.Collection(colKeys).UpdateMany(nil, map[string]string{keyKeysUser: user},
+		map[string]interface{}{"$set": map[string]string{keyKeysUser: newUser}})
+	if err != nil {
+		return errors.New("mongo rename API key user: " + err.Error()) // dunno how to test
+	}
+	return nil
+}
+
+// unexpired returns a filter matching expiration times after the current time.
+func (s *MongoStore) unexpired() map[string]interface{} {
+	return map[string]interface{}{"$gt": s.now()}
+}
+
+func toKey(doc map[string]interface{}) *Key {
+	// errors must be nil unless the db is corrupt
+	id, _ := uuid.Parse(doc[keyKeysID].(string))
+	nodes := []uuid.UUID{}
+	for _, n := range []interface{}(doc[keyKeysNodes].(primitive.A)) {
+		nid, _ := uuid.Parse(n.(string))
+		nodes = append(nodes, nid)
+	}
+	return &Key{
+		ID:      id,
+		User:    doc[keyKeysUser].(string),
+		Name:    doc[keyKeysName].(string),
+		Scope:   Scope(doc[keyKeysScope].(string)),
+		Nodes:   nodes,
+		Created: toTime(doc[keyKeysCreated].(primitive.DateTime)),
+		Expires: toTime(doc[keyKeysExpires].(primitive.DateTime)),
+	}
+}
+
+// see the equivalent function in the nodestore package.
+func toTime(d primitive.DateTime) time.Time {
+	return time.Unix(int64(d)/1000, int64(d)%1000*1000000).UTC()
+}
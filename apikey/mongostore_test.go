@@ -0,0 +1,305 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kbase/blobstore/core/values"
+	"github.com/kbase/blobstore/test/mongocontroller"
+	"github.com/kbase/blobstore/test/testhelpers"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	testDB = "test_apikeys"
+)
+
+type TestSuite struct {
+	suite.Suite
+	mongo         *mongocontroller.Controller
+	deleteTempDir bool
+	client        *mongo.Client
+}
+
+func (t *TestSuite) SetupSuite() {
+	tcfg, err := testhelpers.GetConfig()
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+
+	mongoctl, err := mongocontroller.New(mongocontroller.Params{
+		ExecutablePath: tcfg.MongoExePath,
+		UseWiredTiger:  tcfg.UseWiredTiger,
+		RootTempDir:    tcfg.TempDir,
+	})
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	t.mongo = mongoctl
+	t.deleteTempDir = tcfg.DeleteTempDir
+	copts := options.ClientOptions{Hosts: []string{
+		"localhost:" + strconv.Itoa(mongoctl.GetPort())}}
+	err = copts.Validate()
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	client, err := mongo.NewClient(&copts)
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	err = client.Connect(context.Background())
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	t.client = client
+}
+
+func (t *TestSuite) TearDownSuite() {
+	if t.mongo != nil {
+		t.mongo.Destroy(t.deleteTempDir)
+	}
+}
+
+func (t *TestSuite) SetupTest() {
+	t.client.Database(testDB).Drop(context.Background())
+}
+
+func TestRunSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (t *TestSuite) newStore(times ...time.Time) *MongoStore {
+	s, err := NewMongoStore(t.client.Database(testDB))
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	// the last time is returned for all subsequent calls
+	s.now = func() time.Time {
+		tm := times[0]
+		if len(times) > 1 {
+			times = times[1:]
+		}
+		return tm
+	}
+	return s
+}
+
+func (t *TestSuite) TestConstructFail() {
+	s, err := NewMongoStore(nil)
+	t.Nil(s, "expected error")
+	t.Equal(errors.New("db cannot be nil"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestCreateAndGetKeys() {
+	t1 := time.Date(2019, 6, 1, 1, 1, 1, 1234567, time.UTC)
+	t2 := time.Date(2019, 6, 2, 1, 1, 1, 0, time.FixedZone("foo", 3600))
+	t3 := time.Date(2019, 6, 3, 1, 1, 1, 0, time.UTC)
+	s := t.newStore(t1, t2, t3)
+	n1 := uuid.New()
+	n2 := uuid.New()
+
+	k1, sec1, err := s.CreateKey("  user1  ", "  cron job  ", ScopeRead, nil, MaxLifetime)
+	t.Nil(err, "unexpected error")
+	k2, sec2, err := s.CreateKey(
+		"user1", "", ScopeWrite, []uuid.UUID{n1, n2, n1}, 48*time.Hour+time.Microsecond)
+	t.Nil(err, "unexpected error")
+	k3, sec3, err := s.CreateKey("user2", "other", ScopeWrite, []uuid.UUID{}, time.Hour)
+	t.Nil(err, "unexpected error")
+
+	for _, sec := range []string{sec1, sec2, sec3} {
+		t.True(strings.HasPrefix(sec, "bsk_"), "incorrect prefix")
+		t.Equal(47, len(sec), "incorrect key length")
+	}
+	t.NotEqual(sec1, sec2, "keys are identical")
+
+	e1 := &Key{ID: k1.ID, User: "user1", Name: "cron job", Scope: ScopeRead,
+		Nodes: []uuid.UUID{}, Created: time.Date(2019, 6, 1, 1, 1, 1, 1000000, time.UTC),
+		Expires: time.Date(2020, 5, 31, 1, 1, 1, 1000000, time.UTC)}
+	e2 := &Key{ID: k2.ID, User: "user1", Name: "", Scope: ScopeWrite,
+		Nodes: []uuid.UUID{n1, n2}, Created: time.Date(2019, 6, 2, 0, 1, 1, 0, time.UTC),
+		Expires: time.Date(2019, 6, 4, 0, 1, 1, 0, time.UTC)}
+	e3 := &Key{ID: k3.ID, User: "user2", Name: "other", Scope: ScopeWrite,
+		Nodes: []uuid.UUID{}, Created: t3, Expires: time.Date(2019, 6, 3, 2, 1, 1, 0, time.UTC)}
+	t.Equal(e1, k1, "incorrect key")
+	t.Equal(e2, k2, "incorrect key")
+	t.Equal(e3, k3, "incorrect key")
+
+	k, err := s.GetKey("  " + sec1 + "  ")
+	t.Nil(err, "unexpected error")
+	t.Equal(e1, k, "incorrect key")
+	k, err = s.GetKey(sec2)
+	t.Nil(err, "unexpected error")
+	t.Equal(e2, k, "incorrect key")
+
+	keys, err := s.GetKeys("  user1 ")
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Key{e1, e2}, keys, "incorrect keys")
+	keys, err = s.GetKeys("user2")
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Key{e3}, keys, "incorrect keys")
+	keys, err = s.GetKeys("user3")
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Key{}, keys, "incorrect keys")
+}
+
+func (t *TestSuite) TestKeyExpiry() {
+	t1 := time.Date(2019, 6, 1, 1, 1, 1, 0, time.UTC)
+	s := t.newStore(t1, t1.Add(time.Hour-time.Millisecond), t1.Add(time.Hour-time.Millisecond),
+		t1.Add(time.Hour))
+	k, sec, err := s.CreateKey("user1", "", ScopeRead, nil, time.Hour)
+	t.Nil(err, "unexpected error")
+	expected := &Key{ID: k.ID, User: "user1", Scope: ScopeRead, Nodes: []uuid.UUID{},
+		Created: t1, Expires: t1.Add(time.Hour)}
+
+	got, err := s.GetKey(sec)
+	t.Nil(err, "unexpected error")
+	t.Equal(expected, got, "incorrect key")
+	keys, err := s.GetKeys("user1")
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Key{expected}, keys, "incorrect keys")
+
+	got, err = s.GetKey(sec)
+	t.Nil(got, "expected error")
+	t.Equal(NewNoKeyError("No such API key"), err, "incorrect error")
+	keys, err = s.GetKeys("user1")
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Key{}, keys, "incorrect keys")
+}
+
+func (t *TestSuite) TestCreateKeyFail() {
+	s := t.newStore()
+	nodes := []uuid.UUID{}
+	for i := 0; i < 1001; i++ {
+		nodes = append(nodes, uuid.New())
+	}
+
+	type testcase struct {
+		user     string
+		name     string
+		scope    Scope
+		nodes    []uuid.UUID
+		lifetime time.Duration
+		expected error
+	}
+
+	badlife := values.NewIllegalInputError("API key lifetime must be > 0 and at most 365 days")
+	testcases := []testcase{
+		testcase{"  \t  ", "n", ScopeRead, nil, MaxLifetime,
+			errors.New("user cannot be empty or whitespace only")},
+		testcase{"u", strings.Repeat("a", 101), ScopeRead, nil, MaxLifetime,
+			values.NewIllegalInputError("API key name is > 100 bytes")},
+		testcase{"u", "foo\tbar", ScopeRead, nil, MaxLifetime,
+			values.NewIllegalInputError("API key name contains control characters")},
+		testcase{"u", "n", Scope("admin"), nil, MaxLifetime,
+			values.NewIllegalInputError("API key scope must be read or write")},
+		testcase{"u", "n", ScopeRead, nodes, MaxLifetime,
+			values.NewIllegalInputError("API keys may be restricted to at most 1000 nodes")},
+		testcase{"u", "n", ScopeRead, nil, 0, badlife},
+		testcase{"u", "n", ScopeRead, nil, -time.Hour, badlife},
+		testcase{"u", "n", ScopeRead, nil, MaxLifetime + time.Nanosecond, badlife},
+	}
+
+	for _, tc := range testcases {
+		k, sec, err := s.CreateKey(tc.user, tc.name, tc.scope, tc.nodes, tc.lifetime)
+		t.Nil(k, "expected error")
+		t.Equal("", sec, "expected error")
+		t.Equal(tc.expected, err, "incorrect error")
+	}
+}
+
+func (t *TestSuite) TestGetKeyFail() {
+	s := t.newStore(time.Now())
+	_, sec, _ := s.CreateKey("user1", "", ScopeRead, nil, MaxLifetime)
+
+	k, err := s.GetKey("   ")
+	t.Nil(k, "expected error")
+	t.Equal(errors.New("key cannot be empty or whitespace only"), err, "incorrect error")
+
+	for _, sec := range []string{sec + "a", sec[:len(sec)-1], "bsk_foo"} {
+		k, err = s.GetKey(sec)
+		t.Nil(k, "expected error")
+		t.Equal(NewNoKeyError("No such API key"), err, "incorrect error")
+	}
+
+	keys, err := s.GetKeys("  ")
+	t.Nil(keys, "expected error")
+	t.Equal(errors.New("user cannot be empty or whitespace only"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestDeleteKey() {
+	s := t.newStore(time.Now(), time.Now())
+	k1, sec1, _ := s.CreateKey("user1", "", ScopeRead, nil, MaxLifetime)
+	_, sec2, _ := s.CreateKey("user1", "", ScopeRead, nil, MaxLifetime)
+
+	// other users can't delete the key
+	err := s.DeleteKey("user2", k1.ID)
+	t.Equal(NewNoKeyError("No such API key: "+k1.ID.String()), err, "incorrect error")
+
+	t.Nil(s.DeleteKey("  user1  ", k1.ID), "unexpected error")
+
+	k, err := s.GetKey(sec1)
+	t.Nil(k, "expected error")
+	t.Equal(NewNoKeyError("No such API key"), err, "incorrect error")
+	_, err = s.GetKey(sec2)
+	t.Nil(err, "unexpected error")
+
+	err = s.DeleteKey("user1", k1.ID)
+	t.Equal(NewNoKeyError("No such API key: "+k1.ID.String()), err, "incorrect error")
+
+	err = s.DeleteKey(" \t ", k1.ID)
+	t.Equal(errors.New("user cannot be empty or whitespace only"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestDeleteKeys() {
+	s := t.newStore(time.Now())
+	_, sec1, _ := s.CreateKey("user1", "", ScopeRead, nil, MaxLifetime)
+	_, sec2, _ := s.CreateKey("user1", "", ScopeWrite, nil, MaxLifetime)
+	k3, sec3, _ := s.CreateKey("user2", "", ScopeRead, nil, MaxLifetime)
+
+	t.Nil(s.DeleteKeys("  user1  "), "unexpected error")
+	// deleting the keys of a user without keys has no effect
+	t.Nil(s.DeleteKeys("user1"), "unexpected error")
+
+	for _, sec := range []string{sec1, sec2} {
+		k, err := s.GetKey(sec)
+		t.Nil(k, "expected error")
+		t.Equal(NewNoKeyError("No such API key"), err, "incorrect error")
+	}
+	k, err := s.GetKey(sec3)
+	t.Nil(err, "unexpected error")
+	t.Equal(k3, k, "incorrect key")
+
+	err = s.DeleteKeys(" \t ")
+	t.Equal(errors.New("user cannot be empty or whitespace only"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestRenameUser() {
+	s := t.newStore(time.Now())
+	k1, sec1, _ := s.CreateKey("user1", "", ScopeRead, nil, MaxLifetime)
+	k2, _, _ := s.CreateKey("user2", "", ScopeRead, nil, MaxLifetime)
+
+	t.Nil(s.RenameUser("  user1  ", "  user3  "), "unexpected error")
+
+	k, err := s.GetKey(sec1)
+	t.Nil(err, "unexpected error")
+	k1.User = "user3"
+	t.Equal(k1, k, "incorrect key")
+	keys, err := s.GetKeys("user1")
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Key{}, keys, "incorrect keys")
+	keys, err = s.GetKeys("user2")
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Key{k2}, keys, "incorrect keys")
+
+	err = s.RenameUser(" \t ", "user3")
+	t.Equal(errors.New("user cannot be empty or whitespace only"), err, "incorrect error")
+	err = s.RenameUser("user3", " \t ")
+	t.Equal(errors.New("newUser cannot be empty or whitespace only"), err, "incorrect error")
+}
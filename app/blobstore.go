@@ -75,11 +75,11 @@ func main() {
 		}
 	}()
 
-	graceful(server, 5*time.Second)
+	graceful(server, serv, 5*time.Second)
 }
 
 // see https://gist.github.com/peterhellberg/38117e546c217960747aacf689af3dc2
-func graceful(hs *http.Server, timeout time.Duration) {
+func graceful(hs *http.Server, serv *service.Server, timeout time.Duration) {
 	stop := make(chan os.Signal, 1)
 
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -96,4 +96,5 @@ func graceful(hs *http.Server, timeout time.Duration) {
 	} else {
 		fmt.Println("Server stopped")
 	}
+	serv.Close()
 }
@@ -0,0 +1,111 @@
+// Package audit contains an append-only log of changes made to blobstore nodes.
+package audit
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Action is the type of change that was made to a node.
+type Action string
+
+const (
+	// ActionCreate denotes a node was created from an uploaded file.
+	ActionCreate Action = "create"
+	// ActionCopy denotes a node was created by copying another node.
+	ActionCopy Action = "copy"
+	// ActionDelete denotes a node was deleted.
+	ActionDelete Action = "delete"
+	// ActionAddReaders denotes users were added to a node's read ACL.
+	ActionAddReaders Action = "addreaders"
+	// ActionRemoveReaders denotes users were removed from a node's read ACL.
+	ActionRemoveReaders Action = "removereaders"
+	// ActionSetPublic denotes a node's public flag was changed.
+	ActionSetPublic Action = "setpublic"
+	// ActionChangeOwner denotes a node's owner was changed.
+	ActionChangeOwner Action = "changeowner"
+	// ActionSetFileMetadata denotes a node's filename or format was changed.
+	ActionSetFileMetadata Action = "setfilemetadata"
+	// ActionRenameUser denotes the account name of a node's owner or a user in the node's read
+	// ACL was changed.
+	ActionRenameUser Action = "renameuser"
+)
+
+// NodeState is the state of a node's access controls and file metadata at a point in time.
+type NodeState struct {
+	// Owner is the account name of the node's owner.
+	Owner string
+	// Readers are the account names of the users in the node's read ACL, including the owner.
+	Readers []string
+	// Public is whether the node is publicly readable.
+	Public bool
+	// Filename is the node's filename.
+	Filename string
+	// Format is the node's file format.
+	Format string
+}
+
+// Record is a record of a change to a node.
+type Record struct {
+	// Time is the time the change was recorded. It is set by the log when the record is added.
+	Time time.Time
+	// Action is the type of change made to the node.
+	Action Action
+	// NodeID is the ID of the node that was changed.
+	NodeID uuid.UUID
+	// SourceNodeID is the ID of the node from which the node was copied. Only present for
+	// copy actions.
+	SourceNodeID *uuid.UUID
+	// Actor is the account name of the user that made the change.
+	Actor string
+	// ActorIsAdmin is whether the user that made the change was a blobstore administrator at
+	// the time of the change.
+	ActorIsAdmin bool
+	// Impersonator is the account name of the administrator that made the change while acting
+	// as the actor. Empty if the actor made the change.
+	Impersonator string
+	// IP is the IP address from which the change was requested.
+	IP string
+	// RequestID is the ID of the request that made the change.
+	RequestID string
+	// Before is the state of the node before the change. Absent for create and copy actions.
+	Before *NodeState
+	// After is the state of the node after the change. Absent for delete actions.
+	After *NodeState
+}
+
+// Params are parameters for querying the audit log.
+type Params struct {
+	// NodeID restricts the records to those for the given node, including records where the
+	// node was the source of a copy. Ignored if nil.
+	NodeID *uuid.UUID
+	// Actor restricts the records to those where the change was made by the given user.
+	// Ignored if empty.
+	Actor string
+	// Limit is the maximum number of records to return. Values < 1 or greater than
+	// MaxLimit are treated as MaxLimit.
+	Limit int
+}
+
+// MaxLimit is the maximum number of records that will be returned from a query.
+const MaxLimit = 1000
+
+// Log is an append-only log of changes made to nodes.
+type Log interface {
+	// AddRecord adds a record to the log. The record's time is set to the current time.
+	AddRecord(rec *Record) error
+	// GetRecords gets records from the log, most recent first.
+	GetRecords(params *Params) ([]*Record, error)
+}
+
+func checkRecord(rec *Record) error {
+	if rec == nil {
+		return errors.New("record cannot be nil")
+	}
+	if rec.Action == "" {
+		return errors.New("action cannot be empty")
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	colAudit          = "audit"
+	keyAuditTime      = "time"
+	keyAuditAction    = "act"
+	keyAuditNode      = "node"
+	keyAuditSource    = "src"
+	keyAuditActor     = "user"
+	keyAuditAdmin     = "admin"
+	keyAuditImp       = "imp"
+	keyAuditIP        = "ip"
+	keyAuditRequestID = "rid"
+	keyAuditBefore    = "before"
+	keyAuditAfter     = "after"
+
+	keyStateOwner   = "own"
+	keyStateReaders = "read"
+	keyStatePublic  = "pub"
+	keyStateFile    = "fname"
+	keyStateFormat  = "fmt"
+)
+
+// MongoLog is an audit log using Mongo as the underlying database.
+type MongoLog struct {
+	db  *mongo.Database
+	now func() time.Time
+}
+
+// NewMongoLog creates a new audit log given a MongoDB database for storing records.
+func NewMongoLog(db *mongo.Database) (*MongoLog, error) {
+	if db == nil {
+		return nil, errors.New("db cannot be nil")
+	}
+	col := db.Collection(colAudit)
+	for _, k := range []string{keyAuditNode, keyAuditSource, keyAuditActor, keyAuditTime} {
+		if err := addIndex(col, k); err != nil {
+			return nil, err
+		}
+	}
+	return &MongoLog{db: db, now: time.Now}, nil
+}
+
+func addIndex(col *mongo.Collection, key string) error {
+	mdl := mongo.IndexModel{Keys: map[string]int{key: 1}}
+	_, err := col.Indexes().CreateOne(context.Background(), mdl, nil)
+	if err != nil {
+		return errors.New("mongo create index: " + err.Error())
+	}
+	return nil
+}
+
+// AddRecord adds a record to the log. The record's time is set to the current time.
+func (l *MongoLog) AddRecord(rec *Record) error {
+	if err := checkRecord(rec); err != nil {
+		return err
+	}
+	// mongo only stores milliseconds
+	rec.Time = l.now().UTC().Truncate(time.Millisecond)
+	doc := map[string]interface{}{
+		keyAuditTime:      rec.Time,
+		keyAuditAction:    string(rec.Action),
+		keyAuditNode:      rec.NodeID.String(),
+		keyAuditActor:     rec.Actor,
+		keyAuditAdmin:     rec.ActorIsAdmin,
+		keyAuditIP:        rec.IP,
+		keyAuditRequestID: rec.RequestID,
+		keyAuditBefore:    toStateDoc(rec.Before),
+		keyAuditAfter:     toStateDoc(rec.After),
+	}
+	if rec.SourceNodeID != nil {
+		doc[keyAuditSource] = rec.SourceNodeID.String()
+	}
+	if rec.Impersonator != "" {
+		doc[keyAuditImp] = rec.Impersonator
+	}
+	_, err := l.db.Collection(colAudit).InsertOne(nil, doc)
+	if err != nil {
+		return errors.New("mongo audit add record: " + err.Error()) // dunno how to test this
+	}
+	return nil
+}
+
+func toStateDoc(s *NodeState) interface{} {
+	if s == nil {
+		return nil
+	}
+	readers := s.Readers
+	if readers == nil {
+		readers = []string{}
+	}
+	return bson.D{
+		{Key: keyStateOwner, Value: s.Owner},
+		{Key: keyStateReaders, Value: readers},
+		{Key: keyStatePublic, Value: s.Public},
+		{Key: keyStateFile, Value: s.Filename},
+		{Key: keyStateFormat, Value: s.Format},
+	}
+}
+
+// GetRecords gets records from the log, most recent first.
+func (l *MongoLog) GetRecords(params *Params) ([]*Record, error) {
+	if params == nil {
+		return nil, errors.New("params cannot be nil")
+	}
+	filter := map[string]interface{}{}
+	if params.NodeID != nil {
+		filter["$or"] = []map[string]interface{}{
+			{keyAuditNode: params.NodeID.String()},
+			{keyAuditSource: params.NodeID.String()},
+		}
+	}
+	if params.Actor != "" {
+		filter[keyAuditActor] = params.Actor
+	}
+	limit := int64(params.Limit)
+	if limit < 1 || limit > MaxLimit {
+		limit = MaxLimit
+	}
+	opts := options.Find().SetSort(map[string]int{keyAuditTime: -1}).SetLimit(limit)
+	cur, err := l.db.Collection(colAudit).Find(nil, filter, opts)
+	if err != nil {
+		return nil, errors.New("mongo audit get records: " + err.Error()) // dunno how to test
+	}
+	defer cur.Close(context.Background())
+	recs := []*Record{}
+	for cur.Next(context.Background()) {
+		var doc map[string]interface{}
+		if err := cur.Decode(&doc); err != nil {
+			// dunno how to test this
+			return nil, errors.New("mongo audit decode record: " + err.Error())
+		}
+		recs = append(recs, toRecord(doc))
+	}
+	if err := cur.Err(); err != nil {
+		return nil, errors.New("mongo audit iterate records: " + err.Error()) // or this
+	}
+	return recs, nil
+}
+
+func toRecord(doc map[string]interface{}) *Record {
+	// errors must be nil unless the db is corrupt
+	nid, _ := uuid.Parse(doc[keyAuditNode].(string))
+	rec := &Record{
+		Time:         toTime(doc[keyAuditTime].(primitive.DateTime)),
+		Action:       Action(doc[keyAuditAction].(string)),
+		NodeID:       nid,
+		Actor:        doc[keyAuditActor].(string),
+		ActorIsAdmin: doc[keyAuditAdmin].(bool),
+		IP:           doc[keyAuditIP].(string),
+		RequestID:    doc[keyAuditRequestID].(string),
+		Before:       toState(doc[keyAuditBefore]),
+		After:        toState(doc[keyAuditAfter]),
+	}
+	if src, ok := doc[keyAuditSource]; ok {
+		sid, _ := uuid.Parse(src.(string))
+		rec.SourceNodeID = &sid
+	}
+	if imp, ok := doc[keyAuditImp]; ok {
+		rec.Impersonator = imp.(string)
+	}
+	return rec
+}
+
+func toState(s interface{}) *NodeState {
+	sdoc, ok := s.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	readers := []string{}
+	for _, r := range []interface{}(sdoc[keyStateReaders].(primitive.A)) {
+		readers = append(readers, r.(string))
+	}
+	// records added prior to the addition of file metadata have no filename or format.
+	filename, _ := sdoc[keyStateFile].(string)
+	format, _ := sdoc[keyStateFormat].(string)
+	return &NodeState{
+		Owner:    sdoc[keyStateOwner].(string),
+		Readers:  readers,
+		Public:   sdoc[keyStatePublic].(bool),
+		Filename: filename,
+		Format:   format,
+	}
+}
+
+// see the equivalent function in the nodestore package.
+func toTime(d primitive.DateTime) time.Time {
+	return time.Unix(int64(d)/1000, int64(d)%1000*1000000).UTC()
+}
@@ -0,0 +1,169 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kbase/blobstore/test/mongocontroller"
+	"github.com/kbase/blobstore/test/testhelpers"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	testDB = "test_auditlog"
+)
+
+type TestSuite struct {
+	suite.Suite
+	mongo         *mongocontroller.Controller
+	deleteTempDir bool
+	client        *mongo.Client
+}
+
+func (t *TestSuite) SetupSuite() {
+	tcfg, err := testhelpers.GetConfig()
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+
+	mongoctl, err := mongocontroller.New(mongocontroller.Params{
+		ExecutablePath: tcfg.MongoExePath,
+		UseWiredTiger:  tcfg.UseWiredTiger,
+		RootTempDir:    tcfg.TempDir,
+	})
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	t.mongo = mongoctl
+	t.deleteTempDir = tcfg.DeleteTempDir
+	copts := options.ClientOptions{Hosts: []string{
+		"localhost:" + strconv.Itoa(mongoctl.GetPort())}}
+	err = copts.Validate()
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	client, err := mongo.NewClient(&copts)
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	err = client.Connect(context.Background())
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	t.client = client
+}
+
+func (t *TestSuite) TearDownSuite() {
+	if t.mongo != nil {
+		t.mongo.Destroy(t.deleteTempDir)
+	}
+}
+
+func (t *TestSuite) SetupTest() {
+	t.client.Database(testDB).Drop(context.Background())
+}
+
+func TestRunSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (t *TestSuite) TestConstructFail() {
+	l, err := NewMongoLog(nil)
+	t.Nil(l, "expected error")
+	t.Equal(errors.New("db cannot be nil"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestAddRecordFail() {
+	l, err := NewMongoLog(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+
+	t.Equal(errors.New("record cannot be nil"), l.AddRecord(nil), "incorrect error")
+	t.Equal(errors.New("action cannot be empty"), l.AddRecord(&Record{}), "incorrect error")
+}
+
+func (t *TestSuite) TestGetRecordsFail() {
+	l, err := NewMongoLog(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+
+	recs, err := l.GetRecords(nil)
+	t.Nil(recs, "expected error")
+	t.Equal(errors.New("params cannot be nil"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestAddAndGetRecords() {
+	l, err := NewMongoLog(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+
+	nid := uuid.New()
+	nid2 := uuid.New()
+	tme := time.Date(2019, 6, 1, 12, 30, 45, 123456789, time.UTC)
+	l.now = func() time.Time { return tme }
+
+	create := &Record{
+		Action:    ActionCreate,
+		NodeID:    nid,
+		Actor:     "owner",
+		IP:        "1.2.3.4",
+		RequestID: "1234",
+		After:     &NodeState{Owner: "owner", Readers: []string{"owner"}},
+	}
+	t.Nil(l.AddRecord(create), "unexpected error")
+	t.Equal(time.Date(2019, 6, 1, 12, 30, 45, 123000000, time.UTC), create.Time, "bad time")
+
+	tme = tme.Add(time.Second)
+	share := &Record{
+		Action:       ActionAddReaders,
+		NodeID:       nid,
+		Actor:        "admin",
+		ActorIsAdmin: true,
+		IP:           "5.6.7.8",
+		RequestID:    "5678",
+		Before:       &NodeState{Owner: "owner", Readers: []string{"owner"}},
+		After:        &NodeState{Owner: "owner", Readers: []string{"owner", "r1"}, Public: true},
+	}
+	t.Nil(l.AddRecord(share), "unexpected error")
+
+	tme = tme.Add(time.Second)
+	cp := &Record{
+		Action:       ActionCopy,
+		NodeID:       nid2,
+		SourceNodeID: &nid,
+		Actor:        "r1",
+		Impersonator: "admin",
+		IP:           "1.2.3.4",
+		RequestID:    "9012",
+		After: &NodeState{
+			Owner: "r1", Readers: []string{"r1"}, Filename: "fn.txt", Format: "txt"},
+	}
+	t.Nil(l.AddRecord(cp), "unexpected error")
+
+	recs, err := l.GetRecords(&Params{})
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Record{cp, share, create}, recs, "incorrect records")
+
+	recs, err = l.GetRecords(&Params{NodeID: &nid})
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Record{cp, share, create}, recs, "incorrect records")
+
+	recs, err = l.GetRecords(&Params{NodeID: &nid2})
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Record{cp}, recs, "incorrect records")
+
+	recs, err = l.GetRecords(&Params{NodeID: &nid, Actor: "owner"})
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Record{create}, recs, "incorrect records")
+
+	recs, err = l.GetRecords(&Params{Limit: 2})
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Record{cp, share}, recs, "incorrect records")
+
+	recs, err = l.GetRecords(&Params{Actor: "nobody"})
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Record{}, recs, "incorrect records")
+}
@@ -1,14 +1,17 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/kbase/blobstore/auth"
-
-	gcache "github.com/patrickmn/go-cache"
 )
 
 // TimeProvider provides the current time.
@@ -23,11 +26,102 @@ func (tp *defaultTimeProvider) Now() time.Time {
 	return time.Now()
 }
 
-// Cache caches auth service data from a provider.
+// NamespaceSeparator separates a provider's namespace from the names of the provider's users.
+const NamespaceSeparator = ":"
+
+var namespaceRegex = regexp.MustCompile("^[a-z][a-z\\d_]*$")
+
+// ChainedProvider is an auth provider in a chain of providers.
+type ChainedProvider struct {
+	// Provider is the auth provider.
+	Provider auth.Provider
+	// Namespace, if not empty, is prepended to the names of the provider's users, followed by
+	// NamespaceSeparator, so that they cannot collide with users from other providers.
+	// It must start with a lowercase letter and otherwise consist of lowercase letters, digits,
+	// and underscores.
+	Namespace string
+	// LookupToken, if not empty, is a token for the provider that is used to validate the
+	// provider's user names rather than the token of the user making the request, which
+	// may be from a different provider.
+	LookupToken string
+}
+
+// DefaultSize is the default maximum number of tokens and user names in the cache.
+const DefaultSize = 10000
+
+// Stats are statistics for the cache of valid tokens and user names.
+type Stats struct {
+	// Hits is the number of lookups that found an unexpired entry.
+	Hits int64
+	// Misses is the number of lookups that didn't find an unexpired entry.
+	Misses int64
+	// Evictions is the number of unexpired entries removed to make room for new entries.
+	Evictions int64
+	// Expirations is the number of expired entries removed from the cache.
+	Expirations int64
+	// Size is the current number of entries, some of which may be expired.
+	Size int
+	// MaxSize is the maximum number of entries.
+	MaxSize int
+}
+
+// Cache caches auth service data from one or more providers.
+// Tokens are only stored as hashes.
 type Cache struct {
-	cache *gcache.Cache
-	prov  auth.Provider
-	time  TimeProvider
+	cache    *lru
+	size     int
+	provs    []ChainedProvider
+	time     TimeProvider
+	negcache *lru
+	negttl   time.Duration
+	negsize  int
+	stale    *lru
+	grace    time.Duration
+}
+
+// Size sets the maximum number of tokens and user names in the cache. When the cache is full,
+// the least recently used entry is evicted. The default is DefaultSize.
+func Size(size int) func(*Cache) error {
+	return func(c *Cache) error {
+		if size < 1 {
+			return errors.New("cache size must be > 0")
+		}
+		c.size = size
+		return nil
+	}
+}
+
+// NegativeCache causes the cache to remember invalid tokens and user names for the given
+// time, so that repeated requests with them don't reach the auth providers. At most size
+// invalid tokens and user names are cached; when the cache is full the least recently used
+// entry is evicted.
+func NegativeCache(ttl time.Duration, size int) func(*Cache) error {
+	return func(c *Cache) error {
+		if ttl <= 0 {
+			return errors.New("negative cache time must be > 0")
+		}
+		if size < 1 {
+			return errors.New("negative cache size must be > 0")
+		}
+		c.negttl = ttl
+		c.negsize = size
+		return nil
+	}
+}
+
+// GracePeriod causes the cache to keep users and user names for the given time after their
+// cache time expires. If the auth providers fail, rather than report the token or user name
+// as invalid, when revalidating an expired entry, the expired entry is used instead. Users are
+// never kept past their token's expiration time. The number of expired entries kept is limited
+// to the cache size.
+func GracePeriod(grace time.Duration) func(*Cache) error {
+	return func(c *Cache) error {
+		if grace <= 0 {
+			return errors.New("grace period must be > 0")
+		}
+		c.grace = grace
+		return nil
+	}
 }
 
 // NewCache creates a new auth cache.
@@ -38,29 +132,172 @@ func NewCache(prov auth.Provider) *Cache {
 // NewCacheWithTimeProvider creates a new auth cache with the given time provider.
 // This is primarily useful for testing.
 func NewCacheWithTimeProvider(prov auth.Provider, tp TimeProvider) *Cache {
-	// don't use the default expire time anyway
-	return &Cache{gcache.New(5*time.Minute, 10*time.Minute), prov, tp}
+	return newCache([]ChainedProvider{ChainedProvider{Provider: prov}}, tp)
+}
+
+// NewChainedCache creates a new auth cache that tries each of the providers in order when
+// looking up a user from a token. At most one provider may have an empty namespace, and
+// the namespaces must be unique.
+func NewChainedCache(provs []ChainedProvider, options ...func(*Cache) error) (*Cache, error) {
+	return NewChainedCacheWithTimeProvider(&defaultTimeProvider{}, provs, options...)
+}
+
+// NewChainedCacheWithTimeProvider creates a new chained auth cache with the given time
+// provider. This is primarily useful for testing.
+func NewChainedCacheWithTimeProvider(
+	tp TimeProvider,
+	provs []ChainedProvider,
+	options ...func(*Cache) error,
+) (*Cache, error) {
+	if len(provs) < 1 {
+		return nil, errors.New("at least one provider is required")
+	}
+	seen := map[string]bool{}
+	for _, p := range provs {
+		if p.Provider == nil {
+			return nil, errors.New("provider cannot be nil")
+		}
+		if p.Namespace != "" && !namespaceRegex.MatchString(p.Namespace) {
+			return nil, errors.New("illegal namespace: " + p.Namespace)
+		}
+		if seen[p.Namespace] {
+			return nil, fmt.Errorf("duplicate namespace: '%s'", p.Namespace)
+		}
+		seen[p.Namespace] = true
+	}
+	c := &Cache{size: DefaultSize, provs: provs, time: tp}
+	for _, opt := range options {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	c.init()
+	return c, nil
+}
+
+func newCache(provs []ChainedProvider, tp TimeProvider) *Cache {
+	c := &Cache{size: DefaultSize, provs: provs, time: tp}
+	c.init()
+	return c
+}
+
+// creates the caches once the options are set.
+func (c *Cache) init() {
+	c.cache = newLRU(c.time, c.size)
+	if c.negttl > 0 {
+		c.negcache = newLRU(c.time, c.negsize)
+	}
+	if c.grace > 0 {
+		c.stale = newLRU(c.time, c.size)
+	}
+}
+
+func tokenKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return "t:" + hex.EncodeToString(h[:])
+}
+
+func userKey(name string) string {
+	return "u:" + name
 }
 
-// GetUser gets a user given a token.
+// GetUser gets a user given a token. If there is more than one provider, the providers are
+// tried in order and the user from the first provider that accepts the token is returned.
+// Invalid tokens are cached if a negative cache is configured, and expired users are returned
+// on provider failures if a grace period is configured.
 // Returns InvalidToken error.
 func (c *Cache) GetUser(le *logrus.Entry, token string) (*auth.User, error) {
 	if le == nil {
 		return nil, errors.New("logger cannot be nil")
 	}
-	// could cache bad tokens, but that's just incompetent client programming if they keep trying
-	// to use a bad token.
-	if u, ok := c.cache.Get(token); ok {
+	key := tokenKey(token)
+	if u, ok := c.cache.get(key); ok {
 		return u.(*auth.User), nil
 	}
-	u, expires, cachefor, err := c.prov.GetUser(le, token)
+	if c.negcache != nil {
+		if err, ok := c.negcache.get(key); ok {
+			le.Info("invalid token found in auth negative cache")
+			return nil, err.(error)
+		}
+	}
+	u, expires, cachefor, err := c.getUserFromProviders(le, token)
 	if err != nil {
+		if _, ok := err.(*auth.InvalidTokenError); ok {
+			if c.negcache != nil {
+				c.negcache.set(key, err, c.negttl)
+			}
+		} else if c.stale != nil {
+			if u, ok := c.stale.get(key); ok {
+				le.WithField("error", err.Error()).Warn(
+					"auth providers failed, using expired user from auth cache")
+				return u.(*auth.User), nil
+			}
+		}
 		return nil, err
 	}
-	c.cache.Set(token, u, c.getCacheTime(expires, cachefor))
+	c.cache.set(key, u, c.getCacheTime(expires, cachefor))
+	if c.stale != nil {
+		grace := int(c.grace / time.Millisecond)
+		c.stale.set(key, u, c.getCacheTime(expires, cachefor+grace))
+	}
 	return u, nil
 }
 
+// Stats returns statistics for the cache of valid tokens and user names.
+func (c *Cache) Stats() Stats {
+	return c.cache.stats()
+}
+
+// FlushUser removes a user's cached tokens, including any expired tokens kept for the grace
+// period, so that changes to the user, such as changes to their admin roles, apply to their
+// next request. Returns the number of unexpired or expired tokens removed from the cache.
+func (c *Cache) FlushUser(userName string) int {
+	isUser := func(key string, value interface{}) bool {
+		u, ok := value.(*auth.User)
+		return ok && u.GetUserName() == userName
+	}
+	n := c.cache.removeIf(isUser)
+	if c.stale != nil {
+		c.stale.removeIf(isUser)
+	}
+	return n
+}
+
+// if no provider accepts the token, returns the first error that is not an invalid token error
+// so that provider failures are not hidden, or failing that the first provider's error.
+func (c *Cache) getUserFromProviders(le *logrus.Entry, token string,
+) (*auth.User, int64, int, error) {
+	var tokenerr error
+	var othererr error
+	for _, p := range c.provs {
+		u, expires, cachefor, err := p.Provider.GetUser(le, token)
+		if err == nil {
+			if p.Namespace != "" {
+				u, err = auth.NewUserWithAdminLevel(
+					p.Namespace+NamespaceSeparator+u.GetUserName(), u.GetAdminLevel())
+			}
+			return u, expires, cachefor, err
+		}
+		if len(c.provs) == 1 {
+			return nil, -1, -1, err
+		}
+		if _, ok := err.(*auth.InvalidTokenError); ok {
+			if tokenerr == nil {
+				tokenerr = err
+			}
+		} else {
+			le.WithField("namespace", p.Namespace).WithField("error", err.Error()).Error(
+				"auth provider failed")
+			if othererr == nil {
+				othererr = err
+			}
+		}
+	}
+	if othererr != nil {
+		return nil, -1, -1, othererr
+	}
+	return nil, -1, -1, tokenerr
+}
 func (c *Cache) getCacheTime(expires int64, cachefor int) time.Duration {
 	now := c.time.Now().UnixNano() / 1000000
 	if now+int64(cachefor) < expires { // assume cachefor > 0
@@ -71,28 +308,125 @@ func (c *Cache) getCacheTime(expires int64, cachefor int) time.Duration {
 
 // ValidateUserNames validates that user names exist in the auth system.
 // token can be any valid token - it's used only to look up the userName.
-// Returns InvalidToken error and InvalidUserError.
+// If there is more than one provider, names starting with a provider's namespace and
+// NamespaceSeparator are validated by that provider, and other names by the provider without a
+// namespace. Names that don't match any provider are invalid.
+// Invalid names are cached if a negative cache is configured, and expired names are treated as
+// valid on provider failures if a grace period is configured.
+// token may be empty if the names are cached or the providers have lookup tokens.
+// Returns InvalidToken error, InvalidUserError, and NoTokenError.
 func (c *Cache) ValidateUserNames(le *logrus.Entry, userNames *[]string, token string) error {
 	if le == nil {
 		return errors.New("logger cannot be nil")
 	}
-	cachemiss := []string{}
+	cachemiss := map[int][]string{}
+	invalid := []string{}
 	for _, name := range *userNames {
-		if _, found := c.cache.Get(name); !found {
-			cachemiss = append(cachemiss, name)
+		if _, found := c.cache.get(userKey(name)); !found {
+			i := c.getProviderIndex(name)
+			if i < 0 {
+				invalid = append(invalid, name)
+			} else if c.isNegativeUser(le, name) {
+				invalid = append(invalid, name)
+			} else {
+				cachemiss[i] = append(cachemiss[i], name)
+			}
 		}
 	}
-	if len(cachemiss) > 0 {
-		cachefor, err := c.prov.ValidateUserNames(le, &cachemiss, token)
+	// go through the providers in order to make errors deterministic
+	for i, p := range c.provs {
+		names, ok := cachemiss[i]
+		if !ok {
+			continue
+		}
+		provnames := []string{}
+		for _, n := range names {
+			if p.Namespace != "" {
+				n = strings.TrimPrefix(n, p.Namespace+NamespaceSeparator)
+			}
+			provnames = append(provnames, n)
+		}
+		tok := token
+		if p.LookupToken != "" {
+			tok = p.LookupToken
+		}
+		if strings.TrimSpace(tok) == "" {
+			return auth.NewNoTokenError("User names cannot be validated without a token for " +
+				"the auth provider, and no lookup token is configured")
+		}
+		cachefor, err := p.Provider.ValidateUserNames(le, &provnames, tok)
 		if err != nil {
 			// could cache the good usernames here. Not worth the added complexity.
-			// could also cache bad usernames. That should be rare unless programmers are
-			// incompetent
-			return err
+			iue, ok := err.(*auth.InvalidUserError)
+			if !ok {
+				if c.allStale(names) {
+					le.WithField("error", err.Error()).Warn(
+						"auth providers failed, using expired user names from auth cache")
+					continue
+				}
+				return err
+			}
+			for _, n := range *iue.InvalidUsers {
+				if p.Namespace != "" {
+					n = p.Namespace + NamespaceSeparator + n
+				}
+				invalid = append(invalid, n)
+				if c.negcache != nil {
+					c.negcache.set(userKey(n), struct{}{}, c.negttl)
+				}
+			}
+			continue
 		}
-		for _, name := range cachemiss {
-			c.cache.Set(name, struct{}{}, time.Duration(cachefor)*time.Millisecond)
+		for _, name := range names {
+			c.cache.set(userKey(name), struct{}{}, time.Duration(cachefor)*time.Millisecond)
+			if c.stale != nil {
+				c.stale.set(userKey(name), struct{}{},
+					time.Duration(cachefor)*time.Millisecond+c.grace)
+			}
 		}
 	}
+	if len(invalid) > 0 {
+		return &auth.InvalidUserError{InvalidUsers: &invalid}
+	}
 	return nil
 }
+
+func (c *Cache) isNegativeUser(le *logrus.Entry, name string) bool {
+	if c.negcache == nil {
+		return false
+	}
+	if _, found := c.negcache.get(userKey(name)); found {
+		le.WithField("username", name).Info("invalid user name found in auth negative cache")
+		return true
+	}
+	return false
+}
+
+func (c *Cache) allStale(names []string) bool {
+	if c.stale == nil {
+		return false
+	}
+	for _, n := range names {
+		if _, found := c.stale.get(userKey(n)); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// returns -1 if no provider handles the name.
+func (c *Cache) getProviderIndex(name string) int {
+	if i := strings.Index(name, NamespaceSeparator); i > 0 {
+		for j, p := range c.provs {
+			if p.Namespace == name[:i] {
+				return j
+			}
+		}
+	}
+	for j, p := range c.provs {
+		if p.Namespace == "" {
+			return j
+		}
+	}
+	return -1
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/kbase/blobstore/auth"
 	"github.com/sirupsen/logrus"
+	logrust "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 
 	cachemocks "github.com/kbase/blobstore/auth/cache/mocks"
@@ -26,24 +27,24 @@ func TestGetUserCacheFor(t *testing.T) {
 	le := logrus.WithField("a", "b")
 	// expect cachefor to take precedence
 	provmock.On("GetUser", le, "sometoken").Return(u, int64(1200), 100, nil).Once()
-	timemock.On("Now").Return(time.Unix(1, 0)).Once()
+	now := time.Unix(1, 0)
+	timemock.On("Now").Return(func() time.Time { return now })
 
 	got, err := c.GetUser(le, "sometoken")
 	assert.Equal(t, u, got, "incorrect user")
 	assert.Nil(t, err, "unexpected error")
 
-	time.Sleep(50 * time.Millisecond)
+	now = now.Add(50 * time.Millisecond)
 
 	// now should hit cache
 	got, err = c.GetUser(le, "sometoken")
 	assert.Equal(t, u, got, "incorrect user")
 	assert.Nil(t, err, "unexpected error")
 
-	time.Sleep(60 * time.Millisecond)
+	now = now.Add(60 * time.Millisecond)
 
 	// cache miss again
 	provmock.On("GetUser", le, "sometoken").Return(u, int64(1310), 100, nil).Once()
-	timemock.On("Now").Return(time.Unix(1, 110*1000000)).Once()
 	got, err = c.GetUser(le, "sometoken")
 	assert.Equal(t, u, got, "incorrect user")
 	assert.Nil(t, err, "unexpected error")
@@ -54,7 +55,8 @@ func TestGetUserCacheFor(t *testing.T) {
 	assert.Nil(t, err, "unexpected error")
 
 	provmock.AssertNumberOfCalls(t, "GetUser", 2)
-	timemock.AssertNumberOfCalls(t, "Now", 2)
+	assert.Equal(t, Stats{Hits: 2, Misses: 2, Expirations: 1, Size: 1, MaxSize: 10000},
+		c.Stats(), "incorrect stats")
 }
 
 // could maybe combine w/ test above but I think it'd get too annoying to follow
@@ -73,24 +75,24 @@ func TestGetUserExpires(t *testing.T) {
 	le := logrus.WithField("a", "b")
 	// expect cachefor to take precedence
 	provmock.On("GetUser", le, "sometoken").Return(u, int64(4100), 200, nil).Once()
-	timemock.On("Now").Return(time.Unix(4, 0)).Once()
+	now := time.Unix(4, 0)
+	timemock.On("Now").Return(func() time.Time { return now })
 
 	got, err := c.GetUser(le, "sometoken")
 	assert.Equal(t, u, got, "incorrect user")
 	assert.Nil(t, err, "unexpected error")
 
-	time.Sleep(50 * time.Millisecond)
+	now = now.Add(50 * time.Millisecond)
 
 	// now should hit cache
 	got, err = c.GetUser(le, "sometoken")
 	assert.Equal(t, u, got, "incorrect user")
 	assert.Nil(t, err, "unexpected error")
 
-	time.Sleep(60 * time.Millisecond)
+	now = now.Add(60 * time.Millisecond)
 
 	// cache miss again
 	provmock.On("GetUser", le, "sometoken").Return(u, int64(4210), 200, nil).Once()
-	timemock.On("Now").Return(time.Unix(4, 110*1000000)).Once()
 	got, err = c.GetUser(le, "sometoken")
 	assert.Equal(t, u, got, "incorrect user")
 	assert.Nil(t, err, "unexpected error")
@@ -101,7 +103,8 @@ func TestGetUserExpires(t *testing.T) {
 	assert.Nil(t, err, "unexpected error")
 
 	provmock.AssertNumberOfCalls(t, "GetUser", 2)
-	timemock.AssertNumberOfCalls(t, "Now", 2)
+	assert.Equal(t, Stats{Hits: 2, Misses: 2, Expirations: 1, Size: 1, MaxSize: 10000},
+		c.Stats(), "incorrect stats")
 }
 
 func TestGetUserError(t *testing.T) {
@@ -121,13 +124,13 @@ func TestGetUserError(t *testing.T) {
 	u, _ := auth.NewUser("username", false)
 
 	provmock.On("GetUser", le, "sometoken").Return(u, int64(4100), 200, nil).Once()
-	timemock.On("Now").Return(time.Unix(4, 0)).Once()
+	timemock.On("Now").Return(time.Unix(4, 0))
 	got, err = c.GetUser(le, "sometoken")
 	assert.Equal(t, u, got, "incorrect user")
 	assert.Nil(t, err, "unexpected error")
 
 	provmock.AssertNumberOfCalls(t, "GetUser", 2)
-	timemock.AssertNumberOfCalls(t, "Now", 1)
+	assert.Equal(t, Stats{Misses: 2, Size: 1, MaxSize: 10000}, c.Stats(), "incorrect stats")
 }
 
 func TestGetUserFailNilLogger(t *testing.T) {
@@ -216,3 +219,489 @@ func TestValidateUserNamesFailNilLogger(t *testing.T) {
 	err := c.ValidateUserNames(nil, &[]string{"u1"}, "othertoken")
 	assert.Equal(t, errors.New("logger cannot be nil"), err, "incorrect error")
 }
+
+func TestChainedGetUser(t *testing.T) {
+	kbmock := new(authmocks.Provider)
+	svcmock := new(authmocks.Provider)
+	timemock := new(cachemocks.TimeProvider)
+
+	c, err := NewChainedCacheWithTimeProvider(timemock, []ChainedProvider{
+		ChainedProvider{Provider: kbmock},
+		ChainedProvider{Provider: svcmock, Namespace: "svc"},
+	})
+	assert.Nil(t, err, "unexpected error")
+
+	le := logrus.WithField("a", "b")
+	u, _ := auth.NewUser("username", false)
+	su, _ := auth.NewUserWithAdminLevel("batch", auth.AdminRead)
+	kbmock.On("GetUser", le, "kbtoken").Return(u, int64(10000), 100, nil)
+	kbmock.On("GetUser", le, "svctoken").Return(
+		nil, int64(-1), -1, auth.NewInvalidTokenError("bad kb token"))
+	svcmock.On("GetUser", le, "svctoken").Return(su, int64(10000), 100, nil)
+	timemock.On("Now").Return(time.Unix(1, 0))
+
+	got, err := c.GetUser(le, "kbtoken")
+	assert.Equal(t, u, got, "incorrect user")
+	assert.Nil(t, err, "unexpected error")
+
+	esu, _ := auth.NewUserWithAdminLevel("svc:batch", auth.AdminRead)
+	got, err = c.GetUser(le, "svctoken")
+	assert.Equal(t, esu, got, "incorrect user")
+	assert.Nil(t, err, "unexpected error")
+
+	// cache hits
+	got, _ = c.GetUser(le, "kbtoken")
+	assert.Equal(t, u, got, "incorrect user")
+	got, _ = c.GetUser(le, "svctoken")
+	assert.Equal(t, esu, got, "incorrect user")
+
+	kbmock.AssertNumberOfCalls(t, "GetUser", 2)
+	svcmock.AssertNumberOfCalls(t, "GetUser", 1)
+}
+
+func TestChainedGetUserFail(t *testing.T) {
+	kbmock := new(authmocks.Provider)
+	jwtmock := new(authmocks.Provider)
+	svcmock := new(authmocks.Provider)
+
+	c, _ := NewChainedCache([]ChainedProvider{
+		ChainedProvider{Provider: kbmock},
+		ChainedProvider{Provider: jwtmock, Namespace: "jwt"},
+		ChainedProvider{Provider: svcmock, Namespace: "svc"},
+	})
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	invtok := func(tok string) error {
+		return auth.NewInvalidTokenError("bad " + tok)
+	}
+	kbmock.On("GetUser", le, "t1").Return(nil, int64(-1), -1, invtok("kb"))
+	jwtmock.On("GetUser", le, "t1").Return(nil, int64(-1), -1, invtok("jwt"))
+	svcmock.On("GetUser", le, "t1").Return(nil, int64(-1), -1, invtok("svc"))
+
+	got, err := c.GetUser(le, "t1")
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, invtok("kb"), err, "incorrect error")
+	assert.Equal(t, 0, len(hook.AllEntries()), "unexpected log entries")
+
+	kbmock.On("GetUser", le, "t2").Return(nil, int64(-1), -1, invtok("kb"))
+	jwtmock.On("GetUser", le, "t2").Return(nil, int64(-1), -1, errors.New("jwt down"))
+	svcmock.On("GetUser", le, "t2").Return(nil, int64(-1), -1, errors.New("svc down"))
+
+	got, err = c.GetUser(le, "t2")
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, errors.New("jwt down"), err, "incorrect error")
+	assert.Equal(t, 2, len(hook.AllEntries()), "incorrect log entry count")
+	assert.Equal(t, "auth provider failed", hook.Entries[0].Message, "incorrect message")
+	assert.Equal(t, logrus.Fields{"a": "b", "namespace": "jwt", "error": "jwt down"},
+		hook.Entries[0].Data, "incorrect fields")
+	assert.Equal(t, logrus.Fields{"a": "b", "namespace": "svc", "error": "svc down"},
+		hook.Entries[1].Data, "incorrect fields")
+
+	// a failing provider doesn't prevent a later provider from authenticating the user
+	u, _ := auth.NewUser("batch", false)
+	kbmock.On("GetUser", le, "t3").Return(nil, int64(-1), -1, errors.New("kb down"))
+	jwtmock.On("GetUser", le, "t3").Return(nil, int64(-1), -1, invtok("jwt"))
+	svcmock.On("GetUser", le, "t3").Return(u, int64(1)<<62, 100, nil)
+
+	got, err = c.GetUser(le, "t3")
+	eu, _ := auth.NewUser("svc:batch", false)
+	assert.Equal(t, eu, got, "incorrect user")
+	assert.Nil(t, err, "unexpected error")
+}
+
+func TestChainedValidateUserNames(t *testing.T) {
+	kbmock := new(authmocks.Provider)
+	svcmock := new(authmocks.Provider)
+	othermock := new(authmocks.Provider)
+
+	c, _ := NewChainedCache([]ChainedProvider{
+		ChainedProvider{Provider: svcmock, Namespace: "svc"},
+		ChainedProvider{Provider: kbmock, LookupToken: "kblookup"},
+		ChainedProvider{Provider: othermock, Namespace: "other"},
+	})
+	le := logrus.WithField("a", "b")
+	kbmock.On("ValidateUserNames", le, &[]string{"u1", "foo:u2"}, "kblookup").Return(100, nil)
+	svcmock.On("ValidateUserNames", le, &[]string{"batch", "svc:x"}, "tok").Return(100, nil)
+
+	err := c.ValidateUserNames(
+		le, &[]string{"u1", "svc:batch", "foo:u2", "svc:svc:x"}, "tok")
+	assert.Nil(t, err, "unexpected error")
+
+	// cache hits
+	err = c.ValidateUserNames(le, &[]string{"svc:batch", "u1"}, "tok")
+	assert.Nil(t, err, "unexpected error")
+
+	kbmock.AssertNumberOfCalls(t, "ValidateUserNames", 1)
+	svcmock.AssertNumberOfCalls(t, "ValidateUserNames", 1)
+	othermock.AssertNumberOfCalls(t, "ValidateUserNames", 0)
+}
+
+func TestChainedValidateUserNamesNoToken(t *testing.T) {
+	kbmock := new(authmocks.Provider)
+	svcmock := new(authmocks.Provider)
+
+	c, _ := NewChainedCache([]ChainedProvider{
+		ChainedProvider{Provider: kbmock, LookupToken: "kblookup"},
+		ChainedProvider{Provider: svcmock, Namespace: "svc"},
+	})
+	le := logrus.WithField("a", "b")
+	kbmock.On("ValidateUserNames", le, &[]string{"u1"}, "kblookup").Return(100, nil)
+
+	// the lookup token is used when there's no token
+	err := c.ValidateUserNames(le, &[]string{"u1"}, "")
+	assert.Nil(t, err, "unexpected error")
+
+	err = c.ValidateUserNames(le, &[]string{"u1", "svc:batch"}, "  ")
+	assert.Equal(t, auth.NewNoTokenError("User names cannot be validated without a token for "+
+		"the auth provider, and no lookup token is configured"), err, "incorrect error")
+
+	kbmock.AssertNumberOfCalls(t, "ValidateUserNames", 1)
+	svcmock.AssertNumberOfCalls(t, "ValidateUserNames", 0)
+}
+
+func TestChainedValidateUserNamesFail(t *testing.T) {
+	kbmock := new(authmocks.Provider)
+	svcmock := new(authmocks.Provider)
+	othermock := new(authmocks.Provider)
+
+	c, _ := NewChainedCache([]ChainedProvider{
+		ChainedProvider{Provider: kbmock},
+		ChainedProvider{Provider: svcmock, Namespace: "svc"},
+		ChainedProvider{Provider: othermock, Namespace: "other"},
+	})
+	le := logrus.WithField("a", "b")
+	kbmock.On("ValidateUserNames", le, &[]string{"u1", "u2"}, "tok").Return(
+		-1, &auth.InvalidUserError{InvalidUsers: &[]string{"u2"}})
+	svcmock.On("ValidateUserNames", le, &[]string{"b1", "b2"}, "tok").Return(
+		-1, &auth.InvalidUserError{InvalidUsers: &[]string{"b1", "b2"}})
+	othermock.On("ValidateUserNames", le, &[]string{"o1"}, "tok").Return(100, nil)
+
+	err := c.ValidateUserNames(
+		le, &[]string{"svc:b1", "u1", "other:o1", "u2", "svc:b2"}, "tok")
+	assert.Equal(t, &auth.InvalidUserError{InvalidUsers: &[]string{"u2", "svc:b1", "svc:b2"}},
+		err, "incorrect error")
+
+	// errors other than invalid users are returned immediately
+	kbmock.On("ValidateUserNames", le, &[]string{"u3"}, "tok2").Return(
+		-1, auth.NewInvalidTokenError("bad token"))
+
+	err = c.ValidateUserNames(le, &[]string{"u3", "other:o2"}, "tok2")
+	assert.Equal(t, auth.NewInvalidTokenError("bad token"), err, "incorrect error")
+	othermock.AssertNumberOfCalls(t, "ValidateUserNames", 1)
+
+	// with no provider without a namespace, names without a known namespace are invalid
+	c, _ = NewChainedCache([]ChainedProvider{
+		ChainedProvider{Provider: svcmock, Namespace: "svc"},
+		ChainedProvider{Provider: othermock, Namespace: "other"},
+	})
+	err = c.ValidateUserNames(le, &[]string{"u1", "other:o1", "foo:u2"}, "tok")
+	assert.Equal(t, &auth.InvalidUserError{InvalidUsers: &[]string{"u1", "foo:u2"}},
+		err, "incorrect error")
+}
+
+func TestNewChainedCacheFail(t *testing.T) {
+	provmock := new(authmocks.Provider)
+
+	type testcase struct {
+		provs    []ChainedProvider
+		expected error
+	}
+
+	testcases := []testcase{
+		testcase{nil, errors.New("at least one provider is required")},
+		testcase{[]ChainedProvider{ChainedProvider{Provider: nil}},
+			errors.New("provider cannot be nil")},
+		testcase{[]ChainedProvider{ChainedProvider{Provider: provmock, Namespace: "Svc"}},
+			errors.New("illegal namespace: Svc")},
+		testcase{[]ChainedProvider{ChainedProvider{Provider: provmock, Namespace: "1svc"}},
+			errors.New("illegal namespace: 1svc")},
+		testcase{[]ChainedProvider{ChainedProvider{Provider: provmock, Namespace: "s:vc"}},
+			errors.New("illegal namespace: s:vc")},
+		testcase{[]ChainedProvider{
+			ChainedProvider{Provider: provmock},
+			ChainedProvider{Provider: provmock, Namespace: "svc"},
+			ChainedProvider{Provider: provmock},
+		}, errors.New("duplicate namespace: ''")},
+		testcase{[]ChainedProvider{
+			ChainedProvider{Provider: provmock, Namespace: "svc"},
+			ChainedProvider{Provider: provmock, Namespace: "svc"},
+		}, errors.New("duplicate namespace: 'svc'")},
+	}
+
+	for _, tc := range testcases {
+		c, err := NewChainedCache(tc.provs)
+		assert.Nil(t, c, "expected error")
+		assert.Equal(t, tc.expected, err, "incorrect error")
+	}
+}
+
+func TestNegativeCacheGetUser(t *testing.T) {
+	provmock := new(authmocks.Provider)
+
+	c, err := NewChainedCache([]ChainedProvider{ChainedProvider{Provider: provmock}},
+		NegativeCache(50*time.Millisecond, 10))
+	assert.Nil(t, err, "unexpected error")
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	provmock.On("GetUser", le, "badtoken").Return(
+		nil, int64(-1), -1, auth.NewInvalidTokenError("bad token"))
+	provmock.On("GetUser", le, "downtoken").Return(nil, int64(-1), -1, errors.New("down"))
+
+	for i := 0; i < 2; i++ {
+		got, err := c.GetUser(le, "badtoken")
+		assert.Nil(t, got, "expected error")
+		assert.Equal(t, auth.NewInvalidTokenError("bad token"), err, "incorrect error")
+		got, err = c.GetUser(le, "downtoken")
+		assert.Nil(t, got, "expected error")
+		assert.Equal(t, errors.New("down"), err, "incorrect error")
+	}
+	provmock.AssertNumberOfCalls(t, "GetUser", 3) // provider failures aren't cached
+	assert.Equal(t, 1, len(hook.AllEntries()), "incorrect log entry count")
+	assert.Equal(t, "invalid token found in auth negative cache", hook.Entries[0].Message,
+		"incorrect message")
+	assert.Equal(t, logrus.InfoLevel, hook.Entries[0].Level, "incorrect level")
+
+	time.Sleep(60 * time.Millisecond)
+
+	got, err := c.GetUser(le, "badtoken")
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, auth.NewInvalidTokenError("bad token"), err, "incorrect error")
+	provmock.AssertNumberOfCalls(t, "GetUser", 4)
+}
+
+func TestNegativeCacheFull(t *testing.T) {
+	provmock := new(authmocks.Provider)
+
+	c, _ := NewChainedCache([]ChainedProvider{ChainedProvider{Provider: provmock}},
+		NegativeCache(time.Minute, 1))
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	provmock.On("GetUser", le, "t1").Return(nil, int64(-1), -1, auth.NewInvalidTokenError("t1"))
+	provmock.On("GetUser", le, "t2").Return(nil, int64(-1), -1, auth.NewInvalidTokenError("t2"))
+
+	c.GetUser(le, "t1")
+	c.GetUser(le, "t2") // evicts t1
+	c.GetUser(le, "t2")
+	provmock.AssertNumberOfCalls(t, "GetUser", 2)
+	assert.Equal(t, 1, len(hook.AllEntries()), "incorrect log entry count")
+	c.GetUser(le, "t1")
+	provmock.AssertNumberOfCalls(t, "GetUser", 3)
+}
+
+func TestNegativeCacheValidateUserNames(t *testing.T) {
+	kbmock := new(authmocks.Provider)
+	svcmock := new(authmocks.Provider)
+
+	c, _ := NewChainedCache([]ChainedProvider{
+		ChainedProvider{Provider: kbmock},
+		ChainedProvider{Provider: svcmock, Namespace: "svc"},
+	}, NegativeCache(50*time.Millisecond, 10))
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	kbmock.On("ValidateUserNames", le, &[]string{"u1", "u2"}, "tok").Return(
+		-1, &auth.InvalidUserError{InvalidUsers: &[]string{"u2"}}).Once()
+	svcmock.On("ValidateUserNames", le, &[]string{"b1"}, "tok").Return(
+		-1, &auth.InvalidUserError{InvalidUsers: &[]string{"b1"}}).Once()
+
+	err := c.ValidateUserNames(le, &[]string{"u1", "svc:b1", "u2"}, "tok")
+	assert.Equal(t, &auth.InvalidUserError{InvalidUsers: &[]string{"u2", "svc:b1"}},
+		err, "incorrect error")
+	assert.Equal(t, 0, len(hook.AllEntries()), "unexpected log entries")
+
+	kbmock.On("ValidateUserNames", le, &[]string{"u1"}, "tok").Return(100, nil).Once()
+	err = c.ValidateUserNames(le, &[]string{"u1", "svc:b1", "u2"}, "tok")
+	assert.Equal(t, &auth.InvalidUserError{InvalidUsers: &[]string{"svc:b1", "u2"}},
+		err, "incorrect error")
+	kbmock.AssertNumberOfCalls(t, "ValidateUserNames", 2)
+	svcmock.AssertNumberOfCalls(t, "ValidateUserNames", 1)
+	assert.Equal(t, 2, len(hook.AllEntries()), "incorrect log entry count")
+	assert.Equal(t, "invalid user name found in auth negative cache", hook.Entries[0].Message,
+		"incorrect message")
+	assert.Equal(t, logrus.Fields{"a": "b", "username": "svc:b1"}, hook.Entries[0].Data,
+		"incorrect fields")
+	assert.Equal(t, logrus.Fields{"a": "b", "username": "u2"}, hook.Entries[1].Data,
+		"incorrect fields")
+}
+
+func TestGracePeriodGetUser(t *testing.T) {
+	provmock := new(authmocks.Provider)
+	timemock := new(cachemocks.TimeProvider)
+
+	c, err := NewChainedCacheWithTimeProvider(timemock,
+		[]ChainedProvider{ChainedProvider{Provider: provmock}}, GracePeriod(time.Second))
+	assert.Nil(t, err, "unexpected error")
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	u, _ := auth.NewUser("username", false)
+	now := time.Unix(1, 0)
+	timemock.On("Now").Return(func() time.Time { return now })
+	provmock.On("GetUser", le, "tok").Return(u, int64(1)<<62, 50, nil).Once()
+	// the token expires before the grace period ends
+	provmock.On("GetUser", le, "exptok").Return(u, int64(1050), 50, nil).Once()
+	c.GetUser(le, "tok")
+	c.GetUser(le, "exptok")
+
+	now = now.Add(60 * time.Millisecond)
+
+	provmock.On("GetUser", le, "tok").Return(nil, int64(-1), -1, errors.New("down")).Once()
+	got, err := c.GetUser(le, "tok")
+	assert.Equal(t, u, got, "incorrect user")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, 1, len(hook.AllEntries()), "incorrect log entry count")
+	assert.Equal(t, "auth providers failed, using expired user from auth cache",
+		hook.Entries[0].Message, "incorrect message")
+	assert.Equal(t, logrus.WarnLevel, hook.Entries[0].Level, "incorrect level")
+	assert.Equal(t, logrus.Fields{"a": "b", "error": "down"}, hook.Entries[0].Data,
+		"incorrect fields")
+
+	provmock.On("GetUser", le, "exptok").Return(nil, int64(-1), -1, errors.New("down")).Once()
+	got, err = c.GetUser(le, "exptok")
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, errors.New("down"), err, "incorrect error")
+
+	// invalid tokens are never replaced with expired users
+	provmock.On("GetUser", le, "tok").Return(
+		nil, int64(-1), -1, auth.NewInvalidTokenError("revoked")).Once()
+	got, err = c.GetUser(le, "tok")
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, auth.NewInvalidTokenError("revoked"), err, "incorrect error")
+	provmock.AssertNumberOfCalls(t, "GetUser", 5)
+}
+
+func TestGracePeriodValidateUserNames(t *testing.T) {
+	provmock := new(authmocks.Provider)
+
+	c, _ := NewChainedCache([]ChainedProvider{ChainedProvider{Provider: provmock}},
+		GracePeriod(time.Second))
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	provmock.On("ValidateUserNames", le, &[]string{"u1", "u2"}, "tok").Return(50, nil).Once()
+	assert.Nil(t, c.ValidateUserNames(le, &[]string{"u1", "u2"}, "tok"), "unexpected error")
+
+	time.Sleep(60 * time.Millisecond)
+
+	provmock.On("ValidateUserNames", le, &[]string{"u1", "u2"}, "tok").Return(
+		-1, errors.New("down")).Once()
+	assert.Nil(t, c.ValidateUserNames(le, &[]string{"u1", "u2"}, "tok"), "unexpected error")
+	assert.Equal(t, 1, len(hook.AllEntries()), "incorrect log entry count")
+	assert.Equal(t, "auth providers failed, using expired user names from auth cache",
+		hook.Entries[0].Message, "incorrect message")
+
+	// names that were never validated fail
+	provmock.On("ValidateUserNames", le, &[]string{"u1", "u3"}, "tok").Return(
+		-1, errors.New("down")).Once()
+	err := c.ValidateUserNames(le, &[]string{"u1", "u3"}, "tok")
+	assert.Equal(t, errors.New("down"), err, "incorrect error")
+	provmock.AssertNumberOfCalls(t, "ValidateUserNames", 3)
+}
+
+func TestSizeAndStats(t *testing.T) {
+	provmock := new(authmocks.Provider)
+	timemock := new(cachemocks.TimeProvider)
+
+	c, err := NewChainedCacheWithTimeProvider(timemock,
+		[]ChainedProvider{ChainedProvider{Provider: provmock}}, Size(2))
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, Stats{MaxSize: 2}, c.Stats(), "incorrect stats")
+
+	le := logrus.WithField("a", "b")
+	now := time.Unix(1, 0)
+	timemock.On("Now").Return(func() time.Time { return now })
+	for _, n := range []string{"u1", "u2", "u3"} {
+		u, _ := auth.NewUser(n, false)
+		provmock.On("GetUser", le, "tok"+n).Return(u, int64(1)<<62, 60000, nil)
+	}
+	c.GetUser(le, "toku1")
+	c.GetUser(le, "toku2")
+	c.GetUser(le, "toku1") // u2 is now least recently used
+	assert.Equal(t, Stats{Hits: 1, Misses: 2, Size: 2, MaxSize: 2}, c.Stats(),
+		"incorrect stats")
+
+	c.GetUser(le, "toku3") // evicts u2
+	c.GetUser(le, "toku1")
+	c.GetUser(le, "toku2")
+	assert.Equal(t, Stats{Hits: 2, Misses: 4, Evictions: 2, Size: 2, MaxSize: 2}, c.Stats(),
+		"incorrect stats")
+	provmock.AssertNumberOfCalls(t, "GetUser", 4)
+
+	// user names share the cache
+	provmock.On("ValidateUserNames", le, &[]string{"u4"}, "toku1").Return(60000, nil)
+	assert.Nil(t, c.ValidateUserNames(le, &[]string{"u4"}, "toku1"), "unexpected error")
+	assert.Nil(t, c.ValidateUserNames(le, &[]string{"u4"}, "toku1"), "unexpected error")
+	assert.Equal(t, Stats{Hits: 3, Misses: 5, Evictions: 3, Size: 2, MaxSize: 2}, c.Stats(),
+		"incorrect stats")
+	provmock.AssertNumberOfCalls(t, "ValidateUserNames", 1)
+
+	// expired entries removed to make room for new entries aren't evictions
+	now = now.Add(time.Minute)
+	c.GetUser(le, "toku3")
+	assert.Equal(t, Stats{Hits: 3, Misses: 6, Evictions: 3, Expirations: 1, Size: 2, MaxSize: 2},
+		c.Stats(), "incorrect stats")
+	provmock.AssertNumberOfCalls(t, "GetUser", 5)
+}
+
+func TestDefaultSize(t *testing.T) {
+	c := NewCache(new(authmocks.Provider))
+	assert.Equal(t, Stats{MaxSize: 10000}, c.Stats(), "incorrect stats")
+}
+
+func TestFlushUser(t *testing.T) {
+	provmock := new(authmocks.Provider)
+
+	c, _ := NewChainedCache([]ChainedProvider{ChainedProvider{Provider: provmock}},
+		GracePeriod(time.Minute))
+	le := logrus.WithField("a", "b")
+	u1, _ := auth.NewUser("u1", true)
+	u1n, _ := auth.NewUser("u1", false)
+	u2, _ := auth.NewUser("u2", false)
+	provmock.On("GetUser", le, "t1").Return(u1, int64(1)<<62, 60000, nil).Once()
+	provmock.On("GetUser", le, "t1b").Return(u1, int64(1)<<62, 60000, nil).Once()
+	provmock.On("GetUser", le, "t2").Return(u2, int64(1)<<62, 60000, nil).Once()
+	provmock.On("ValidateUserNames", le, &[]string{"u1"}, "t2").Return(60000, nil).Once()
+	c.GetUser(le, "t1")
+	c.GetUser(le, "t1b")
+	c.GetUser(le, "t2")
+	c.ValidateUserNames(le, &[]string{"u1"}, "t2")
+
+	assert.Equal(t, 0, c.FlushUser("u3"), "incorrect flush count")
+	assert.Equal(t, 2, c.FlushUser("u1"), "incorrect flush count")
+	assert.Equal(t, 2, c.Stats().Size, "incorrect cache size")
+
+	// the user is looked up again, and the grace period copy is gone
+	provmock.On("GetUser", le, "t1").Return(u1n, int64(1)<<62, 60000, nil).Once()
+	provmock.On("GetUser", le, "t1b").Return(nil, int64(-1), -1, errors.New("down")).Once()
+	got, err := c.GetUser(le, "t1")
+	assert.Equal(t, u1n, got, "incorrect user")
+	assert.Nil(t, err, "unexpected error")
+	got, err = c.GetUser(le, "t1b")
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, errors.New("down"), err, "incorrect error")
+
+	got, _ = c.GetUser(le, "t2")
+	assert.Equal(t, u2, got, "incorrect user")
+	assert.Nil(t, c.ValidateUserNames(le, &[]string{"u1"}, "t2"), "unexpected error")
+	provmock.AssertNumberOfCalls(t, "GetUser", 5)
+	provmock.AssertNumberOfCalls(t, "ValidateUserNames", 1)
+}
+
+func TestCacheOptionsFail(t *testing.T) {
+	provs := []ChainedProvider{ChainedProvider{Provider: new(authmocks.Provider)}}
+
+	type testcase struct {
+		opt      func(*Cache) error
+		expected error
+	}
+
+	testcases := []testcase{
+		testcase{NegativeCache(0, 1), errors.New("negative cache time must be > 0")},
+		testcase{NegativeCache(time.Second, 0), errors.New("negative cache size must be > 0")},
+		testcase{GracePeriod(0), errors.New("grace period must be > 0")},
+		testcase{Size(0), errors.New("cache size must be > 0")},
+	}
+
+	for _, tc := range testcases {
+		c, err := NewChainedCache(provs, tc.opt)
+		assert.Nil(t, c, "expected error")
+		assert.Equal(t, tc.expected, err, "incorrect error")
+	}
+}
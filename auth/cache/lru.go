@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lru is a size bounded, least recently used cache with per entry expiration times.
+// It is safe for concurrent use.
+type lru struct {
+	mutex       sync.Mutex
+	time        TimeProvider
+	maxSize     int
+	items       map[string]*list.Element
+	order       *list.List // front is most recently used
+	hits        int64
+	misses      int64
+	evictions   int64
+	expirations int64
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRU(tp TimeProvider, maxSize int) *lru {
+	return &lru{time: tp, maxSize: maxSize, items: map[string]*list.Element{}, order: list.New()}
+}
+
+// get returns the value for a key if the key is present and unexpired.
+func (l *lru) get(key string) (interface{}, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	el, ok := l.items[key]
+	if ok && l.time.Now().Before(el.Value.(*lruEntry).expires) {
+		l.hits++
+		l.order.MoveToFront(el)
+		return el.Value.(*lruEntry).value, true
+	}
+	if ok {
+		l.removeElement(el)
+		l.expirations++
+	}
+	l.misses++
+	return nil, false
+}
+
+// set adds a value to the cache, evicting the least recently used entry if the cache is full.
+func (l *lru) set(key string, value interface{}, ttl time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.time.Now()
+	expires := now.Add(ttl)
+	if el, ok := l.items[key]; ok {
+		el.Value = &lruEntry{key, value, expires}
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[key] = l.order.PushFront(&lruEntry{key, value, expires})
+	if l.order.Len() > l.maxSize {
+		el := l.order.Back()
+		l.removeElement(el)
+		if now.Before(el.Value.(*lruEntry).expires) {
+			l.evictions++
+		} else {
+			l.expirations++
+		}
+	}
+}
+
+// removeIf removes all entries for which the function returns true and returns the number of
+// entries removed.
+func (l *lru) removeIf(remove func(key string, value interface{}) bool) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	count := 0
+	for el := l.order.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*lruEntry)
+		if remove(e.key, e.value) {
+			l.removeElement(el)
+			count++
+		}
+		el = next
+	}
+	return count
+}
+
+func (l *lru) removeElement(el *list.Element) {
+	l.order.Remove(el)
+	delete(l.items, el.Value.(*lruEntry).key)
+}
+
+func (l *lru) stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return Stats{
+		Hits:        l.hits,
+		Misses:      l.misses,
+		Evictions:   l.evictions,
+		Expirations: l.expirations,
+		Size:        l.order.Len(),
+		MaxSize:     l.maxSize,
+	}
+}
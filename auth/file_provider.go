@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	bserr "github.com/kbase/blobstore/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// revoked tokens and removed users may be accepted for this long after the file changes.
+	fileCacheTimeMS = 60 * 1000
+)
+
+// FileProvider provides authentication based on a JSON file containing the valid users, whether
+// each user is a blobstore admin, and the users' tokens. The file has the structure:
+//
+//	{
+//	  "users": {
+//	    "<user name>": {"admin": <true or false>, "readadmin": <true or false>,
+//	                    "tokens": ["<token>", ...]},
+//	    ...
+//	  }
+//	}
+//
+// "admin", "readadmin", and "tokens" are optional, and "admin" takes precedence over
+// "readadmin". The file is reloaded when it changes. If a changed file cannot be loaded, the
+// error is logged and the previous contents are used.
+// Implements auth.Provider.
+type FileProvider struct {
+	path    string
+	lock    sync.Mutex
+	modtime time.Time
+	size    int64
+	users   map[string]*User
+	tokens  map[string]*User
+}
+
+type tokenFile struct {
+	Users map[string]struct {
+		Admin     bool     `json:"admin"`
+		ReadAdmin bool     `json:"readadmin"`
+		Tokens    []string `json:"tokens"`
+	} `json:"users"`
+}
+
+// NewFileProvider creates a new auth provider from the token file at the given path.
+func NewFileProvider(path string) (*FileProvider, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, bserr.WhiteSpaceError("path")
+	}
+	fp := &FileProvider{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.New("auth token file: " + err.Error())
+	}
+	if err := fp.load(info); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// GetPath returns the path to the token file.
+func (fp *FileProvider) GetPath() string {
+	return fp.path
+}
+
+// load loads the token file. The file info is recorded whether or not loading succeeds, so
+// that a bad file is not reloaded until it changes again.
+func (fp *FileProvider) load(info os.FileInfo) error {
+	fp.modtime = info.ModTime()
+	fp.size = info.Size()
+	b, err := ioutil.ReadFile(fp.path)
+	if err != nil {
+		return errors.New("auth token file: " + err.Error()) // dunno how to test this
+	}
+	var tf tokenFile
+	if err := json.Unmarshal(b, &tf); err != nil {
+		return fmt.Errorf("auth token file %s is not valid JSON: %s", fp.path, err)
+	}
+	users := map[string]*User{}
+	tokens := map[string]*User{}
+	for name, fu := range tf.Users {
+		if !validUserName(name) {
+			return fmt.Errorf("auth token file %s contains an illegal user name: %s",
+				fp.path, name)
+		}
+		u := &User{userName: name, admin: AdminNone}
+		if fu.Admin {
+			u.admin = AdminFull
+		} else if fu.ReadAdmin {
+			u.admin = AdminRead
+		}
+		users[name] = u
+		for _, t := range fu.Tokens {
+			t = strings.TrimSpace(t)
+			if t == "" {
+				return fmt.Errorf("auth token file %s contains an empty token for user %s",
+					fp.path, name)
+			}
+			if _, ok := tokens[t]; ok {
+				return fmt.Errorf("auth token file %s contains a duplicate token", fp.path)
+			}
+			tokens[t] = u
+		}
+	}
+	fp.users = users
+	fp.tokens = tokens
+	return nil
+}
+
+// refresh reloads the token file if it has changed. Must be called with the lock held.
+func (fp *FileProvider) refresh(le *logrus.Entry) {
+	info, err := os.Stat(fp.path)
+	if err != nil {
+		le.WithField("error", err.Error()).Error("could not check auth token file")
+		return
+	}
+	if info.ModTime().Equal(fp.modtime) && info.Size() == fp.size {
+		return
+	}
+	if err := fp.load(info); err != nil {
+		le.WithField("error", err.Error()).Error("could not reload auth token file")
+	}
+}
+
+// GetUser gets a user given a token. Tokens never expire, but are only cached for a short time
+// so that changes to the token file take effect.
+// Returns InvalidToken error.
+func (fp *FileProvider) GetUser(le *logrus.Entry, token string) (*User, int64, int, error) {
+	if le == nil {
+		return nil, -1, -1, errors.New("logger cannot be nil")
+	}
+	if strings.TrimSpace(token) == "" {
+		return nil, -1, -1, bserr.WhiteSpaceError("token")
+	}
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fp.refresh(le)
+	u, ok := fp.tokens[strings.TrimSpace(token)]
+	if !ok {
+		return nil, -1, -1, NewInvalidTokenError("Auth token file does not contain token")
+	}
+	return &User{userName: u.userName, admin: u.admin}, math.MaxInt64, fileCacheTimeMS, nil
+}
+
+// ValidateUserNames validates that user names exist in the token file.
+// token can be any valid token - it's used only to look up the userNames.
+// Returns InvalidToken error and InvalidUserError.
+func (fp *FileProvider) ValidateUserNames(le *logrus.Entry, userNames *[]string, token string,
+) (int, error) {
+	if le == nil {
+		return -1, errors.New("logger cannot be nil")
+	}
+	if strings.TrimSpace(token) == "" {
+		return -1, bserr.WhiteSpaceError("token")
+	}
+	if userNames == nil || len(*userNames) < 1 {
+		return -1, errors.New("userNames cannot be nil or empty")
+	}
+	names := []string{}
+	for _, n := range *userNames {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			return -1, bserr.WhiteSpaceError("names in userNames array")
+		}
+		names = append(names, n) // don't modify input
+	}
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fp.refresh(le)
+	if _, ok := fp.tokens[strings.TrimSpace(token)]; !ok {
+		return -1, NewInvalidTokenError("Auth token file does not contain token")
+	}
+	invalid := []string{}
+	for _, n := range names {
+		if _, ok := fp.users[n]; !ok {
+			invalid = append(invalid, n)
+		}
+	}
+	if len(invalid) > 0 {
+		return -1, &InvalidUserError{&invalid}
+	}
+	return fileCacheTimeMS, nil
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logrust "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const tokenFileContents = `{
+	"users": {
+		"user1": {"tokens": ["tok1", "  tok2  "]},
+		"admin": {"admin": true, "tokens": ["tokadmin"]},
+		"reader": {"readadmin": true, "tokens": ["tokread"]},
+		"both": {"admin": true, "readadmin": true, "tokens": ["tokboth"]},
+		"notokens": {}
+	}
+}`
+
+func writeTokenFile(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "FileProviderTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "tokens.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// rewrites the token file and moves the modification time forward, since the file system time
+// resolution may be too coarse to detect the change otherwise.
+func rewriteTokenFile(t *testing.T, path string, contents string, mod time.Time) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileProviderGetUser(t *testing.T) {
+	path, cleanup := writeTokenFile(t, tokenFileContents)
+	defer cleanup()
+
+	fp, err := NewFileProvider("  " + path + "  ")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, path, fp.GetPath(), "incorrect path")
+
+	type testcase struct {
+		token    string
+		expected *User
+	}
+
+	testcases := []testcase{
+		testcase{"tok1", &User{"user1", AdminNone}},
+		testcase{"  tok2 ", &User{"user1", AdminNone}},
+		testcase{"tokadmin", &User{"admin", AdminFull}},
+		testcase{"tokread", &User{"reader", AdminRead}},
+		testcase{"tokboth", &User{"both", AdminFull}},
+	}
+
+	for _, tc := range testcases {
+		u, expires, cachefor, err := fp.GetUser(logrus.WithField("a", "b"), tc.token)
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, tc.expected, u, "incorrect user")
+		assert.Equal(t, int64(math.MaxInt64), expires, "incorrect expires")
+		assert.Equal(t, 60000, cachefor, "incorrect cache time")
+	}
+}
+
+func TestFileProviderGetUserFail(t *testing.T) {
+	path, cleanup := writeTokenFile(t, tokenFileContents)
+	defer cleanup()
+	fp, _ := NewFileProvider(path)
+
+	type testcase struct {
+		le       *logrus.Entry
+		token    string
+		expected error
+	}
+
+	testcases := []testcase{
+		testcase{nil, "tok1", errors.New("logger cannot be nil")},
+		testcase{logrus.WithField("a", "b"), "  \t ",
+			errors.New("token cannot be empty or whitespace only")},
+		testcase{logrus.WithField("a", "b"), "tok3",
+			NewInvalidTokenError("Auth token file does not contain token")},
+	}
+
+	for _, tc := range testcases {
+		u, expires, cachefor, err := fp.GetUser(tc.le, tc.token)
+		assert.Nil(t, u, "expected error")
+		assert.Equal(t, int64(-1), expires, "incorrect expires")
+		assert.Equal(t, -1, cachefor, "incorrect cache time")
+		assert.Equal(t, tc.expected, err, "incorrect error")
+	}
+}
+
+func TestFileProviderValidateUserNames(t *testing.T) {
+	path, cleanup := writeTokenFile(t, tokenFileContents)
+	defer cleanup()
+	fp, _ := NewFileProvider(path)
+
+	names := []string{"  user1  ", "admin", "notokens"}
+	cachefor, err := fp.ValidateUserNames(logrus.WithField("a", "b"), &names, "tok1")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, 60000, cachefor, "incorrect cache time")
+	assert.Equal(t, []string{"  user1  ", "admin", "notokens"}, names, "input modified")
+}
+
+func TestFileProviderValidateUserNamesFail(t *testing.T) {
+	path, cleanup := writeTokenFile(t, tokenFileContents)
+	defer cleanup()
+	fp, _ := NewFileProvider(path)
+
+	type testcase struct {
+		le       *logrus.Entry
+		names    *[]string
+		token    string
+		expected error
+	}
+
+	le := logrus.WithField("a", "b")
+	testcases := []testcase{
+		testcase{nil, &[]string{"user1"}, "tok1", errors.New("logger cannot be nil")},
+		testcase{le, &[]string{"user1"}, "   ",
+			errors.New("token cannot be empty or whitespace only")},
+		testcase{le, nil, "tok1", errors.New("userNames cannot be nil or empty")},
+		testcase{le, &[]string{}, "tok1", errors.New("userNames cannot be nil or empty")},
+		testcase{le, &[]string{"user1", "  \t "}, "tok1",
+			errors.New("names in userNames array cannot be empty or whitespace only")},
+		testcase{le, &[]string{"user1"}, "tok3",
+			NewInvalidTokenError("Auth token file does not contain token")},
+		testcase{le, &[]string{"user2", "admin", "Bad*Name"}, "tok1",
+			&InvalidUserError{&[]string{"user2", "Bad*Name"}}},
+	}
+
+	for _, tc := range testcases {
+		cachefor, err := fp.ValidateUserNames(tc.le, tc.names, tc.token)
+		assert.Equal(t, -1, cachefor, "incorrect cache time")
+		assert.Equal(t, tc.expected, err, "incorrect error")
+	}
+}
+
+func TestFileProviderReload(t *testing.T) {
+	path, cleanup := writeTokenFile(t, tokenFileContents)
+	defer cleanup()
+	fp, _ := NewFileProvider(path)
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	mod := time.Now().Add(time.Hour)
+
+	rewriteTokenFile(t, path, `{"users": {"user2": {"admin": true, "tokens": ["tok1"]}}}`, mod)
+
+	u, _, _, err := fp.GetUser(le, "tok1")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, &User{"user2", AdminFull}, u, "incorrect user")
+	_, err = fp.ValidateUserNames(le, &[]string{"user1"}, "tok1")
+	assert.Equal(t, &InvalidUserError{&[]string{"user1"}}, err, "incorrect error")
+	assert.Equal(t, 0, len(hook.AllEntries()), "unexpected log entries")
+
+	// a bad file is logged and the previous contents are used
+	rewriteTokenFile(t, path, `{"users": {"user2": {"tokens": [" "]}}}`, mod.Add(time.Hour))
+
+	u, _, _, err = fp.GetUser(le, "tok1")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, &User{"user2", AdminFull}, u, "incorrect user")
+	assert.Equal(t, 1, len(hook.AllEntries()), "incorrect log entry count")
+	assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level, "incorrect level")
+	assert.Equal(t, "could not reload auth token file", hook.LastEntry().Message,
+		"incorrect message")
+	assert.Equal(t, "auth token file "+path+" contains an empty token for user user2",
+		hook.LastEntry().Data["error"], "incorrect error")
+
+	// the bad file is not reloaded until it changes
+	_, err = fp.ValidateUserNames(le, &[]string{"user2"}, "tok1")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, 1, len(hook.AllEntries()), "incorrect log entry count")
+
+	// a deleted file is logged and the previous contents are used
+	os.Remove(path)
+	u, _, _, err = fp.GetUser(le, "tok1")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, &User{"user2", AdminFull}, u, "incorrect user")
+	assert.Equal(t, 2, len(hook.AllEntries()), "incorrect log entry count")
+	assert.Equal(t, "could not check auth token file", hook.LastEntry().Message,
+		"incorrect message")
+}
+
+func TestNewFileProviderFail(t *testing.T) {
+	path, cleanup := writeTokenFile(t, "")
+	defer cleanup()
+
+	type testcase struct {
+		contents string
+		expected string
+	}
+
+	testcases := []testcase{
+		testcase{`{"users": {"user1": {}`,
+			"auth token file " + path + " is not valid JSON: unexpected end of JSON input"},
+		testcase{`{"users": []}`,
+			"auth token file " + path + " is not valid JSON: json: cannot unmarshal array " +
+				"into Go struct field tokenFile.users of type map[string]struct { Admin bool " +
+				"\"json:\\\"admin\\\"\"; ReadAdmin bool \"json:\\\"readadmin\\\"\"; " +
+				"Tokens []string \"json:\\\"tokens\\\"\" }"},
+		testcase{`{"users": {"User1": {}}}`,
+			"auth token file " + path + " contains an illegal user name: User1"},
+		testcase{`{"users": {"1user": {}}}`,
+			"auth token file " + path + " contains an illegal user name: 1user"},
+		testcase{`{"users": {"user1": {"tokens": ["tok1", ""]}}}`,
+			"auth token file " + path + " contains an empty token for user user1"},
+		testcase{`{"users": {"user1": {"tokens": ["tok1"]}, "user2": {"tokens": [" tok1"]}}}`,
+			"auth token file " + path + " contains a duplicate token"},
+	}
+
+	for _, tc := range testcases {
+		rewriteTokenFile(t, path, tc.contents, time.Now())
+		fp, err := NewFileProvider(path)
+		assert.Nil(t, fp, "expected error")
+		assert.Equal(t, errors.New(tc.expected), err, "incorrect error")
+	}
+
+	fp, err := NewFileProvider("   \t   ")
+	assert.Nil(t, fp, "expected error")
+	assert.Equal(t, errors.New("path cannot be empty or whitespace only"), err, "incorrect error")
+
+	fp, err = NewFileProvider(path + "nope")
+	assert.Nil(t, fp, "expected error")
+	assert.Equal(t, errors.New("auth token file: stat "+path+"nope: no such file or directory"),
+		err, "incorrect error")
+}
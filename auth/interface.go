@@ -9,21 +9,46 @@ import (
 	"github.com/kbase/blobstore/errors"
 )
 
+// AdminLevel is the level of blob store administration privileges granted to a user.
+type AdminLevel int
+
+const (
+	// AdminNone denotes a user with no administration privileges.
+	AdminNone AdminLevel = iota
+	// AdminRead denotes a user that may read any node and audit record, but may only alter
+	// nodes as a standard user.
+	AdminRead
+	// AdminFull denotes a user that may read and alter any node.
+	AdminFull
+)
+
 // User is a user of an authentication system. The user account name (which is expected to
-// be a unique, permanent identifier for the user) and whether the user is an administrator
-// of the blob store is provided.
+// be a unique, permanent identifier for the user) and the user's level of blob store
+// administration privileges is provided.
 type User struct {
 	userName string
-	isAdmin  bool
+	admin    AdminLevel
 }
 
-// NewUser creates a new user.
+// NewUser creates a new user. If isAdmin is true, the user is a full administrator.
 func NewUser(userName string, isAdmin bool) (*User, error) {
+	admin := AdminNone
+	if isAdmin {
+		admin = AdminFull
+	}
+	return NewUserWithAdminLevel(userName, admin)
+}
+
+// NewUserWithAdminLevel creates a new user with the given administration privileges.
+func NewUserWithAdminLevel(userName string, admin AdminLevel) (*User, error) {
 	userName = strings.TrimSpace(userName)
 	if userName == "" {
 		return nil, errors.WhiteSpaceError("userName")
 	}
-	return &User{userName, isAdmin}, nil
+	if admin < AdminNone || admin > AdminFull {
+		return nil, fmt.Errorf("Invalid admin level: %d", admin)
+	}
+	return &User{userName, admin}, nil
 }
 
 // GetUserName returns the user's user name.
@@ -31,9 +56,20 @@ func (u *User) GetUserName() string {
 	return u.userName
 }
 
-// IsAdmin returns whether the user is a blob store administrator.
+// GetAdminLevel returns the user's level of blob store administration privileges.
+func (u *User) GetAdminLevel() AdminLevel {
+	return u.admin
+}
+
+// IsAdmin returns whether the user is a full blob store administrator.
 func (u *User) IsAdmin() bool {
-	return u.isAdmin
+	return u.admin == AdminFull
+}
+
+// IsReadAdmin returns whether the user may read any data in the blob store, which is true for
+// both read only and full administrators.
+func (u *User) IsReadAdmin() bool {
+	return u.admin >= AdminRead
 }
 
 // InvalidUserError occurs when invalid user names are submitted to ValidateUserNames.
@@ -61,6 +97,20 @@ func (e *InvalidTokenError) Error() string {
 	return string(*e)
 }
 
+// NoTokenError occurs when a token is required but none is available, for example when
+// validating user names for a request that was not authenticated with an auth provider token.
+type NoTokenError string
+
+// NewNoTokenError creates a new no token error.
+func NewNoTokenError(err string) *NoTokenError {
+	e := NoTokenError(err)
+	return &e
+}
+
+func (e *NoTokenError) Error() string {
+	return string(*e)
+}
+
 // Provider provides authentication for a user given the user's token.
 type Provider interface {
 	// GetUser gets a user given a token.
@@ -17,6 +17,31 @@ func TestUser(t *testing.T) {
 	assert.Nil(t, err, "unexpected error")
 	assert.Equal(t, "un2", u.GetUserName(), "incorrect username")
 	assert.Equal(t, true, u.IsAdmin(), "incorrect isAdmin")
+	assert.Equal(t, true, u.IsReadAdmin(), "incorrect isReadAdmin")
+	assert.Equal(t, AdminFull, u.GetAdminLevel(), "incorrect admin level")
+}
+
+func TestUserWithAdminLevel(t *testing.T) {
+	type testcase struct {
+		level     AdminLevel
+		admin     bool
+		readadmin bool
+	}
+
+	testcases := []testcase{
+		testcase{AdminNone, false, false},
+		testcase{AdminRead, false, true},
+		testcase{AdminFull, true, true},
+	}
+
+	for _, tc := range testcases {
+		u, err := NewUserWithAdminLevel("  un  ", tc.level)
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, "un", u.GetUserName(), "incorrect username")
+		assert.Equal(t, tc.level, u.GetAdminLevel(), "incorrect admin level")
+		assert.Equal(t, tc.admin, u.IsAdmin(), "incorrect isAdmin")
+		assert.Equal(t, tc.readadmin, u.IsReadAdmin(), "incorrect isReadAdmin")
+	}
 }
 
 func TestUserFailInput(t *testing.T) {
@@ -24,6 +49,13 @@ func TestUserFailInput(t *testing.T) {
 	assert.Nil(t, u, "expected error")
 	assert.Equal(t, err, errors.New("userName cannot be empty or whitespace only"),
 		"incorrect error")
+
+	u, err = NewUserWithAdminLevel("un", AdminFull+1)
+	assert.Nil(t, u, "expected error")
+	assert.Equal(t, err, errors.New("Invalid admin level: 3"), "incorrect error")
+	u, err = NewUserWithAdminLevel("un", AdminNone-1)
+	assert.Nil(t, u, "expected error")
+	assert.Equal(t, err, errors.New("Invalid admin level: -1"), "incorrect error")
 }
 
 func TestInvalidUserError(t *testing.T) {
@@ -48,3 +80,8 @@ func TestInvalidTokenError(t *testing.T) {
 	e := NewInvalidTokenError("some error")
 	assert.Equal(t, "some error", e.Error(), "incorrect error")
 }
+
+func TestNoTokenError(t *testing.T) {
+	e := NewNoTokenError("some error")
+	assert.Equal(t, "some error", e.Error(), "incorrect error")
+}
@@ -0,0 +1,526 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	// registers the hashes with the crypto package
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	bserr "github.com/kbase/blobstore/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// allowed clock skew between the issuer and the blobstore when checking exp and nbf.
+	jwtLeewaySec = 60
+	// DefaultJWTUserClaim is the claim containing the user name if none is specified.
+	DefaultJWTUserClaim = "preferred_username"
+	// DefaultJWTRolesClaim is the claim containing the user's roles if none is specified.
+	DefaultJWTRolesClaim = "roles"
+)
+
+// JWTProvider provides authentication based on JSON Web Tokens, such as OpenID Connect ID and
+// access tokens, signed by a single issuer. Tokens are verified locally with the issuer's public
+// keys, which are loaded from either a JSON Web Key Set (JWKS) file or a PEM file containing
+// public keys and / or certificates. RS*, PS*, and ES* signatures are supported.
+//
+// Tokens must contain the iss claim, which must match the issuer, and the exp claim.
+// The user name is taken from a configurable claim and must be a legal KBase user name.
+// Since the issuer cannot be queried for users, ValidateUserNames only checks that user names
+// are legal.
+// Implements auth.Provider.
+type JWTProvider struct {
+	issuer      string
+	audience    string
+	userClaim   string
+	rolesClaim  string
+	adminRoles  map[string]struct{}
+	readRoles   map[string]struct{}
+	keys        map[string]crypto.PublicKey
+	unnamedKeys []crypto.PublicKey
+}
+
+// JWTAudience is an option for NewJWTProvider that requires that tokens' aud claim contains
+// the specified audience.
+func JWTAudience(audience string) func(*JWTProvider) error {
+	return func(jp *JWTProvider) error {
+		audience = strings.TrimSpace(audience)
+		if audience == "" {
+			return bserr.WhiteSpaceError("audience")
+		}
+		jp.audience = audience
+		return nil
+	}
+}
+
+// JWTUserClaim is an option for NewJWTProvider that specifies the claim containing the user
+// name. Nested claims are specified with periods, e.g. "kbase.user". The default is
+// DefaultJWTUserClaim.
+func JWTUserClaim(claim string) func(*JWTProvider) error {
+	return func(jp *JWTProvider) error {
+		claim = strings.TrimSpace(claim)
+		if claim == "" {
+			return bserr.WhiteSpaceError("claim")
+		}
+		jp.userClaim = claim
+		return nil
+	}
+}
+
+// JWTRolesClaim is an option for NewJWTProvider that specifies the claim containing the
+// list of the user's roles. Nested claims are specified with periods, e.g.
+// "realm_access.roles". The default is DefaultJWTRolesClaim.
+func JWTRolesClaim(claim string) func(*JWTProvider) error {
+	return func(jp *JWTProvider) error {
+		claim = strings.TrimSpace(claim)
+		if claim == "" {
+			return bserr.WhiteSpaceError("claim")
+		}
+		jp.rolesClaim = claim
+		return nil
+	}
+}
+
+// JWTAdminRole is an option for NewJWTProvider that designates that users with the specified
+// role in the roles claim are blobstore admins.
+func JWTAdminRole(role string) func(*JWTProvider) error {
+	return func(jp *JWTProvider) error {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			return bserr.WhiteSpaceError("role")
+		}
+		jp.adminRoles[role] = struct{}{}
+		return nil
+	}
+}
+
+// JWTReadAdminRole is an option for NewJWTProvider that designates that users with the specified
+// role in the roles claim are read only blobstore admins. JWTAdminRole takes precedence if a
+// user has roles specified by both options.
+func JWTReadAdminRole(role string) func(*JWTProvider) error {
+	return func(jp *JWTProvider) error {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			return bserr.WhiteSpaceError("role")
+		}
+		jp.readRoles[role] = struct{}{}
+		return nil
+	}
+}
+
+// NewJWTProvider creates a new auth provider that accepts tokens from the given issuer signed
+// with the keys in the given JWKS or PEM file.
+func NewJWTProvider(issuer string, keyFile string, options ...func(*JWTProvider) error,
+) (*JWTProvider, error) {
+	issuer = strings.TrimSpace(issuer)
+	if issuer == "" {
+		return nil, bserr.WhiteSpaceError("issuer")
+	}
+	keyFile = strings.TrimSpace(keyFile)
+	if keyFile == "" {
+		return nil, bserr.WhiteSpaceError("keyFile")
+	}
+	jp := &JWTProvider{
+		issuer:     issuer,
+		userClaim:  DefaultJWTUserClaim,
+		rolesClaim: DefaultJWTRolesClaim,
+		adminRoles: map[string]struct{}{},
+		readRoles:  map[string]struct{}{},
+		keys:       map[string]crypto.PublicKey{},
+	}
+	for _, option := range options {
+		err := option(jp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.New("jwt key file: " + err.Error())
+	}
+	b = bytes.TrimSpace(b)
+	if bytes.HasPrefix(b, []byte("{")) {
+		err = jp.loadJWKS(b)
+	} else {
+		err = jp.loadPEM(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwt key file %s: %s", keyFile, err)
+	}
+	if len(jp.keys) < 1 && len(jp.unnamedKeys) < 1 {
+		return nil, fmt.Errorf("jwt key file %s contains no usable keys", keyFile)
+	}
+	return jp, nil
+}
+
+// GetIssuer returns the issuer of the tokens accepted by the provider.
+func (jp *JWTProvider) GetIssuer() string {
+	return jp.issuer
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keys that are not signing keys or are of unsupported types are ignored, as JWKS files
+// commonly contain encryption keys as well as signing keys.
+func (jp *JWTProvider) loadJWKS(b []byte) error {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &jwks); err != nil {
+		return errors.New("invalid JWKS: " + err.Error())
+	}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = toRSAKey(k)
+		case "EC":
+			key, err = toECKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("invalid key %s: %s", k.Kid, err)
+		}
+		if k.Kid == "" {
+			jp.unnamedKeys = append(jp.unnamedKeys, key)
+		} else if _, ok := jp.keys[k.Kid]; ok {
+			return errors.New("duplicate key ID " + k.Kid)
+		} else {
+			jp.keys[k.Kid] = key
+		}
+	}
+	return nil
+}
+
+func toRSAKey(k jwk) (crypto.PublicKey, error) {
+	n, err := decodeBigInt(k.N, "n")
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(k.E, "e")
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() > 1<<31-1 || e.Int64() < 3 {
+		return nil, errors.New("illegal exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func toECKey(k jwk) (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.New("unsupported curve " + k.Crv)
+	}
+	x, err := decodeBigInt(k.X, "x")
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(k.Y, "y")
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on curve " + k.Crv)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeBigInt(s string, name string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) < 1 {
+		return nil, fmt.Errorf("missing or invalid %s parameter", name)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (jp *JWTProvider) loadPEM(b []byte) error {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			return errors.New("unsupported PEM block type " + block.Type)
+		}
+		if err != nil {
+			return errors.New("invalid PEM block: " + err.Error())
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			jp.unnamedKeys = append(jp.unnamedKeys, key)
+		default:
+			return fmt.Errorf("unsupported key type %T", key)
+		}
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		return errors.New("contains data that is not PEM encoded")
+	}
+	return nil
+}
+
+// GetUser gets a user given a token. The token is cached until it expires.
+// Returns InvalidToken error.
+func (jp *JWTProvider) GetUser(le *logrus.Entry, token string) (*User, int64, int, error) {
+	if le == nil {
+		return nil, -1, -1, errors.New("logger cannot be nil")
+	}
+	if strings.TrimSpace(token) == "" {
+		return nil, -1, -1, bserr.WhiteSpaceError("token")
+	}
+	claims, expires, err := jp.verify(strings.TrimSpace(token))
+	if err != nil {
+		return nil, -1, -1, err
+	}
+	name, _ := getClaim(claims, jp.userClaim).(string)
+	name = strings.TrimSpace(name)
+	if !validUserName(name) {
+		return nil, -1, -1, NewInvalidTokenError(fmt.Sprintf(
+			"JWT claim %s is missing or is not a legal user name", jp.userClaim))
+	}
+	admin := AdminNone
+	roles, _ := getClaim(claims, jp.rolesClaim).([]interface{})
+	for _, r := range roles {
+		if rs, ok := r.(string); ok {
+			if _, ok := jp.adminRoles[rs]; ok {
+				admin = AdminFull
+			} else if _, ok := jp.readRoles[rs]; ok && admin == AdminNone {
+				admin = AdminRead
+			}
+		}
+	}
+	cachefor := expires - time.Now().UnixNano()/1000000
+	return &User{userName: name, admin: admin}, expires, int(cachefor), nil
+}
+
+// ValidateUserNames validates that user names are legal KBase user names.
+// token can be any valid token.
+// Returns InvalidToken error and InvalidUserError.
+func (jp *JWTProvider) ValidateUserNames(le *logrus.Entry, userNames *[]string, token string,
+) (int, error) {
+	if le == nil {
+		return -1, errors.New("logger cannot be nil")
+	}
+	if strings.TrimSpace(token) == "" {
+		return -1, bserr.WhiteSpaceError("token")
+	}
+	if userNames == nil || len(*userNames) < 1 {
+		return -1, errors.New("userNames cannot be nil or empty")
+	}
+	invalid := []string{}
+	for _, n := range *userNames {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			return -1, bserr.WhiteSpaceError("names in userNames array")
+		}
+		if !validUserName(n) {
+			invalid = append(invalid, n)
+		}
+	}
+	if _, _, err := jp.verify(strings.TrimSpace(token)); err != nil {
+		return -1, err
+	}
+	if len(invalid) > 0 {
+		return -1, &InvalidUserError{&invalid}
+	}
+	return userExpireTimeMS, nil
+}
+
+// verify checks the token's signature and standard claims and returns the claims and the
+// expiration time in epoch milliseconds.
+func (jp *JWTProvider) verify(token string) (map[string]interface{}, int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, -1, NewInvalidTokenError("Token is not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, -1, NewInvalidTokenError("Invalid JWT header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, -1, NewInvalidTokenError("Invalid JWT signature")
+	}
+	keys := jp.unnamedKeys
+	if k, ok := jp.keys[header.Kid]; ok {
+		keys = []crypto.PublicKey{k}
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		ok, err := verifySignature(header.Alg, k, signed, sig)
+		if err != nil {
+			return nil, -1, err
+		}
+		if ok {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, -1, NewInvalidTokenError("JWT signature could not be verified")
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, -1, NewInvalidTokenError("Invalid JWT claims")
+	}
+	if iss, _ := claims["iss"].(string); iss != jp.issuer {
+		return nil, -1, NewInvalidTokenError("JWT has an unexpected issuer")
+	}
+	if jp.audience != "" && !hasAudience(claims["aud"], jp.audience) {
+		return nil, -1, NewInvalidTokenError("JWT has an unexpected audience")
+	}
+	now := time.Now().Unix()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, -1, NewInvalidTokenError("JWT has no expiration time")
+	}
+	if int64(exp)+jwtLeewaySec <= now {
+		return nil, -1, NewInvalidTokenError("JWT has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && int64(nbf)-jwtLeewaySec > now {
+		return nil, -1, NewInvalidTokenError("JWT is not yet valid")
+	}
+	return claims, int64(exp * 1000), nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+type jwtAlg struct {
+	hash crypto.Hash
+	// RS, PS, or ES
+	family string
+	// the size of the curve for ES algorithms
+	curveBits int
+}
+
+var jwtAlgs = map[string]jwtAlg{
+	"RS256": jwtAlg{crypto.SHA256, "RS", 0},
+	"RS384": jwtAlg{crypto.SHA384, "RS", 0},
+	"RS512": jwtAlg{crypto.SHA512, "RS", 0},
+	"PS256": jwtAlg{crypto.SHA256, "PS", 0},
+	"PS384": jwtAlg{crypto.SHA384, "PS", 0},
+	"PS512": jwtAlg{crypto.SHA512, "PS", 0},
+	"ES256": jwtAlg{crypto.SHA256, "ES", 256},
+	"ES384": jwtAlg{crypto.SHA384, "ES", 384},
+	"ES512": jwtAlg{crypto.SHA512, "ES", 521},
+}
+
+// returns false if the signature is invalid or the key is the wrong type for the algorithm.
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte,
+) (bool, error) {
+	a, ok := jwtAlgs[alg]
+	if !ok {
+		return false, NewInvalidTokenError("Unsupported JWT algorithm " + alg)
+	}
+	h := a.hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch a.family {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, a.hash, digest, sig) == nil, nil
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(k, a.hash, digest, sig, nil) == nil, nil
+	default:
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || k.Curve.Params().BitSize != a.curveBits {
+			return false, nil
+		}
+		size := (a.curveBits + 7) / 8
+		if len(sig) != 2*size {
+			return false, nil
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s), nil
+	}
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getClaim gets a possibly nested claim, where the levels of nesting are separated by periods.
+// Returns nil if the claim doesn't exist.
+func getClaim(claims map[string]interface{}, claim string) interface{} {
+	var v interface{} = claims
+	for _, c := range strings.Split(claim, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[c]
+	}
+	return v
+}
@@ -30,6 +30,7 @@ var nameRegex = regexp.MustCompile(nameInvalidChars)
 type KBaseProvider struct {
 	url           url.URL
 	adminRoles    *[]string
+	readRoles     *[]string
 	endpointToken url.URL
 	endpointMe    url.URL
 	endpointUser  string
@@ -49,6 +50,21 @@ func AdminRole(role string) func(*KBaseProvider) error {
 	}
 }
 
+// ReadAdminRole is an option for NewKBaseProvider that designates that users with the specified
+// KBase auth service role are read only blobstore admins. AdminRole takes precedence if a user
+// has roles specified by both options.
+func ReadAdminRole(role string) func(*KBaseProvider) error {
+	return func(kb *KBaseProvider) error {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			return bserr.WhiteSpaceError("role")
+		}
+		r := append(*kb.readRoles, role)
+		kb.readRoles = &r
+		return nil
+	}
+}
+
 // NewKBaseProvider creates a new auth provider targeting the KBase auth server.
 func NewKBaseProvider(kbaseurl url.URL, options ...func(*KBaseProvider) error,
 ) (*KBaseProvider, error) {
@@ -60,7 +76,8 @@ func NewKBaseProvider(kbaseurl url.URL, options ...func(*KBaseProvider) error,
 		kbaseurl = *kburl
 	}
 	r := []string(nil)
-	kb := &KBaseProvider{url: kbaseurl, adminRoles: &r}
+	rr := []string(nil)
+	kb := &KBaseProvider{url: kbaseurl, adminRoles: &r, readRoles: &rr}
 	for _, option := range options {
 		err := option(kb)
 		if err != nil {
@@ -101,26 +118,31 @@ func (kb *KBaseProvider) GetUser(le *logrus.Entry, token string) (*User, int64,
 		return nil, -1, -1, err // not sure how to test this given the previous passed
 	}
 	roles := mejson["customroles"].([]interface{})
-	isadmin := kb.isAdmin(&roles)
+	admin := AdminNone
+	if hasRole(&roles, kb.adminRoles) {
+		admin = AdminFull
+	} else if hasRole(&roles, kb.readRoles) {
+		admin = AdminRead
+	}
 	expires := int64(tokenjson["expires"].(float64))
 	cachetime := int(tokenjson["cachefor"].(float64))
-	u := &User{userName: tokenjson["user"].(string), isAdmin: isadmin}
+	u := &User{userName: tokenjson["user"].(string), admin: admin}
 	return u, expires, cachetime, nil
 }
 
-// expects roles to be strings
-func (kb *KBaseProvider) isAdmin(roles *[]interface{}) bool {
-	if len(*roles) < 1 || len(*kb.adminRoles) < 1 {
+// expects roles to be strings. Returns true if any of the user's roles are in the target roles.
+func hasRole(roles *[]interface{}, targetRoles *[]string) bool {
+	if len(*roles) < 1 || len(*targetRoles) < 1 {
 		return false
 	}
 	rolemap := map[string]struct{}{}
-	for _, r := range *kb.adminRoles {
+	for _, r := range *targetRoles {
 		rolemap[r] = struct{}{}
 	}
 	for _, r := range *roles {
 		delete(rolemap, r.(string))
 	}
-	return len(rolemap) < len(*kb.adminRoles)
+	return len(rolemap) < len(*targetRoles)
 }
 
 func get(le *logrus.Entry, u url.URL, token string) (map[string]interface{}, error) {
@@ -201,7 +223,7 @@ func (kb *KBaseProvider) ValidateUserNames(le *logrus.Entry, userNames *[]string
 		if n == "" {
 			return -1, bserr.WhiteSpaceError("names in userNames array")
 		}
-		if nameRegex.Match([]byte(n)) || !startsWithLetter(n) {
+		if !validUserName(n) {
 			invalid = append(invalid, n)
 		} else {
 			names = append(names, n) // don't modify input
@@ -227,6 +249,11 @@ func (kb *KBaseProvider) ValidateUserNames(le *logrus.Entry, userNames *[]string
 	return userExpireTimeMS, nil
 }
 
+// validUserName returns whether a user name is a legal KBase user name.
+func validUserName(name string) bool {
+	return !nameRegex.Match([]byte(name)) && startsWithLetter(name)
+}
+
 func startsWithLetter(s string) bool {
 	r, _ := utf8.DecodeRuneInString(s)
 	return unicode.IsLetter(r)
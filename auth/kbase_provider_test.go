@@ -158,28 +158,40 @@ func (t *TestSuite) TestConstructFailBadArgs() {
 	kb, err = NewKBaseProvider(*u, AdminRole("   \t   \n  "))
 	t.Nil(kb, "expected error")
 	t.Equal(errors.New("role cannot be empty or whitespace only"), err, "incorrect error")
+
+	kb, err = NewKBaseProvider(*u, ReadAdminRole("   \t   \n  "))
+	t.Nil(kb, "expected error")
+	t.Equal(errors.New("role cannot be empty or whitespace only"), err, "incorrect error")
 }
 
 type tgu struct {
 	Token      string
 	AdminRoles *[]string
+	ReadRoles  *[]string
 	UserName   string
-	IsAdmin    bool
+	Admin      AdminLevel
 }
 
 func (t *TestSuite) TestGetUser() {
+	none := &[]string{}
+	both := &[]string{blobstoreRole, adminRole}
 
 	testcases := []tgu{
-		tgu{t.tokenNoRole, &[]string{}, "noroles", false},
-		tgu{t.tokenNoRole, &[]string{blobstoreRole, adminRole}, "noroles", false},
-
-		tgu{t.tokenStdRole, &[]string{}, "admin_std_role", false},
-		tgu{t.tokenStdRole, &[]string{"foo"}, "admin_std_role", false},
-		tgu{t.tokenStdRole, &[]string{adminRole}, "admin_std_role", false},
-		tgu{t.tokenStdRole, &[]string{blobstoreRole, adminRole}, "admin_std_role", true},
-
-		tgu{t.tokenKBaseAdmin, &[]string{blobstoreRole}, "admin_kbase", false},
-		tgu{t.tokenKBaseAdmin, &[]string{blobstoreRole, adminRole}, "admin_kbase", true},
+		tgu{t.tokenNoRole, &[]string{}, none, "noroles", AdminNone},
+		tgu{t.tokenNoRole, both, both, "noroles", AdminNone},
+
+		tgu{t.tokenStdRole, &[]string{}, none, "admin_std_role", AdminNone},
+		tgu{t.tokenStdRole, &[]string{"foo"}, none, "admin_std_role", AdminNone},
+		tgu{t.tokenStdRole, &[]string{adminRole}, none, "admin_std_role", AdminNone},
+		tgu{t.tokenStdRole, both, none, "admin_std_role", AdminFull},
+		tgu{t.tokenStdRole, &[]string{adminRole}, &[]string{blobstoreRole}, "admin_std_role",
+			AdminRead},
+		tgu{t.tokenStdRole, &[]string{blobstoreRole}, &[]string{blobstoreRole},
+			"admin_std_role", AdminFull},
+
+		tgu{t.tokenKBaseAdmin, &[]string{blobstoreRole}, none, "admin_kbase", AdminNone},
+		tgu{t.tokenKBaseAdmin, both, none, "admin_kbase", AdminFull},
+		tgu{t.tokenKBaseAdmin, none, &[]string{adminRole}, "admin_kbase", AdminRead},
 	}
 
 	for _, tc := range testcases {
@@ -192,12 +204,15 @@ func (t *TestSuite) checkUser(tc *tgu) {
 	for _, r := range *tc.AdminRoles {
 		opts = append(opts, AdminRole(r))
 	}
+	for _, r := range *tc.ReadRoles {
+		opts = append(opts, ReadAdminRole(r))
+	}
 
 	kb, err := NewKBaseProvider(*t.authURL, opts...)
 	t.Nil(err, "unexpected error")
 	u, expires, cachefor, err := kb.GetUser(logrus.WithField("a", "b"), tc.Token)
 	t.Nil(err, "unexpected error")
-	expected := User{tc.UserName, tc.IsAdmin}
+	expected := User{tc.UserName, tc.Admin}
 	t.Equal(&expected, u, "incorrect user")
 	// testing against a local authserver, so checking more or less exact values is ok
 	t.Equal(5*60*1000, cachefor, "incorrect cachefor")
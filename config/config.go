@@ -4,7 +4,9 @@ package config
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-ini/ini"
 )
@@ -37,16 +39,107 @@ const (
 	KeyS3DisableSSL = "s3-disable-ssl"
 	// KeyS3Region is the configuration key where the value is the S3 region
 	KeyS3Region = "s3-region"
+	// KeyAuthProvider is the configuration key where the value is comma-delimited auth
+	// providers to try in order, each one of AuthProviderKBase (the default), AuthProviderFile,
+	// or AuthProviderJWT, optionally followed by a colon and the namespace for the provider's
+	// users.
+	KeyAuthProvider = "auth-provider"
+	// KeyAuthLookupTokenFormat is the format of the configuration key where the value is the
+	// token used to validate user names with an auth provider.
+	KeyAuthLookupTokenFormat = "auth-%s-lookup-token"
+	// KeyAuthCacheSize is the configuration key where the value is the maximum number of
+	// valid tokens and user names to cache.
+	KeyAuthCacheSize = "auth-cache-size"
+	// KeyAuthNegativeCacheSec is the configuration key where the value is the number of
+	// seconds to cache invalid tokens and user names. 0, the default, disables the cache.
+	KeyAuthNegativeCacheSec = "auth-negative-cache-sec"
+	// KeyAuthNegativeCacheSize is the configuration key where the value is the maximum number
+	// of invalid tokens and user names to cache.
+	KeyAuthNegativeCacheSize = "auth-negative-cache-size"
+	// KeyAuthGracePeriodSec is the configuration key where the value is the number of seconds
+	// after cached users and user names expire that they may still be used if the auth
+	// providers fail. 0, the default, disables the grace period.
+	KeyAuthGracePeriodSec = "auth-grace-period-sec"
+	// KeyAuthTokenFile is the configuration key where the value is the path to the token file
+	// for the file auth provider.
+	KeyAuthTokenFile = "auth-token-file"
+	// KeyJWTIssuer is the configuration key where the value is the issuer of the JWTs accepted
+	// by the jwt auth provider.
+	KeyJWTIssuer = "jwt-issuer"
+	// KeyJWTKeyFile is the configuration key where the value is the path to a JWKS or PEM file
+	// containing the issuer's public keys.
+	KeyJWTKeyFile = "jwt-key-file"
+	// KeyJWTAudience is the configuration key where the value is the audience that must be
+	// present in JWTs.
+	KeyJWTAudience = "jwt-audience"
+	// KeyJWTUserClaim is the configuration key where the value is the JWT claim containing the
+	// user name.
+	KeyJWTUserClaim = "jwt-user-claim"
+	// KeyJWTRolesClaim is the configuration key where the value is the JWT claim containing the
+	// user's roles.
+	KeyJWTRolesClaim = "jwt-roles-claim"
+	// KeyJWTAdminRoles is the configuration key where the value is comma-delimited JWT roles
+	// that denote that a user is a blobstore admin
+	KeyJWTAdminRoles = "jwt-admin-roles"
+	// KeyJWTReadAdminRoles is the configuration key where the value is comma-delimited JWT roles
+	// that denote that a user is a read only blobstore admin
+	KeyJWTReadAdminRoles = "jwt-read-admin-roles"
 	// KeyAuthURL is the configuration key where the value is the KBase auth server URL
 	KeyAuthURL = "kbase-auth-url"
 	// KeyAuthAdminRoles is the configuration key where the value is comma-delimited auth server
 	// roles that denote that a user is a blobstore admin
 	KeyAuthAdminRoles = "kbase-auth-admin-roles"
+	// KeyAuthReadAdminRoles is the configuration key where the value is comma-delimited auth
+	// server roles that denote that a user is a read only blobstore admin
+	KeyAuthReadAdminRoles = "kbase-auth-read-admin-roles"
+	// KeyAuthCookieName is the configuration key where the value is the name of a cookie from
+	// which to read the user's token if the Authorization header is not present.
+	KeyAuthCookieName = "auth-cookie-name"
 	// KeyDontTrustXIPHeaders is the configuration key where the value determines whether to
 	// distrust the X-Forwarded-For and X-Real-IP headers (true) or not (anything else).
 	KeyDontTrustXIPHeaders = "dont-trust-x-ip-headers"
+	// KeyWebhooks is the configuration key where the value is comma-delimited names of webhooks
+	// to which node events will be delivered. For each name, the URL and secret for the webhook
+	// are found at the keys webhook-[name]-url and webhook-[name]-secret.
+	KeyWebhooks = "webhooks"
+	// KeyWebhookURLFormat is the format of the configuration key where the value is the URL of
+	// a webhook.
+	KeyWebhookURLFormat = "webhook-%s-url"
+	// KeyWebhookSecretFormat is the format of the configuration key where the value is the
+	// secret used to sign events delivered to a webhook.
+	KeyWebhookSecretFormat = "webhook-%s-secret"
 )
 
+const (
+	// AuthProviderKBase denotes that users are authenticated with the KBase auth server.
+	AuthProviderKBase = "kbase"
+	// AuthProviderFile denotes that users are authenticated with a static token file.
+	AuthProviderFile = "file"
+	// AuthProviderJWT denotes that users are authenticated with JSON Web Tokens.
+	AuthProviderJWT = "jwt"
+)
+
+// Webhook contains the configuration for a webhook.
+type Webhook struct {
+	// Name is the name of the webhook.
+	Name string
+	// URL is the absolute URL to which events will be delivered. It is never nil.
+	URL *url.URL
+	// Secret is the secret used to sign events delivered to the webhook.
+	Secret string
+}
+
+// AuthProvider contains the configuration for an auth provider in the chain of providers.
+type AuthProvider struct {
+	// Type is the type of the provider, one of AuthProviderKBase, AuthProviderFile, or
+	// AuthProviderJWT.
+	Type string
+	// Namespace is the namespace for the provider's users. It may be empty.
+	Namespace string
+	// LookupToken is the token used to validate user names with the provider. It may be empty.
+	LookupToken string
+}
+
 // Config contains the server configuration.
 type Config struct {
 	// Host is the host for the server, e.g. localhost:[port] or 0.0.0.0:[port]
@@ -71,14 +164,59 @@ type Config struct {
 	S3DisableSSL bool
 	// S3Region is the S3 region
 	S3Region string
-	// AuthURL is the KBase auth server URL. It is never nil.
+	// AuthProviders are the auth providers to try, in order. It is never nil or empty, and
+	// contains at most one provider of each type.
+	AuthProviders *[]AuthProvider
+	// AuthCacheSize is the maximum number of valid tokens and user names to cache. If 0, the
+	// default size is used.
+	AuthCacheSize int
+	// AuthNegativeCacheTime is the time to cache invalid tokens and user names. If 0, they are
+	// not cached.
+	AuthNegativeCacheTime time.Duration
+	// AuthNegativeCacheSize is the maximum number of invalid tokens and user names to cache. If
+	// 0, the default size is used.
+	AuthNegativeCacheSize int
+	// AuthGracePeriod is the time after cached users and user names expire that they may still
+	// be used if the auth providers fail. If 0, there is no grace period.
+	AuthGracePeriod time.Duration
+	// AuthTokenFile is the path to the token file for the file auth provider. It is empty
+	// unless AuthProviders contains AuthProviderFile.
+	AuthTokenFile string
+	// AuthURL is the KBase auth server URL. It is nil unless AuthProviders contains
+	// AuthProviderKBase.
 	AuthURL *url.URL
 	// AuthAdminRoles are the auth server roles that denote that a user is a blobstore admin.
 	// It is never nil but may be empty.
 	AuthAdminRoles *[]string
+	// AuthReadAdminRoles are the auth server roles that denote that a user is a read only
+	// blobstore admin. It is never nil but may be empty.
+	AuthReadAdminRoles *[]string
+	// JWTIssuer is the issuer of the JWTs accepted by the jwt auth provider. It is empty unless
+	// AuthProviders contains AuthProviderJWT, as are the other JWT fields.
+	JWTIssuer string
+	// JWTKeyFile is the path to a JWKS or PEM file containing the issuer's public keys.
+	JWTKeyFile string
+	// JWTAudience is the audience that must be present in JWTs. It may be empty.
+	JWTAudience string
+	// JWTUserClaim is the JWT claim containing the user name. It may be empty.
+	JWTUserClaim string
+	// JWTRolesClaim is the JWT claim containing the user's roles. It may be empty.
+	JWTRolesClaim string
+	// JWTAdminRoles are the JWT roles that denote that a user is a blobstore admin. It is nil
+	// unless AuthProviders contains AuthProviderJWT, but may be empty.
+	JWTAdminRoles *[]string
+	// JWTReadAdminRoles are the JWT roles that denote that a user is a read only blobstore
+	// admin. It is nil unless AuthProviders contains AuthProviderJWT, but may be empty.
+	JWTReadAdminRoles *[]string
+	// AuthCookieName is the name of a cookie from which to read the user's token if the
+	// Authorization header is not present. If empty, cookies are not used for authentication.
+	AuthCookieName string
 	// DontTrustXIPHeaders determines whether to distrust the X-Forwarded-For and X-Real-IP
 	// headers.
 	DontTrustXIPHeaders bool
+	// Webhooks are the webhooks to which node events will be delivered. It is never nil but may
+	// be empty.
+	Webhooks *[]Webhook
 }
 
 // New creates a new config struct from the given config file.
@@ -103,9 +241,16 @@ func New(configFilePath string) (*Config, error) {
 	s3secret, err := getString(err, configFilePath, sec, KeyS3AccessSecret, true)
 	s3disableSSL, err := getString(err, configFilePath, sec, KeyS3DisableSSL, false)
 	s3region, err := getString(err, configFilePath, sec, KeyS3Region, true)
-	authurl, err := getURL(err, configFilePath, sec, KeyAuthURL)
+	authcfg, err := getAuth(err, configFilePath, sec)
+	cachesize, err := getNonNegativeInt(err, configFilePath, sec, KeyAuthCacheSize)
+	negsec, err := getNonNegativeInt(err, configFilePath, sec, KeyAuthNegativeCacheSec)
+	negsize, err := getNonNegativeInt(err, configFilePath, sec, KeyAuthNegativeCacheSize)
+	gracesec, err := getNonNegativeInt(err, configFilePath, sec, KeyAuthGracePeriodSec)
 	roles, err := getStringList(err, configFilePath, sec, KeyAuthAdminRoles)
+	readroles, err := getStringList(err, configFilePath, sec, KeyAuthReadAdminRoles)
+	cookie, err := getString(err, configFilePath, sec, KeyAuthCookieName, false)
 	xip, err := getString(err, configFilePath, sec, KeyDontTrustXIPHeaders, false)
+	webhooks, err := getWebhooks(err, configFilePath, sec)
 	if err != nil {
 		return nil, err
 	}
@@ -116,24 +261,140 @@ func New(configFilePath string) (*Config, error) {
 	}
 
 	return &Config{
-			Host:                host,
-			MongoHost:           mongohost,
-			MongoDatabase:       mongodb,
-			MongoUser:           mongouser,
-			MongoPwd:            mongopwd,
-			S3Host:              s3host,
-			S3Bucket:            s3bucket,
-			S3AccessKey:         s3key,
-			S3AccessSecret:      s3secret,
-			S3DisableSSL:        "true" == s3disableSSL,
-			S3Region:            s3region,
-			AuthURL:             authurl,
-			AuthAdminRoles:      roles,
-			DontTrustXIPHeaders: "true" == xip,
+			Host:                  host,
+			MongoHost:             mongohost,
+			MongoDatabase:         mongodb,
+			MongoUser:             mongouser,
+			MongoPwd:              mongopwd,
+			S3Host:                s3host,
+			S3Bucket:              s3bucket,
+			S3AccessKey:           s3key,
+			S3AccessSecret:        s3secret,
+			S3DisableSSL:          "true" == s3disableSSL,
+			S3Region:              s3region,
+			AuthProviders:         authcfg.AuthProviders,
+			AuthCacheSize:         cachesize,
+			AuthNegativeCacheTime: time.Duration(negsec) * time.Second,
+			AuthNegativeCacheSize: negsize,
+			AuthGracePeriod:       time.Duration(gracesec) * time.Second,
+			AuthTokenFile:         authcfg.AuthTokenFile,
+			AuthURL:               authcfg.AuthURL,
+			AuthAdminRoles:        roles,
+			AuthReadAdminRoles:    readroles,
+			JWTIssuer:             authcfg.JWTIssuer,
+			JWTKeyFile:            authcfg.JWTKeyFile,
+			JWTAudience:           authcfg.JWTAudience,
+			JWTUserClaim:          authcfg.JWTUserClaim,
+			JWTRolesClaim:         authcfg.JWTRolesClaim,
+			JWTAdminRoles:         authcfg.JWTAdminRoles,
+			JWTReadAdminRoles:     authcfg.JWTReadAdminRoles,
+			AuthCookieName:        cookie,
+			DontTrustXIPHeaders:   "true" == xip,
+			Webhooks:              webhooks,
 		},
 		nil
 }
 
+// returns a config with only the auth provider fields set.
+func getAuth(preverr error, filepath string, sec *ini.Section) (*Config, error) {
+	provs, err := getStringList(preverr, filepath, sec, KeyAuthProvider)
+	if err != nil {
+		return nil, err
+	}
+	if len(*provs) < 1 {
+		provs = &[]string{AuthProviderKBase}
+	}
+	cfg := &Config{AuthProviders: &[]AuthProvider{}}
+	for _, p := range *provs {
+		ap := AuthProvider{Type: p}
+		if i := strings.Index(p, ":"); i > -1 {
+			ap.Type = strings.TrimSpace(p[:i])
+			ap.Namespace = strings.TrimSpace(p[i+1:])
+		}
+		for _, prev := range *cfg.AuthProviders {
+			if prev.Type == ap.Type {
+				return nil, fmt.Errorf("Duplicate auth provider %s for key %s in section %s "+
+					"of config file %s", ap.Type, KeyAuthProvider, sec.Name(), filepath)
+			}
+		}
+		switch ap.Type {
+		case AuthProviderKBase:
+			cfg.AuthURL, err = getURL(nil, filepath, sec, KeyAuthURL)
+		case AuthProviderFile:
+			cfg.AuthTokenFile, err = getString(nil, filepath, sec, KeyAuthTokenFile, true)
+		case AuthProviderJWT:
+			err = getJWT(filepath, sec, cfg)
+		default:
+			return nil, fmt.Errorf("Value for key %s in section %s of config file %s "+
+				"contains %s; providers must be one of %s, %s, or %s", KeyAuthProvider,
+				sec.Name(), filepath, ap.Type, AuthProviderKBase, AuthProviderFile,
+				AuthProviderJWT)
+		}
+		ap.LookupToken, err = getString(
+			err, filepath, sec, fmt.Sprintf(KeyAuthLookupTokenFormat, ap.Type), false)
+		if err != nil {
+			return nil, err
+		}
+		aps := append(*cfg.AuthProviders, ap)
+		cfg.AuthProviders = &aps
+	}
+	return cfg, nil
+}
+
+// sets the JWT fields in the config.
+func getJWT(filepath string, sec *ini.Section, cfg *Config) error {
+	iss, err := getString(nil, filepath, sec, KeyJWTIssuer, true)
+	keys, err := getString(err, filepath, sec, KeyJWTKeyFile, true)
+	aud, err := getString(err, filepath, sec, KeyJWTAudience, false)
+	userclaim, err := getString(err, filepath, sec, KeyJWTUserClaim, false)
+	rolesclaim, err := getString(err, filepath, sec, KeyJWTRolesClaim, false)
+	roles, err := getStringList(err, filepath, sec, KeyJWTAdminRoles)
+	readroles, err := getStringList(err, filepath, sec, KeyJWTReadAdminRoles)
+	if err != nil {
+		return err
+	}
+	cfg.JWTIssuer = iss
+	cfg.JWTKeyFile = keys
+	cfg.JWTAudience = aud
+	cfg.JWTUserClaim = userclaim
+	cfg.JWTRolesClaim = rolesclaim
+	cfg.JWTAdminRoles = roles
+	cfg.JWTReadAdminRoles = readroles
+	return nil
+}
+
+func getWebhooks(preverr error, filepath string, sec *ini.Section) (*[]Webhook, error) {
+	names, err := getStringList(preverr, filepath, sec, KeyWebhooks)
+	if err != nil {
+		return nil, err
+	}
+	hooks := []Webhook{}
+	seen := map[string]bool{}
+	for _, n := range *names {
+		if seen[n] {
+			return nil, fmt.Errorf("Duplicate webhook name %s for key %s in section %s of "+
+				"config file %s", n, KeyWebhooks, sec.Name(), filepath)
+		}
+		seen[n] = true
+		urlkey := fmt.Sprintf(KeyWebhookURLFormat, n)
+		u, err := getURL(nil, filepath, sec, urlkey)
+		if err != nil {
+			return nil, err
+		}
+		if !u.IsAbs() {
+			return nil, fmt.Errorf(
+				"Value for key %s in section %s of config file %s is not an absolute url",
+				urlkey, sec.Name(), filepath)
+		}
+		secret, err := getString(nil, filepath, sec, fmt.Sprintf(KeyWebhookSecretFormat, n), true)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, Webhook{Name: n, URL: u, Secret: secret})
+	}
+	return &hooks, nil
+}
+
 func getURL(
 	preverr error,
 	filepath string,
@@ -183,6 +444,26 @@ func getString(
 	return v, nil
 }
 
+// returns 0 if the key is missing or empty.
+func getNonNegativeInt(
+	preverr error,
+	filepath string,
+	sec *ini.Section,
+	key string,
+) (int, error) {
+	v, err := getString(preverr, filepath, sec, key, false)
+	if err != nil || v == "" {
+		return 0, err
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf(
+			"Value for key %s in section %s of config file %s must be an integer >= 0",
+			key, sec.Name(), filepath)
+	}
+	return i, nil
+}
+
 func getStringList(
 	preverr error,
 	filepath string,
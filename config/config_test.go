@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/kbase/blobstore/test/testhelpers"
@@ -90,9 +91,12 @@ func (t *TestSuite) TestMinimalConfig() {
 		S3AccessSecret:      "sooporsekrit",
 		S3Region:            "us-west-1",
 		S3DisableSSL:        false,
+		AuthProviders:       &[]AuthProvider{AuthProvider{Type: "kbase"}},
 		AuthURL:             u,
 		AuthAdminRoles:      &[]string{},
+		AuthReadAdminRoles:  &[]string{},
 		DontTrustXIPHeaders: false,
+		Webhooks:            &[]Webhook{},
 	}
 	t.Equal(&expected, cfg, "incorrect config")
 }
@@ -113,6 +117,7 @@ func (t *TestSuite) TestMinimalConfigWhitespaceFields() {
 		"kbase-auth-url = https://kbase.us/authyauth",
 		"kbase-auth-admin-roles =    \t     ",
 		"dont-trust-x-ip-headers =      \t     ",
+		"webhooks =     \t    ",
 	)
 	cfg, err := New(filePath)
 	t.Nil(err, "unexpected error")
@@ -127,9 +132,12 @@ func (t *TestSuite) TestMinimalConfigWhitespaceFields() {
 		S3AccessSecret:      "sooporsekrit",
 		S3Region:            "us-west-1",
 		S3DisableSSL:        false,
+		AuthProviders:       &[]AuthProvider{AuthProvider{Type: "kbase"}},
 		AuthURL:             u,
 		AuthAdminRoles:      &[]string{},
+		AuthReadAdminRoles:  &[]string{},
 		DontTrustXIPHeaders: false,
+		Webhooks:            &[]Webhook{},
 	}
 	t.Equal(&expected, cfg, "incorrect config")
 }
@@ -147,13 +155,24 @@ func (t *TestSuite) TestMaximalConfig() {
 		"s3-access-secret = sooporsekrit",
 		"s3-region = us-west-1",
 		"s3-disable-ssl=     true    ",
+		"auth-provider =    kbase   ",
+		"auth-token-file = /ignored/when/kbase",
 		"kbase-auth-url = https://kbase.us/authyauth",
 		"kbase-auth-admin-roles =    \t     ,    foo   , \tbar\t , ,  baz ,,",
+		"kbase-auth-read-admin-roles = helpdesk  ,  , support",
+		"auth-cookie-name =   kbase_session  ",
 		"dont-trust-x-ip-headers =     true   \t  ",
+		"webhooks =   , idx  ,, \t handle   ",
+		"webhook-idx-url =   https://indexer.kbase.us/events   ",
+		"webhook-idx-secret =   idxsecret   ",
+		"webhook-handle-url = http://localhost:5000/hook",
+		"webhook-handle-secret = handlesecret",
 	)
 	cfg, err := New(filePath)
 	t.Nil(err, "unexpected error")
 	u, _ := url.Parse("https://kbase.us/authyauth")
+	hu1, _ := url.Parse("https://indexer.kbase.us/events")
+	hu2, _ := url.Parse("http://localhost:5000/hook")
 	expected := Config{
 		Host:                "localhost:12345",
 		MongoHost:           "localhost:67890",
@@ -166,13 +185,231 @@ func (t *TestSuite) TestMaximalConfig() {
 		S3AccessSecret:      "sooporsekrit",
 		S3DisableSSL:        true,
 		S3Region:            "us-west-1",
+		AuthProviders:       &[]AuthProvider{AuthProvider{Type: "kbase"}},
 		AuthURL:             u,
 		AuthAdminRoles:      &[]string{"foo", "bar", "baz"},
+		AuthReadAdminRoles:  &[]string{"helpdesk", "support"},
+		AuthCookieName:      "kbase_session",
 		DontTrustXIPHeaders: true,
+		Webhooks: &[]Webhook{
+			Webhook{Name: "idx", URL: hu1, Secret: "idxsecret"},
+			Webhook{Name: "handle", URL: hu2, Secret: "handlesecret"},
+		},
 	}
 	t.Equal(&expected, cfg, "incorrect config")
 }
 
+func (t *TestSuite) TestFileAuthConfig() {
+	filePath := t.writeFile(
+		"host = localhost:12345",
+		"mongodb-host = localhost:67890",
+		"mongodb-database = mydb",
+		"s3-host = localhost:34567",
+		"s3-bucket = mybucket",
+		"s3-access-key = akey",
+		"s3-access-secret = sooporsekrit",
+		"s3-region = us-west-1",
+		"auth-provider = \t  file   ",
+		"auth-token-file =   /etc/blobstore/tokens.json  ",
+		"kbase-auth-url = https://kbase.us/ignoredwhenfile",
+		"kbase-auth-admin-roles = foo",
+	)
+	cfg, err := New(filePath)
+	t.Nil(err, "unexpected error")
+	expected := Config{
+		Host:                "localhost:12345",
+		MongoHost:           "localhost:67890",
+		MongoDatabase:       "mydb",
+		S3Host:              "localhost:34567",
+		S3Bucket:            "mybucket",
+		S3AccessKey:         "akey",
+		S3AccessSecret:      "sooporsekrit",
+		S3Region:            "us-west-1",
+		S3DisableSSL:        false,
+		AuthProviders:       &[]AuthProvider{AuthProvider{Type: "file"}},
+		AuthTokenFile:       "/etc/blobstore/tokens.json",
+		AuthAdminRoles:      &[]string{"foo"},
+		AuthReadAdminRoles:  &[]string{},
+		DontTrustXIPHeaders: false,
+		Webhooks:            &[]Webhook{},
+	}
+	t.Equal(&expected, cfg, "incorrect config")
+}
+
+func (t *TestSuite) TestJWTAuthConfig() {
+	base := []string{
+		"host = localhost:12345",
+		"mongodb-host = localhost:67890",
+		"mongodb-database = mydb",
+		"s3-host = localhost:34567",
+		"s3-bucket = mybucket",
+		"s3-access-key = akey",
+		"s3-access-secret = sooporsekrit",
+		"s3-region = us-west-1",
+		"auth-provider = jwt",
+		"jwt-issuer =   https://login.example.org  ",
+		"jwt-key-file = \t  /etc/blobstore/jwks.json   ",
+	}
+	expected := Config{
+		Host:                "localhost:12345",
+		MongoHost:           "localhost:67890",
+		MongoDatabase:       "mydb",
+		S3Host:              "localhost:34567",
+		S3Bucket:            "mybucket",
+		S3AccessKey:         "akey",
+		S3AccessSecret:      "sooporsekrit",
+		S3Region:            "us-west-1",
+		S3DisableSSL:        false,
+		AuthProviders:       &[]AuthProvider{AuthProvider{Type: "jwt"}},
+		AuthAdminRoles:      &[]string{},
+		AuthReadAdminRoles:  &[]string{},
+		JWTIssuer:           "https://login.example.org",
+		JWTKeyFile:          "/etc/blobstore/jwks.json",
+		JWTAdminRoles:       &[]string{},
+		JWTReadAdminRoles:   &[]string{},
+		DontTrustXIPHeaders: false,
+		Webhooks:            &[]Webhook{},
+	}
+
+	cfg, err := New(t.writeFile(base...))
+	t.Nil(err, "unexpected error")
+	t.Equal(&expected, cfg, "incorrect config")
+
+	cfg, err = New(t.writeFile(append(base,
+		"jwt-audience =  blobstore  ",
+		"jwt-user-claim =   kbase.user  ",
+		"jwt-roles-claim = realm_access.roles   ",
+		"jwt-admin-roles =  admin,  , blobadmin ",
+		"jwt-read-admin-roles =  helpdesk ",
+	)...))
+	t.Nil(err, "unexpected error")
+	expected.JWTAudience = "blobstore"
+	expected.JWTUserClaim = "kbase.user"
+	expected.JWTRolesClaim = "realm_access.roles"
+	expected.JWTAdminRoles = &[]string{"admin", "blobadmin"}
+	expected.JWTReadAdminRoles = &[]string{"helpdesk"}
+	t.Equal(&expected, cfg, "incorrect config")
+}
+
+func (t *TestSuite) TestChainedAuthConfig() {
+	filePath := t.writeFile(
+		"host = localhost:12345",
+		"mongodb-host = localhost:67890",
+		"mongodb-database = mydb",
+		"s3-host = localhost:34567",
+		"s3-bucket = mybucket",
+		"s3-access-key = akey",
+		"s3-access-secret = sooporsekrit",
+		"s3-region = us-west-1",
+		"auth-provider = kbase,  , file  :   svc  , jwt:",
+		"auth-kbase-lookup-token =   kbtoken   ",
+		"auth-file-lookup-token = \t  ",
+		"auth-token-file = /etc/blobstore/tokens.json",
+		"jwt-issuer = https://login.example.org",
+		"jwt-key-file = /etc/blobstore/jwks.json",
+		"kbase-auth-url = https://kbase.us/authyauth",
+	)
+	cfg, err := New(filePath)
+	t.Nil(err, "unexpected error")
+	u, _ := url.Parse("https://kbase.us/authyauth")
+	expected := Config{
+		Host:           "localhost:12345",
+		MongoHost:      "localhost:67890",
+		MongoDatabase:  "mydb",
+		S3Host:         "localhost:34567",
+		S3Bucket:       "mybucket",
+		S3AccessKey:    "akey",
+		S3AccessSecret: "sooporsekrit",
+		S3Region:       "us-west-1",
+		AuthProviders: &[]AuthProvider{
+			AuthProvider{Type: "kbase", LookupToken: "kbtoken"},
+			AuthProvider{Type: "file", Namespace: "svc"},
+			AuthProvider{Type: "jwt"},
+		},
+		AuthTokenFile:      "/etc/blobstore/tokens.json",
+		AuthURL:            u,
+		AuthAdminRoles:     &[]string{},
+		AuthReadAdminRoles: &[]string{},
+		JWTIssuer:          "https://login.example.org",
+		JWTKeyFile:         "/etc/blobstore/jwks.json",
+		JWTAdminRoles:      &[]string{},
+		JWTReadAdminRoles:  &[]string{},
+		Webhooks:           &[]Webhook{},
+	}
+	t.Equal(&expected, cfg, "incorrect config")
+}
+
+func (t *TestSuite) TestAuthCacheConfig() {
+	filePath := t.writeFile(
+		"host = localhost:12345",
+		"mongodb-host = localhost:67890",
+		"mongodb-database = mydb",
+		"s3-host = localhost:34567",
+		"s3-bucket = mybucket",
+		"s3-access-key = akey",
+		"s3-access-secret = sooporsekrit",
+		"s3-region = us-west-1",
+		"kbase-auth-url = https://kbase.us/authyauth",
+		"auth-cache-size = 20000",
+		"auth-negative-cache-sec =   30  ",
+		"auth-negative-cache-size = \t 5000",
+		"auth-grace-period-sec = 600",
+	)
+	cfg, err := New(filePath)
+	t.Nil(err, "unexpected error")
+	u, _ := url.Parse("https://kbase.us/authyauth")
+	expected := Config{
+		Host:                  "localhost:12345",
+		MongoHost:             "localhost:67890",
+		MongoDatabase:         "mydb",
+		S3Host:                "localhost:34567",
+		S3Bucket:              "mybucket",
+		S3AccessKey:           "akey",
+		S3AccessSecret:        "sooporsekrit",
+		S3Region:              "us-west-1",
+		AuthProviders:         &[]AuthProvider{AuthProvider{Type: "kbase"}},
+		AuthCacheSize:         20000,
+		AuthNegativeCacheTime: 30 * time.Second,
+		AuthNegativeCacheSize: 5000,
+		AuthGracePeriod:       10 * time.Minute,
+		AuthURL:               u,
+		AuthAdminRoles:        &[]string{},
+		AuthReadAdminRoles:    &[]string{},
+		Webhooks:              &[]Webhook{},
+	}
+	t.Equal(&expected, cfg, "incorrect config")
+}
+
+func (t *TestSuite) TestConfigFailAuthCache() {
+	base := []string{
+		"host = localhost:12345",
+		"mongodb-host = localhost:67890",
+		"mongodb-database = mydb",
+		"s3-host = localhost:34567",
+		"s3-bucket = mybucket",
+		"s3-access-key = akey",
+		"s3-access-secret = sooporsekrit",
+		"s3-region = us-west-1",
+		"kbase-auth-url = https://kbase.us/authyauth",
+	}
+	tc := map[string]string{}
+	for _, kv := range [][]string{
+		[]string{"auth-cache-size", "10k"},
+		[]string{"auth-negative-cache-sec", "foo"},
+		[]string{"auth-negative-cache-size", "-1"},
+		[]string{"auth-grace-period-sec", "1.5"},
+	} {
+		tc[t.writeFile(append(base, kv[0]+" = "+kv[1])...)] = kv[0]
+	}
+
+	for filename, key := range tc {
+		cfg, err := New(filename)
+		t.Nil(cfg, "expected error")
+		t.Equal(fmt.Errorf("Value for key %s in section BlobStore of config file %s must be "+
+			"an integer >= 0", key, filename), err, "incorrect error")
+	}
+}
+
 func (t *TestSuite) TestConfigImmediateFail() {
 	nofile := uuid.New().String()
 	badsec := t.writeFileWithSec("Blbstore", "foo=bar")
@@ -504,6 +741,101 @@ func (t *TestSuite) TestConfigFailBadAuthURL() {
 		err, "incorrect error")
 }
 
+func (t *TestSuite) TestConfigFailAuthProvider() {
+	base := []string{
+		"host = localhost:12345",
+		"mongodb-host = localhost:67890",
+		"mongodb-database = mydb",
+		"s3-host = localhost:34567",
+		"s3-bucket = mybucket",
+		"s3-access-key = akey",
+		"s3-access-secret = sooporsekrit",
+		"s3-region = us-west-1",
+		"kbase-auth-url = https://kbase.us/authyauth",
+	}
+	badprov := t.writeFile(append(base, "auth-provider = kbasefile")...)
+	t.checkFile(
+		t.writeFile(append(base, "auth-provider = file")...),
+		t.writeFile(append(base, "auth-provider = file", "auth-token-file =  \t  ")...),
+		"auth-token-file")
+	t.checkFile(
+		t.writeFile(append(base, "auth-provider = jwt", "jwt-key-file = keys.json")...),
+		t.writeFile(append(base, "auth-provider = jwt", "jwt-issuer =  \t  ",
+			"jwt-key-file = keys.json")...),
+		"jwt-issuer")
+	t.checkFile(
+		t.writeFile(append(base, "auth-provider = jwt", "jwt-issuer = https://iss.org")...),
+		t.writeFile(append(base, "auth-provider = jwt", "jwt-issuer = https://iss.org",
+			"jwt-key-file =    ")...),
+		"jwt-key-file")
+
+	badns := t.writeFile(append(base, "auth-provider = kbase, jwt kbase:svc")...)
+	dupe := t.writeFile(append(base, "auth-provider = file:svc, kbase, file:svc2",
+		"auth-token-file = tokens.json")...)
+
+	tc := map[string]error{
+		badprov: fmt.Errorf("Value for key auth-provider in section BlobStore of config file %s "+
+			"contains kbasefile; providers must be one of kbase, file, or jwt", badprov),
+		badns: fmt.Errorf("Value for key auth-provider in section BlobStore of config file %s "+
+			"contains jwt kbase; providers must be one of kbase, file, or jwt", badns),
+		dupe: fmt.Errorf("Duplicate auth provider file for key auth-provider in section "+
+			"BlobStore of config file %s", dupe),
+	}
+
+	for filename, expectedErr := range tc {
+		cfg, err := New(filename)
+		t.Nil(cfg, "expected error")
+		t.Equal(expectedErr, err, "incorrect error")
+	}
+}
+
+func (t *TestSuite) TestConfigFailWebhooks() {
+	base := []string{
+		"host = localhost:12345",
+		"mongodb-host = localhost:67890",
+		"mongodb-database = mydb",
+		"s3-host = localhost:34567",
+		"s3-bucket = mybucket",
+		"s3-access-key = akey",
+		"s3-access-secret = sooporsekrit",
+		"s3-region = us-west-1",
+		"kbase-auth-url = https://kbase.us/authyauth",
+		"webhooks = idx, handle",
+		"webhook-idx-url = https://indexer.kbase.us/events",
+		"webhook-idx-secret = idxsecret",
+	}
+	nourl := t.writeFile(append(base, "webhook-handle-secret = s")...)
+	wsurl := t.writeFile(append(base, "webhook-handle-url =  \t ", "webhook-handle-secret = s")...)
+	relurl := t.writeFile(append(base, "webhook-handle-url = /hook",
+		"webhook-handle-secret = s")...)
+	nosecret := t.writeFile(append(base, "webhook-handle-url = http://localhost/hook")...)
+	wssecret := t.writeFile(append(base, "webhook-handle-url = http://localhost/hook",
+		"webhook-handle-secret =   \t ")...)
+	dupe := t.writeFile(append(base[:9:9], "webhooks = idx, idx",
+		"webhook-idx-url = https://indexer.kbase.us/events", "webhook-idx-secret = s")...)
+
+	tc := map[string]error{
+		nourl: fmt.Errorf("Missing key webhook-handle-url in section BlobStore of config file "+
+			"%s", nourl),
+		wsurl: fmt.Errorf("Missing value for key webhook-handle-url in section BlobStore of "+
+			"config file %s", wsurl),
+		relurl: fmt.Errorf("Value for key webhook-handle-url in section BlobStore of config "+
+			"file %s is not an absolute url", relurl),
+		nosecret: fmt.Errorf("Missing key webhook-handle-secret in section BlobStore of config "+
+			"file %s", nosecret),
+		wssecret: fmt.Errorf("Missing value for key webhook-handle-secret in section BlobStore "+
+			"of config file %s", wssecret),
+		dupe: fmt.Errorf("Duplicate webhook name idx for key webhooks in section BlobStore of "+
+			"config file %s", dupe),
+	}
+
+	for filename, expectedErr := range tc {
+		cfg, err := New(filename)
+		t.Nil(cfg, "expected error")
+		t.Equal(expectedErr, err, "incorrect error")
+	}
+}
+
 func (t *TestSuite) checkFile(nokey string, wskey string, key string) {
 	cfg, err := New(nokey)
 	t.Nil(cfg, "expected error")
@@ -3,15 +3,21 @@ package core
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/google/uuid"
 
+	"github.com/kbase/blobstore/apikey"
+	"github.com/kbase/blobstore/audit"
 	"github.com/kbase/blobstore/auth"
 	"github.com/kbase/blobstore/core/values"
+	"github.com/kbase/blobstore/events"
 
 	"github.com/kbase/blobstore/filestore"
 	"github.com/kbase/blobstore/nodestore"
@@ -27,15 +33,23 @@ type User struct {
 
 // BlobNode contains basic information about a blob stored in the blobstore.
 type BlobNode struct {
-	ID       uuid.UUID
-	Size     int64
-	MD5      values.MD5
-	Stored   time.Time
+	ID     uuid.UUID
+	Size   int64
+	MD5    values.MD5
+	Stored time.Time
+	// Modified is the time the blob's filename or format was last changed, or the stored time
+	// if they have never been changed.
+	Modified time.Time
 	Filename string
 	Format   string
 	Owner    User
 	Readers  *[]User
 	Public   bool
+	// Version is incremented every time the node's ACLs, owner, filename, or format change.
+	Version int64
+	// Checksums contains the checksums, other than the MD5, of the blob. nil for blobs stored
+	// before checksums other than the MD5 were calculated.
+	Checksums *values.Checksums
 }
 
 // might want to move this somewhere else
@@ -54,6 +68,18 @@ func (u *UUIDGenDefault) GetUUID() uuid.UUID {
 	return uuid.New()
 }
 
+// TimeProvider provides the current time.
+type TimeProvider interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+type defaultTimeProvider struct{}
+
+func (tp *defaultTimeProvider) Now() time.Time {
+	return time.Now()
+}
+
 // NoBlobError is returned when a requested blob does not exist.
 type NoBlobError string
 
@@ -94,26 +120,153 @@ func (e *UnauthorizedACLError) Error() string {
 	return string(*e)
 }
 
+// VersionMismatchError is returned when a node is not at the version expected by the caller.
+type VersionMismatchError string
+
+// NewVersionMismatchError creates a new VersionMismatchError.
+func NewVersionMismatchError(err string) *VersionMismatchError {
+	e := VersionMismatchError(err)
+	return &e
+}
+
+func (e *VersionMismatchError) Error() string {
+	return string(*e)
+}
+
+// NoUserError is returned when a user does not exist.
+type NoUserError string
+
+// NewNoUserError creates a new NoUserError.
+func NewNoUserError(err string) *NoUserError {
+	e := NoUserError(err)
+	return &e
+}
+
+func (e *NoUserError) Error() string {
+	return string(*e)
+}
+
+// UserExistsError is returned when a user unexpectedly already exists.
+type UserExistsError string
+
+// NewUserExistsError creates a new UserExistsError.
+func NewUserExistsError(err string) *UserExistsError {
+	e := UserExistsError(err)
+	return &e
+}
+
+func (e *UserExistsError) Error() string {
+	return string(*e)
+}
+
+const (
+	// LogFieldRequestID is the logger field in which the ID of the current request is
+	// expected to be found. It is recorded in the audit log.
+	LogFieldRequestID = "requestid"
+	// LogFieldIP is the logger field in which the IP address of the current request is
+	// expected to be found. It is recorded in the audit log.
+	LogFieldIP = "ip"
+	// LogFieldImpersonator is the logger field in which the account name of an administrator
+	// acting as the current request's user is expected to be found, if any. It is recorded in
+	// the audit log.
+	LogFieldImpersonator = "impersonator"
+)
+
 // BlobStore is the storage system for blobs.
 type BlobStore struct {
 	fileStore filestore.FileStore
 	nodeStore nodestore.NodeStore
 	uuidGen   UUIDGen
+	time      TimeProvider
+	auditLog  audit.Log
+	events    events.Store
+	apiKeys   apikey.Store
+	subsLock  sync.Mutex
+	subs      map[chan struct{}]struct{}
+}
+
+// AuditLog is an option for New and NewWithUUIDGen that causes all changes to nodes to be
+// recorded in the given audit log.
+func AuditLog(log audit.Log) func(*BlobStore) {
+	return func(bs *BlobStore) {
+		bs.auditLog = log
+	}
+}
+
+// EventStore is an option for New and NewWithUUIDGen that causes an event to be stored in the
+// given event store for every change to a node.
+func EventStore(store events.Store) func(*BlobStore) {
+	return func(bs *BlobStore) {
+		bs.events = store
+	}
+}
+
+// APIKeyStore is an option for New and NewWithUUIDGen that causes users' API keys to be
+// transferred when users are renamed and revoked when users are purged.
+func APIKeyStore(store apikey.Store) func(*BlobStore) {
+	return func(bs *BlobStore) {
+		bs.apiKeys = store
+	}
+}
+
+// Clock is an option for New and NewWithUUIDGen that sets the provider of the current time,
+// which allows for easier testing.
+func Clock(tp TimeProvider) func(*BlobStore) {
+	return func(bs *BlobStore) {
+		bs.time = tp
+	}
 }
 
 // New creates a new blob store.
-func New(filestore filestore.FileStore, nodestore nodestore.NodeStore) *BlobStore {
-	return NewWithUUIDGen(filestore, nodestore, &UUIDGenDefault{})
+func New(
+	filestore filestore.FileStore,
+	nodestore nodestore.NodeStore,
+	options ...func(*BlobStore),
+) *BlobStore {
+	return NewWithUUIDGen(filestore, nodestore, &UUIDGenDefault{}, options...)
 }
 
 // NewWithUUIDGen creates a new blob store with a provided UUID generator, which allows for
 // easier testing.
-func NewWithUUIDGen(filestore filestore.FileStore, nodestore nodestore.NodeStore, uuidGen UUIDGen,
+func NewWithUUIDGen(
+	filestore filestore.FileStore,
+	nodestore nodestore.NodeStore,
+	uuidGen UUIDGen,
+	options ...func(*BlobStore),
 ) *BlobStore {
-	return &BlobStore{fileStore: filestore, nodeStore: nodestore, uuidGen: uuidGen}
+	bs := &BlobStore{fileStore: filestore, nodeStore: nodestore, uuidGen: uuidGen,
+		time: &defaultTimeProvider{}, subs: map[chan struct{}]struct{}{}}
+	for _, option := range options {
+		option(bs)
+	}
+	return bs
+}
+
+// StoreOptions contains optional parameters for the Store method.
+type StoreOptions struct {
+	md5    *values.MD5
+	sha256 *values.SHA256
+}
+
+// ExpectedMD5 is an option for Store that causes the file to be rejected if its MD5 does not
+// match the given MD5.
+func ExpectedMD5(md5 values.MD5) func(*StoreOptions) {
+	return func(o *StoreOptions) {
+		o.md5 = &md5
+	}
+}
+
+// ExpectedSHA256 is an option for Store that causes the file to be rejected if its SHA-256 does
+// not match the given SHA-256.
+func ExpectedSHA256(sha values.SHA256) func(*StoreOptions) {
+	return func(o *StoreOptions) {
+		o.sha256 = &sha
+	}
 }
 
 // Store stores a blob. The caller is responsible for closing the reader.
+// If expected checksums are provided in the options and do not match the stored data, the
+// stored data is deleted and an IllegalInputError is returned.
 func (bs *BlobStore) Store(
 	le *logrus.Entry,
 	user auth.User,
@@ -121,6 +274,7 @@ func (bs *BlobStore) Store(
 	size int64,
 	filename values.FileName, // TODO OPS make filename and format optional
 	format values.FileFormat,
+	options ...func(*StoreOptions),
 ) (*BlobNode, error) {
 	if le == nil {
 		return nil, errors.New("logger cannot be nil")
@@ -128,6 +282,10 @@ func (bs *BlobStore) Store(
 	if size < 1 {
 		return nil, values.NewIllegalInputError("file size must be > 0")
 	}
+	opts := &StoreOptions{}
+	for _, option := range options {
+		option(opts)
+	}
 	uid := bs.uuidGen.GetUUID()
 
 	nodeuser, err := bs.nodeStore.GetUser(user.GetUserName())
@@ -140,33 +298,185 @@ func (bs *BlobStore) Store(
 	if err != nil {
 		return nil, err // errors should only occur for unusual situations here
 	}
+	if opts.md5 != nil {
+		err = checkChecksum("MD5", opts.md5.GetMD5(), f.MD5.GetMD5())
+	}
+	if err == nil && opts.sha256 != nil {
+		err = checkChecksum("SHA-256", opts.sha256.GetSHA256(), getChecksum(f.Checksums,
+			values.ChecksumSHA256))
+	}
+	if err != nil {
+		if delerr := bs.fileStore.DeleteFile(uuidToFilePath(uid)); delerr != nil {
+			le.WithField("error", delerr.Error()).Error(
+				"could not delete file with incorrect checksum")
+		}
+		return nil, err
+	}
+	nopts := []func(*nodestore.Node) error{
+		nodestore.FileName(filename.GetFileName()), nodestore.Format(format.GetFileFormat())}
+	if f.Checksums != nil {
+		nopts = append(nopts, nodestore.Checksums(*f.Checksums))
+	}
+	if sha := getChecksum(f.Checksums, values.ChecksumSHA256); sha != "" {
+		fileID, err := bs.nodeStore.AddFile(uuidToFilePath(uid), size, sha)
+		if err != nil {
+			return nil, err // errors should only occur for unusual situations here
+		}
+		if fileID != uuidToFilePath(uid) {
+			// an identical file is already stored, so share it and delete the new file
+			if delerr := bs.fileStore.DeleteFile(uuidToFilePath(uid)); delerr != nil {
+				le.WithField("error", delerr.Error()).Error("could not delete duplicate file")
+			}
+		}
+		nopts = append(nopts, nodestore.FileID(fileID))
+	}
 	// enforce presence of a correct MD5
-	node, _ := nodestore.NewNode(uid, *nodeuser, size, *f.MD5, f.Stored,
-		nodestore.FileName(filename.GetFileName()), nodestore.Format(format.GetFileFormat()))
+	node, _ := nodestore.NewNode(uid, *nodeuser, size, *f.MD5, f.Stored, nopts...)
 	err = bs.nodeStore.StoreNode(node)
 	if err != nil {
-		return nil, err // errors should only occur for unusual situations here
-		// consider deleting the file here, although errors should be extremely rare
-		// since we recently contacted mongo
+		// errors should be extremely rare since we recently contacted mongo
+		bs.removeFileReference(le, fileID(node))
+		return nil, err
 	}
+	bs.recordChange(le, user, audit.ActionCreate, uid, nil, nil, node)
 	return toBlobNode(node), nil
 }
 
+func getChecksum(checksums *values.Checksums, algorithm string) string {
+	if checksums == nil {
+		return ""
+	}
+	return checksums.Get(algorithm)
+}
+
+func checkChecksum(name string, expected string, actual string) error {
+	if !strings.EqualFold(expected, actual) {
+		return values.NewIllegalInputError(fmt.Sprintf(
+			"%s checksum mismatch: expected %s, got %s", name, expected, strings.ToLower(actual)))
+	}
+	return nil
+}
+
+var actionToEventType = map[audit.Action]events.Type{
+	audit.ActionCreate:          events.NodeCreated,
+	audit.ActionCopy:            events.NodeCopied,
+	audit.ActionDelete:          events.NodeDeleted,
+	audit.ActionAddReaders:      events.ACLChanged,
+	audit.ActionRemoveReaders:   events.ACLChanged,
+	audit.ActionSetPublic:       events.ACLChanged,
+	audit.ActionChangeOwner:     events.OwnerChanged,
+	audit.ActionSetFileMetadata: events.FileMetadataChanged,
+	audit.ActionRenameUser:      events.ACLChanged,
+}
+
+// recordChange records a change to a node in the audit log and the event store, if they are
+// configured. The change has already been made, so failures are logged rather than returned.
+// before should be nil for newly created nodes and after should be nil for deleted nodes.
+func (bs *BlobStore) recordChange(
+	le *logrus.Entry,
+	user auth.User,
+	action audit.Action,
+	id uuid.UUID,
+	source *uuid.UUID,
+	before *nodestore.Node,
+	after *nodestore.Node,
+) {
+	if bs.auditLog != nil {
+		err := bs.auditLog.AddRecord(&audit.Record{
+			Action:       action,
+			NodeID:       id,
+			SourceNodeID: source,
+			Actor:        user.GetUserName(),
+			ActorIsAdmin: user.IsAdmin(),
+			Impersonator: getLogField(le, LogFieldImpersonator),
+			IP:           getLogField(le, LogFieldIP),
+			RequestID:    getLogField(le, LogFieldRequestID),
+			Before:       toNodeState(before),
+			After:        toNodeState(after),
+		})
+		if err != nil {
+			le.WithField("error", err.Error()).Error("could not add audit record")
+		}
+	}
+	if bs.events != nil {
+		state := toNodeState(after)
+		if state == nil {
+			state = toNodeState(before)
+		}
+		err := bs.events.AddEvent(&events.Event{
+			Type:         actionToEventType[action],
+			NodeID:       id,
+			SourceNodeID: source,
+			User:         user.GetUserName(),
+			Owner:        state.Owner,
+			Readers:      state.Readers,
+			Public:       state.Public,
+		})
+		if err != nil {
+			le.WithField("error", err.Error()).Error("could not add event")
+		} else {
+			bs.notifySubscribers()
+		}
+	}
+}
+
+func (bs *BlobStore) notifySubscribers() {
+	bs.subsLock.Lock()
+	defer bs.subsLock.Unlock()
+	for c := range bs.subs {
+		select {
+		case c <- struct{}{}:
+		default: // the subscriber already has a pending notification
+		}
+	}
+}
+
+func getLogField(le *logrus.Entry, field string) string {
+	if le == nil {
+		return ""
+	}
+	if v, ok := le.Data[field].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func toNodeState(node *nodestore.Node) *audit.NodeState {
+	if node == nil {
+		return nil
+	}
+	readers := []string{}
+	for _, r := range *node.GetReaders() {
+		readers = append(readers, r.GetAccountName())
+	}
+	owner := node.GetOwner()
+	return &audit.NodeState{
+		Owner:    owner.GetAccountName(),
+		Readers:  readers,
+		Public:   node.GetPublic(),
+		Filename: node.GetFileName(),
+		Format:   node.GetFormat(),
+	}
+}
+
 func toBlobNode(node *nodestore.Node) *BlobNode {
 	readers := &[]User{}
 	for _, u := range *node.GetReaders() {
 		*readers = append(*readers, toUser(u))
 	}
 	return &BlobNode{
-		ID:       node.GetID(),
-		Size:     node.GetSize(),
-		MD5:      node.GetMD5(),
-		Stored:   node.GetStoredTime(),
-		Filename: node.GetFileName(),
-		Format:   node.GetFormat(),
-		Owner:    toUser(node.GetOwner()),
-		Readers:  readers,
-		Public:   node.GetPublic(),
+		ID:        node.GetID(),
+		Size:      node.GetSize(),
+		MD5:       node.GetMD5(),
+		Stored:    node.GetStoredTime(),
+		Modified:  node.GetModifiedTime(),
+		Filename:  node.GetFileName(),
+		Format:    node.GetFormat(),
+		Owner:     toUser(node.GetOwner()),
+		Readers:   readers,
+		Public:    node.GetPublic(),
+		Version:   node.GetVersion(),
+		Checksums: node.GetChecksums(),
 	}
 }
 
@@ -177,6 +487,15 @@ func toUser(u nodestore.User) User {
 	}
 }
 
+// fileID returns the ID of a node's file in the file store.
+func fileID(node *nodestore.Node) string {
+	if node.GetFileID() != "" {
+		return node.GetFileID()
+	}
+	// the node was stored before files could be shared
+	return uuidToFilePath(node.GetID())
+}
+
 func uuidToFilePath(uid uuid.UUID) string {
 	uidstr := uid.String()
 	return uidstr[0:2] + "/" + uidstr[2:4] + "/" + uidstr[4:6] + "/" + uidstr
@@ -194,6 +513,96 @@ func (bs *BlobStore) Get(user *auth.User, id uuid.UUID) (*BlobNode, error) {
 	return toBlobNode(node), nil
 }
 
+// NodeResult is the result of retrieving or altering one of a set of nodes.
+type NodeResult struct {
+	// ID is the ID of the node.
+	ID uuid.UUID
+	// Node is the node, or nil if an error occurred.
+	Node *BlobNode
+	// Error is the error that occurred, if any.
+	Error error
+}
+
+// GetMany gets details about multiple nodes. The node store is queried once for all the nodes.
+// The results are in the same order as the IDs, and each result contains either the node or
+// a NoBlobError or UnauthorizedError. Other errors cause the entire operation to fail.
+func (bs *BlobStore) GetMany(user *auth.User, ids []uuid.UUID) ([]*NodeResult, error) {
+	results, _, err := bs.getMany(user, ids)
+	return results, err
+}
+
+// getMany returns the results for GetMany along with the nodes, keyed by node ID.
+func (bs *BlobStore) getMany(user *auth.User, ids []uuid.UUID,
+) ([]*NodeResult, map[uuid.UUID]*nodestore.Node, error) {
+	nodeuser, nodemap, err := bs.getNodeMap(user, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := []*NodeResult{}
+	for _, id := range ids {
+		res := &NodeResult{ID: id}
+		node, ok := nodemap[id]
+		if !ok {
+			res.Error = NewNoBlobError("No such node " + id.String())
+		} else if !authok(user, nodeuser, node) {
+			res.Error = NewUnauthorizedError("Unauthorized")
+		} else {
+			res.Node = toBlobNode(node)
+		}
+		results = append(results, res)
+	}
+	return results, nodemap, nil
+}
+
+// getNodeMap gets the user and the nodes, keyed by node ID, with one query for the nodes.
+// Nodes that don't exist are not included in the map.
+func (bs *BlobStore) getNodeMap(user *auth.User, ids []uuid.UUID,
+) (*nodestore.User, map[uuid.UUID]*nodestore.Node, error) {
+	var nodeuser *nodestore.User
+	if user != nil {
+		var err error
+		nodeuser, err = bs.nodeStore.GetUser(user.GetUserName())
+		if err != nil {
+			return nil, nil, err // errors should only occur for unusual situations here
+		}
+	}
+	nodes, err := bs.nodeStore.GetNodes(ids)
+	if err != nil {
+		return nil, nil, err // errors should only occur for unusual situations here
+	}
+	nodemap := map[uuid.UUID]*nodestore.Node{}
+	for _, n := range nodes {
+		nodemap[n.GetID()] = n
+	}
+	return nodeuser, nodemap, nil
+}
+
+// alterMany applies an alteration to each of a set of nodes, which are retrieved with one
+// query. The results are in the same order as the IDs. The alteration is responsible for
+// checking the user may alter the node. An error for one node does not affect the others, but
+// errors retrieving the user or nodes cause the entire operation to fail.
+func (bs *BlobStore) alterMany(
+	user auth.User,
+	ids []uuid.UUID,
+	alter func(nodeuser *nodestore.User, node *nodestore.Node) (*BlobNode, error),
+) ([]*NodeResult, error) {
+	nodeuser, nodemap, err := bs.getNodeMap(&user, ids)
+	if err != nil {
+		return nil, err
+	}
+	results := []*NodeResult{}
+	for _, id := range ids {
+		res := &NodeResult{ID: id}
+		if node, ok := nodemap[id]; ok {
+			res.Node, res.Error = alter(nodeuser, node)
+		} else {
+			res.Error = NewNoBlobError("No such node " + id.String())
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
 func (bs *BlobStore) getNode(user *auth.User, id uuid.UUID,
 ) (*nodestore.Node, *nodestore.User, error) {
 	var nodeuser *nodestore.User
@@ -216,20 +625,34 @@ func translateError(err error) error {
 		// seems weird to rewrap, but also seems weird to expose errors in lower api levels
 		return NewNoBlobError(err.Error())
 	}
+	if _, ok := err.(*nodestore.VersionMismatchError); ok {
+		return NewVersionMismatchError(err.Error())
+	}
+	if _, ok := err.(*nodestore.NoUserError); ok {
+		return NewNoUserError(err.Error())
+	}
+	if _, ok := err.(*nodestore.UserExistsError); ok {
+		return NewUserExistsError(err.Error())
+	}
 	// errors should only occur for unusual situations here
 	return err
 }
 
 func authok(user *auth.User, nodeuser *nodestore.User, node *nodestore.Node) bool {
+	if user != nil && user.IsReadAdmin() {
+		return true
+	}
+	return readok(nodeuser, node)
+}
+
+// readok returns whether a user may read a node without administration privileges.
+func readok(nodeuser *nodestore.User, node *nodestore.Node) bool {
 	if node.GetPublic() {
 		return true
 	}
-	if user == nil {
+	if nodeuser == nil {
 		return false
 	}
-	if user.IsAdmin() {
-		return true
-	}
 	if node.GetOwner() == *nodeuser {
 		return true
 	}
@@ -244,116 +667,297 @@ func authok(user *auth.User, nodeuser *nodestore.User, node *nodestore.Node) boo
 // GetFile gets the file from a node. Returns NoBlobError and UnauthorizedError.
 func (bs *BlobStore) GetFile(user *auth.User, id uuid.UUID,
 ) (data io.ReadCloser, size int64, filename string, err error) {
-	node, err := bs.Get(user, id) // checks auth
+	data, size, node, err := bs.GetFileWithNode(user, id)
 	if err != nil {
 		return nil, 0, "", err
 	}
-	f, err := bs.fileStore.GetFile(uuidToFilePath(id))
+	return data, size, node.Filename, nil
+}
+
+// GetFileWithNode gets the file from a node along with the node, for example so the node's
+// checksums can be sent with the file. Returns NoBlobError and UnauthorizedError.
+func (bs *BlobStore) GetFileWithNode(user *auth.User, id uuid.UUID,
+) (data io.ReadCloser, size int64, node *BlobNode, err error) {
+	n, nodeuser, err := bs.getNode(user, id)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if !authok(user, nodeuser, n) {
+		return nil, 0, nil, NewUnauthorizedError("Unauthorized")
+	}
+	f, err := bs.fileStore.GetFile(fileID(n))
 	if err != nil {
 		// errors should only occur for unusual situations here since we got the node
-		return nil, 0, "", err
+		return nil, 0, nil, err
+	}
+	return f.Data, f.Size, toBlobNode(n), nil
+}
+
+// GetFiles gets the files from multiple nodes, for example to build an archive.
+// The user must be able to read every node - if not, the NoBlobError or UnauthorizedError for
+// the first such node is returned before any file is retrieved. The files are then retrieved
+// one at a time in the order of the IDs and passed to the handler, which must not retain the
+// reader. An error from the handler stops the retrieval and is returned.
+func (bs *BlobStore) GetFiles(
+	user *auth.User,
+	ids []uuid.UUID,
+	handler func(node *BlobNode, data io.Reader) error,
+) error {
+	results, nodes, err := bs.getMany(user, ids) // checks auth
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+	for _, res := range results {
+		f, err := bs.fileStore.GetFile(fileID(nodes[res.ID]))
+		if err != nil {
+			// errors should only occur for unusual situations here since we got the node
+			return err
+		}
+		err = handler(res.Node, f.Data)
+		f.Data.Close()
+		if err != nil {
+			return err
+		}
 	}
-	return f.Data, f.Size, node.Filename, nil
+	return nil
 }
 
 // SetNodePublic sets whether a node can be read by anyone, including anonymous users.
-// Returns NoBlobError and UnauthorizedACLError.
-func (bs *BlobStore) SetNodePublic(user auth.User, id uuid.UUID, public bool,
+// If version is not nil, the change is only made if the node is at that version.
+// Returns NoBlobError, UnauthorizedACLError, and VersionMismatchError.
+func (bs *BlobStore) SetNodePublic(
+	le *logrus.Entry,
+	user auth.User,
+	id uuid.UUID,
+	public bool,
+	version *int64,
 ) (*BlobNode, error) {
-	_, node, err := bs.writeok(user, id, false)
+	_, node, err := bs.writeok(user, id, false, version)
 	if err != nil {
 		return nil, err
 	}
-	err = bs.nodeStore.SetNodePublic(id, public)
+	return bs.setNodePublic(le, user, node, public, version)
+}
+
+// SetNodesPublic sets whether multiple nodes can be read by anyone. The node store is queried
+// once for all the nodes. The results are in the same order as the IDs, and each result
+// contains either the altered node or the error SetNodePublic would return for the node.
+// Other errors cause the entire operation to fail.
+func (bs *BlobStore) SetNodesPublic(
+	le *logrus.Entry,
+	user auth.User,
+	ids []uuid.UUID,
+	public bool,
+) ([]*NodeResult, error) {
+	return bs.alterMany(user, ids,
+		func(nodeuser *nodestore.User, node *nodestore.Node) (*BlobNode, error) {
+			if err := checkWrite(user, nodeuser, node, false, nil); err != nil {
+				return nil, err
+			}
+			return bs.setNodePublic(le, user, node, public, nil)
+		})
+}
+
+func (bs *BlobStore) setNodePublic(
+	le *logrus.Entry,
+	user auth.User,
+	node *nodestore.Node,
+	public bool,
+	version *int64,
+) (*BlobNode, error) {
+	newnode, err := bs.nodeStore.SetNodePublic(node.GetID(), public, version)
 	if err != nil {
 		return nil, translateError(err)
 	}
-	return toBlobNode(node.WithPublic(public)), nil
+	bs.recordChange(le, user, audit.ActionSetPublic, node.GetID(), nil, node, newnode)
+	return toBlobNode(newnode), nil
 }
 
-func (bs *BlobStore) writeok(user auth.User, id uuid.UUID, removeself bool,
+func (bs *BlobStore) writeok(user auth.User, id uuid.UUID, removeself bool, version *int64,
 ) (*nodestore.User, *nodestore.Node, error) {
 	node, nodeuser, err := bs.getNode(&user, id)
 	if err != nil {
 		return nil, nil, err
 	}
-	if removeself && node.HasReader(*nodeuser) {
-		return nodeuser, node, nil
-	}
-	if node.GetOwner() != *nodeuser && !user.IsAdmin() {
-		return nil, nil,
-			NewUnauthorizedACLError("Users can only remove themselves from the read ACL")
+	if err := checkWrite(user, nodeuser, node, removeself, version); err != nil {
+		return nil, nil, err
 	}
 	return nodeuser, node, nil
 }
 
+// checkWrite checks that the user may alter the node's ACLs and that the node is at the given
+// version, if any.
+func checkWrite(
+	user auth.User,
+	nodeuser *nodestore.User,
+	node *nodestore.Node,
+	removeself bool,
+	version *int64,
+) error {
+	if !(removeself && node.HasReader(*nodeuser)) &&
+		node.GetOwner() != *nodeuser && !user.IsAdmin() {
+		return NewUnauthorizedACLError("Users can only remove themselves from the read ACL")
+	}
+	// the node store checks the version as well, but the node may not need to be altered
+	if version != nil && *version != node.GetVersion() {
+		return translateError(
+			nodestore.NewVersionMismatchError(node.GetID(), *version, node.GetVersion()))
+	}
+	return nil
+}
+
 // AddReaders adds readers to a node.
 // Has no effect if the user is the node's owner or the user is already in the read ACL.
-// Returns NoBlobError and UnauthorizedACLError.
-func (bs *BlobStore) AddReaders(user auth.User, id uuid.UUID, readerAccountNames []string,
+// If version is not nil, the change is only made if the node is at that version.
+// Returns NoBlobError, UnauthorizedACLError, and VersionMismatchError.
+func (bs *BlobStore) AddReaders(
+	le *logrus.Entry,
+	user auth.User,
+	id uuid.UUID,
+	readerAccountNames []string,
+	version *int64,
 ) (*BlobNode, error) {
-	return bs.alterReaders(user, id, readerAccountNames, true)
+	return bs.alterReaders(le, user, id, readerAccountNames, true, version)
 }
 
 // RemoveReaders removes readers from a node.
 // Has no effect if the user is not already in the read ACL.
-// Returns NoBlobError and UnauthorizedACLError.
-func (bs *BlobStore) RemoveReaders(user auth.User, id uuid.UUID, readerAccountNames []string,
+// If version is not nil, the change is only made if the node is at that version.
+// Returns NoBlobError, UnauthorizedACLError, and VersionMismatchError.
+func (bs *BlobStore) RemoveReaders(
+	le *logrus.Entry,
+	user auth.User,
+	id uuid.UUID,
+	readerAccountNames []string,
+	version *int64,
 ) (*BlobNode, error) {
-	return bs.alterReaders(user, id, readerAccountNames, false)
+	return bs.alterReaders(le, user, id, readerAccountNames, false, version)
 }
 
 func (bs *BlobStore) alterReaders(
+	le *logrus.Entry,
 	user auth.User,
 	id uuid.UUID,
 	readerAccountNames []string,
 	add bool,
+	version *int64,
 ) (*BlobNode, error) {
-	removeself := !add &&
-		len(readerAccountNames) == 1 &&
-		user.GetUserName() == readerAccountNames[0]
-	nodeuser, node, err := bs.writeok(user, id, removeself)
+	removeself := isRemoveSelf(user, readerAccountNames, add)
+	nodeuser, node, err := bs.writeok(user, id, removeself, version)
 	if err != nil {
 		return nil, err
 	}
 	// errors at this point should be unusual since we've already fetched the node
-	readers := []nodestore.User{}
-	if removeself {
-		readers = append(readers, *nodeuser)
-	} else {
-		for _, ran := range readerAccountNames {
-			u, err := bs.nodeStore.GetUser(ran)
-			if err != nil {
-				return nil, err // errors should only occur for unusual situations here
-			}
-			readers = append(readers, *u)
+	readers := []nodestore.User{*nodeuser}
+	if !removeself {
+		readers, err = bs.nodeStore.GetUsers(readerAccountNames)
+		if err != nil {
+			return nil, err // errors should only occur for unusual situations here
 		}
 	}
-	for _, u := range readers {
-		if add {
-			err = bs.nodeStore.AddReader(id, u)
-		} else {
-			err = bs.nodeStore.RemoveReader(id, u)
-		}
+	return bs.applyReaders(le, user, node, readers, add, version)
+}
+
+// AddReadersToNodes adds readers to multiple nodes. The node store is queried once for all the
+// nodes. The results are in the same order as the IDs, and each result contains either the
+// altered node or the error AddReaders would return for the node. Other errors cause the
+// entire operation to fail.
+func (bs *BlobStore) AddReadersToNodes(
+	le *logrus.Entry,
+	user auth.User,
+	ids []uuid.UUID,
+	readerAccountNames []string,
+) ([]*NodeResult, error) {
+	return bs.alterManyReaders(le, user, ids, readerAccountNames, true)
+}
+
+// RemoveReadersFromNodes removes readers from multiple nodes. The node store is queried once
+// for all the nodes. The results are in the same order as the IDs, and each result contains
+// either the altered node or the error RemoveReaders would return for the node. Other errors
+// cause the entire operation to fail.
+func (bs *BlobStore) RemoveReadersFromNodes(
+	le *logrus.Entry,
+	user auth.User,
+	ids []uuid.UUID,
+	readerAccountNames []string,
+) ([]*NodeResult, error) {
+	return bs.alterManyReaders(le, user, ids, readerAccountNames, false)
+}
+
+func (bs *BlobStore) alterManyReaders(
+	le *logrus.Entry,
+	user auth.User,
+	ids []uuid.UUID,
+	readerAccountNames []string,
+	add bool,
+) ([]*NodeResult, error) {
+	removeself := isRemoveSelf(user, readerAccountNames, add)
+	var readers []nodestore.User
+	if !removeself {
+		var err error
+		readers, err = bs.nodeStore.GetUsers(readerAccountNames)
 		if err != nil {
-			return nil, translateError(err)
+			return nil, err // errors should only occur for unusual situations here
 		}
 	}
+	return bs.alterMany(user, ids,
+		func(nodeuser *nodestore.User, node *nodestore.Node) (*BlobNode, error) {
+			if err := checkWrite(user, nodeuser, node, removeself, nil); err != nil {
+				return nil, err
+			}
+			if removeself {
+				return bs.applyReaders(le, user, node, []nodestore.User{*nodeuser}, add, nil)
+			}
+			return bs.applyReaders(le, user, node, readers, add, nil)
+		})
+}
+
+func isRemoveSelf(user auth.User, readerAccountNames []string, add bool) bool {
+	return !add && len(readerAccountNames) == 1 && user.GetUserName() == readerAccountNames[0]
+}
+
+func (bs *BlobStore) applyReaders(
+	le *logrus.Entry,
+	user auth.User,
+	node *nodestore.Node,
+	readers []nodestore.User,
+	add bool,
+	version *int64,
+) (*BlobNode, error) {
+	var newnode *nodestore.Node
+	var err error
+	action := audit.ActionAddReaders
 	if add {
-		node = node.WithReaders(readers...)
+		newnode, err = bs.nodeStore.AddReaders(node.GetID(), readers, version)
 	} else {
-		node = node.WithoutReaders(readers...)
+		newnode, err = bs.nodeStore.RemoveReaders(node.GetID(), readers, version)
+		action = audit.ActionRemoveReaders
 	}
-	return toBlobNode(node), nil
+	if err != nil {
+		return nil, translateError(err)
+	}
+	bs.recordChange(le, user, action, node.GetID(), nil, node, newnode)
+	return toBlobNode(newnode), nil
 }
 
 // ChangeOwner changes the owner of a node.
 // If the new owner is in the read ACL, the new owner will be removed.
 // Setting the new owner to the current owner has no effect.
-// Returns NoBlobError and UnauthorizedACLError.
-func (bs *BlobStore) ChangeOwner(user auth.User, id uuid.UUID, newowner string,
+// If version is not nil, the change is only made if the node is at that version.
+// Returns NoBlobError, UnauthorizedACLError, and VersionMismatchError.
+func (bs *BlobStore) ChangeOwner(
+	le *logrus.Entry,
+	user auth.User,
+	id uuid.UUID,
+	newowner string,
+	version *int64,
 ) (*BlobNode, error) {
-	_, node, err := bs.writeok(user, id, false)
+	_, node, err := bs.writeok(user, id, false, version)
 	if err != nil {
 		return nil, err
 	}
@@ -361,53 +965,628 @@ func (bs *BlobStore) ChangeOwner(user auth.User, id uuid.UUID, newowner string,
 	if err != nil {
 		return nil, err // errors should only occur for unusual situations here
 	}
-	if err = bs.nodeStore.ChangeOwner(id, *u); err != nil {
+	newnode, err := bs.nodeStore.ChangeOwner(id, *u, version)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	bs.recordChange(le, user, audit.ActionChangeOwner, id, nil, node, newnode)
+	return toBlobNode(newnode), nil
+}
+
+// SetFileMetadata sets the filename and / or format of a node. A nil filename or format is not
+// changed, but at least one must be provided. Only the node owner and full blobstore
+// administrators may change a node's file metadata.
+// If version is not nil, the change is only made if the node is at that version.
+// Returns NoBlobError, UnauthorizedError, and VersionMismatchError.
+func (bs *BlobStore) SetFileMetadata(
+	le *logrus.Entry,
+	user auth.User,
+	id uuid.UUID,
+	filename *values.FileName,
+	format *values.FileFormat,
+	version *int64,
+) (*BlobNode, error) {
+	if filename == nil && format == nil {
+		return nil, values.NewIllegalInputError(
+			"At least one of filename or format must be provided")
+	}
+	node, nodeuser, err := bs.getNode(&user, id)
+	if err != nil {
+		return nil, err
+	}
+	if node.GetOwner() != *nodeuser && !user.IsAdmin() {
+		return nil, NewUnauthorizedError("Unauthorized")
+	}
+	// the node store checks the version as well, but the node may not need to be altered
+	if version != nil && *version != node.GetVersion() {
+		return nil, translateError(
+			nodestore.NewVersionMismatchError(id, *version, node.GetVersion()))
+	}
+	var fn, ff *string
+	if filename != nil {
+		f := filename.GetFileName()
+		fn = &f
+	}
+	if format != nil {
+		f := format.GetFileFormat()
+		ff = &f
+	}
+	newnode, err := bs.nodeStore.SetFileMetadata(id, fn, ff, bs.time.Now(), version)
+	if err != nil {
 		return nil, translateError(err)
 	}
-	return toBlobNode(node.WithOwner(*u)), nil
+	bs.recordChange(le, user, audit.ActionSetFileMetadata, id, nil, node, newnode)
+	return toBlobNode(newnode), nil
 }
 
-// DeleteNode deletes the given node.
+// DeleteNode deletes the given node. Only the node owner and full blobstore administrators may
+// delete a node.
 // Returns NoBlobError and UnauthorizedError.
-func (bs *BlobStore) DeleteNode(user auth.User, id uuid.UUID) error {
+func (bs *BlobStore) DeleteNode(le *logrus.Entry, user auth.User, id uuid.UUID) error {
 	node, nodeuser, err := bs.getNode(&user, id)
 	if err != nil {
 		return err
 	}
+	return bs.deleteNode(le, user, nodeuser, node)
+}
+
+// DeleteNodes deletes multiple nodes. The node store is queried once for all the nodes.
+// The results are in the same order as the IDs, and each result contains the error DeleteNode
+// would return for the node, if any. The result never contains the node. Other errors cause
+// the entire operation to fail.
+func (bs *BlobStore) DeleteNodes(le *logrus.Entry, user auth.User, ids []uuid.UUID,
+) ([]*NodeResult, error) {
+	return bs.alterMany(user, ids,
+		func(nodeuser *nodestore.User, node *nodestore.Node) (*BlobNode, error) {
+			return nil, bs.deleteNode(le, user, nodeuser, node)
+		})
+}
+
+func (bs *BlobStore) deleteNode(
+	le *logrus.Entry,
+	user auth.User,
+	nodeuser *nodestore.User,
+	node *nodestore.Node,
+) error {
 	if node.GetOwner() != *nodeuser && !user.IsAdmin() {
 		return NewUnauthorizedError("Unauthorized")
 	}
-	err = bs.nodeStore.DeleteNode(id)
+	id := node.GetID()
+	err := bs.nodeStore.DeleteNode(id)
 	if err != nil {
 		return translateError(err)
 	}
 	// theoretically there's a race here but probably not worth worrying about
 	// also a possibility of leaving orphaned files, no way to avoid that really.
-	return bs.fileStore.DeleteFile(uuidToFilePath(id))
+	last, err := bs.nodeStore.RemoveFileReference(fileID(node))
+	if err == nil && last { // otherwise other nodes share the file
+		err = bs.fileStore.DeleteFile(fileID(node))
+	}
+	// the node is deleted regardless of whether the file could be, so always record the change
+	bs.recordChange(le, user, audit.ActionDelete, id, nil, node, nil)
+	return err // errors should only occur for unusual situations here
+}
+
+// CopyOptions contains optional parameters for the CopyNode method.
+type CopyOptions struct {
+	readers  bool
+	public   bool
+	filename *values.FileName
+	format   *values.FileFormat
+	owner    *string
+}
+
+// CopyReaders is an option for CopyNode that causes the copy to have the same read ACL as the
+// source node.
+func CopyReaders() func(*CopyOptions) {
+	return func(o *CopyOptions) {
+		o.readers = true
+	}
+}
+
+// CopyPublic is an option for CopyNode that causes the copy to be publicly readable if the
+// source node is publicly readable.
+func CopyPublic() func(*CopyOptions) {
+	return func(o *CopyOptions) {
+		o.public = true
+	}
+}
+
+// CopyFileName is an option for CopyNode that sets the filename of the copy rather than using
+// the source node's filename.
+func CopyFileName(filename values.FileName) func(*CopyOptions) {
+	return func(o *CopyOptions) {
+		o.filename = &filename
+	}
+}
+
+// CopyFormat is an option for CopyNode that sets the file format of the copy rather than using
+// the source node's format.
+func CopyFormat(format values.FileFormat) func(*CopyOptions) {
+	return func(o *CopyOptions) {
+		o.format = &format
+	}
 }
 
-// CopyNode makes a copy of the given node with an empty readers list.
+// CopyOwner is an option for CopyNode that sets the owner of the copy rather than the user
+// making the copy. Only full blobstore administrators may set the owner.
+// The caller is responsible for ensuring the owner is a valid user.
+func CopyOwner(owner string) func(*CopyOptions) {
+	return func(o *CopyOptions) {
+		o.owner = &owner
+	}
+}
+
+// CopyNode makes a copy of the given node. By default the copy is owned by the user, has an
+// empty readers list and is not public. The copy shares the node's file, so no data is copied.
 // Returns NoBlobError and UnauthorizedError.
-func (bs *BlobStore) CopyNode(user auth.User, id uuid.UUID) (*BlobNode, error) {
+func (bs *BlobStore) CopyNode(
+	le *logrus.Entry,
+	user auth.User,
+	id uuid.UUID,
+	options ...func(*CopyOptions),
+) (*BlobNode, error) {
+	opts := &CopyOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+	if opts.owner != nil && !user.IsAdmin() {
+		return nil, NewUnauthorizedError("Only administrators may set the owner of a copy")
+	}
 	node, nodeuser, err := bs.getNode(&user, id)
 	if err != nil {
 		return nil, err
 	}
-	if !authok(&user, nodeuser, node) {
+	owner, err := bs.getCopyOwner(nodeuser, opts)
+	if err != nil {
+		return nil, err
+	}
+	return bs.copyNode(le, user, nodeuser, node, owner, opts)
+}
+
+// CopyNodes makes copies of multiple nodes with the same options as CopyNode. The node store
+// is queried once for all the nodes. The results are in the same order as the IDs, and each
+// result contains either the copy or the error CopyNode would return for the node. Other
+// errors cause the entire operation to fail.
+func (bs *BlobStore) CopyNodes(
+	le *logrus.Entry,
+	user auth.User,
+	ids []uuid.UUID,
+	options ...func(*CopyOptions),
+) ([]*NodeResult, error) {
+	opts := &CopyOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+	if opts.owner != nil && !user.IsAdmin() {
+		results := []*NodeResult{}
+		for _, id := range ids {
+			results = append(results, &NodeResult{ID: id,
+				Error: NewUnauthorizedError("Only administrators may set the owner of a copy")})
+		}
+		return results, nil
+	}
+	var owner *nodestore.User
+	return bs.alterMany(user, ids,
+		func(nodeuser *nodestore.User, node *nodestore.Node) (*BlobNode, error) {
+			if owner == nil {
+				var err error
+				owner, err = bs.getCopyOwner(nodeuser, opts)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return bs.copyNode(le, user, nodeuser, node, owner, opts)
+		})
+}
+
+// getCopyOwner gets the owner for a copy, which is the user unless an owner is specified.
+func (bs *BlobStore) getCopyOwner(nodeuser *nodestore.User, opts *CopyOptions,
+) (*nodestore.User, error) {
+	if opts.owner == nil {
+		return nodeuser, nil
+	}
+	owner, err := bs.nodeStore.GetUser(*opts.owner)
+	if err != nil {
+		return nil, err // errors should only occur for unusual situations here
+	}
+	return owner, nil
+}
+
+func (bs *BlobStore) copyNode(
+	le *logrus.Entry,
+	user auth.User,
+	nodeuser *nodestore.User,
+	node *nodestore.Node,
+	owner *nodestore.User,
+	opts *CopyOptions,
+) (*BlobNode, error) {
+	// copying creates a node, so read only administrators may only copy nodes they could copy
+	// without administration privileges
+	if !user.IsAdmin() && !readok(nodeuser, node) {
 		return nil, NewUnauthorizedError("Unauthorized")
 	}
+	id := node.GetID()
+	filename, format := node.GetFileName(), node.GetFormat()
+	if opts.filename != nil {
+		filename = opts.filename.GetFileName()
+	}
+	if opts.format != nil {
+		format = opts.format.GetFileFormat()
+	}
 	newid := bs.uuidGen.GetUUID()
-	fi, err := bs.fileStore.CopyFile(uuidToFilePath(id), uuidToFilePath(newid))
+	err := bs.nodeStore.AddFileReference(fileID(node), id)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	// if the node was deleted before the reference was added, the file may have been deleted
+	// too. Nodes are deleted before their file references are removed, so if the node still
+	// exists the new reference was counted before the node's reference was removed.
+	_, err = bs.nodeStore.GetNode(id)
 	if err != nil {
-		return nil, err // since node exists file should exist
+		bs.removeFileReference(le, fileID(node))
+		return nil, translateError(err)
+	}
+	nopts := []func(*nodestore.Node) error{nodestore.FileName(filename),
+		nodestore.Format(format), nodestore.FileID(fileID(node))}
+	if node.GetChecksums() != nil {
+		nopts = append(nopts, nodestore.Checksums(*node.GetChecksums()))
+	}
+	if opts.readers {
+		for _, r := range *node.GetReaders() {
+			nopts = append(nopts, nodestore.Reader(r))
+		}
 	}
-	newnode, _ := nodestore.NewNode(newid, *nodeuser, node.GetSize(), node.GetMD5(), fi.Stored,
-		nodestore.FileName(node.GetFileName()), nodestore.Format(node.GetFormat()))
+	if opts.public {
+		nopts = append(nopts, nodestore.Public(node.GetPublic()))
+	}
+	newnode, _ := nodestore.NewNode(newid, *owner, node.GetSize(), node.GetMD5(),
+		bs.time.Now(), nopts...)
 	err = bs.nodeStore.StoreNode(newnode)
 	if err != nil {
+		bs.removeFileReference(le, fileID(node))
 		return nil, err // errors should only occur for unusual situations here
-		// consider deleting the file here, although errors should be extremely rare
-		// since we recently contacted mongo
 	}
+	bs.recordChange(le, user, audit.ActionCopy, newid, &id, nil, newnode)
 	return toBlobNode(newnode), nil
 }
+
+// removeFileReference removes a file reference that was added for a node that was never stored,
+// deleting the file if no references remain. Errors are logged, since the caller is already
+// handling an error.
+func (bs *BlobStore) removeFileReference(le *logrus.Entry, fileID string) {
+	last, err := bs.nodeStore.RemoveFileReference(fileID)
+	if err == nil && last {
+		err = bs.fileStore.DeleteFile(fileID)
+	}
+	if err != nil {
+		le.WithField("error", err.Error()).Error("could not remove file reference")
+	}
+}
+
+// RenameUser changes a user's account name, for example when the account is renamed in the
+// authentication system. The user's internal ID is unchanged, and the user's nodes and read ACL
+// entries are updated with the new name. Only full blobstore administrators may rename users.
+// The change to each node is recorded in the audit log, and the user's API keys are transferred
+// to the new name.
+// The caller is responsible for ensuring the new account name is valid.
+// If an account with the new name already exists, the accounts may be merged via MergeUsers.
+// Returns UnauthorizedError, IllegalInputError, NoUserError, and UserExistsError.
+func (bs *BlobStore) RenameUser(
+	le *logrus.Entry,
+	user auth.User,
+	accountName string,
+	newAccountName string,
+) error {
+	if !user.IsAdmin() {
+		return NewUnauthorizedError("Only full administrators may rename users")
+	}
+	accountName = strings.TrimSpace(accountName)
+	newAccountName = strings.TrimSpace(newAccountName)
+	if accountName == "" || newAccountName == "" {
+		return values.NewIllegalInputError("Account names cannot be empty")
+	}
+	renamed, err := bs.nodeStore.GetExistingUser(accountName)
+	if err != nil {
+		return translateError(err)
+	}
+	// theoretically there's a race here if the nodes change after they're fetched, which would
+	// make the before state in the audit log incorrect, but probably not worth worrying about
+	nodes, err := bs.getUserNodes(*renamed)
+	if err != nil {
+		return err // errors should only occur for unusual situations here
+	}
+	_, err = bs.nodeStore.RenameUser(accountName, newAccountName)
+	if err != nil {
+		return translateError(err)
+	}
+	if bs.apiKeys != nil {
+		if err := bs.apiKeys.RenameUser(accountName, newAccountName); err != nil {
+			return err // errors should only occur for unusual situations here
+		}
+	}
+	for _, before := range nodes {
+		after, err := bs.nodeStore.GetNode(before.GetID())
+		if err != nil {
+			// the user has already been renamed, so log rather than fail. NoNodeErrors are
+			// expected for nodes deleted while renaming.
+			if _, ok := err.(*nodestore.NoNodeError); !ok {
+				le.WithField("error", err.Error()).Error("could not get renamed node")
+			}
+			continue
+		}
+		bs.recordChange(le, user, audit.ActionRenameUser, before.GetID(), nil, before, after)
+	}
+	return nil
+}
+
+// getUserNodes gets the nodes a user owns or can read, without duplicates.
+func (bs *BlobStore) getUserNodes(user nodestore.User) ([]*nodestore.Node, error) {
+	owned, err := bs.nodeStore.GetNodesByOwner(user)
+	if err != nil {
+		return nil, err
+	}
+	readable, err := bs.nodeStore.GetNodesByReader(user)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[uuid.UUID]struct{}{}
+	nodes := []*nodestore.Node{}
+	for _, n := range append(owned, readable...) {
+		if _, ok := seen[n.GetID()]; !ok {
+			seen[n.GetID()] = struct{}{}
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// UserChanges describes the nodes altered when a user is merged or purged.
+type UserChanges struct {
+	// Owned is the number of nodes the user owned.
+	Owned int
+	// Read is the number of nodes, other than those the user owned, with the user in their read
+	// ACL.
+	Read int
+}
+
+// MergeUsers transfers the ownership of a user's nodes and the user's read ACL entries to
+// another user. Only full blobstore administrators may merge users.
+// Each node is altered individually and recorded in the audit log. Nodes that are deleted
+// while the users are being merged are skipped.
+// The caller is responsible for ensuring the user receiving the nodes is a valid user.
+// Returns UnauthorizedError, IllegalInputError, and NoUserError if the user to be merged is
+// unknown to the blobstore.
+func (bs *BlobStore) MergeUsers(
+	le *logrus.Entry,
+	user auth.User,
+	accountName string,
+	intoAccountName string,
+) (*UserChanges, error) {
+	if !user.IsAdmin() {
+		return nil, NewUnauthorizedError("Only full administrators may merge users")
+	}
+	accountName = strings.TrimSpace(accountName)
+	intoAccountName = strings.TrimSpace(intoAccountName)
+	if accountName == "" || intoAccountName == "" {
+		return nil, values.NewIllegalInputError("Account names cannot be empty")
+	}
+	if accountName == intoAccountName {
+		return nil, values.NewIllegalInputError("Cannot merge a user into itself")
+	}
+	from, err := bs.nodeStore.GetExistingUser(accountName)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	// the user receiving the nodes is created when the first node is transferred if necessary
+	into, err := bs.nodeStore.GetExistingUser(intoAccountName)
+	if _, ok := err.(*nodestore.NoUserError); ok {
+		into, err = nil, nil
+	}
+	if err != nil {
+		return nil, err // errors should only occur for unusual situations here
+	}
+	owned, err := bs.nodeStore.GetNodesByOwner(*from)
+	if err != nil {
+		return nil, err // errors should only occur for unusual situations here
+	}
+	changes := &UserChanges{}
+	ownedIDs := map[uuid.UUID]struct{}{}
+	// theoretically there's a race here if the owner of a node changes after the nodes are
+	// fetched, but probably not worth worrying about
+	for _, n := range owned {
+		_, err := bs.ChangeOwner(le, user, n.GetID(), intoAccountName, nil)
+		if isNoBlob(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ownedIDs[n.GetID()] = struct{}{}
+		changes.Owned++
+	}
+	// the previous owner remains in the read ACL of the nodes transferred above
+	readable, err := bs.nodeStore.GetNodesByReader(*from)
+	if err != nil {
+		return nil, err // errors should only occur for unusual situations here
+	}
+	for _, n := range readable {
+		var err error
+		if into == nil || !n.HasReader(*into) {
+			_, err = bs.AddReaders(le, user, n.GetID(), []string{intoAccountName}, nil)
+		}
+		if err == nil {
+			_, err = bs.RemoveReaders(le, user, n.GetID(), []string{accountName}, nil)
+		}
+		if isNoBlob(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ownedIDs[n.GetID()]; !ok {
+			changes.Read++
+		}
+	}
+	return changes, nil
+}
+
+// PurgeUser deletes all the nodes a user owns and removes the user from the read ACL of all
+// other nodes, for example in response to a data deletion request. Only full blobstore
+// administrators may purge users.
+// Each node is altered or deleted individually and recorded in the audit log. Nodes that are
+// deleted by other users while the user is being purged are skipped. The audit log is not
+// altered. The user's API keys are revoked.
+// Returns UnauthorizedError, IllegalInputError, and NoUserError if the user is unknown to the
+// blobstore.
+func (bs *BlobStore) PurgeUser(le *logrus.Entry, user auth.User, accountName string,
+) (*UserChanges, error) {
+	if !user.IsAdmin() {
+		return nil, NewUnauthorizedError("Only full administrators may purge users")
+	}
+	accountName = strings.TrimSpace(accountName)
+	if accountName == "" {
+		return nil, values.NewIllegalInputError("Account name cannot be empty")
+	}
+	purged, err := bs.nodeStore.GetExistingUser(accountName)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	// revoke the keys first so the user can't create new nodes while being purged
+	if bs.apiKeys != nil {
+		if err := bs.apiKeys.DeleteKeys(accountName); err != nil {
+			return nil, err // errors should only occur for unusual situations here
+		}
+	}
+	owned, err := bs.nodeStore.GetNodesByOwner(*purged)
+	if err != nil {
+		return nil, err // errors should only occur for unusual situations here
+	}
+	changes := &UserChanges{}
+	for _, n := range owned {
+		err := bs.DeleteNode(le, user, n.GetID())
+		if isNoBlob(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		changes.Owned++
+	}
+	readable, err := bs.nodeStore.GetNodesByReader(*purged)
+	if err != nil {
+		return nil, err // errors should only occur for unusual situations here
+	}
+	for _, n := range readable {
+		_, err := bs.RemoveReaders(le, user, n.GetID(), []string{accountName}, nil)
+		if isNoBlob(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		changes.Read++
+	}
+	return changes, nil
+}
+
+func isNoBlob(err error) bool {
+	_, ok := err.(*NoBlobError)
+	return ok
+}
+
+// GetAuditRecords gets records from the audit log. Only blobstore administrators, including
+// read only administrators, may view the entire audit log.
+// Returns UnauthorizedError.
+func (bs *BlobStore) GetAuditRecords(user auth.User, params *audit.Params,
+) ([]*audit.Record, error) {
+	if !user.IsReadAdmin() {
+		return nil, NewUnauthorizedError("Unauthorized")
+	}
+	return bs.getAuditRecords(params)
+}
+
+// GetNodeAuditRecords gets the audit log records for a node. Only the node owner and
+// blobstore administrators, including read only administrators, may view a node's audit records.
+// Returns NoBlobError and UnauthorizedError.
+func (bs *BlobStore) GetNodeAuditRecords(user auth.User, id uuid.UUID, limit int,
+) ([]*audit.Record, error) {
+	node, nodeuser, err := bs.getNode(&user, id)
+	if err != nil {
+		return nil, err
+	}
+	if node.GetOwner() != *nodeuser && !user.IsReadAdmin() {
+		return nil, NewUnauthorizedError("Unauthorized")
+	}
+	return bs.getAuditRecords(&audit.Params{NodeID: &id, Limit: limit})
+}
+
+func (bs *BlobStore) getAuditRecords(params *audit.Params) ([]*audit.Record, error) {
+	if bs.auditLog == nil {
+		return nil, errors.New("No audit log is configured")
+	}
+	return bs.auditLog.GetRecords(params)
+}
+
+// SubscribeEvents returns a channel that receives a value whenever this blob store adds an
+// event to the event store, allowing callers to check for new events via GetEvents without
+// waiting to poll. Notifications are coalesced, and events added by other blob store
+// instances sharing the event store do not cause a notification.
+// The returned function must be called to cancel the subscription.
+func (bs *BlobStore) SubscribeEvents() (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+	bs.subsLock.Lock()
+	defer bs.subsLock.Unlock()
+	bs.subs[c] = struct{}{}
+	return c, func() {
+		bs.subsLock.Lock()
+		defer bs.subsLock.Unlock()
+		delete(bs.subs, c)
+	}
+}
+
+// GetLastEventSeq gets the sequence number of the most recent event, or 0 if there are no
+// events.
+func (bs *BlobStore) GetLastEventSeq() (int64, error) {
+	if bs.events == nil {
+		return -1, errors.New("No event store is configured")
+	}
+	return bs.events.GetLastSeq()
+}
+
+// GetEvents gets up to limit events with sequence numbers greater than after, in sequence
+// order, and removes any events for nodes the user cannot read. Blobstore administrators may
+// read all events. Events for deleted nodes are readable by users who could read the node
+// prior to deletion.
+// Also returns the sequence number of the last event examined, which should be used as the
+// value of after in the next call. If no events were examined, after is returned.
+func (bs *BlobStore) GetEvents(user auth.User, after int64, limit int,
+) ([]*events.Event, int64, error) {
+	if bs.events == nil {
+		return nil, -1, errors.New("No event store is configured")
+	}
+	evs, err := bs.events.GetEvents(after, limit)
+	if err != nil {
+		return nil, -1, err
+	}
+	ret := []*events.Event{}
+	for _, ev := range evs {
+		after = ev.Seq
+		if canReadEvent(user, ev) {
+			ret = append(ret, ev)
+		}
+	}
+	return ret, after, nil
+}
+
+func canReadEvent(user auth.User, ev *events.Event) bool {
+	if user.IsReadAdmin() || ev.Public || ev.Owner == user.GetUserName() {
+		return true
+	}
+	for _, r := range ev.Readers {
+		if r == user.GetUserName() {
+			return true
+		}
+	}
+	return false
+}
@@ -2,23 +2,34 @@ package core
 
 import (
 	"errors"
+	"io"
 	"io/ioutil"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	akmocks "github.com/kbase/blobstore/apikey/mocks"
+	"github.com/kbase/blobstore/audit"
+	amocks "github.com/kbase/blobstore/audit/mocks"
 	"github.com/kbase/blobstore/auth"
 	cmocks "github.com/kbase/blobstore/core/mocks"
 	"github.com/kbase/blobstore/core/values"
+	"github.com/kbase/blobstore/events"
+	emocks "github.com/kbase/blobstore/events/mocks"
 	"github.com/kbase/blobstore/filestore"
 	fsmocks "github.com/kbase/blobstore/filestore/mocks"
 	"github.com/kbase/blobstore/nodestore"
 	nsmocks "github.com/kbase/blobstore/nodestore/mocks"
 	"github.com/sirupsen/logrus"
+	logrust "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
+// noVersion matches calls to the node store that don't check the node version.
+var noVersion *int64
+
 func TestNoBlobError(t *testing.T) {
 	e := NewNoBlobError("some error")
 	assert.Equal(t, "some error", e.Error(), "incorrect error")
@@ -34,6 +45,21 @@ func TestUnauthorizedACLError(t *testing.T) {
 	assert.Equal(t, "some error", e.Error(), "incorrect error")
 }
 
+func TestVersionMismatchError(t *testing.T) {
+	e := NewVersionMismatchError("some error")
+	assert.Equal(t, "some error", e.Error(), "incorrect error")
+}
+
+func TestNoUserError(t *testing.T) {
+	e := NewNoUserError("some error")
+	assert.Equal(t, "some error", e.Error(), "incorrect error")
+}
+
+func TestUserExistsError(t *testing.T) {
+	e := NewUserExistsError("some error")
+	assert.Equal(t, "some error", e.Error(), "incorrect error")
+}
+
 func TestStoreBasic(t *testing.T) {
 	uidmock := new(cmocks.UUIDGen)
 	fsmock := new(fsmocks.FileStore)
@@ -85,11 +111,13 @@ func TestStoreBasic(t *testing.T) {
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "",
 		Format:   "",
 		Owner:    User{userid, "username"},
 		Readers:  &[]User{User{userid, "username"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -149,15 +177,256 @@ func TestStoreWithFilenameAndFormat(t *testing.T) {
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "myfile",
 		Format:   "excel",
 		Owner:    User{userid, "username"},
 		Readers:  &[]User{User{userid, "username"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
 
+func TestStoreWithChecksums(t *testing.T) {
+	uidmock := new(cmocks.UUIDGen)
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+
+	bs := NewWithUUIDGen(fsmock, nsmock, uidmock)
+
+	uid, _ := uuid.Parse("4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+	userid := uuid.New()
+	nuser, _ := nodestore.NewUser(userid, "username")
+
+	uidmock.On("GetUUID").Return(uid)
+	nsmock.On("GetUser", "username").Return(nuser, nil)
+
+	p, _ := filestore.NewStoreFileParams(
+		"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		12,
+		strings.NewReader("012345678910"))
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	sums, _ := values.NewChecksums(map[string]string{
+		"sha1":   "36a27136f3015f5ed0e1fe268ad7a93a985196cf",
+		"sha256": "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29",
+		"crc32c": "8412e281",
+	})
+	sto := filestore.FileInfo{
+		ID:        "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		Size:      12,
+		MD5:       md5,
+		Checksums: sums,
+		Stored:    tme,
+	}
+	le := logrus.WithField("a", "b")
+	fsmock.On("StoreFile", le, p).Return(&sto, nil)
+	nsmock.On("AddFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74", int64(12),
+		"cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29").Return(
+		"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74", nil)
+
+	node, _ := nodestore.NewNode(uid, *nuser, 12, *md5, tme, nodestore.Checksums(*sums),
+		nodestore.FileID("41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74"))
+	nsmock.On("StoreNode", node).Return(nil)
+	auser, _ := auth.NewUser("username", false)
+
+	fn, _ := values.NewFileName("")
+	ff, _ := values.NewFileFormat("")
+	// checksums are case insensitive
+	emd5, _ := values.NewMD5("5D838D477DDF355FC15DF1DB90BEE0AA")
+	esha, _ := values.NewSHA256("CC57129A45495196AFB880A3861AABF218B4028CFD3717816F93D8C5D998EC29")
+	bnode, err := bs.Store(
+		le,
+		*auser,
+		strings.NewReader("012345678910"),
+		12,
+		*fn,
+		*ff,
+		ExpectedMD5(*emd5),
+		ExpectedSHA256(*esha),
+	)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, uid, bnode.ID, "incorrect node id")
+	assert.Equal(t, sums, bnode.Checksums, "incorrect checksums")
+	fsmock.AssertNotCalled(t, "DeleteFile", mock.Anything)
+}
+
+func TestStoreFailChecksumMismatch(t *testing.T) {
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	sums, _ := values.NewChecksums(map[string]string{
+		"sha256": "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29"})
+	badmd5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0ab")
+	badsha, _ := values.NewSHA256(
+		"CC57129A45495196AFB880A3861AABF218B4028CFD3717816F93D8C5D998EC2A")
+
+	type testcase struct {
+		opts    []func(*StoreOptions)
+		delerr  error
+		err     string
+		logmsgs int
+	}
+
+	md5err := "MD5 checksum mismatch: expected 5d838d477ddf355fc15df1db90bee0ab, got " +
+		"5d838d477ddf355fc15df1db90bee0aa"
+	shaerr := "SHA-256 checksum mismatch: expected " +
+		"CC57129A45495196AFB880A3861AABF218B4028CFD3717816F93D8C5D998EC2A, got " +
+		"cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29"
+
+	testcases := []testcase{
+		testcase{[]func(*StoreOptions){ExpectedMD5(*badmd5)}, nil, md5err, 0},
+		testcase{[]func(*StoreOptions){ExpectedMD5(*badmd5), ExpectedSHA256(*badsha)}, nil,
+			md5err, 0},
+		testcase{[]func(*StoreOptions){ExpectedMD5(*md5), ExpectedSHA256(*badsha)}, nil,
+			shaerr, 0},
+		// a failed delete is logged, but the checksum error is still returned
+		testcase{[]func(*StoreOptions){ExpectedSHA256(*badsha)}, errors.New("oh dear"),
+			shaerr, 1},
+	}
+
+	for _, tc := range testcases {
+		uidmock := new(cmocks.UUIDGen)
+		fsmock := new(fsmocks.FileStore)
+		nsmock := new(nsmocks.NodeStore)
+		bs := NewWithUUIDGen(fsmock, nsmock, uidmock)
+
+		uid, _ := uuid.Parse("4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+		nuser, _ := nodestore.NewUser(uuid.New(), "username")
+		uidmock.On("GetUUID").Return(uid)
+		nsmock.On("GetUser", "username").Return(nuser, nil)
+
+		p, _ := filestore.NewStoreFileParams(
+			"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+			12,
+			strings.NewReader("012345678910"))
+		sto := filestore.FileInfo{
+			ID:        "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+			Size:      12,
+			MD5:       md5,
+			Checksums: sums,
+			Stored:    time.Now(),
+		}
+		logger, hook := logrust.NewNullLogger()
+		le := logger.WithField("a", "b")
+		fsmock.On("StoreFile", le, p).Return(&sto, nil)
+		fsmock.On("DeleteFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74").Return(
+			tc.delerr)
+
+		auser, _ := auth.NewUser("username", false)
+		fn, _ := values.NewFileName("")
+		ff, _ := values.NewFileFormat("")
+		bnode, err := bs.Store(
+			le, *auser, strings.NewReader("012345678910"), 12, *fn, *ff, tc.opts...)
+		assert.Nil(t, bnode, "expected error")
+		assert.Equal(t, values.NewIllegalInputError(tc.err), err, "incorrect error")
+		fsmock.AssertCalled(t, "DeleteFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+		nsmock.AssertNotCalled(t, "StoreNode", mock.Anything)
+		assert.Equal(t, tc.logmsgs, len(hook.AllEntries()), "incorrect log count")
+	}
+}
+
+func TestStoreSharesIdenticalFile(t *testing.T) {
+	type testcase struct {
+		delerr  error
+		logmsgs int
+	}
+	testcases := []testcase{
+		testcase{nil, 0},
+		// a failed delete of the duplicate file is logged, but the store succeeds
+		testcase{errors.New("oh dear"), 1},
+	}
+
+	for _, tc := range testcases {
+		uidmock := new(cmocks.UUIDGen)
+		fsmock := new(fsmocks.FileStore)
+		nsmock := new(nsmocks.NodeStore)
+		bs := NewWithUUIDGen(fsmock, nsmock, uidmock)
+
+		uid, _ := uuid.Parse("4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+		nuser, _ := nodestore.NewUser(uuid.New(), "username")
+		uidmock.On("GetUUID").Return(uid)
+		nsmock.On("GetUser", "username").Return(nuser, nil)
+
+		p, _ := filestore.NewStoreFileParams(
+			"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+			12,
+			strings.NewReader("012345678910"))
+		tme := time.Now()
+		md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+		sums, _ := values.NewChecksums(map[string]string{
+			"sha256": "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29"})
+		sto := filestore.FileInfo{
+			ID:        "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+			Size:      12,
+			MD5:       md5,
+			Checksums: sums,
+			Stored:    tme,
+		}
+		logger, hook := logrust.NewNullLogger()
+		le := logger.WithField("a", "b")
+		fsmock.On("StoreFile", le, p).Return(&sto, nil)
+		nsmock.On("AddFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74", int64(12),
+			"cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29").Return(
+			"f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d", nil)
+		fsmock.On("DeleteFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74").Return(
+			tc.delerr)
+
+		node, _ := nodestore.NewNode(uid, *nuser, 12, *md5, tme, nodestore.Checksums(*sums),
+			nodestore.FileID("f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"))
+		nsmock.On("StoreNode", node).Return(nil)
+
+		auser, _ := auth.NewUser("username", false)
+		fn, _ := values.NewFileName("")
+		ff, _ := values.NewFileFormat("")
+		bnode, err := bs.Store(le, *auser, strings.NewReader("012345678910"), 12, *fn, *ff)
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, uid, bnode.ID, "incorrect node id")
+		fsmock.AssertCalled(t, "DeleteFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+		nsmock.AssertCalled(t, "StoreNode", node)
+		assert.Equal(t, tc.logmsgs, len(hook.AllEntries()), "incorrect log count")
+	}
+}
+
+func TestStoreFailAddFile(t *testing.T) {
+	uidmock := new(cmocks.UUIDGen)
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := NewWithUUIDGen(fsmock, nsmock, uidmock)
+
+	uid, _ := uuid.Parse("4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+	nuser, _ := nodestore.NewUser(uuid.New(), "username")
+	uidmock.On("GetUUID").Return(uid)
+	nsmock.On("GetUser", "username").Return(nuser, nil)
+
+	p, _ := filestore.NewStoreFileParams(
+		"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		12,
+		strings.NewReader("012345678910"))
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	sums, _ := values.NewChecksums(map[string]string{
+		"sha256": "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29"})
+	sto := filestore.FileInfo{
+		ID:        "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		Size:      12,
+		MD5:       md5,
+		Checksums: sums,
+		Stored:    time.Now(),
+	}
+	le := logrus.WithField("a", "b")
+	fsmock.On("StoreFile", le, p).Return(&sto, nil)
+	nsmock.On("AddFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74", int64(12),
+		"cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29").Return(
+		"", errors.New("lordy"))
+
+	auser, _ := auth.NewUser("username", false)
+	fn, _ := values.NewFileName("")
+	ff, _ := values.NewFileFormat("")
+	bnode, err := bs.Store(le, *auser, strings.NewReader("012345678910"), 12, *fn, *ff)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, errors.New("lordy"), err, "incorrect error")
+	nsmock.AssertNotCalled(t, "StoreNode", mock.Anything)
+}
+
 func TestStoreFailNullLogger(t *testing.T) {
 	fsmock := new(fsmocks.FileStore)
 	nsmock := new(nsmocks.NodeStore)
@@ -300,6 +569,9 @@ func TestStoreFailStoreNode(t *testing.T) {
 
 	node, _ := nodestore.NewNode(uid, *nuser, 12, *md5, tme)
 	nsmock.On("StoreNode", node).Return(errors.New("the loveliest of them all"))
+	nsmock.On("RemoveFileReference", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74").Return(
+		true, nil)
+	fsmock.On("DeleteFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74").Return(nil)
 
 	auser, _ := auth.NewUser("username", false)
 
@@ -315,6 +587,56 @@ func TestStoreFailStoreNode(t *testing.T) {
 	)
 	assert.Nil(t, bnode, "expected error")
 	assert.Equal(t, errors.New("the loveliest of them all"), err, "incorrect error")
+	nsmock.AssertCalled(t, "RemoveFileReference", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+	fsmock.AssertCalled(t, "DeleteFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+}
+
+func TestStoreFailStoreNodeSharedFile(t *testing.T) {
+	uidmock := new(cmocks.UUIDGen)
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := NewWithUUIDGen(fsmock, nsmock, uidmock)
+
+	uid, _ := uuid.Parse("4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+	nuser, _ := nodestore.NewUser(uuid.New(), "username")
+	uidmock.On("GetUUID").Return(uid)
+	nsmock.On("GetUser", "username").Return(nuser, nil)
+
+	p, _ := filestore.NewStoreFileParams(
+		"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		12,
+		strings.NewReader("012345678910"))
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	sums, _ := values.NewChecksums(map[string]string{
+		"sha256": "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29"})
+	tme := time.Now()
+	sto := filestore.FileInfo{
+		ID:        "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		Size:      12,
+		MD5:       md5,
+		Checksums: sums,
+		Stored:    tme,
+	}
+	le := logrus.WithField("a", "b")
+	fid := "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"
+	fsmock.On("StoreFile", le, p).Return(&sto, nil)
+	nsmock.On("AddFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74", int64(12),
+		"cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29").Return(fid, nil)
+	fsmock.On("DeleteFile", "41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74").Return(nil)
+	node, _ := nodestore.NewNode(uid, *nuser, 12, *md5, tme, nodestore.Checksums(*sums),
+		nodestore.FileID(fid))
+	nsmock.On("StoreNode", node).Return(errors.New("oh dear"))
+	// the shared file is still referenced by another node, so it must not be deleted
+	nsmock.On("RemoveFileReference", fid).Return(false, nil)
+
+	auser, _ := auth.NewUser("username", false)
+	fn, _ := values.NewFileName("")
+	ff, _ := values.NewFileFormat("")
+	bnode, err := bs.Store(le, *auser, strings.NewReader("012345678910"), 12, *fn, *ff)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, errors.New("oh dear"), err, "incorrect error")
+	nsmock.AssertCalled(t, "RemoveFileReference", fid)
+	fsmock.AssertNotCalled(t, "DeleteFile", fid)
 }
 
 func TestGetAsOwner(t *testing.T) {
@@ -345,11 +667,13 @@ func TestGetAsOwner(t *testing.T) {
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "fn",
 		Format:   "json",
 		Owner:    User{userid, "username"},
 		Readers:  &[]User{User{userid, "username"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -386,11 +710,13 @@ func TestGetAsReader(t *testing.T) {
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "",
 		Format:   "",
 		Owner:    User{nid, "username"},
 		Readers:  &[]User{User{nid, "username"}, User{oid, "other"}, User{rid, "reader"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -425,11 +751,50 @@ func TestGetAsAdmin(t *testing.T) {
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "",
 		Format:   "",
 		Owner:    User{nid, "username"},
 		Readers:  &[]User{User{nid, "username"}, User{oid, "other"}},
 		Public:   false,
+		Version:  1,
+	}
+	assert.Equal(t, expected, bnode, "incorrect node")
+}
+
+func TestGetAsReadAdmin(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+
+	bs := New(fsmock, nsmock)
+
+	uid := uuid.New()
+	auser, _ := auth.NewUserWithAdminLevel("helpdesk", auth.AdminRead)
+
+	nid := uuid.New()
+	nuser, _ := nodestore.NewUser(nid, "username")
+	huser, _ := nodestore.NewUser(uuid.New(), "helpdesk")
+
+	nsmock.On("GetUser", "helpdesk").Return(huser, nil)
+
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(uid, *nuser, 12, *md5, tme)
+
+	nsmock.On("GetNode", uid).Return(node, nil)
+
+	bnode, err := bs.Get(auser, uid)
+	assert.Nil(t, err, "unexpected error")
+	expected := &BlobNode{
+		ID:       uid,
+		Size:     12,
+		MD5:      *md5,
+		Stored:   tme,
+		Modified: tme,
+		Owner:    User{nid, "username"},
+		Readers:  &[]User{User{nid, "username"}},
+		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -460,11 +825,13 @@ func TestGetPublic(t *testing.T) {
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "",
 		Format:   "",
 		Owner:    User{nid, "username"},
 		Readers:  &[]User{User{nid, "username"}},
 		Public:   true,
+		Version:  1,
 	}
 	bnode, err := bs.Get(nil, uid)
 	assert.Nil(t, err, "unexpected error")
@@ -550,6 +917,82 @@ func TestGetFailUnauthorized(t *testing.T) {
 
 // GetFile calls GET under the hood, so we only test one error case (auth) from the Get code
 
+func TestGetMany(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	oid := uuid.New()
+	o, _ := nodestore.NewUser(oid, "owner")
+	rid := uuid.New()
+	r, _ := nodestore.NewUser(rid, "reader")
+	nsmock.On("GetUser", "reader").Return(r, nil)
+
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	nid1 := uuid.New()
+	nid2 := uuid.New()
+	nid3 := uuid.New()
+	nid4 := uuid.New()
+	n1, _ := nodestore.NewNode(nid1, *o, 12, *md5, tme, nodestore.Reader(*r))
+	n2, _ := nodestore.NewNode(nid2, *o, 42, *md5, tme)
+	n3, _ := nodestore.NewNode(nid3, *o, 7, *md5, tme, nodestore.Public(true))
+	ids := []uuid.UUID{nid3, nid2, nid4, nid1}
+	nsmock.On("GetNodes", ids).Return([]*nodestore.Node{n1, n2, n3}, nil)
+
+	blobnode := func(id uuid.UUID, size int64, public bool, readers ...User) *BlobNode {
+		return &BlobNode{
+			ID:       id,
+			Size:     size,
+			MD5:      *md5,
+			Stored:   tme,
+			Modified: tme,
+			Owner:    User{oid, "owner"},
+			Readers:  &readers,
+			Public:   public,
+			Version:  1,
+		}
+	}
+
+	auser, _ := auth.NewUser("reader", false)
+	res, err := bs.GetMany(auser, ids)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*NodeResult{
+		{ID: nid3, Node: blobnode(nid3, 7, true, User{oid, "owner"})},
+		{ID: nid2, Error: NewUnauthorizedError("Unauthorized")},
+		{ID: nid4, Error: NewNoBlobError("No such node " + nid4.String())},
+		{ID: nid1, Node: blobnode(nid1, 12, false, User{oid, "owner"}, User{rid, "reader"})},
+	}, res, "incorrect results")
+
+	// anonymous users can only see public nodes
+	res, err = bs.GetMany(nil, ids)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*NodeResult{
+		{ID: nid3, Node: blobnode(nid3, 7, true, User{oid, "owner"})},
+		{ID: nid2, Error: NewUnauthorizedError("Unauthorized")},
+		{ID: nid4, Error: NewNoBlobError("No such node " + nid4.String())},
+		{ID: nid1, Error: NewUnauthorizedError("Unauthorized")},
+	}, res, "incorrect results")
+}
+
+func TestGetManyFail(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	ids := []uuid.UUID{uuid.New()}
+	auser, _ := auth.NewUser("un", false)
+	nsmock.On("GetUser", "un").Return(nil, errors.New("no users here"))
+	res, err := bs.GetMany(auser, ids)
+	assert.Nil(t, res, "expected error")
+	assert.Equal(t, errors.New("no users here"), err, "incorrect error")
+
+	nsmock.On("GetNodes", ids).Return(nil, errors.New("no nodes here"))
+	res, err = bs.GetMany(nil, ids)
+	assert.Nil(t, res, "expected error")
+	assert.Equal(t, errors.New("no nodes here"), err, "incorrect error")
+}
+
 func TestGetFileAsOwner(t *testing.T) {
 	fsmock := new(fsmocks.FileStore)
 	nsmock := new(nsmocks.NodeStore)
@@ -589,6 +1032,90 @@ func TestGetFileAsOwner(t *testing.T) {
 	assert.Equal(t, rd, ioutil.NopCloser(strings.NewReader("012345678")), "incorrect data")
 }
 
+func TestGetFileWithNode(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+
+	bs := New(fsmock, nsmock)
+
+	uid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	auser, _ := auth.NewUser("un", false)
+	nuser, _ := nodestore.NewUser(uuid.New(), "un")
+	nsmock.On("GetUser", "un").Return(nuser, nil)
+
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	sums, _ := values.NewChecksums(map[string]string{"crc32c": "8412e281"})
+	node, _ := nodestore.NewNode(uid, *nuser, 12, *md5, tme, nodestore.FileName("a_file"),
+		nodestore.Checksums(*sums))
+	nsmock.On("GetNode", uid).Return(node, nil)
+
+	gfo := filestore.GetFileOutput{
+		ID:     "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d",
+		Size:   12,
+		MD5:    md5,
+		Stored: time.Now(),
+		Data:   ioutil.NopCloser(strings.NewReader("012345678910")),
+	}
+	fsmock.On("GetFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(&gfo, nil)
+
+	rd, size, bnode, err := bs.GetFileWithNode(auser, uid)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, int64(12), size, "incorrect size")
+	expected := &BlobNode{
+		ID:        uid,
+		Size:      12,
+		MD5:       *md5,
+		Stored:    tme,
+		Modified:  tme,
+		Filename:  "a_file",
+		Owner:     User{nuser.GetID(), "un"},
+		Readers:   &[]User{User{nuser.GetID(), "un"}},
+		Version:   1,
+		Checksums: sums,
+	}
+	assert.Equal(t, expected, bnode, "incorrect node")
+	assert.Equal(t, rd, ioutil.NopCloser(strings.NewReader("012345678910")), "incorrect data")
+}
+
+func TestGetFileSharedFile(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	uid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
+	auser, _ := auth.NewUser("un", false)
+	nuser, _ := nodestore.NewUser(uuid.New(), "un")
+	nsmock.On("GetUser", "un").Return(nuser, nil)
+
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(uid, *nuser, 12, *md5, time.Now(), nodestore.FileName("a_file"),
+		nodestore.FileID("f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"))
+	nsmock.On("GetNode", uid).Return(node, nil)
+	nsmock.On("GetNodes", []uuid.UUID{uid}).Return([]*nodestore.Node{node}, nil)
+
+	fsmock.On("GetFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		&filestore.GetFileOutput{
+			ID:   "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d",
+			Size: 12,
+			MD5:  md5,
+			Data: ioutil.NopCloser(strings.NewReader("012345678910")),
+		}, nil)
+
+	rd, size, filename, err := bs.GetFile(auser, uid)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, int64(12), size, "incorrect size")
+	assert.Equal(t, "a_file", filename, "incorrect filename")
+	assert.Equal(t, rd, ioutil.NopCloser(strings.NewReader("012345678910")), "incorrect data")
+
+	err = bs.GetFiles(auser, []uuid.UUID{uid}, func(n *BlobNode, data io.Reader) error {
+		assert.Equal(t, uid, n.ID, "incorrect node")
+		return nil
+	})
+	assert.Nil(t, err, "unexpected error")
+	fsmock.AssertNumberOfCalls(t, "GetFile", 2)
+}
+
 func TestGetFileAsReader(t *testing.T) {
 	fsmock := new(fsmocks.FileStore)
 	nsmock := new(nsmocks.NodeStore)
@@ -784,40 +1311,130 @@ func TestGetFileFailGetFromStorage(t *testing.T) {
 	assert.Equal(t, errors.New("whoopsie"), err, "incorrect error")
 }
 
-func TestSetNodePublicTrueAsOwner(t *testing.T) {
+func TestGetFiles(t *testing.T) {
 	fsmock := new(fsmocks.FileStore)
 	nsmock := new(nsmocks.NodeStore)
-
 	bs := New(fsmock, nsmock)
 
-	auser, _ := auth.NewUser("un", false)
-
 	oid := uuid.New()
-	nuser, _ := nodestore.NewUser(oid, "un")
-
-	nsmock.On("GetUser", "un").Return(nuser, nil)
+	o, _ := nodestore.NewUser(oid, "owner")
+	r, _ := nodestore.NewUser(uuid.New(), "reader")
+	nsmock.On("GetUser", "reader").Return(r, nil)
 
-	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
 	tme := time.Now()
 	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
-	node, _ := nodestore.NewNode(nid, *nuser, 12, *md5, tme, nodestore.FileName("foo"))
-
-	nsmock.On("GetNode", nid).Return(node, nil)
+	nid1, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	nid2, _ := uuid.Parse("a1b2c3d4-0914-42b3-beea-fed420f75d7d")
+	n1, _ := nodestore.NewNode(nid1, *o, 3, *md5, tme, nodestore.Reader(*r),
+		nodestore.FileName("a_file"))
+	n2, _ := nodestore.NewNode(nid2, *o, 4, *md5, tme, nodestore.Public(true))
+	ids := []uuid.UUID{nid2, nid1}
+	nsmock.On("GetNodes", ids).Return([]*nodestore.Node{n1, n2}, nil)
 
-	nsmock.On("SetNodePublic", nid, true).Return(nil)
+	fsmock.On("GetFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		&filestore.GetFileOutput{Data: ioutil.NopCloser(strings.NewReader("012"))}, nil)
+	fsmock.On("GetFile", "a1/b2/c3/a1b2c3d4-0914-42b3-beea-fed420f75d7d").Return(
+		&filestore.GetFileOutput{Data: ioutil.NopCloser(strings.NewReader("3456"))}, nil)
 
-	bnode, err := bs.SetNodePublic(*auser, nid, true)
+	auser, _ := auth.NewUser("reader", false)
+	files := []string{}
+	err := bs.GetFiles(auser, ids, func(node *BlobNode, data io.Reader) error {
+		b, _ := ioutil.ReadAll(data)
+		files = append(files, node.ID.String()+" "+node.Filename+" "+string(b))
+		return nil
+	})
 	assert.Nil(t, err, "unexpected error")
-	expected := &BlobNode{
-		ID:       nid,
+	assert.Equal(t, []string{nid2.String() + "  3456", nid1.String() + " a_file 012"}, files,
+		"incorrect files")
+
+	// handler errors stop the retrieval
+	count := 0
+	err = bs.GetFiles(auser, ids, func(node *BlobNode, data io.Reader) error {
+		count++
+		return errors.New("client went away")
+	})
+	assert.Equal(t, errors.New("client went away"), err, "incorrect error")
+	assert.Equal(t, 1, count, "incorrect handler call count")
+}
+
+func TestGetFilesFail(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	nid1, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	nid2 := uuid.New()
+	nid3 := uuid.New()
+	n1, _ := nodestore.NewNode(nid1, *o, 3, *md5, tme, nodestore.Public(true))
+	n2, _ := nodestore.NewNode(nid2, *o, 3, *md5, tme)
+	nsmock.On("GetNodes", []uuid.UUID{nid1, nid2}).Return([]*nodestore.Node{n1, n2}, nil)
+	nsmock.On("GetNodes", []uuid.UUID{nid1, nid3}).Return([]*nodestore.Node{n1}, nil)
+	nsmock.On("GetNodes", []uuid.UUID{nid1}).Return([]*nodestore.Node{n1}, nil)
+	nsmock.On("GetNodes", []uuid.UUID{nid3}).Return(nil, errors.New("no nodes here"))
+	fsmock.On("GetFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		nil, errors.New("no files here"))
+
+	handler := func(node *BlobNode, data io.Reader) error {
+		assert.Fail(t, "handler should not be called")
+		return nil
+	}
+
+	type testcase struct {
+		ids []uuid.UUID
+		err error
+	}
+
+	testcases := []testcase{
+		testcase{[]uuid.UUID{nid1, nid2}, NewUnauthorizedError("Unauthorized")},
+		testcase{[]uuid.UUID{nid1, nid3}, NewNoBlobError("No such node " + nid3.String())},
+		testcase{[]uuid.UUID{nid1}, errors.New("no files here")},
+		testcase{[]uuid.UUID{nid3}, errors.New("no nodes here")},
+	}
+	for _, tc := range testcases {
+		err := bs.GetFiles(nil, tc.ids, handler)
+		assert.Equal(t, tc.err, err, "incorrect error")
+	}
+}
+
+func TestSetNodePublicTrueAsOwner(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+
+	bs := New(fsmock, nsmock)
+
+	auser, _ := auth.NewUser("un", false)
+
+	oid := uuid.New()
+	nuser, _ := nodestore.NewUser(oid, "un")
+
+	nsmock.On("GetUser", "un").Return(nuser, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *nuser, 12, *md5, tme, nodestore.FileName("foo"))
+
+	nsmock.On("GetNode", nid).Return(node, nil)
+
+	nsmock.On("SetNodePublic", nid, true, noVersion).Return(node.WithPublic(true), nil)
+
+	bnode, err := bs.SetNodePublic(logrus.WithField("a", "b"), *auser, nid, true, nil)
+	assert.Nil(t, err, "unexpected error")
+	expected := &BlobNode{
+		ID:       nid,
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "foo",
 		Format:   "",
 		Owner:    User{oid, "un"},
 		Readers:  &[]User{User{oid, "un"}},
 		Public:   true,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -844,20 +1461,22 @@ func TestSetNodePublicFalseAsAdmin(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	nsmock.On("SetNodePublic", nid, false).Return(nil)
+	nsmock.On("SetNodePublic", nid, false, noVersion).Return(node.WithPublic(false), nil)
 
-	bnode, err := bs.SetNodePublic(*auser, nid, false)
+	bnode, err := bs.SetNodePublic(logrus.WithField("a", "b"), *auser, nid, false, nil)
 	assert.Nil(t, err, "unexpected error")
 	expected := &BlobNode{
 		ID:       nid,
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "foo",
 		Format:   "",
 		Owner:    User{oid, "owner"},
 		Readers:  &[]User{User{oid, "owner"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -873,7 +1492,7 @@ func TestSetNodePublicFailGetUser(t *testing.T) {
 
 	nsmock.On("GetUser", "un").Return(nil, errors.New("no users here"))
 
-	bnode, err := bs.SetNodePublic(*auser, uid, true)
+	bnode, err := bs.SetNodePublic(logrus.WithField("a", "b"), *auser, uid, true, nil)
 	assert.Equal(t, errors.New("no users here"), err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
 }
@@ -898,7 +1517,7 @@ func TestSetNodePublicFailGetNode(t *testing.T) {
 
 		nsmock.On("GetNode", uid).Return(nil, causeerr)
 
-		bnode, err := bs.SetNodePublic(*auser, uid, false)
+		bnode, err := bs.SetNodePublic(logrus.WithField("a", "b"), *auser, uid, false, nil)
 		assert.Nil(t, bnode, "expected error")
 		assert.Equal(t, expectederr, err, "incorrect error")
 	}
@@ -925,7 +1544,7 @@ func TestSetNodePublicFailUnauthorized(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	bnode, err := bs.SetNodePublic(*auser, nid, false)
+	bnode, err := bs.SetNodePublic(logrus.WithField("a", "b"), *auser, nid, false, nil)
 	assert.Equal(t, NewUnauthorizedACLError("Users can only remove themselves from the read ACL"),
 		err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
@@ -956,9 +1575,9 @@ func TestSetNodePublicFailSetPublic(t *testing.T) {
 
 		nsmock.On("GetNode", nid).Return(node, nil)
 
-		nsmock.On("SetNodePublic", nid, false).Return(causeerr)
+		nsmock.On("SetNodePublic", nid, false, noVersion).Return(nil, causeerr)
 
-		bnode, err := bs.SetNodePublic(*auser, nid, false)
+		bnode, err := bs.SetNodePublic(logrus.WithField("a", "b"), *auser, nid, false, nil)
 		assert.Nil(t, bnode, "expected error")
 		assert.Equal(t, expectederr, err, "incorrect error")
 	}
@@ -983,26 +1602,26 @@ func TestAddReaders(t *testing.T) {
 
 	r1id := uuid.New()
 	r1, _ := nodestore.NewUser(r1id, "r1")
-	nsmock.On("GetUser", "r1").Return(r1, nil)
-	nsmock.On("AddReader", nid, *r1).Return(nil)
-
 	r2id := uuid.New()
 	r2, _ := nodestore.NewUser(r2id, "r2")
-	nsmock.On("GetUser", "r2").Return(r2, nil)
-	nsmock.On("AddReader", nid, *r2).Return(nil)
+	rdrs := []nodestore.User{*r1, *r2}
+	nsmock.On("GetUsers", []string{"r1", "r2"}).Return(rdrs, nil)
+	nsmock.On("AddReaders", nid, rdrs, noVersion).Return(node.WithReaders(rdrs...), nil)
 
-	bnode, err := bs.AddReaders(*auser, nid, []string{"r1", "r2"})
+	bnode, err := bs.AddReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r1", "r2"}, nil)
 	assert.Nil(t, err, "unexpected error")
 	expected := &BlobNode{
 		ID:       nid,
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "foo",
 		Format:   "",
 		Owner:    User{oid, "owner"},
 		Readers:  &[]User{User{oid, "owner"}, User{r1id, "r1"}, User{r2id, "r2"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 
@@ -1010,7 +1629,7 @@ func TestAddReaders(t *testing.T) {
 	auser, _ = auth.NewUser("notowner", true)
 	no, _ := nodestore.NewUser(uuid.New(), "notowner")
 	nsmock.On("GetUser", "notowner").Return(no, nil)
-	bnode, err = bs.AddReaders(*auser, nid, []string{"r1", "r2"})
+	bnode, err = bs.AddReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r1", "r2"}, nil)
 	assert.Nil(t, err, "unexpected error")
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -1038,24 +1657,25 @@ func TestRemoveReaders(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	nsmock.On("GetUser", "r1").Return(r1, nil)
-	nsmock.On("RemoveReader", nid, *r1).Return(nil)
-
-	nsmock.On("GetUser", "r2").Return(r2, nil)
-	nsmock.On("RemoveReader", nid, *r2).Return(nil)
+	rdrs := []nodestore.User{*r1, *r2}
+	nsmock.On("GetUsers", []string{"r1", "r2"}).Return(rdrs, nil)
+	nsmock.On("RemoveReaders", nid, rdrs, noVersion).Return(node.WithoutReaders(rdrs...), nil)
 
-	bnode, err := bs.RemoveReaders(*auser, nid, []string{"r1", "r2"})
+	bnode, err := bs.RemoveReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r1", "r2"},
+		nil)
 	assert.Nil(t, err, "unexpected error")
 	expected := &BlobNode{
 		ID:       nid,
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "foo",
 		Format:   "",
 		Owner:    User{oid, "owner"},
 		Readers:  &[]User{User{oid, "owner"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 
@@ -1063,7 +1683,8 @@ func TestRemoveReaders(t *testing.T) {
 	auser, _ = auth.NewUser("notowner", true)
 	no, _ := nodestore.NewUser(uuid.New(), "notowner")
 	nsmock.On("GetUser", "notowner").Return(no, nil)
-	bnode, err = bs.RemoveReaders(*auser, nid, []string{"r1", "r2"})
+	bnode, err = bs.RemoveReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r1", "r2"},
+		nil)
 	assert.Nil(t, err, "unexpected error")
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -1093,20 +1714,23 @@ func TestRemoveReaderSelf(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	nsmock.On("RemoveReader", nid, *r1).Return(nil)
+	nsmock.On("RemoveReaders", nid, []nodestore.User{*r1}, noVersion).Return(
+		node.WithoutReaders(*r1), nil)
 
-	bnode, err := bs.RemoveReaders(*auser, nid, []string{"r1"})
+	bnode, err := bs.RemoveReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r1"}, nil)
 	assert.Nil(t, err, "unexpected error")
 	expected := &BlobNode{
 		ID:       nid,
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "foo",
 		Format:   "",
 		Owner:    User{oid, "owner"},
 		Readers:  &[]User{User{oid, "owner"}, User{r2id, "r2"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -1122,11 +1746,11 @@ func TestAddAndRemoveReadersFailGetUser(t *testing.T) {
 
 	nsmock.On("GetUser", "un").Return(nil, errors.New("no users here"))
 
-	bnode, err := bs.AddReaders(*auser, uid, []string{"r"})
+	bnode, err := bs.AddReaders(logrus.WithField("a", "b"), *auser, uid, []string{"r"}, nil)
 	assert.Equal(t, errors.New("no users here"), err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
 
-	bnode, err = bs.RemoveReaders(*auser, uid, []string{"r"})
+	bnode, err = bs.RemoveReaders(logrus.WithField("a", "b"), *auser, uid, []string{"r"}, nil)
 	assert.Equal(t, errors.New("no users here"), err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
 }
@@ -1151,11 +1775,11 @@ func TestAddAndRemoveReadersFailGetNode(t *testing.T) {
 
 		nsmock.On("GetNode", uid).Return(nil, causeerr)
 
-		bnode, err := bs.AddReaders(*auser, uid, []string{"r"})
+		bnode, err := bs.AddReaders(logrus.WithField("a", "b"), *auser, uid, []string{"r"}, nil)
 		assert.Nil(t, bnode, "expected error")
 		assert.Equal(t, expectederr, err, "incorrect error")
 
-		bnode, err = bs.RemoveReaders(*auser, uid, []string{"r"})
+		bnode, err = bs.RemoveReaders(logrus.WithField("a", "b"), *auser, uid, []string{"r"}, nil)
 		assert.Nil(t, bnode, "expected error")
 		assert.Equal(t, expectederr, err, "incorrect error")
 	}
@@ -1188,13 +1812,13 @@ func TestAddAndRemoveReadersFailUnauthorized(t *testing.T) {
 	}
 
 	for _, rdrs := range readers {
-		bnode, err := bs.AddReaders(*auser, nid, rdrs)
+		bnode, err := bs.AddReaders(logrus.WithField("a", "b"), *auser, nid, rdrs, nil)
 		expectederr := NewUnauthorizedACLError(
 			"Users can only remove themselves from the read ACL")
 		assert.Equal(t, expectederr, err, "incorrect error")
 		assert.Nil(t, bnode, "expected error")
 
-		bnode, err = bs.RemoveReaders(*auser, nid, rdrs)
+		bnode, err = bs.RemoveReaders(logrus.WithField("a", "b"), *auser, nid, rdrs, nil)
 		assert.Equal(t, expectederr, err, "incorrect error")
 		assert.Nil(t, bnode, "expected error")
 	}
@@ -1222,7 +1846,7 @@ func TestAddReaderSelfFailUnauthorized(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	bnode, err := bs.AddReaders(*auser, nid, []string{"reader"})
+	bnode, err := bs.AddReaders(logrus.WithField("a", "b"), *auser, nid, []string{"reader"}, nil)
 	expectederr := NewUnauthorizedACLError(
 		"Users can only remove themselves from the read ACL")
 	assert.Equal(t, expectederr, err, "incorrect error")
@@ -1246,13 +1870,13 @@ func TestAddAndRemoveReadersFailGetReader(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	nsmock.On("GetUser", "r").Return(nil, errors.New("Yeah? Sausages and?"))
+	nsmock.On("GetUsers", []string{"r"}).Return(nil, errors.New("Yeah? Sausages and?"))
 
-	bnode, err := bs.AddReaders(*auser, nid, []string{"r"})
+	bnode, err := bs.AddReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r"}, nil)
 	assert.Equal(t, errors.New("Yeah? Sausages and?"), err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
 
-	bnode, err = bs.RemoveReaders(*auser, nid, []string{"r"})
+	bnode, err = bs.RemoveReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r"}, nil)
 	assert.Equal(t, errors.New("Yeah? Sausages and?"), err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
 }
@@ -1284,16 +1908,16 @@ func TestAddAndRemoveReadersFailAddRemoveReader(t *testing.T) {
 
 		nsmock.On("GetNode", nid).Return(node, nil)
 
-		nsmock.On("GetUser", "r").Return(r, nil)
+		nsmock.On("GetUsers", []string{"r"}).Return([]nodestore.User{*r}, nil)
 
-		nsmock.On("AddReader", nid, *r).Return(causeerr)
-		nsmock.On("RemoveReader", nid, *r).Return(causeerr)
+		nsmock.On("AddReaders", nid, []nodestore.User{*r}, noVersion).Return(nil, causeerr)
+		nsmock.On("RemoveReaders", nid, []nodestore.User{*r}, noVersion).Return(nil, causeerr)
 
-		bnode, err := bs.AddReaders(*auser, nid, []string{"r"})
+		bnode, err := bs.AddReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r"}, nil)
 		assert.Equal(t, expectederr, err, "incorrect error")
 		assert.Nil(t, bnode, "expected error")
 
-		bnode, err = bs.RemoveReaders(*auser, nid, []string{"r"})
+		bnode, err = bs.RemoveReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r"}, nil)
 		assert.Equal(t, expectederr, err, "incorrect error")
 		assert.Nil(t, bnode, "expected error")
 	}
@@ -1323,19 +1947,21 @@ func TestChangeOwner(t *testing.T) {
 	newid := uuid.New()
 	newowner, _ := nodestore.NewUser(newid, "new")
 	nsmock.On("GetUser", "new").Return(newowner, nil)
-	nsmock.On("ChangeOwner", nid, *newowner).Return(nil)
+	nsmock.On("ChangeOwner", nid, *newowner, noVersion).Return(node.WithOwner(*newowner), nil)
 
-	bnode, err := bs.ChangeOwner(*auser, nid, "new")
+	bnode, err := bs.ChangeOwner(logrus.WithField("a", "b"), *auser, nid, "new", nil)
 	expected := &BlobNode{
 		ID:       nid,
 		Size:     12,
 		MD5:      *md5,
 		Stored:   tme,
+		Modified: tme,
 		Filename: "foo",
 		Format:   "",
 		Owner:    User{newid, "new"},
 		Readers:  &[]User{User{newid, "new"}, User{oid, "owner"}, User{r1id, "r1"}},
 		Public:   false,
+		Version:  1,
 	}
 	assert.Equal(t, expected, bnode, "incorrect node")
 	assert.Nil(t, err, "unexpected error")
@@ -1344,7 +1970,7 @@ func TestChangeOwner(t *testing.T) {
 	auser, _ = auth.NewUser("notowner", true)
 	no, _ := nodestore.NewUser(uuid.New(), "notowner")
 	nsmock.On("GetUser", "notowner").Return(no, nil)
-	bnode, err = bs.ChangeOwner(*auser, nid, "new")
+	bnode, err = bs.ChangeOwner(logrus.WithField("a", "b"), *auser, nid, "new", nil)
 	assert.Nil(t, err, "unexpected error")
 	assert.Equal(t, expected, bnode, "incorrect node")
 }
@@ -1360,7 +1986,7 @@ func TestChangeOwnerFailGetUser(t *testing.T) {
 
 	nsmock.On("GetUser", "un").Return(nil, errors.New("no users here"))
 
-	bnode, err := bs.ChangeOwner(*auser, uid, "foo")
+	bnode, err := bs.ChangeOwner(logrus.WithField("a", "b"), *auser, uid, "foo", nil)
 	assert.Equal(t, errors.New("no users here"), err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
 }
@@ -1385,7 +2011,7 @@ func TestChangeOwnerFailGetNode(t *testing.T) {
 
 		nsmock.On("GetNode", uid).Return(nil, causeerr)
 
-		bnode, err := bs.ChangeOwner(*auser, uid, "foo")
+		bnode, err := bs.ChangeOwner(logrus.WithField("a", "b"), *auser, uid, "foo", nil)
 		assert.Equal(t, expectederr, err, "incorrect error")
 		assert.Nil(t, bnode, "expected error")
 	}
@@ -1412,7 +2038,7 @@ func TestChangeOwnerFailUnauthorized(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	bnode, err := bs.ChangeOwner(*auser, nid, "foo")
+	bnode, err := bs.ChangeOwner(logrus.WithField("a", "b"), *auser, nid, "foo", nil)
 	expectederr := NewUnauthorizedACLError("Users can only remove themselves from the read ACL")
 	assert.Equal(t, expectederr, err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
@@ -1437,7 +2063,7 @@ func TestChangeOwnerFailGetNewOwner(t *testing.T) {
 
 	nsmock.On("GetUser", "newown").Return(nil, errors.New("I've discharged my responsibilities"))
 
-	bnode, err := bs.ChangeOwner(*auser, nid, "newown")
+	bnode, err := bs.ChangeOwner(logrus.WithField("a", "b"), *auser, nid, "newown", nil)
 	assert.Equal(t, errors.New("I've discharged my responsibilities"), err, "incorrect error")
 	assert.Nil(t, bnode, "expected error")
 }
@@ -1470,14 +2096,69 @@ func TestChangeOwnerFailChangeOwner(t *testing.T) {
 
 		nsmock.On("GetUser", "new").Return(newowner, nil)
 
-		nsmock.On("ChangeOwner", nid, *newowner).Return(causeerr)
+		nsmock.On("ChangeOwner", nid, *newowner, noVersion).Return(nil, causeerr)
 
-		bnode, err := bs.ChangeOwner(*auser, nid, "new")
+		bnode, err := bs.ChangeOwner(logrus.WithField("a", "b"), *auser, nid, "new", nil)
 		assert.Equal(t, expectederr, err, "incorrect error")
 		assert.Nil(t, bnode, "expected error")
 	}
 }
 
+func TestACLChangesWithVersion(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	auser, _ := auth.NewUser("owner", false)
+	oid := uuid.New()
+	o, _ := nodestore.NewUser(oid, "owner")
+	r1, _ := nodestore.NewUser(uuid.New(), "r1")
+	r2, _ := nodestore.NewUser(uuid.New(), "r2")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+	nsmock.On("GetUser", "r1").Return(r1, nil)
+	nsmock.On("GetUsers", []string{"r1", "r2"}).Return([]nodestore.User{*r1, *r2}, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.Version(3))
+	nsmock.On("GetNode", nid).Return(node, nil)
+
+	v3 := int64(3)
+	n4, _ := nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.Reader(*r1),
+		nodestore.Reader(*r2), nodestore.Version(4))
+	nsmock.On("AddReaders", nid, []nodestore.User{*r1, *r2}, &v3).Return(n4, nil)
+
+	bnode, err := bs.AddReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r1", "r2"},
+		&v3)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, int64(4), bnode.Version, "incorrect version")
+	assert.Equal(t, 3, len(*bnode.Readers), "incorrect readers")
+
+	// the version of the fetched node doesn't match
+	verr := NewVersionMismatchError("Node f6029a11-0914-42b3-beea-fed420f75d7d is at version 3, " +
+		"not 2")
+	v2 := int64(2)
+	bnode, err = bs.SetNodePublic(logrus.WithField("a", "b"), *auser, nid, true, &v2)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, verr, err, "incorrect error")
+	bnode, err = bs.RemoveReaders(logrus.WithField("a", "b"), *auser, nid, []string{"r1"}, &v2)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, verr, err, "incorrect error")
+	bnode, err = bs.ChangeOwner(logrus.WithField("a", "b"), *auser, nid, "r1", &v2)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, verr, err, "incorrect error")
+
+	// the node changes between fetching and updating
+	nsmock.On("ChangeOwner", nid, *r1, &v3).Return(nil,
+		nodestore.NewVersionMismatchError(nid, 3, 4))
+	bnode, err = bs.ChangeOwner(logrus.WithField("a", "b"), *auser, nid, "r1", &v3)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, NewVersionMismatchError(
+		"Node f6029a11-0914-42b3-beea-fed420f75d7d is at version 4, not 3"),
+		err, "incorrect error")
+}
+
 func TestDeleteNode(t *testing.T) {
 	fsmock := new(fsmocks.FileStore)
 	nsmock := new(nsmocks.NodeStore)
@@ -1497,16 +2178,18 @@ func TestDeleteNode(t *testing.T) {
 
 	nsmock.On("DeleteNode", nid).Return(nil)
 
+	nsmock.On("RemoveFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		true, nil)
 	fsmock.On("DeleteFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(nil)
 
-	err := bs.DeleteNode(*auser, nid)
+	err := bs.DeleteNode(logrus.WithField("a", "b"), *auser, nid)
 	assert.Nil(t, err, "unexpected error")
 
 	// test as admin
 	auser, _ = auth.NewUser("notowner", true)
 	no, _ := nodestore.NewUser(uuid.New(), "notowner")
 	nsmock.On("GetUser", "notowner").Return(no, nil)
-	err = bs.DeleteNode(*auser, nid)
+	err = bs.DeleteNode(logrus.WithField("a", "b"), *auser, nid)
 	assert.Nil(t, err, "unexpected error")
 }
 
@@ -1521,7 +2204,7 @@ func TestDeleteNodeFailGetUser(t *testing.T) {
 
 	nsmock.On("GetUser", "un").Return(nil, errors.New("no users here"))
 
-	err := bs.DeleteNode(*auser, uid)
+	err := bs.DeleteNode(logrus.WithField("a", "b"), *auser, uid)
 	assert.Equal(t, errors.New("no users here"), err, "incorrect error")
 }
 
@@ -1545,7 +2228,7 @@ func TestDeleteNodeFailGetNode(t *testing.T) {
 
 		nsmock.On("GetNode", uid).Return(nil, causeerr)
 
-		err := bs.DeleteNode(*auser, uid)
+		err := bs.DeleteNode(logrus.WithField("a", "b"), *auser, uid)
 		assert.Equal(t, expectederr, err, "incorrect error")
 	}
 }
@@ -1571,8 +2254,59 @@ func TestDeleteNodeFailUnauthorized(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	err := bs.DeleteNode(*auser, nid)
+	err := bs.DeleteNode(logrus.WithField("a", "b"), *auser, nid)
+	assert.Equal(t, NewUnauthorizedError("Unauthorized"), err, "incorrect error")
+}
+
+func TestWriteFailReadAdmin(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+
+	bs := New(fsmock, nsmock)
+
+	auser, _ := auth.NewUserWithAdminLevel("helpdesk", auth.AdminRead)
+	huser, _ := nodestore.NewUser(uuid.New(), "helpdesk")
+	nowner, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "helpdesk").Return(huser, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *nowner, 12, *md5, time.Now())
+	nsmock.On("GetNode", nid).Return(node, nil)
+
+	le := logrus.WithField("a", "b")
+	err := bs.DeleteNode(le, *auser, nid)
+	assert.Equal(t, NewUnauthorizedError("Unauthorized"), err, "incorrect error")
+
+	bnode, err := bs.SetNodePublic(le, *auser, nid, true, nil)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, NewUnauthorizedACLError("Users can only remove themselves from the read ACL"),
+		err, "incorrect error")
+
+	fn, _ := values.NewFileName("foo")
+	bnode, err = bs.SetFileMetadata(le, *auser, nid, fn, nil, nil)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, NewUnauthorizedError("Unauthorized"), err, "incorrect error")
+
+	bnode, err = bs.CopyNode(le, *auser, nid, CopyOwner("owner"))
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, NewUnauthorizedError("Only administrators may set the owner of a copy"),
+		err, "incorrect error")
+
+	// copying creates a node, so read only admins may not copy nodes they can't otherwise read
+	bnode, err = bs.CopyNode(le, *auser, nid)
+	assert.Nil(t, bnode, "expected error")
 	assert.Equal(t, NewUnauthorizedError("Unauthorized"), err, "incorrect error")
+
+	nsmock.On("GetNodes", []uuid.UUID{nid}).Return([]*nodestore.Node{node}, nil)
+	res, err := bs.CopyNodes(le, *auser, []uuid.UUID{nid})
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*NodeResult{{ID: nid, Error: NewUnauthorizedError("Unauthorized")}}, res,
+		"incorrect results")
+
+	nsmock.AssertNotCalled(t, "AddFileReference", mock.Anything, mock.Anything)
+	nsmock.AssertNotCalled(t, "DeleteNode", mock.Anything)
+	nsmock.AssertNotCalled(t, "SetNodePublic", mock.Anything, mock.Anything, mock.Anything)
 }
 
 func TestDeleteNodeFailDeleteNode(t *testing.T) {
@@ -1601,7 +2335,7 @@ func TestDeleteNodeFailDeleteNode(t *testing.T) {
 
 		nsmock.On("DeleteNode", nid).Return(causeerr)
 
-		err := bs.DeleteNode(*auser, nid)
+		err := bs.DeleteNode(logrus.WithField("a", "b"), *auser, nid)
 		assert.Equal(t, expectederr, err, "incorrect error")
 	}
 }
@@ -1625,14 +2359,77 @@ func TestDeleteNodeFailDeleteFile(t *testing.T) {
 
 	nsmock.On("DeleteNode", nid).Return(nil)
 
+	nsmock.On("RemoveFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		true, nil)
 	fsmock.On("DeleteFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
 		errors.New("whoopsie daisy"),
 	)
 
-	err := bs.DeleteNode(*auser, nid)
+	err := bs.DeleteNode(logrus.WithField("a", "b"), *auser, nid)
 	assert.Equal(t, errors.New("whoopsie daisy"), err, "incorrect error")
 }
 
+func TestDeleteNodeSharedFile(t *testing.T) {
+	type testcase struct {
+		last    bool
+		deleted bool
+	}
+	testcases := []testcase{
+		testcase{false, false}, // other nodes still use the file
+		testcase{true, true},
+	}
+
+	for _, tc := range testcases {
+		fsmock := new(fsmocks.FileStore)
+		nsmock := new(nsmocks.NodeStore)
+		bs := New(fsmock, nsmock)
+
+		auser, _ := auth.NewUser("owner", false)
+		o, _ := nodestore.NewUser(uuid.New(), "owner")
+		nsmock.On("GetUser", "owner").Return(o, nil)
+
+		nid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
+		md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+		node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now(),
+			nodestore.FileID("f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"))
+		nsmock.On("GetNode", nid).Return(node, nil)
+		nsmock.On("DeleteNode", nid).Return(nil)
+		nsmock.On("RemoveFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+			tc.last, nil)
+		fsmock.On("DeleteFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(nil)
+
+		err := bs.DeleteNode(logrus.WithField("a", "b"), *auser, nid)
+		assert.Nil(t, err, "unexpected error")
+		if tc.deleted {
+			fsmock.AssertCalled(t, "DeleteFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d")
+		} else {
+			fsmock.AssertNotCalled(t, "DeleteFile", mock.Anything)
+		}
+	}
+}
+
+func TestDeleteNodeFailRemoveFileReference(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now())
+	nsmock.On("GetNode", nid).Return(node, nil)
+	nsmock.On("DeleteNode", nid).Return(nil)
+	nsmock.On("RemoveFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		false, errors.New("oopsie"))
+
+	err := bs.DeleteNode(logrus.WithField("a", "b"), *auser, nid)
+	assert.Equal(t, errors.New("oopsie"), err, "incorrect error")
+	fsmock.AssertNotCalled(t, "DeleteFile", mock.Anything)
+}
+
 func TestCopyNode(t *testing.T) {
 	testCopyNodeWithFnF(t, "", "")
 	testCopyNodeWithFnF(t, "filename.txt", "JSON")
@@ -1662,7 +2459,6 @@ func testCopyNodeWithFnF(t *testing.T, filename string, format string) {
 		nodestore.FileName(filename), nodestore.Format(format))
 
 	newnid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
-	newfid := "b6/f2/d8/b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1"
 	newtme, _ := time.Parse("2000-01-01T01:01:02Z01:00", time.RFC3339)
 
 	type testcase struct {
@@ -1682,41 +2478,164 @@ func testCopyNodeWithFnF(t *testing.T, filename string, format string) {
 		fsmock := new(fsmocks.FileStore)
 		nsmock := new(nsmocks.NodeStore)
 		uuidmock := new(cmocks.UUIDGen)
-		bs := NewWithUUIDGen(fsmock, nsmock, uuidmock)
+		tmock := new(cmocks.TimeProvider)
+		bs := NewWithUUIDGen(fsmock, nsmock, uuidmock, Clock(tmock))
 
 		nsmock.On("GetUser", tc.user.GetUserName()).Return(&tc.nuser, nil)
 		nsmock.On("GetNode", nid).Return(tc.node, nil)
 		uuidmock.On("GetUUID").Return(newnid)
-		md5fake, _ := values.NewMD5("4d838d477ddf355fc15df1db90bee0aa")
-		fsmock.On("CopyFile", fid, newfid).Return(
-			&filestore.FileInfo{
-				ID: newfid, Size: 120, Format: "ignored", Filename: "ignored", MD5: md5fake,
-				Stored: newtme},
-			nil,
-		)
+		tmock.On("Now").Return(newtme)
+		nsmock.On("AddFileReference", fid, nid).Return(nil)
 
 		md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
 		newnode, _ := nodestore.NewNode(newnid, tc.nuser, 12, *md5, newtme,
-			nodestore.FileName(filename), nodestore.Format(format))
+			nodestore.FileName(filename), nodestore.Format(format), nodestore.FileID(fid))
 		nsmock.On("StoreNode", newnode).Return(nil)
 
-		bnode, err := bs.CopyNode(tc.user, nid)
+		bnode, err := bs.CopyNode(logrus.WithField("a", "b"), tc.user, nid)
 		assert.Nil(t, err, "unexpected error for user "+tc.user.GetUserName())
 		expected := &BlobNode{
 			ID:       newnid,
 			Size:     12,
 			MD5:      *md5,
 			Stored:   newtme,
+			Modified: newtme,
 			Filename: filename,
 			Format:   format,
 			Owner:    User{tc.nuser.GetID(), tc.user.GetUserName()},
 			Readers:  &[]User{User{tc.nuser.GetID(), tc.user.GetUserName()}},
 			Public:   false,
+			Version:  1,
 		}
 		assert.Equal(t, expected, bnode, "incorrect node")
+		fsmock.AssertNotCalled(t, "CopyFile", mock.Anything, mock.Anything)
+	}
+}
+
+func TestCopyNodeWithChecksums(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	uuidmock := new(cmocks.UUIDGen)
+	bs := NewWithUUIDGen(fsmock, nsmock, uuidmock)
+
+	owner, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	tme, _ := time.Parse("2000-01-01T01:01:01Z01:00", time.RFC3339)
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	sums, _ := values.NewChecksums(map[string]string{
+		"sha256": "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29",
+		"crc32c": "8412e281",
+	})
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.Checksums(*sums))
+
+	newnid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
+	newtme, _ := time.Parse("2000-01-01T01:01:02Z01:00", time.RFC3339)
+	tmock := new(cmocks.TimeProvider)
+	bs = NewWithUUIDGen(fsmock, nsmock, uuidmock, Clock(tmock))
+
+	nsmock.On("GetUser", "owner").Return(o, nil)
+	nsmock.On("GetNode", nid).Return(node, nil)
+	uuidmock.On("GetUUID").Return(newnid)
+	tmock.On("Now").Return(newtme)
+	nsmock.On("AddFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d", nid).Return(nil)
+	newnode, _ := nodestore.NewNode(newnid, *o, 12, *md5, newtme, nodestore.Checksums(*sums),
+		nodestore.FileID("f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"))
+	nsmock.On("StoreNode", newnode).Return(nil)
+
+	bnode, err := bs.CopyNode(logrus.WithField("a", "b"), *owner, nid)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, sums, bnode.Checksums, "incorrect checksums")
+}
+
+func TestCopyNodeWithOptions(t *testing.T) {
+	owner, _ := auth.NewUser("owner", false)
+	admin, _ := auth.NewUser("admin", true)
+
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	a, _ := nodestore.NewUser(uuid.New(), "admin")
+	r1, _ := nodestore.NewUser(uuid.New(), "r1")
+	newowner, _ := nodestore.NewUser(uuid.New(), "newowner")
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	fid := "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now(), nodestore.Reader(*r1),
+		nodestore.Public(true), nodestore.FileName("fn"), nodestore.Format("fmt"))
+	newnid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
+	newtme := time.Now()
+
+	fn, _ := values.NewFileName("newfn")
+	ff, _ := values.NewFileFormat("newfmt")
+	emptyfn, _ := values.NewFileName("")
+
+	type testcase struct {
+		user     auth.User
+		opts     []func(*CopyOptions)
+		expected *nodestore.Node
+	}
+
+	testcases := []testcase{
+		testcase{*owner, []func(*CopyOptions){CopyReaders()},
+			mustNode(nodestore.NewNode(newnid, *o, 12, *md5, newtme, nodestore.Reader(*r1),
+				nodestore.FileName("fn"), nodestore.Format("fmt"), nodestore.FileID(fid)))},
+		testcase{*owner, []func(*CopyOptions){CopyPublic(), CopyFileName(*emptyfn)},
+			mustNode(nodestore.NewNode(newnid, *o, 12, *md5, newtme, nodestore.Public(true),
+				nodestore.Format("fmt"), nodestore.FileID(fid)))},
+		testcase{*owner, []func(*CopyOptions){CopyFileName(*fn), CopyFormat(*ff)},
+			mustNode(nodestore.NewNode(newnid, *o, 12, *md5, newtme,
+				nodestore.FileName("newfn"), nodestore.Format("newfmt"), nodestore.FileID(fid)))},
+		// the source owner is in the read ACL, and so is copied as a reader
+		testcase{*admin, []func(*CopyOptions){CopyOwner("newowner"), CopyReaders(), CopyPublic()},
+			mustNode(nodestore.NewNode(newnid, *newowner, 12, *md5, newtme,
+				nodestore.Reader(*o), nodestore.Reader(*r1), nodestore.Public(true),
+				nodestore.FileName("fn"), nodestore.Format("fmt"), nodestore.FileID(fid)))},
+	}
+
+	for _, tc := range testcases {
+		fsmock := new(fsmocks.FileStore)
+		nsmock := new(nsmocks.NodeStore)
+		uuidmock := new(cmocks.UUIDGen)
+		tmock := new(cmocks.TimeProvider)
+		bs := NewWithUUIDGen(fsmock, nsmock, uuidmock, Clock(tmock))
+
+		nsmock.On("GetUser", "owner").Return(o, nil)
+		nsmock.On("GetUser", "admin").Return(a, nil)
+		nsmock.On("GetUser", "newowner").Return(newowner, nil)
+		nsmock.On("GetNode", nid).Return(node, nil)
+		uuidmock.On("GetUUID").Return(newnid)
+		tmock.On("Now").Return(newtme)
+		nsmock.On("AddFileReference", fid, nid).Return(nil)
+		nsmock.On("StoreNode", tc.expected).Return(nil)
+
+		bnode, err := bs.CopyNode(logrus.WithField("a", "b"), tc.user, nid, tc.opts...)
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, toBlobNode(tc.expected), bnode, "incorrect node")
 	}
 }
 
+func mustNode(n *nodestore.Node, err error) *nodestore.Node {
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestCopyNodeFailOwnerNotAdmin(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	owner, _ := auth.NewUser("owner", false)
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+
+	bnode, err := bs.CopyNode(logrus.WithField("a", "b"), *owner, nid, CopyOwner("someone"))
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, NewUnauthorizedError("Only administrators may set the owner of a copy"), err,
+		"incorrect error")
+	nsmock.AssertNotCalled(t, "StoreNode", mock.Anything)
+}
+
 func TestCopyNodeFailGetUser(t *testing.T) {
 	fsmock := new(fsmocks.FileStore)
 	nsmock := new(nsmocks.NodeStore)
@@ -1728,7 +2647,7 @@ func TestCopyNodeFailGetUser(t *testing.T) {
 
 	nsmock.On("GetUser", "un").Return(nil, errors.New("no users here"))
 
-	bnode, err := bs.CopyNode(*auser, uid)
+	bnode, err := bs.CopyNode(logrus.WithField("a", "b"), *auser, uid)
 	assert.Nil(t, bnode, "expected error")
 	assert.Equal(t, errors.New("no users here"), err, "incorrect error")
 }
@@ -1753,7 +2672,7 @@ func TestCopyNodeFailGetNode(t *testing.T) {
 
 		nsmock.On("GetNode", uid).Return(nil, causeerr)
 
-		bnode, err := bs.CopyNode(*auser, uid)
+		bnode, err := bs.CopyNode(logrus.WithField("a", "b"), *auser, uid)
 		assert.Nil(t, bnode, "expected error")
 		assert.Equal(t, expectederr, err, "incorrect error")
 	}
@@ -1780,12 +2699,12 @@ func TestCopyNodeFailUnauthorized(t *testing.T) {
 
 	nsmock.On("GetNode", nid).Return(node, nil)
 
-	bnode, err := bs.CopyNode(*auser, nid)
+	bnode, err := bs.CopyNode(logrus.WithField("a", "b"), *auser, nid)
 	assert.Nil(t, bnode, "expected error")
 	assert.Equal(t, NewUnauthorizedError("Unauthorized"), err, "incorrect error")
 }
 
-func TestCopyNodeFailCopyFile(t *testing.T) {
+func TestCopyNodeFailAddFileReference(t *testing.T) {
 	owner, _ := auth.NewUser("owner", false)
 
 	o, _ := nodestore.NewUser(uuid.New(), "owner")
@@ -1797,7 +2716,6 @@ func TestCopyNodeFailCopyFile(t *testing.T) {
 	node, _ := nodestore.NewNode(nid, *o, 12, *md5, tme)
 
 	newnid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
-	newfid := "b6/f2/d8/b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1"
 	fsmock := new(fsmocks.FileStore)
 
 	nsmock := new(nsmocks.NodeStore)
@@ -1807,11 +2725,20 @@ func TestCopyNodeFailCopyFile(t *testing.T) {
 	nsmock.On("GetUser", "owner").Return(o, nil)
 	nsmock.On("GetNode", nid).Return(node, nil)
 	uuidmock.On("GetUUID").Return(newnid)
-	fsmock.On("CopyFile", fid, newfid).Return(nil, errors.New("well poop"))
+	nsmock.On("AddFileReference", fid, nid).Return(errors.New("well poop")).Once()
 
-	bnode, err := bs.CopyNode(*owner, nid)
+	bnode, err := bs.CopyNode(logrus.WithField("a", "b"), *owner, nid)
 	assert.Nil(t, bnode, "expected error")
 	assert.Equal(t, errors.New("well poop"), err, "incorrect error")
+
+	// the file is unrecorded and the node was deleted after it was fetched
+	nsmock.On("AddFileReference", fid, nid).Return(
+		nodestore.NewNoNodeError("No such node " + nid.String())).Once()
+
+	bnode, err = bs.CopyNode(logrus.WithField("a", "b"), *owner, nid)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, NewNoBlobError("No such node "+nid.String()), err, "incorrect error")
+	nsmock.AssertNotCalled(t, "RemoveFileReference", mock.Anything)
 }
 
 func TestCopyNodeFailStoreNode(t *testing.T) {
@@ -1826,29 +2753,1461 @@ func TestCopyNodeFailStoreNode(t *testing.T) {
 	node, _ := nodestore.NewNode(nid, *o, 12, *md5, tme)
 
 	newnid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
-	newfid := "b6/f2/d8/b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1"
 	fsmock := new(fsmocks.FileStore)
 
 	nsmock := new(nsmocks.NodeStore)
 	uuidmock := new(cmocks.UUIDGen)
-	bs := NewWithUUIDGen(fsmock, nsmock, uuidmock)
+	tmock := new(cmocks.TimeProvider)
+	bs := NewWithUUIDGen(fsmock, nsmock, uuidmock, Clock(tmock))
 
 	storedtime := time.Now()
 	nsmock.On("GetUser", "owner").Return(o, nil)
 	nsmock.On("GetNode", nid).Return(node, nil)
 	uuidmock.On("GetUUID").Return(newnid)
-	md5fake, _ := values.NewMD5("4d838d477ddf355fc15df1db90bee0aa")
-	fsmock.On("CopyFile", fid, newfid).Return(
-		&filestore.FileInfo{
-			ID: newfid, Size: 120, Format: "ignored", Filename: "ignored", MD5: md5fake,
-			Stored: storedtime},
-		nil,
-	)
+	tmock.On("Now").Return(storedtime)
+	nsmock.On("AddFileReference", fid, nid).Return(nil)
 
-	newnode, _ := nodestore.NewNode(newnid, *o, 12, *md5, storedtime)
+	newnode, _ := nodestore.NewNode(newnid, *o, 12, *md5, storedtime, nodestore.FileID(fid))
 	nsmock.On("StoreNode", newnode).Return(errors.New("some error here"))
+	nsmock.On("RemoveFileReference", fid).Return(false, nil)
 
-	bnode, err := bs.CopyNode(*owner, nid)
+	bnode, err := bs.CopyNode(logrus.WithField("a", "b"), *owner, nid)
 	assert.Nil(t, bnode, "expected error")
 	assert.Equal(t, errors.New("some error here"), err, "incorrect error")
+	nsmock.AssertCalled(t, "RemoveFileReference", fid)
+	fsmock.AssertNotCalled(t, "DeleteFile", mock.Anything)
+}
+
+func TestCopyNodeFailSourceDeleted(t *testing.T) {
+	// tests the case where the source node is deleted while the copy is in progress
+	type testcase struct {
+		last    bool
+		referr  error
+		delerr  error
+		deleted bool
+		logmsgs int
+	}
+	testcases := []testcase{
+		testcase{false, nil, nil, false, 0},
+		testcase{true, nil, nil, true, 0},
+		testcase{true, nil, errors.New("delete failed"), true, 1},
+		testcase{false, errors.New("remove failed"), nil, false, 1},
+	}
+
+	for _, tc := range testcases {
+		owner, _ := auth.NewUser("owner", false)
+		o, _ := nodestore.NewUser(uuid.New(), "owner")
+		nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+		fid := "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"
+		md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+		node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now())
+
+		fsmock := new(fsmocks.FileStore)
+		nsmock := new(nsmocks.NodeStore)
+		uuidmock := new(cmocks.UUIDGen)
+		bs := NewWithUUIDGen(fsmock, nsmock, uuidmock)
+
+		nsmock.On("GetUser", "owner").Return(o, nil)
+		nsmock.On("GetNode", nid).Return(node, nil).Once()
+		nsmock.On("GetNode", nid).Return(nil, nodestore.NewNoNodeError("No such node"))
+		uuidmock.On("GetUUID").Return(uuid.New())
+		nsmock.On("AddFileReference", fid, nid).Return(nil)
+		nsmock.On("RemoveFileReference", fid).Return(tc.last, tc.referr)
+		fsmock.On("DeleteFile", fid).Return(tc.delerr)
+
+		logger, hook := logrust.NewNullLogger()
+		bnode, err := bs.CopyNode(logger.WithField("a", "b"), *owner, nid)
+		assert.Nil(t, bnode, "expected error")
+		assert.Equal(t, NewNoBlobError("No such node"), err, "incorrect error")
+		nsmock.AssertNotCalled(t, "StoreNode", mock.Anything)
+		if tc.deleted {
+			fsmock.AssertCalled(t, "DeleteFile", fid)
+		} else {
+			fsmock.AssertNotCalled(t, "DeleteFile", mock.Anything)
+		}
+		assert.Equal(t, tc.logmsgs, len(hook.AllEntries()), "incorrect log count")
+	}
+}
+
+func auditLogger() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"requestid": "1234567890123456", "ip": "1.2.3.4"})
+}
+
+func TestAlterManyNodes(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	uuidmock := new(cmocks.UUIDGen)
+	tmock := new(cmocks.TimeProvider)
+	bs := NewWithUUIDGen(fsmock, nsmock, uuidmock, Clock(tmock))
+	le := logrus.WithField("a", "b")
+
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	other, _ := nodestore.NewUser(uuid.New(), "other")
+	r1, _ := nodestore.NewUser(uuid.New(), "r1")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	nid1, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	nid2 := uuid.New()
+	nid3 := uuid.New()
+	n1, _ := nodestore.NewNode(nid1, *o, 12, *md5, tme)
+	n2, _ := nodestore.NewNode(nid2, *other, 42, *md5, tme)
+	ids := []uuid.UUID{nid1, nid3, nid2}
+	nsmock.On("GetNodes", ids).Return([]*nodestore.Node{n1, n2}, nil)
+
+	aclerr := NewUnauthorizedACLError("Users can only remove themselves from the read ACL")
+	noblob := NewNoBlobError("No such node " + nid3.String())
+
+	// set public
+	pub := n1.WithPublic(true)
+	nsmock.On("SetNodePublic", nid1, true, noVersion).Return(pub, nil)
+	res, err := bs.SetNodesPublic(le, *auser, ids, true)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*NodeResult{
+		{ID: nid1, Node: toBlobNode(pub)},
+		{ID: nid3, Error: noblob},
+		{ID: nid2, Error: aclerr},
+	}, res, "incorrect results")
+
+	// add and remove readers
+	rdrs := []nodestore.User{*r1}
+	nsmock.On("GetUsers", []string{"r1"}).Return(rdrs, nil)
+	withr := n1.WithReaders(rdrs...)
+	nsmock.On("AddReaders", nid1, rdrs, noVersion).Return(withr, nil)
+	nsmock.On("RemoveReaders", nid1, rdrs, noVersion).Return(n1, nil)
+	res, err = bs.AddReadersToNodes(le, *auser, ids, []string{"r1"})
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*NodeResult{
+		{ID: nid1, Node: toBlobNode(withr)},
+		{ID: nid3, Error: noblob},
+		{ID: nid2, Error: aclerr},
+	}, res, "incorrect results")
+	res, err = bs.RemoveReadersFromNodes(le, *auser, ids, []string{"r1"})
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*NodeResult{
+		{ID: nid1, Node: toBlobNode(n1)},
+		{ID: nid3, Error: noblob},
+		{ID: nid2, Error: aclerr},
+	}, res, "incorrect results")
+
+	// copy
+	newnid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
+	fid := "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"
+	uuidmock.On("GetUUID").Return(newnid)
+	tmock.On("Now").Return(tme)
+	nsmock.On("AddFileReference", fid, nid1).Return(nil)
+	nsmock.On("GetNode", nid1).Return(n1, nil)
+	newnode, _ := nodestore.NewNode(newnid, *o, 12, *md5, tme, nodestore.FileID(fid))
+	nsmock.On("StoreNode", newnode).Return(nil)
+	res, err = bs.CopyNodes(le, *auser, ids)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*NodeResult{
+		{ID: nid1, Node: toBlobNode(newnode)},
+		{ID: nid3, Error: noblob},
+		{ID: nid2, Error: NewUnauthorizedError("Unauthorized")},
+	}, res, "incorrect results")
+
+	// only admins can set the owner of copies
+	res, err = bs.CopyNodes(le, *auser, ids, CopyOwner("other"))
+	assert.Nil(t, err, "unexpected error")
+	ownerr := NewUnauthorizedError("Only administrators may set the owner of a copy")
+	assert.Equal(t, []*NodeResult{
+		{ID: nid1, Error: ownerr},
+		{ID: nid3, Error: ownerr},
+		{ID: nid2, Error: ownerr},
+	}, res, "incorrect results")
+
+	// delete
+	nsmock.On("DeleteNode", nid1).Return(nil)
+	nsmock.On("RemoveFileReference", fid).Return(false, nil)
+	res, err = bs.DeleteNodes(le, *auser, ids)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*NodeResult{
+		{ID: nid1},
+		{ID: nid3, Error: noblob},
+		{ID: nid2, Error: NewUnauthorizedError("Unauthorized")},
+	}, res, "incorrect results")
+
+	// each operation queries the nodes and users once
+	nsmock.AssertNumberOfCalls(t, "GetNodes", 5)
+	nsmock.AssertNumberOfCalls(t, "GetUser", 5)
+	nsmock.AssertNumberOfCalls(t, "GetUsers", 2)
+	nsmock.AssertNotCalled(t, "SetNodePublic", nid2, mock.Anything, mock.Anything)
+	nsmock.AssertNotCalled(t, "DeleteNode", nid2)
+}
+
+func TestAlterManyNodesFail(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+	le := logrus.WithField("a", "b")
+
+	ids := []uuid.UUID{uuid.New()}
+	auser, _ := auth.NewUser("un", false)
+	nsmock.On("GetUsers", []string{"r1"}).Return(nil, errors.New("no readers here"))
+	res, err := bs.AddReadersToNodes(le, *auser, ids, []string{"r1"})
+	assert.Nil(t, res, "expected error")
+	assert.Equal(t, errors.New("no readers here"), err, "incorrect error")
+
+	nsmock.On("GetUser", "un").Return(nil, errors.New("no users here"))
+	res, err = bs.DeleteNodes(le, *auser, ids)
+	assert.Nil(t, res, "expected error")
+	assert.Equal(t, errors.New("no users here"), err, "incorrect error")
+
+	nsmock = new(nsmocks.NodeStore)
+	bs = New(fsmock, nsmock)
+	u, _ := nodestore.NewUser(uuid.New(), "un")
+	nsmock.On("GetUser", "un").Return(u, nil)
+	nsmock.On("GetNodes", ids).Return(nil, errors.New("no nodes here"))
+	res, err = bs.SetNodesPublic(le, *auser, ids, true)
+	assert.Nil(t, res, "expected error")
+	assert.Equal(t, errors.New("no nodes here"), err, "incorrect error")
+}
+
+func TestSetFileMetadata(t *testing.T) {
+	auser, _ := auth.NewUser("owner", false)
+	admin, _ := auth.NewUser("notowner", true)
+	oid := uuid.New()
+	o, _ := nodestore.NewUser(oid, "owner")
+	no, _ := nodestore.NewUser(uuid.New(), "notowner")
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	tme := time.Now()
+	modtme := tme.Add(time.Hour)
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.FileName("foo"),
+		nodestore.Format("fmt"))
+	fn, _ := values.NewFileName("bar")
+	ff, _ := values.NewFileFormat("json")
+	ver := int64(1)
+
+	type testcase struct {
+		user        auth.User
+		filename    *values.FileName
+		format      *values.FileFormat
+		version     *int64
+		expfilename *string
+		expformat   *string
+		newnode     *nodestore.Node
+	}
+
+	bar := "bar"
+	json := "json"
+	testcases := []testcase{
+		testcase{*auser, fn, nil, nil, &bar, nil,
+			mustNode(nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.FileName("bar"),
+				nodestore.Format("fmt"), nodestore.Modified(modtme), nodestore.Version(2)))},
+		testcase{*admin, nil, ff, &ver, nil, &json,
+			mustNode(nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.FileName("foo"),
+				nodestore.Format("json"), nodestore.Modified(modtme), nodestore.Version(2)))},
+		testcase{*auser, fn, ff, nil, &bar, &json,
+			mustNode(nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.FileName("bar"),
+				nodestore.Format("json"), nodestore.Modified(modtme), nodestore.Version(2)))},
+	}
+
+	for _, tc := range testcases {
+		fsmock := new(fsmocks.FileStore)
+		nsmock := new(nsmocks.NodeStore)
+		tmock := new(cmocks.TimeProvider)
+		bs := New(fsmock, nsmock, Clock(tmock))
+
+		nsmock.On("GetUser", "owner").Return(o, nil)
+		nsmock.On("GetUser", "notowner").Return(no, nil)
+		nsmock.On("GetNode", nid).Return(node, nil)
+		tmock.On("Now").Return(modtme)
+		nsmock.On("SetFileMetadata", nid, tc.expfilename, tc.expformat, modtme, tc.version).
+			Return(tc.newnode, nil)
+
+		bnode, err := bs.SetFileMetadata(logrus.WithField("a", "b"), tc.user, nid, tc.filename,
+			tc.format, tc.version)
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, toBlobNode(tc.newnode), bnode, "incorrect node")
+		assert.Equal(t, tme, bnode.Stored, "incorrect stored time")
+		assert.Equal(t, modtme, bnode.Modified, "incorrect modified time")
+	}
+}
+
+func TestSetFileMetadataFailBadInput(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	auser, _ := auth.NewUser("owner", false)
+	bnode, err := bs.SetFileMetadata(logrus.WithField("a", "b"), *auser, uuid.New(), nil, nil,
+		nil)
+	assert.Nil(t, bnode, "expected error")
+	assert.Equal(t, values.NewIllegalInputError(
+		"At least one of filename or format must be provided"), err, "incorrect error")
+}
+
+func TestSetFileMetadataFailGetNode(t *testing.T) {
+	uid := uuid.New()
+	auser, _ := auth.NewUser("un", false)
+	nuser, _ := nodestore.NewUser(uuid.New(), "un")
+	fn, _ := values.NewFileName("bar")
+
+	inputs := map[error]error{
+		errors.New("You are all individuals"): errors.New("You are all individuals"),
+		nodestore.NewNoNodeError("oops"):      NewNoBlobError("oops"),
+	}
+
+	for causeerr, expectederr := range inputs {
+		fsmock := new(fsmocks.FileStore)
+		nsmock := new(nsmocks.NodeStore)
+		bs := New(fsmock, nsmock)
+		nsmock.On("GetUser", "un").Return(nuser, nil)
+		nsmock.On("GetNode", uid).Return(nil, causeerr)
+
+		bnode, err := bs.SetFileMetadata(logrus.WithField("a", "b"), *auser, uid, fn, nil, nil)
+		assert.Equal(t, expectederr, err, "incorrect error")
+		assert.Nil(t, bnode, "expected error")
+	}
+}
+
+func TestSetFileMetadataFailUnauthorized(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	auser, _ := auth.NewUser("un", false)
+	nuser, _ := nodestore.NewUser(uuid.New(), "un")
+	nowner, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "un").Return(nuser, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	// readers may not change the file metadata
+	node, _ := nodestore.NewNode(nid, *nowner, 12, *md5, time.Now(), nodestore.Reader(*nuser))
+	nsmock.On("GetNode", nid).Return(node, nil)
+	fn, _ := values.NewFileName("bar")
+
+	bnode, err := bs.SetFileMetadata(logrus.WithField("a", "b"), *auser, nid, fn, nil, nil)
+	assert.Equal(t, NewUnauthorizedError("Unauthorized"), err, "incorrect error")
+	assert.Nil(t, bnode, "expected error")
+}
+
+func TestSetFileMetadataFailVersionMismatch(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now(), nodestore.Version(3))
+	nsmock.On("GetNode", nid).Return(node, nil)
+	fn, _ := values.NewFileName("bar")
+	ver := int64(2)
+
+	bnode, err := bs.SetFileMetadata(logrus.WithField("a", "b"), *auser, nid, fn, nil, &ver)
+	assert.Equal(t, NewVersionMismatchError(
+		"Node f6029a11-0914-42b3-beea-fed420f75d7d is at version 3, not 2"), err,
+		"incorrect error")
+	assert.Nil(t, bnode, "expected error")
+	nsmock.AssertNotCalled(t, "SetFileMetadata", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything)
+}
+
+func TestSetFileMetadataFailSetFileMetadata(t *testing.T) {
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now())
+	fn, _ := values.NewFileName("bar")
+	bar := "bar"
+	tme := time.Now()
+
+	inputs := map[error]error{
+		errors.New("Now you discharge yours"): errors.New("Now you discharge yours"),
+		nodestore.NewNoNodeError("oops"):      NewNoBlobError("oops"),
+	}
+
+	for causeerr, expectederr := range inputs {
+		fsmock := new(fsmocks.FileStore)
+		nsmock := new(nsmocks.NodeStore)
+		tmock := new(cmocks.TimeProvider)
+		bs := New(fsmock, nsmock, Clock(tmock))
+
+		nsmock.On("GetUser", "owner").Return(o, nil)
+		nsmock.On("GetNode", nid).Return(node, nil)
+		tmock.On("Now").Return(tme)
+		nsmock.On("SetFileMetadata", nid, &bar, (*string)(nil), tme, noVersion).Return(
+			nil, causeerr)
+
+		bnode, err := bs.SetFileMetadata(logrus.WithField("a", "b"), *auser, nid, fn, nil, nil)
+		assert.Equal(t, expectederr, err, "incorrect error")
+		assert.Nil(t, bnode, "expected error")
+	}
+}
+
+func TestSetFileMetadataWithAuditLogAndEventStore(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	tmock := new(cmocks.TimeProvider)
+	almock := new(amocks.Log)
+	esmock := new(emocks.Store)
+	bs := New(fsmock, nsmock, Clock(tmock), AuditLog(almock), EventStore(esmock))
+
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	tme := time.Now()
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.FileName("foo"))
+	newnode, _ := nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.FileName("foo"),
+		nodestore.Format("json"), nodestore.Version(2), nodestore.Modified(tme))
+	nsmock.On("GetNode", nid).Return(node, nil)
+	tmock.On("Now").Return(tme)
+	json := "json"
+	nsmock.On("SetFileMetadata", nid, (*string)(nil), &json, tme, noVersion).Return(newnode, nil)
+
+	almock.On("AddRecord", &audit.Record{
+		Action:    audit.ActionSetFileMetadata,
+		NodeID:    nid,
+		Actor:     "owner",
+		IP:        "1.2.3.4",
+		RequestID: "1234567890123456",
+		Before:    &audit.NodeState{Owner: "owner", Readers: []string{"owner"}, Filename: "foo"},
+		After: &audit.NodeState{
+			Owner: "owner", Readers: []string{"owner"}, Filename: "foo", Format: "json"},
+	}).Return(nil)
+	esmock.On("AddEvent", &events.Event{
+		Type:    events.FileMetadataChanged,
+		NodeID:  nid,
+		User:    "owner",
+		Owner:   "owner",
+		Readers: []string{"owner"},
+	}).Return(nil)
+
+	ff, _ := values.NewFileFormat("json")
+	bnode, err := bs.SetFileMetadata(auditLogger(), *auser, nid, nil, ff, nil)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, toBlobNode(newnode), bnode, "incorrect node")
+	almock.AssertNumberOfCalls(t, "AddRecord", 1)
+	esmock.AssertNumberOfCalls(t, "AddEvent", 1)
+}
+
+func TestStoreWithAuditLog(t *testing.T) {
+	uidmock := new(cmocks.UUIDGen)
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+
+	bs := NewWithUUIDGen(fsmock, nsmock, uidmock, AuditLog(almock))
+
+	uid, _ := uuid.Parse("4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+	nuser, _ := nodestore.NewUser(uuid.New(), "username")
+
+	uidmock.On("GetUUID").Return(uid)
+	nsmock.On("GetUser", "username").Return(nuser, nil)
+
+	le := auditLogger()
+	p, _ := filestore.NewStoreFileParams(
+		"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		12,
+		strings.NewReader("012345678910"))
+	tme := time.Now()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	fsmock.On("StoreFile", le, p).Return(&filestore.FileInfo{MD5: md5, Stored: tme}, nil)
+
+	node, _ := nodestore.NewNode(uid, *nuser, 12, *md5, tme)
+	nsmock.On("StoreNode", node).Return(nil)
+
+	almock.On("AddRecord", &audit.Record{
+		Action:       audit.ActionCreate,
+		NodeID:       uid,
+		Actor:        "username",
+		ActorIsAdmin: true,
+		IP:           "1.2.3.4",
+		RequestID:    "1234567890123456",
+		After:        &audit.NodeState{Owner: "username", Readers: []string{"username"}},
+	}).Return(nil)
+
+	auser, _ := auth.NewUser("username", true)
+	fn, _ := values.NewFileName("")
+	ff, _ := values.NewFileFormat("")
+	bnode, err := bs.Store(le, *auser, strings.NewReader("012345678910"), 12, *fn, *ff)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, uid, bnode.ID, "incorrect node")
+	almock.AssertNumberOfCalls(t, "AddRecord", 1)
+}
+
+func TestStoreFailAuditLog(t *testing.T) {
+	uidmock := new(cmocks.UUIDGen)
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+
+	bs := NewWithUUIDGen(fsmock, nsmock, uidmock, AuditLog(almock))
+
+	uid, _ := uuid.Parse("4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+	nuser, _ := nodestore.NewUser(uuid.New(), "username")
+
+	uidmock.On("GetUUID").Return(uid)
+	nsmock.On("GetUser", "username").Return(nuser, nil)
+
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	p, _ := filestore.NewStoreFileParams(
+		"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		12,
+		strings.NewReader("012345678910"))
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	fsmock.On("StoreFile", le, p).Return(&filestore.FileInfo{MD5: md5}, nil)
+	nsmock.On("StoreNode", mock.Anything).Return(nil)
+	almock.On("AddRecord", mock.Anything).Return(errors.New("audit borked"))
+
+	// the node is stored, so the failure is logged rather than returned
+	auser, _ := auth.NewUser("username", false)
+	fn, _ := values.NewFileName("")
+	ff, _ := values.NewFileFormat("")
+	bnode, err := bs.Store(le, *auser, strings.NewReader("012345678910"), 12, *fn, *ff)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, uid, bnode.ID, "incorrect node")
+	checkRecordFailLogs(t, hook, 1, "could not add audit record", "audit borked")
+}
+
+func checkRecordFailLogs(t *testing.T, hook *logrust.Hook, count int, msg string, err string) {
+	assert.Equal(t, count, len(hook.AllEntries()), "incorrect log count")
+	for _, e := range hook.AllEntries() {
+		assert.Equal(t, logrus.ErrorLevel, e.Level, "incorrect level")
+		assert.Equal(t, msg, e.Message, "incorrect message")
+		assert.Equal(t, err, e.Data["error"], "incorrect error")
+	}
+}
+
+func TestACLChangesWithAuditLog(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+	bs := New(fsmock, nsmock, AuditLog(almock))
+
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	r1, _ := nodestore.NewUser(uuid.New(), "r1")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+	nsmock.On("GetUser", "r1").Return(r1, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now(), nodestore.Reader(*r1))
+	nsmock.On("GetNode", nid).Return(node, nil)
+	nsmock.On("SetNodePublic", nid, true, noVersion).Return(node.WithPublic(true), nil)
+	nsmock.On("GetUsers", []string{"r1"}).Return([]nodestore.User{*r1}, nil)
+	nsmock.On("AddReaders", nid, []nodestore.User{*r1}, noVersion).Return(
+		node.WithReaders(*r1), nil)
+	nsmock.On("RemoveReaders", nid, []nodestore.User{*r1}, noVersion).Return(
+		node.WithoutReaders(*r1), nil)
+	nsmock.On("ChangeOwner", nid, *r1, noVersion).Return(node.WithOwner(*r1), nil)
+
+	rec := func(action audit.Action, after *audit.NodeState) *audit.Record {
+		return &audit.Record{
+			Action:    action,
+			NodeID:    nid,
+			Actor:     "owner",
+			IP:        "1.2.3.4",
+			RequestID: "1234567890123456",
+			Before:    &audit.NodeState{Owner: "owner", Readers: []string{"owner", "r1"}},
+			After:     after,
+		}
+	}
+	almock.On("AddRecord", rec(audit.ActionSetPublic, &audit.NodeState{
+		Owner: "owner", Readers: []string{"owner", "r1"}, Public: true})).Return(nil)
+	almock.On("AddRecord", rec(audit.ActionAddReaders, &audit.NodeState{
+		Owner: "owner", Readers: []string{"owner", "r1"}})).Return(nil)
+	almock.On("AddRecord", rec(audit.ActionRemoveReaders, &audit.NodeState{
+		Owner: "owner", Readers: []string{"owner"}})).Return(nil)
+	almock.On("AddRecord", rec(audit.ActionChangeOwner, &audit.NodeState{
+		Owner: "r1", Readers: []string{"r1", "owner"}})).Return(nil)
+
+	_, err := bs.SetNodePublic(auditLogger(), *auser, nid, true, nil)
+	assert.Nil(t, err, "unexpected error")
+	_, err = bs.AddReaders(auditLogger(), *auser, nid, []string{"r1"}, nil)
+	assert.Nil(t, err, "unexpected error")
+	_, err = bs.RemoveReaders(auditLogger(), *auser, nid, []string{"r1"}, nil)
+	assert.Nil(t, err, "unexpected error")
+	_, err = bs.ChangeOwner(auditLogger(), *auser, nid, "r1", nil)
+	assert.Nil(t, err, "unexpected error")
+	almock.AssertNumberOfCalls(t, "AddRecord", 4)
+}
+
+func TestACLChangesFailAuditLog(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+	bs := New(fsmock, nsmock, AuditLog(almock))
+
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	r1, _ := nodestore.NewUser(uuid.New(), "r1")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+	nsmock.On("GetUser", "r1").Return(r1, nil)
+
+	nid := uuid.New()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now())
+	nsmock.On("GetNode", nid).Return(node, nil)
+	nsmock.On("SetNodePublic", nid, true, noVersion).Return(node.WithPublic(true), nil)
+	nsmock.On("GetUsers", []string{"r1"}).Return([]nodestore.User{*r1}, nil)
+	nsmock.On("AddReaders", nid, []nodestore.User{*r1}, noVersion).Return(
+		node.WithReaders(*r1), nil)
+	nsmock.On("ChangeOwner", nid, *r1, noVersion).Return(node.WithOwner(*r1), nil)
+	almock.On("AddRecord", mock.Anything).Return(errors.New("audit borked"))
+
+	// the changes are made, so the failures are logged rather than returned
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	bnode, err := bs.SetNodePublic(le, *auser, nid, true, nil)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, true, bnode.Public, "incorrect node")
+	bnode, err = bs.AddReaders(le, *auser, nid, []string{"r1"}, nil)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, 2, len(*bnode.Readers), "incorrect node")
+	bnode, err = bs.ChangeOwner(le, *auser, nid, "r1", nil)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, "r1", bnode.Owner.AccountName, "incorrect node")
+	checkRecordFailLogs(t, hook, 3, "could not add audit record", "audit borked")
+}
+
+func TestDeleteNodeWithAuditLog(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+	bs := New(fsmock, nsmock, AuditLog(almock))
+
+	auser, _ := auth.NewUser("admin", true)
+	a, _ := nodestore.NewUser(uuid.New(), "admin")
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "admin").Return(a, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now(), nodestore.Public(true))
+	nsmock.On("GetNode", nid).Return(node, nil)
+	nsmock.On("DeleteNode", nid).Return(nil)
+	nsmock.On("RemoveFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		true, nil)
+	fsmock.On("DeleteFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(nil)
+	almock.On("AddRecord", &audit.Record{
+		Action:       audit.ActionDelete,
+		NodeID:       nid,
+		Actor:        "admin",
+		ActorIsAdmin: true,
+		IP:           "1.2.3.4",
+		RequestID:    "1234567890123456",
+		Before:       &audit.NodeState{Owner: "owner", Readers: []string{"owner"}, Public: true},
+	}).Return(nil)
+
+	err := bs.DeleteNode(auditLogger(), *auser, nid)
+	assert.Nil(t, err, "unexpected error")
+	almock.AssertNumberOfCalls(t, "AddRecord", 1)
+
+	// test failure
+	almock = new(amocks.Log)
+	bs = New(fsmock, nsmock, AuditLog(almock))
+	almock.On("AddRecord", mock.Anything).Return(errors.New("audit borked"))
+	logger, hook := logrust.NewNullLogger()
+	err = bs.DeleteNode(logger.WithField("a", "b"), *auser, nid)
+	assert.Nil(t, err, "unexpected error")
+	checkRecordFailLogs(t, hook, 1, "could not add audit record", "audit borked")
+	nsmock.AssertNumberOfCalls(t, "RemoveFileReference", 2)
+	fsmock.AssertNumberOfCalls(t, "DeleteFile", 2)
+}
+
+func TestDeleteNodeImpersonatedWithAuditLog(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+	bs := New(fsmock, nsmock, AuditLog(almock))
+
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now())
+	nsmock.On("GetNode", nid).Return(node, nil)
+	nsmock.On("DeleteNode", nid).Return(nil)
+	nsmock.On("RemoveFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		true, nil)
+	fsmock.On("DeleteFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(nil)
+	almock.On("AddRecord", &audit.Record{
+		Action:       audit.ActionDelete,
+		NodeID:       nid,
+		Actor:        "owner",
+		ActorIsAdmin: false,
+		Impersonator: "admin",
+		IP:           "1.2.3.4",
+		RequestID:    "1234567890123456",
+		Before:       &audit.NodeState{Owner: "owner", Readers: []string{"owner"}},
+	}).Return(nil)
+
+	le := auditLogger().WithField(LogFieldImpersonator, "admin")
+	err := bs.DeleteNode(le, *auser, nid)
+	assert.Nil(t, err, "unexpected error")
+	almock.AssertNumberOfCalls(t, "AddRecord", 1)
+}
+
+func TestCopyNodeWithAuditLog(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	uuidmock := new(cmocks.UUIDGen)
+	almock := new(amocks.Log)
+	bs := NewWithUUIDGen(fsmock, nsmock, uuidmock, AuditLog(almock))
+
+	auser, _ := auth.NewUser("r1", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	r1, _ := nodestore.NewUser(uuid.New(), "r1")
+	nsmock.On("GetUser", "r1").Return(r1, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	newnid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	tme := time.Now()
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.Reader(*r1))
+	nsmock.On("GetNode", nid).Return(node, nil)
+	uuidmock.On("GetUUID").Return(newnid)
+	nsmock.On("AddFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d", nid).Return(nil)
+	nsmock.On("StoreNode", mock.Anything).Return(nil)
+	almock.On("AddRecord", &audit.Record{
+		Action:       audit.ActionCopy,
+		NodeID:       newnid,
+		SourceNodeID: &nid,
+		Actor:        "r1",
+		IP:           "1.2.3.4",
+		RequestID:    "1234567890123456",
+		After:        &audit.NodeState{Owner: "r1", Readers: []string{"r1"}},
+	}).Return(nil)
+
+	bnode, err := bs.CopyNode(auditLogger(), *auser, nid)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, newnid, bnode.ID, "incorrect id")
+	almock.AssertNumberOfCalls(t, "AddRecord", 1)
+
+	// test failure
+	almock = new(amocks.Log)
+	bs = NewWithUUIDGen(fsmock, nsmock, uuidmock, AuditLog(almock))
+	almock.On("AddRecord", mock.Anything).Return(errors.New("audit borked"))
+	logger, hook := logrust.NewNullLogger()
+	bnode, err = bs.CopyNode(logger.WithField("a", "b"), *auser, nid)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, newnid, bnode.ID, "incorrect id")
+	checkRecordFailLogs(t, hook, 1, "could not add audit record", "audit borked")
+}
+
+func TestStoreWithEventStore(t *testing.T) {
+	uidmock := new(cmocks.UUIDGen)
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	esmock := new(emocks.Store)
+
+	bs := NewWithUUIDGen(fsmock, nsmock, uidmock, EventStore(esmock))
+
+	uid, _ := uuid.Parse("4122a860-ce69-45cc-9d5d-3d2585fbfd74")
+	nuser, _ := nodestore.NewUser(uuid.New(), "username")
+
+	uidmock.On("GetUUID").Return(uid)
+	nsmock.On("GetUser", "username").Return(nuser, nil)
+
+	logger, hook := logrust.NewNullLogger()
+	le := logger.WithField("a", "b")
+	p, _ := filestore.NewStoreFileParams(
+		"41/22/a8/4122a860-ce69-45cc-9d5d-3d2585fbfd74",
+		12,
+		strings.NewReader("012345678910"))
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	fsmock.On("StoreFile", le, p).Return(&filestore.FileInfo{MD5: md5}, nil)
+	nsmock.On("StoreNode", mock.Anything).Return(nil)
+	esmock.On("AddEvent", &events.Event{
+		Type:    events.NodeCreated,
+		NodeID:  uid,
+		User:    "username",
+		Owner:   "username",
+		Readers: []string{"username"},
+	}).Return(nil)
+
+	auser, _ := auth.NewUser("username", false)
+	fn, _ := values.NewFileName("")
+	ff, _ := values.NewFileFormat("")
+	bnode, err := bs.Store(le, *auser, strings.NewReader("012345678910"), 12, *fn, *ff)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, uid, bnode.ID, "incorrect node")
+	esmock.AssertNumberOfCalls(t, "AddEvent", 1)
+
+	// test failure
+	esmock = new(emocks.Store)
+	bs = NewWithUUIDGen(fsmock, nsmock, uidmock, EventStore(esmock))
+	esmock.On("AddEvent", mock.Anything).Return(errors.New("events borked"))
+	bnode, err = bs.Store(le, *auser, strings.NewReader("012345678910"), 12, *fn, *ff)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, uid, bnode.ID, "incorrect node")
+	checkRecordFailLogs(t, hook, 1, "could not add event", "events borked")
+}
+
+func TestNodeChangesWithEventStore(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	uuidmock := new(cmocks.UUIDGen)
+	almock := new(amocks.Log)
+	esmock := new(emocks.Store)
+	bs := NewWithUUIDGen(fsmock, nsmock, uuidmock, AuditLog(almock), EventStore(esmock))
+
+	auser, _ := auth.NewUser("owner", false)
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	r1, _ := nodestore.NewUser(uuid.New(), "r1")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+	nsmock.On("GetUser", "r1").Return(r1, nil)
+
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	newnid, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	tme := time.Now()
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, tme, nodestore.Reader(*r1))
+	nsmock.On("GetNode", nid).Return(node, nil)
+	nsmock.On("SetNodePublic", nid, true, noVersion).Return(node.WithPublic(true), nil)
+	nsmock.On("GetUsers", []string{"r1"}).Return([]nodestore.User{*r1}, nil)
+	nsmock.On("RemoveReaders", nid, []nodestore.User{*r1}, noVersion).Return(
+		node.WithoutReaders(*r1), nil)
+	nsmock.On("ChangeOwner", nid, *r1, noVersion).Return(node.WithOwner(*r1), nil)
+	nsmock.On("DeleteNode", nid).Return(nil)
+	nsmock.On("StoreNode", mock.Anything).Return(nil)
+	nsmock.On("RemoveFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		true, nil)
+	fsmock.On("DeleteFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(nil)
+	nsmock.On("AddFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d", nid).Return(nil)
+	uuidmock.On("GetUUID").Return(newnid)
+	almock.On("AddRecord", mock.Anything).Return(nil)
+
+	ev := func(typ events.Type, owner string, readers []string, public bool) *events.Event {
+		return &events.Event{
+			Type:    typ,
+			NodeID:  nid,
+			User:    "owner",
+			Owner:   owner,
+			Readers: readers,
+			Public:  public,
+		}
+	}
+	esmock.On("AddEvent", ev(events.ACLChanged, "owner", []string{"owner", "r1"}, true)).
+		Return(nil)
+	esmock.On("AddEvent", ev(events.ACLChanged, "owner", []string{"owner"}, false)).
+		Return(nil)
+	esmock.On("AddEvent", ev(events.OwnerChanged, "r1", []string{"r1", "owner"}, false)).
+		Return(nil)
+	// deletion events contain the state of the node prior to deletion
+	esmock.On("AddEvent", ev(events.NodeDeleted, "owner", []string{"owner", "r1"}, false)).
+		Return(nil)
+	esmock.On("AddEvent", &events.Event{
+		Type:         events.NodeCopied,
+		NodeID:       newnid,
+		SourceNodeID: &nid,
+		User:         "owner",
+		Owner:        "owner",
+		Readers:      []string{"owner"},
+	}).Return(nil)
+
+	le := logrus.WithField("a", "b")
+	_, err := bs.SetNodePublic(le, *auser, nid, true, nil)
+	assert.Nil(t, err, "unexpected error")
+	_, err = bs.RemoveReaders(le, *auser, nid, []string{"r1"}, nil)
+	assert.Nil(t, err, "unexpected error")
+	_, err = bs.ChangeOwner(le, *auser, nid, "r1", nil)
+	assert.Nil(t, err, "unexpected error")
+	_, err = bs.CopyNode(le, *auser, nid)
+	assert.Nil(t, err, "unexpected error")
+	err = bs.DeleteNode(le, *auser, nid)
+	assert.Nil(t, err, "unexpected error")
+	esmock.AssertNumberOfCalls(t, "AddEvent", 5)
+	almock.AssertNumberOfCalls(t, "AddRecord", 5)
+
+	// test failure
+	esmock = new(emocks.Store)
+	bs = NewWithUUIDGen(fsmock, nsmock, uuidmock, EventStore(esmock))
+	esmock.On("AddEvent", mock.Anything).Return(errors.New("events borked"))
+	logger, hook := logrust.NewNullLogger()
+	le = logger.WithField("a", "b")
+	bnode, err := bs.SetNodePublic(le, *auser, nid, true, nil)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, true, bnode.Public, "incorrect node")
+	err = bs.DeleteNode(le, *auser, nid)
+	assert.Nil(t, err, "unexpected error")
+	checkRecordFailLogs(t, hook, 2, "could not add event", "events borked")
+}
+
+func TestRenameUser(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+	esmock := new(emocks.Store)
+	akmock := new(akmocks.Store)
+	bs := New(fsmock, nsmock, AuditLog(almock), EventStore(esmock), APIKeyStore(akmock))
+
+	auser, _ := auth.NewUser("admin", true)
+	uid := uuid.New()
+	old, _ := nodestore.NewUser(uid, "old")
+	newu, _ := nodestore.NewUser(uid, "new")
+	other, _ := nodestore.NewUser(uuid.New(), "other")
+	nsmock.On("GetExistingUser", "old").Return(old, nil)
+
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	tme := time.Now()
+	nid1, nid2, nid3 := uuid.New(), uuid.New(), uuid.New()
+	// owned by the user
+	n1, _ := nodestore.NewNode(nid1, *old, 12, *md5, tme)
+	n1renamed, _ := nodestore.NewNode(nid1, *newu, 12, *md5, tme)
+	// readable by the user
+	n2, _ := nodestore.NewNode(nid2, *other, 12, *md5, tme, nodestore.Reader(*old))
+	n2renamed, _ := nodestore.NewNode(nid2, *other, 12, *md5, tme, nodestore.Reader(*newu))
+	// deleted while renaming
+	n3, _ := nodestore.NewNode(nid3, *other, 12, *md5, tme, nodestore.Reader(*old))
+	nsmock.On("GetNodesByOwner", *old).Return([]*nodestore.Node{n1}, nil)
+	nsmock.On("GetNodesByReader", *old).Return([]*nodestore.Node{n1, n2, n3}, nil)
+	nsmock.On("RenameUser", "old", "new").Return(newu, nil)
+	akmock.On("RenameUser", "old", "new").Return(nil)
+	nsmock.On("GetNode", nid1).Return(n1renamed, nil)
+	nsmock.On("GetNode", nid2).Return(n2renamed, nil)
+	nsmock.On("GetNode", nid3).Return(nil, nodestore.NewNoNodeError("no node"))
+
+	rec := func(id uuid.UUID, before *audit.NodeState, after *audit.NodeState) *audit.Record {
+		return &audit.Record{
+			Action:       audit.ActionRenameUser,
+			NodeID:       id,
+			Actor:        "admin",
+			ActorIsAdmin: true,
+			IP:           "1.2.3.4",
+			RequestID:    "1234567890123456",
+			Before:       before,
+			After:        after,
+		}
+	}
+	almock.On("AddRecord", rec(nid1, &audit.NodeState{Owner: "old", Readers: []string{"old"}},
+		&audit.NodeState{Owner: "new", Readers: []string{"new"}})).Return(nil)
+	almock.On("AddRecord", rec(nid2,
+		&audit.NodeState{Owner: "other", Readers: []string{"other", "old"}},
+		&audit.NodeState{Owner: "other", Readers: []string{"other", "new"}})).Return(nil)
+	esmock.On("AddEvent", &events.Event{Type: events.ACLChanged, NodeID: nid1, User: "admin",
+		Owner: "new", Readers: []string{"new"}}).Return(nil)
+	esmock.On("AddEvent", &events.Event{Type: events.ACLChanged, NodeID: nid2, User: "admin",
+		Owner: "other", Readers: []string{"other", "new"}}).Return(nil)
+
+	err := bs.RenameUser(auditLogger(), *auser, "  old  ", " new ")
+	assert.Nil(t, err, "unexpected error")
+	nsmock.AssertNumberOfCalls(t, "RenameUser", 1)
+	akmock.AssertNumberOfCalls(t, "RenameUser", 1)
+	almock.AssertNumberOfCalls(t, "AddRecord", 2)
+	esmock.AssertNumberOfCalls(t, "AddEvent", 2)
+}
+
+func TestRenameUserFail(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	akmock := new(akmocks.Store)
+	bs := New(fsmock, nsmock, APIKeyStore(akmock))
+
+	admin, _ := auth.NewUser("admin", true)
+	user, _ := auth.NewUser("user", false)
+	readadmin, _ := auth.NewUserWithAdminLevel("readadmin", auth.AdminRead)
+	old, _ := nodestore.NewUser(uuid.New(), "old")
+	ownerborked, _ := nodestore.NewUser(uuid.New(), "ownerborked")
+	readerborked, _ := nodestore.NewUser(uuid.New(), "readerborked")
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	n, _ := nodestore.NewNode(uuid.New(), *old, 12, *md5, time.Now())
+
+	nsmock.On("GetExistingUser", "nouser").Return(nil, nodestore.NewNoUserError("no user"))
+	nsmock.On("GetExistingUser", "borked").Return(nil, errors.New("borked"))
+	nsmock.On("GetExistingUser", "old").Return(old, nil)
+	nsmock.On("GetExistingUser", "ownerborked").Return(ownerborked, nil)
+	nsmock.On("GetExistingUser", "readerborked").Return(readerborked, nil)
+	nsmock.On("GetNodesByOwner", *ownerborked).Return(nil, errors.New("owner borked"))
+	nsmock.On("GetNodesByOwner", *readerborked).Return([]*nodestore.Node{}, nil)
+	nsmock.On("GetNodesByReader", *readerborked).Return(nil, errors.New("reader borked"))
+	nsmock.On("GetNodesByOwner", *old).Return([]*nodestore.Node{n}, nil)
+	nsmock.On("GetNodesByReader", *old).Return([]*nodestore.Node{n}, nil)
+	nsmock.On("RenameUser", "old", "exists").Return(nil, nodestore.NewUserExistsError("exists"))
+	nsmock.On("RenameUser", "old", "borked").Return(nil, errors.New("borked"))
+	nsmock.On("RenameUser", "old", "keysborked").Return(old, nil)
+	akmock.On("RenameUser", "old", "keysborked").Return(errors.New("keys borked"))
+	nsmock.On("RenameUser", "old", "nodeborked").Return(old, nil)
+	akmock.On("RenameUser", "old", "nodeborked").Return(nil)
+	nsmock.On("GetNode", n.GetID()).Return(nil, errors.New("node borked"))
+
+	type testcase struct {
+		user     *auth.User
+		name     string
+		newname  string
+		expected error
+	}
+
+	unauth := NewUnauthorizedError("Only full administrators may rename users")
+	empty := values.NewIllegalInputError("Account names cannot be empty")
+	testcases := []testcase{
+		testcase{user, "old", "new", unauth},
+		testcase{readadmin, "old", "new", unauth},
+		testcase{admin, "  \t ", "new", empty},
+		testcase{admin, "old", "   ", empty},
+		testcase{admin, "nouser", "new", NewNoUserError("no user")},
+		testcase{admin, "borked", "new", errors.New("borked")},
+		testcase{admin, "ownerborked", "new", errors.New("owner borked")},
+		testcase{admin, "readerborked", "new", errors.New("reader borked")},
+		testcase{admin, "old", "exists", NewUserExistsError("exists")},
+		testcase{admin, "old", "borked", errors.New("borked")},
+		testcase{admin, "old", "keysborked", errors.New("keys borked")},
+	}
+
+	for _, tc := range testcases {
+		err := bs.RenameUser(auditLogger(), *tc.user, tc.name, tc.newname)
+		assert.Equal(t, tc.expected, err, "incorrect error")
+	}
+
+	// the user has already been renamed when the nodes are fetched for the audit log
+	logger, hook := logrust.NewNullLogger()
+	err := bs.RenameUser(logger.WithField("a", "b"), *admin, "old", "nodeborked")
+	assert.Nil(t, err, "unexpected error")
+	checkRecordFailLogs(t, hook, 1, "could not get renamed node", "node borked")
+}
+
+func TestMergeUsers(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+	bs := New(fsmock, nsmock, AuditLog(almock))
+
+	auser, _ := auth.NewUser("admin", true)
+	a, _ := nodestore.NewUser(uuid.New(), "admin")
+	old, _ := nodestore.NewUser(uuid.New(), "old")
+	newu, _ := nodestore.NewUser(uuid.New(), "new")
+	other, _ := nodestore.NewUser(uuid.New(), "other")
+	nsmock.On("GetUser", "admin").Return(a, nil)
+	nsmock.On("GetUser", "new").Return(newu, nil)
+	nsmock.On("GetExistingUser", "old").Return(old, nil)
+	nsmock.On("GetExistingUser", "new").Return(newu, nil)
+	nsmock.On("GetUsers", []string{"old"}).Return([]nodestore.User{*old}, nil)
+	nsmock.On("GetUsers", []string{"new"}).Return([]nodestore.User{*newu}, nil)
+
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	tme := time.Now()
+	// owned by the old user
+	n1, _ := nodestore.NewNode(uuid.New(), *old, 12, *md5, tme)
+	n1moved := n1.WithOwner(*newu)
+	// readable by the old user
+	n2, _ := nodestore.NewNode(uuid.New(), *other, 12, *md5, tme, nodestore.Reader(*old))
+	// readable by both users
+	n3, _ := nodestore.NewNode(uuid.New(), *other, 12, *md5, tme, nodestore.Reader(*old),
+		nodestore.Reader(*newu))
+	// deleted while merging
+	n4, _ := nodestore.NewNode(uuid.New(), *other, 12, *md5, tme, nodestore.Reader(*old))
+	for _, n := range []*nodestore.Node{n1, n2, n3} {
+		nsmock.On("GetNode", n.GetID()).Return(n, nil)
+	}
+	nsmock.On("GetNode", n4.GetID()).Return(nil, nodestore.NewNoNodeError("no node"))
+
+	nsmock.On("GetNodesByOwner", *old).Return([]*nodestore.Node{n1}, nil)
+	nsmock.On("ChangeOwner", n1.GetID(), *newu, noVersion).Return(n1moved, nil)
+	nsmock.On("GetNodesByReader", *old).Return([]*nodestore.Node{n1moved, n2, n3, n4}, nil)
+	nsmock.On("AddReaders", n2.GetID(), []nodestore.User{*newu}, noVersion).Return(
+		n2.WithReaders(*newu), nil)
+	for _, n := range []*nodestore.Node{n1moved, n2, n3} {
+		nsmock.On("RemoveReaders", n.GetID(), []nodestore.User{*old}, noVersion).Return(
+			n.WithoutReaders(*old), nil)
+	}
+	almock.On("AddRecord", mock.Anything).Return(nil)
+
+	changes, err := bs.MergeUsers(logrus.WithField("a", "b"), *auser, "  old ", " new  ")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, &UserChanges{Owned: 1, Read: 2}, changes, "incorrect changes")
+	nsmock.AssertNumberOfCalls(t, "ChangeOwner", 1)
+	nsmock.AssertNumberOfCalls(t, "AddReaders", 1)
+	nsmock.AssertNumberOfCalls(t, "RemoveReaders", 3)
+	// one record per node change
+	almock.AssertNumberOfCalls(t, "AddRecord", 5)
+}
+
+func TestMergeUsersIntoNewUser(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	auser, _ := auth.NewUser("admin", true)
+	a, _ := nodestore.NewUser(uuid.New(), "admin")
+	old, _ := nodestore.NewUser(uuid.New(), "old")
+	newu, _ := nodestore.NewUser(uuid.New(), "new")
+	other, _ := nodestore.NewUser(uuid.New(), "other")
+	nsmock.On("GetUser", "admin").Return(a, nil)
+	nsmock.On("GetExistingUser", "old").Return(old, nil)
+	// the new user is created when the node is altered
+	nsmock.On("GetExistingUser", "new").Return(nil, nodestore.NewNoUserError("no user"))
+	nsmock.On("GetUsers", []string{"old"}).Return([]nodestore.User{*old}, nil)
+	nsmock.On("GetUsers", []string{"new"}).Return([]nodestore.User{*newu}, nil)
+
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	n, _ := nodestore.NewNode(uuid.New(), *other, 12, *md5, time.Now(), nodestore.Reader(*old))
+	withnew := n.WithReaders(*newu)
+	nsmock.On("GetNode", n.GetID()).Return(n, nil).Once()
+	nsmock.On("GetNode", n.GetID()).Return(withnew, nil).Once()
+	nsmock.On("GetNodesByOwner", *old).Return([]*nodestore.Node{}, nil)
+	nsmock.On("GetNodesByReader", *old).Return([]*nodestore.Node{n}, nil)
+	nsmock.On("AddReaders", n.GetID(), []nodestore.User{*newu}, noVersion).Return(withnew, nil)
+	nsmock.On("RemoveReaders", n.GetID(), []nodestore.User{*old}, noVersion).Return(
+		withnew.WithoutReaders(*old), nil)
+
+	changes, err := bs.MergeUsers(logrus.WithField("a", "b"), *auser, "old", "new")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, &UserChanges{Owned: 0, Read: 1}, changes, "incorrect changes")
+	nsmock.AssertNumberOfCalls(t, "AddReaders", 1)
+	nsmock.AssertNumberOfCalls(t, "RemoveReaders", 1)
+}
+
+func TestMergeUsersFail(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(fsmock, nsmock)
+
+	admin, _ := auth.NewUser("admin", true)
+	user, _ := auth.NewUser("user", false)
+	readadmin, _ := auth.NewUserWithAdminLevel("readadmin", auth.AdminRead)
+	old, _ := nodestore.NewUser(uuid.New(), "old")
+	newu, _ := nodestore.NewUser(uuid.New(), "new")
+	nsmock.On("GetExistingUser", "nouser").Return(nil, nodestore.NewNoUserError("no user"))
+	nsmock.On("GetExistingUser", "borked").Return(nil, errors.New("borked"))
+	nsmock.On("GetExistingUser", "old").Return(old, nil)
+	nsmock.On("GetExistingUser", "new").Return(newu, nil)
+	nsmock.On("GetNodesByOwner", *old).Return(nil, errors.New("owner borked"))
+
+	type testcase struct {
+		user     *auth.User
+		name     string
+		into     string
+		expected error
+	}
+
+	unauth := NewUnauthorizedError("Only full administrators may merge users")
+	empty := values.NewIllegalInputError("Account names cannot be empty")
+	testcases := []testcase{
+		testcase{user, "old", "new", unauth},
+		testcase{readadmin, "old", "new", unauth},
+		testcase{admin, "  \t ", "new", empty},
+		testcase{admin, "old", "   ", empty},
+		testcase{admin, "old", " old ", values.NewIllegalInputError(
+			"Cannot merge a user into itself")},
+		testcase{admin, "nouser", "new", NewNoUserError("no user")},
+		testcase{admin, "borked", "new", errors.New("borked")},
+		testcase{admin, "old", "borked", errors.New("borked")},
+		testcase{admin, "old", "new", errors.New("owner borked")},
+	}
+
+	for _, tc := range testcases {
+		changes, err := bs.MergeUsers(logrus.WithField("a", "b"), *tc.user, tc.name, tc.into)
+		assert.Nil(t, changes, "expected error")
+		assert.Equal(t, tc.expected, err, "incorrect error")
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+	akmock := new(akmocks.Store)
+	bs := New(fsmock, nsmock, AuditLog(almock), APIKeyStore(akmock))
+
+	auser, _ := auth.NewUser("admin", true)
+	a, _ := nodestore.NewUser(uuid.New(), "admin")
+	purged, _ := nodestore.NewUser(uuid.New(), "purged")
+	other, _ := nodestore.NewUser(uuid.New(), "other")
+	nsmock.On("GetUser", "admin").Return(a, nil)
+	nsmock.On("GetExistingUser", "purged").Return(purged, nil)
+	akmock.On("DeleteKeys", "purged").Return(nil)
+	nsmock.On("GetUsers", []string{"purged"}).Return([]nodestore.User{*purged}, nil)
+
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	tme := time.Now()
+	n1, _ := nodestore.NewNode(
+		uuid.MustParse("f6029a11-0914-42b3-beea-fed420f75d7d"), *purged, 12, *md5, tme)
+	// deleted while purging
+	n2, _ := nodestore.NewNode(uuid.New(), *purged, 12, *md5, tme)
+	n3, _ := nodestore.NewNode(uuid.New(), *other, 12, *md5, tme, nodestore.Reader(*purged))
+	nsmock.On("GetNode", n1.GetID()).Return(n1, nil)
+	nsmock.On("GetNode", n2.GetID()).Return(nil, nodestore.NewNoNodeError("no node"))
+	nsmock.On("GetNode", n3.GetID()).Return(n3, nil)
+
+	nsmock.On("GetNodesByOwner", *purged).Return([]*nodestore.Node{n1, n2}, nil)
+	nsmock.On("DeleteNode", n1.GetID()).Return(nil)
+	nsmock.On("RemoveFileReference", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(
+		true, nil)
+	fsmock.On("DeleteFile", "f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d").Return(nil)
+	nsmock.On("GetNodesByReader", *purged).Return([]*nodestore.Node{n3}, nil)
+	nsmock.On("RemoveReaders", n3.GetID(), []nodestore.User{*purged}, noVersion).Return(
+		n3.WithoutReaders(*purged), nil)
+	almock.On("AddRecord", mock.Anything).Return(nil)
+
+	changes, err := bs.PurgeUser(logrus.WithField("a", "b"), *auser, "  purged  ")
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, &UserChanges{Owned: 1, Read: 1}, changes, "incorrect changes")
+	nsmock.AssertNumberOfCalls(t, "DeleteNode", 1)
+	nsmock.AssertNumberOfCalls(t, "RemoveReaders", 1)
+	akmock.AssertNumberOfCalls(t, "DeleteKeys", 1)
+	almock.AssertNumberOfCalls(t, "AddRecord", 2)
+}
+
+func TestPurgeUserFail(t *testing.T) {
+	fsmock := new(fsmocks.FileStore)
+	nsmock := new(nsmocks.NodeStore)
+	akmock := new(akmocks.Store)
+	bs := New(fsmock, nsmock, APIKeyStore(akmock))
+
+	admin, _ := auth.NewUser("admin", true)
+	user, _ := auth.NewUser("user", false)
+	readadmin, _ := auth.NewUserWithAdminLevel("readadmin", auth.AdminRead)
+	nsmock.On("GetExistingUser", "nouser").Return(nil, nodestore.NewNoUserError("no user"))
+	nsmock.On("GetExistingUser", "borked").Return(nil, errors.New("borked"))
+	k, _ := nodestore.NewUser(uuid.New(), "keysborked")
+	nsmock.On("GetExistingUser", "keysborked").Return(k, nil)
+	akmock.On("DeleteKeys", "keysborked").Return(errors.New("keys borked"))
+	u, _ := nodestore.NewUser(uuid.New(), "user2")
+	nsmock.On("GetExistingUser", "user2").Return(u, nil)
+	akmock.On("DeleteKeys", "user2").Return(nil)
+	nsmock.On("GetNodesByOwner", *u).Return(nil, errors.New("owner borked"))
+
+	type testcase struct {
+		user     *auth.User
+		name     string
+		expected error
+	}
+
+	unauth := NewUnauthorizedError("Only full administrators may purge users")
+	testcases := []testcase{
+		testcase{user, "user2", unauth},
+		testcase{readadmin, "user2", unauth},
+		testcase{admin, "  \t ", values.NewIllegalInputError("Account name cannot be empty")},
+		testcase{admin, "nouser", NewNoUserError("no user")},
+		testcase{admin, "borked", errors.New("borked")},
+		testcase{admin, "keysborked", errors.New("keys borked")},
+		testcase{admin, "user2", errors.New("owner borked")},
+	}
+
+	for _, tc := range testcases {
+		changes, err := bs.PurgeUser(logrus.WithField("a", "b"), *tc.user, tc.name)
+		assert.Nil(t, changes, "expected error")
+		assert.Equal(t, tc.expected, err, "incorrect error")
+	}
+}
+
+func TestGetAuditRecords(t *testing.T) {
+	almock := new(amocks.Log)
+	bs := New(new(fsmocks.FileStore), new(nsmocks.NodeStore), AuditLog(almock))
+
+	nid := uuid.New()
+	params := &audit.Params{Actor: "foo", Limit: 2}
+	recs := []*audit.Record{&audit.Record{Action: audit.ActionDelete, NodeID: nid}}
+	almock.On("GetRecords", params).Return(recs, nil)
+
+	admin, _ := auth.NewUser("admin", true)
+	got, err := bs.GetAuditRecords(*admin, params)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, recs, got, "incorrect records")
+
+	readadmin, _ := auth.NewUserWithAdminLevel("helpdesk", auth.AdminRead)
+	got, err = bs.GetAuditRecords(*readadmin, params)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, recs, got, "incorrect records")
+
+	notadmin, _ := auth.NewUser("notadmin", false)
+	got, err = bs.GetAuditRecords(*notadmin, params)
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, NewUnauthorizedError("Unauthorized"), err, "incorrect error")
+}
+
+func TestGetAuditRecordsFailNoLog(t *testing.T) {
+	bs := New(new(fsmocks.FileStore), new(nsmocks.NodeStore))
+
+	admin, _ := auth.NewUser("admin", true)
+	got, err := bs.GetAuditRecords(*admin, &audit.Params{})
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, errors.New("No audit log is configured"), err, "incorrect error")
+}
+
+func TestGetNodeAuditRecords(t *testing.T) {
+	nsmock := new(nsmocks.NodeStore)
+	almock := new(amocks.Log)
+	bs := New(new(fsmocks.FileStore), nsmock, AuditLog(almock))
+
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	r1, _ := nodestore.NewUser(uuid.New(), "r1")
+	a, _ := nodestore.NewUser(uuid.New(), "admin")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+	nsmock.On("GetUser", "r1").Return(r1, nil)
+	nsmock.On("GetUser", "admin").Return(a, nil)
+	h, _ := nodestore.NewUser(uuid.New(), "helpdesk")
+	nsmock.On("GetUser", "helpdesk").Return(h, nil)
+
+	nid := uuid.New()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now(), nodestore.Reader(*r1))
+	nsmock.On("GetNode", nid).Return(node, nil)
+	recs := []*audit.Record{&audit.Record{Action: audit.ActionCreate, NodeID: nid}}
+	almock.On("GetRecords", &audit.Params{NodeID: &nid, Limit: 10}).Return(recs, nil)
+
+	owner, _ := auth.NewUser("owner", false)
+	got, err := bs.GetNodeAuditRecords(*owner, nid, 10)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, recs, got, "incorrect records")
+
+	admin, _ := auth.NewUser("admin", true)
+	got, err = bs.GetNodeAuditRecords(*admin, nid, 10)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, recs, got, "incorrect records")
+
+	readadmin, _ := auth.NewUserWithAdminLevel("helpdesk", auth.AdminRead)
+	got, err = bs.GetNodeAuditRecords(*readadmin, nid, 10)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, recs, got, "incorrect records")
+
+	reader, _ := auth.NewUser("r1", false)
+	got, err = bs.GetNodeAuditRecords(*reader, nid, 10)
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, NewUnauthorizedError("Unauthorized"), err, "incorrect error")
+}
+
+func TestGetNodeAuditRecordsFailGetNode(t *testing.T) {
+	nsmock := new(nsmocks.NodeStore)
+	bs := New(new(fsmocks.FileStore), nsmock, AuditLog(new(amocks.Log)))
+
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+	nid := uuid.New()
+	nsmock.On("GetNode", nid).Return(nil, nodestore.NewNoNodeError("oh poop"))
+
+	owner, _ := auth.NewUser("owner", false)
+	got, err := bs.GetNodeAuditRecords(*owner, nid, 10)
+	assert.Nil(t, got, "expected error")
+	assert.Equal(t, NewNoBlobError("oh poop"), err, "incorrect error")
+}
+
+func TestGetEvents(t *testing.T) {
+	esmock := new(emocks.Store)
+	bs := New(new(fsmocks.FileStore), new(nsmocks.NodeStore), EventStore(esmock))
+
+	ev := func(seq int64, owner string, readers []string, public bool) *events.Event {
+		return &events.Event{Seq: seq, Type: events.ACLChanged, NodeID: uuid.New(),
+			User: owner, Owner: owner, Readers: readers, Public: public}
+	}
+	owned := ev(3, "u", []string{"u"}, false)
+	shared := ev(4, "o", []string{"o", "u"}, false)
+	public := ev(5, "o", []string{"o"}, true)
+	private := ev(6, "o", []string{"o"}, false)
+	esmock.On("GetEvents", int64(2), 10).Return(
+		[]*events.Event{owned, shared, public, private}, nil)
+	esmock.On("GetEvents", int64(6), 10).Return([]*events.Event{}, nil)
+
+	user, _ := auth.NewUser("u", false)
+	evs, last, err := bs.GetEvents(*user, 2, 10)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*events.Event{owned, shared, public}, evs, "incorrect events")
+	assert.Equal(t, int64(6), last, "incorrect last seq")
+
+	admin, _ := auth.NewUser("a", true)
+	evs, last, err = bs.GetEvents(*admin, 2, 10)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*events.Event{owned, shared, public, private}, evs, "incorrect events")
+	assert.Equal(t, int64(6), last, "incorrect last seq")
+
+	readadmin, _ := auth.NewUserWithAdminLevel("h", auth.AdminRead)
+	evs, last, err = bs.GetEvents(*readadmin, 2, 10)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*events.Event{owned, shared, public, private}, evs, "incorrect events")
+	assert.Equal(t, int64(6), last, "incorrect last seq")
+
+	other, _ := auth.NewUser("x", false)
+	evs, last, err = bs.GetEvents(*other, 2, 10)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*events.Event{public}, evs, "incorrect events")
+	assert.Equal(t, int64(6), last, "incorrect last seq")
+
+	evs, last, err = bs.GetEvents(*user, 6, 10)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, []*events.Event{}, evs, "incorrect events")
+	assert.Equal(t, int64(6), last, "incorrect last seq")
+}
+
+func TestGetEventsFail(t *testing.T) {
+	esmock := new(emocks.Store)
+	bs := New(new(fsmocks.FileStore), new(nsmocks.NodeStore), EventStore(esmock))
+	esmock.On("GetEvents", int64(2), 10).Return(nil, errors.New("events borked"))
+
+	user, _ := auth.NewUser("u", false)
+	evs, last, err := bs.GetEvents(*user, 2, 10)
+	assert.Nil(t, evs, "expected error")
+	assert.Equal(t, int64(-1), last, "incorrect last seq")
+	assert.Equal(t, errors.New("events borked"), err, "incorrect error")
+
+	bs = New(new(fsmocks.FileStore), new(nsmocks.NodeStore))
+	evs, last, err = bs.GetEvents(*user, 2, 10)
+	assert.Nil(t, evs, "expected error")
+	assert.Equal(t, int64(-1), last, "incorrect last seq")
+	assert.Equal(t, errors.New("No event store is configured"), err, "incorrect error")
+}
+
+func TestGetLastEventSeq(t *testing.T) {
+	esmock := new(emocks.Store)
+	bs := New(new(fsmocks.FileStore), new(nsmocks.NodeStore), EventStore(esmock))
+	esmock.On("GetLastSeq").Return(int64(42), nil).Once()
+	esmock.On("GetLastSeq").Return(int64(-1), errors.New("events borked")).Once()
+
+	seq, err := bs.GetLastEventSeq()
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, int64(42), seq, "incorrect seq")
+
+	seq, err = bs.GetLastEventSeq()
+	assert.Equal(t, int64(-1), seq, "incorrect seq")
+	assert.Equal(t, errors.New("events borked"), err, "incorrect error")
+
+	bs = New(new(fsmocks.FileStore), new(nsmocks.NodeStore))
+	seq, err = bs.GetLastEventSeq()
+	assert.Equal(t, int64(-1), seq, "incorrect seq")
+	assert.Equal(t, errors.New("No event store is configured"), err, "incorrect error")
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	nsmock := new(nsmocks.NodeStore)
+	esmock := new(emocks.Store)
+	bs := New(new(fsmocks.FileStore), nsmock, EventStore(esmock))
+
+	o, _ := nodestore.NewUser(uuid.New(), "owner")
+	nsmock.On("GetUser", "owner").Return(o, nil)
+	nid := uuid.New()
+	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	node, _ := nodestore.NewNode(nid, *o, 12, *md5, time.Now())
+	nsmock.On("GetNode", nid).Return(node, nil)
+	nsmock.On("SetNodePublic", nid, true, noVersion).Return(node.WithPublic(true), nil)
+	esmock.On("AddEvent", mock.Anything).Return(nil)
+
+	c1, cancel1 := bs.SubscribeEvents()
+	c2, cancel2 := bs.SubscribeEvents()
+	defer cancel2()
+
+	auser, _ := auth.NewUser("owner", false)
+	le := logrus.WithField("a", "b")
+	// notifications are coalesced
+	for i := 0; i < 2; i++ {
+		_, err := bs.SetNodePublic(le, *auser, nid, true, nil)
+		assert.Nil(t, err, "unexpected error")
+	}
+	for _, c := range []<-chan struct{}{c1, c2} {
+		assert.Equal(t, 1, len(c), "incorrect notification count")
+		<-c
+	}
+
+	cancel1()
+	_, err := bs.SetNodePublic(le, *auser, nid, true, nil)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, 0, len(c1), "incorrect notification count")
+	assert.Equal(t, 1, len(c2), "incorrect notification count")
 }
@@ -2,7 +2,12 @@
 package values
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"regexp"
 	"strings"
 	"unicode"
@@ -14,6 +19,7 @@ const (
 )
 
 var md5regex = regexp.MustCompile("^[a-fA-F0-9]{32}$")
+var sha256regex = regexp.MustCompile("^[a-fA-F0-9]{64}$")
 
 // MD5 contains a valid MD5 string.
 type MD5 struct {
@@ -33,6 +39,82 @@ func (md5 *MD5) GetMD5() string {
 	return md5.md5
 }
 
+// SHA256 contains a valid SHA-256 string.
+type SHA256 struct {
+	sha256 string
+}
+
+// NewSHA256 creates a new SHA256.
+func NewSHA256(sha256 string) (*SHA256, error) {
+	if !sha256regex.MatchString(sha256) {
+		return nil, fmt.Errorf("%v is not a SHA-256 string", sha256)
+	}
+	return &SHA256{sha256}, nil
+}
+
+// GetSHA256 returns the SHA-256 string.
+func (sha256 *SHA256) GetSHA256() string {
+	return sha256.sha256
+}
+
+// Names of the checksum algorithms supported by Checksums.
+const (
+	ChecksumSHA1   = "sha1"
+	ChecksumSHA256 = "sha256"
+	ChecksumCRC32C = "crc32c"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumAlgorithms maps the names of the supported checksum algorithms, other than MD5, to
+// functions that create a hash for the algorithm. Checksums for all these algorithms are
+// calculated when a file is stored. Adding an algorithm here is sufficient to support it
+// throughout the blobstore.
+var ChecksumAlgorithms = map[string]func() hash.Hash{
+	ChecksumSHA1:   sha1.New,
+	ChecksumSHA256: sha256.New,
+	ChecksumCRC32C: func() hash.Hash { return crc32.New(crc32cTable) },
+}
+
+// Checksums is a set of checksums for a file, keyed by algorithm name. The checksums are lower
+// case hex strings. MD5 checksums are stored separately, as every file has an MD5.
+type Checksums struct {
+	checksums map[string]string
+}
+
+// NewChecksums creates a new set of checksums. The algorithms must be in ChecksumAlgorithms
+// and the checksums must be hex strings of the correct length for the algorithm.
+func NewChecksums(checksums map[string]string) (*Checksums, error) {
+	c := map[string]string{}
+	for alg, cs := range checksums {
+		newHash, ok := ChecksumAlgorithms[alg]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported checksum algorithm: %v", alg)
+		}
+		b, err := hex.DecodeString(cs)
+		if err != nil || len(b) != newHash().Size() {
+			return nil, fmt.Errorf("%v is not a %v string", cs, alg)
+		}
+		c[alg] = strings.ToLower(cs)
+	}
+	return &Checksums{c}, nil
+}
+
+// Get returns the checksum for an algorithm, or the empty string if the checksum is not
+// present.
+func (c *Checksums) Get(algorithm string) string {
+	return c.checksums[algorithm]
+}
+
+// GetAll returns a copy of all the checksums, keyed by algorithm.
+func (c *Checksums) GetAll() map[string]string {
+	ret := map[string]string{}
+	for alg, cs := range c.checksums {
+		ret[alg] = cs
+	}
+	return ret
+}
+
 // IllegalInputError denotes that some input was illegal
 type IllegalInputError string
 
@@ -1,6 +1,7 @@
 package values
 
 import (
+	"encoding/hex"
 	"errors"
 	"strings"
 	"testing"
@@ -37,6 +38,95 @@ func TestNewMD5Fail(t *testing.T) {
 	}
 }
 
+func TestNewSHA256(t *testing.T) {
+	for _, m := range []string{
+		"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		"2C26B46B68FFC68FF99B453C1D30413413422D706483BFA0F98A5E886266E7AE",
+		"0123456789abcdefABCDEF01234567890123456789abcdefABCDEF0123456789",
+	} {
+		sha, err := NewSHA256(m)
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, m, sha.GetSHA256(), "incorrect sha256")
+	}
+}
+
+func TestNewSHA256Fail(t *testing.T) {
+	for _, m := range []string{
+		"a",
+		"5d838d477ddf355fc15df1db90bee0aa",
+		"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7a",
+		"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7aea",
+		"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7aX",
+		"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7a-",
+	} {
+		sha, err := NewSHA256(m)
+		assert.Nil(t, sha, "expected error")
+		assert.Equal(t, errors.New(m+" is not a SHA-256 string"), err, "incorrect error")
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	c, err := NewChecksums(map[string]string{})
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, map[string]string{}, c.GetAll(), "incorrect checksums")
+	assert.Equal(t, "", c.Get("sha1"), "incorrect checksum")
+
+	in := map[string]string{
+		"sha1":   "8843D7F92416211DE9EBB963FF4CE28125932878",
+		"sha256": "97df3588b5a3f24babc3851b372f0ba71a9dcdded43b14b9d06961bfc1707d9d",
+		"crc32c": "0a1b2c3d",
+	}
+	c, err = NewChecksums(in)
+	assert.Nil(t, err, "unexpected error")
+	expected := map[string]string{
+		"sha1":   "8843d7f92416211de9ebb963ff4ce28125932878",
+		"sha256": "97df3588b5a3f24babc3851b372f0ba71a9dcdded43b14b9d06961bfc1707d9d",
+		"crc32c": "0a1b2c3d",
+	}
+	assert.Equal(t, expected, c.GetAll(), "incorrect checksums")
+	assert.Equal(t, "8843d7f92416211de9ebb963ff4ce28125932878", c.Get("sha1"),
+		"incorrect checksum")
+
+	// check immutable
+	in["sha1"] = "foo"
+	c.GetAll()["crc32c"] = "bar"
+	assert.Equal(t, expected, c.GetAll(), "incorrect checksums")
+}
+
+func TestChecksumsFail(t *testing.T) {
+	type testcase struct {
+		checksums map[string]string
+		err       string
+	}
+	testcases := []testcase{
+		testcase{map[string]string{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+			"Unsupported checksum algorithm: md5"},
+		testcase{map[string]string{"sha1": "6df23dc03f9b54cc38a0fc1483df6e21"},
+			"6df23dc03f9b54cc38a0fc1483df6e21 is not a sha1 string"},
+		testcase{map[string]string{"crc32c": "0a1b2c3x"}, "0a1b2c3x is not a crc32c string"},
+		testcase{map[string]string{"crc32c": "0a1b2c3"}, "0a1b2c3 is not a crc32c string"},
+	}
+	for _, tc := range testcases {
+		c, err := NewChecksums(tc.checksums)
+		assert.Nil(t, c, "expected error")
+		assert.Equal(t, errors.New(tc.err), err, "incorrect error")
+	}
+}
+
+func TestChecksumAlgorithms(t *testing.T) {
+	expected := map[string]string{
+		"sha1":   "5f5513f8822fdbe5145af33b64d8d970dcf95c6e",
+		"sha256": "97df3588b5a3f24babc3851b372f0ba71a9dcdded43b14b9d06961bfc1707d9d",
+		"crc32c": "8636640e",
+	}
+	assert.Equal(t, len(expected), len(ChecksumAlgorithms), "incorrect algorithm count")
+	for alg, exp := range expected {
+		h := ChecksumAlgorithms[alg]()
+		h.Write([]byte("foobarbaz"))
+		assert.Equal(t, exp, hex.EncodeToString(h.Sum(nil)), "incorrect checksum")
+	}
+}
+
 func TestIllegalInputError(t *testing.T) {
 	i := NewIllegalInputError("bad input")
 	assert.Equal(t, "bad input", i.Error(), "incorrect error")
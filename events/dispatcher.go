@@ -0,0 +1,275 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HeaderSignature is the HTTP header containing the HMAC-SHA256 signature of the request
+	// body, in the form sha256=<hex encoded signature>. The signature is keyed with the
+	// webhook secret.
+	HeaderSignature = "X-Blobstore-Signature"
+	// HeaderEvent is the HTTP header containing the event type.
+	HeaderEvent = "X-Blobstore-Event"
+	// HeaderDelivery is the HTTP header containing the event sequence number, which may be
+	// used to detect duplicate deliveries.
+	HeaderDelivery = "X-Blobstore-Delivery"
+
+	defaultInterval    = time.Second
+	defaultTimeout     = 30 * time.Second
+	defaultMinBackoff  = 5 * time.Second
+	defaultMaxBackoff  = time.Hour
+	defaultMaxAttempts = 15
+	// deliveries are claimed one at a time, so the lease only needs to outlast one request.
+	defaultLease = 2 * defaultTimeout
+)
+
+// Webhook is an HTTP endpoint to which events are delivered.
+type Webhook struct {
+	// Name is the name of the webhook.
+	Name string
+	// URL is the URL to which events will be POSTed.
+	URL url.URL
+	// Secret is the key used to sign events delivered to the webhook.
+	Secret string
+}
+
+// Dispatcher delivers events from an outbox to webhooks. Failed deliveries are retried with
+// exponential backoff until a maximum number of attempts is reached.
+type Dispatcher struct {
+	store       Store
+	hooks       map[string]Webhook
+	client      *http.Client
+	interval    time.Duration
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+	now         func() time.Time
+	stop        chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// Backoff is an option for NewDispatcher that sets the minimum and maximum wait between
+// delivery attempts. The wait doubles after each failed attempt.
+func Backoff(min time.Duration, max time.Duration) func(*Dispatcher) error {
+	return func(d *Dispatcher) error {
+		if min < time.Millisecond || max < min {
+			return errors.New("backoff minimum must be at least 1ms and <= the maximum")
+		}
+		d.minBackoff = min
+		d.maxBackoff = max
+		return nil
+	}
+}
+
+// MaxAttempts is an option for NewDispatcher that sets the maximum number of delivery attempts
+// before a delivery is abandoned.
+func MaxAttempts(attempts int) func(*Dispatcher) error {
+	return func(d *Dispatcher) error {
+		if attempts < 1 {
+			return errors.New("attempts must be > 0")
+		}
+		d.maxAttempts = attempts
+		return nil
+	}
+}
+
+// PollInterval is an option for NewDispatcher that sets how often the outbox is checked for
+// deliveries.
+func PollInterval(interval time.Duration) func(*Dispatcher) error {
+	return func(d *Dispatcher) error {
+		if interval < time.Millisecond {
+			return errors.New("interval must be at least 1ms")
+		}
+		d.interval = interval
+		return nil
+	}
+}
+
+// NewDispatcher creates a new dispatcher. Call Start() to start delivering events.
+func NewDispatcher(store Store, hooks []Webhook, options ...func(*Dispatcher) error,
+) (*Dispatcher, error) {
+	if store == nil {
+		return nil, errors.New("store cannot be nil")
+	}
+	hookmap := map[string]Webhook{}
+	for _, h := range hooks {
+		if strings.TrimSpace(h.Name) == "" {
+			return nil, errors.New("webhook names cannot be empty or whitespace only")
+		}
+		if !h.URL.IsAbs() {
+			return nil, fmt.Errorf("url for webhook %s must be absolute", h.Name)
+		}
+		if h.Secret == "" {
+			return nil, fmt.Errorf("secret for webhook %s cannot be empty", h.Name)
+		}
+		hookmap[h.Name] = h
+	}
+	d := &Dispatcher{
+		store:       store,
+		hooks:       hookmap,
+		client:      &http.Client{Timeout: defaultTimeout},
+		interval:    defaultInterval,
+		minBackoff:  defaultMinBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		maxAttempts: defaultMaxAttempts,
+		now:         time.Now,
+		ctx:         context.Background(),
+	}
+	for _, option := range options {
+		if err := option(d); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Start starts delivering events in the background.
+func (d *Dispatcher) Start() {
+	d.stop = make(chan struct{})
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.deliverPending(logrus.WithField("service", "BlobStoreEvents"))
+			}
+		}
+	}()
+}
+
+// Stop stops delivering events, cancelling any in progress delivery, and waits for the
+// dispatcher to finish. Cancelled deliveries are attempted again once their claim expires.
+// Stop does nothing if the dispatcher has not been started.
+func (d *Dispatcher) Stop() {
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	d.cancel()
+	d.wg.Wait()
+	d.stop = nil
+}
+
+// deliverPending attempts all due deliveries, returning the number of deliveries attempted.
+func (d *Dispatcher) deliverPending(le *logrus.Entry) int {
+	count := 0
+	for {
+		select {
+		case <-d.stop:
+			return count
+		default:
+		}
+		// claim one at a time so the lease can't expire while other deliveries are attempted
+		ds, err := d.store.ClaimDeliveries(defaultLease, 1)
+		if err != nil {
+			le.WithField("error", err.Error()).Error("could not claim event deliveries")
+			return count
+		}
+		if len(ds) == 0 {
+			return count
+		}
+		d.deliver(le, ds[0])
+		count++
+	}
+}
+
+func (d *Dispatcher) deliver(le *logrus.Entry, dv *Delivery) {
+	le = le.WithFields(logrus.Fields{"hook": dv.Hook, "seq": dv.Event.Seq})
+	var err error
+	hook, ok := d.hooks[dv.Hook]
+	if ok {
+		err = d.post(hook, dv.Event)
+	} else {
+		err = errors.New("no such webhook")
+	}
+	if err != nil && d.ctx.Err() != nil {
+		// the dispatcher is stopping. Don't count the attempt against the delivery.
+		le.WithField("error", err.Error()).Warn("event delivery cancelled")
+		return
+	}
+	if err == nil {
+		err = d.store.CompleteDelivery(dv)
+		if err != nil {
+			le.WithField("error", err.Error()).Error("could not complete event delivery")
+		}
+		return
+	}
+	le = le.WithFields(logrus.Fields{"error": err.Error(), "attempt": dv.Attempts + 1})
+	if !ok || dv.Attempts+1 >= d.maxAttempts {
+		le.Error("abandoning event delivery")
+		err = d.store.AbandonDelivery(dv)
+	} else {
+		le.Warn("event delivery failed, retrying later")
+		err = d.store.RetryDelivery(dv, d.now().Add(d.backoff(dv.Attempts)))
+	}
+	if err != nil {
+		le.WithField("error", err.Error()).Error("could not update event delivery")
+	}
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.minBackoff
+	for i := 0; i < attempts && b < d.maxBackoff; i++ {
+		b *= 2
+	}
+	if b > d.maxBackoff {
+		return d.maxBackoff
+	}
+	return b
+}
+
+func (d *Dispatcher) post(hook Webhook, ev *Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err // can't happen
+	}
+	req, _ := http.NewRequest(http.MethodPost, hook.URL.String(), bytes.NewReader(body))
+	req = req.WithContext(d.ctx)
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set(HeaderSignature, "sha256="+Sign(hook.Secret, body))
+	req.Header.Set(HeaderEvent, string(ev.Type))
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(ev.Seq, 10))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 10000))
+	if res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a request body keyed with a secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,352 @@
+package events
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore is an in memory outbox. The mocks package can't be used here due to an import cycle.
+type fakeStore struct {
+	pending   []*Delivery
+	completed []*Delivery
+	retried   map[*Delivery]time.Time
+	abandoned []*Delivery
+	claimErr  error
+	limits    []int
+	// if not nil, closed when a delivery is completed
+	done chan struct{}
+}
+
+func newFakeStore(ds ...*Delivery) *fakeStore {
+	return &fakeStore{pending: ds, retried: map[*Delivery]time.Time{}}
+}
+
+func (s *fakeStore) AddEvent(ev *Event) error {
+	return errors.New("not implemented")
+}
+
+func (s *fakeStore) GetEvents(after int64, limit int) ([]*Event, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeStore) GetLastSeq() (int64, error) {
+	return -1, errors.New("not implemented")
+}
+
+func (s *fakeStore) ClaimDeliveries(lease time.Duration, limit int) ([]*Delivery, error) {
+	s.limits = append(s.limits, limit)
+	if s.claimErr != nil {
+		return nil, s.claimErr
+	}
+	if limit > len(s.pending) {
+		limit = len(s.pending)
+	}
+	ds := s.pending[:limit]
+	s.pending = s.pending[limit:]
+	return ds, nil
+}
+
+func (s *fakeStore) CompleteDelivery(d *Delivery) error {
+	s.completed = append(s.completed, d)
+	if s.done != nil {
+		close(s.done)
+	}
+	return nil
+}
+
+func (s *fakeStore) RetryDelivery(d *Delivery, next time.Time) error {
+	s.retried[d] = next
+	return nil
+}
+
+func (s *fakeStore) AbandonDelivery(d *Delivery) error {
+	s.abandoned = append(s.abandoned, d)
+	return nil
+}
+
+func testEvent() *Event {
+	nid, _ := uuid.Parse("f6029a11-0914-42b3-beea-fed420f75d7d")
+	return &Event{
+		Seq:     42,
+		Time:    time.Date(2019, 6, 1, 12, 30, 45, 123000000, time.UTC),
+		Type:    ACLChanged,
+		NodeID:  nid,
+		User:    "someuser",
+		Owner:   "owner",
+		Readers: []string{"owner", "someuser"},
+		Public:  true,
+	}
+}
+
+func testLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logrus.NewEntry(logger)
+}
+
+func hook(name string, rawurl string) Webhook {
+	u, _ := url.Parse(rawurl)
+	return Webhook{Name: name, URL: *u, Secret: "sooporsekrit"}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	ev := testEvent()
+	b, err := ev.MarshalJSON()
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, `{"acl":{"owner":"owner","public":true,"read":["owner","someuser"]},`+
+		`"node":"f6029a11-0914-42b3-beea-fed420f75d7d","seq":42,"source":null,`+
+		`"time":"2019-06-01T12:30:45.123Z","type":"node.acl_changed","user":"someuser"}`,
+		string(b), "incorrect json")
+
+	src, _ := uuid.Parse("b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1")
+	ev = &Event{Seq: 1, Time: ev.Time, Type: NodeCopied, NodeID: ev.NodeID,
+		SourceNodeID: &src, User: "u", Owner: "u"}
+	b, err = ev.MarshalJSON()
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, `{"acl":{"owner":"u","public":false,"read":[]},`+
+		`"node":"f6029a11-0914-42b3-beea-fed420f75d7d","seq":1,`+
+		`"source":"b6f2d8b7-429e-4639-b2d9-c619e4e9f4e1",`+
+		`"time":"2019-06-01T12:30:45.123Z","type":"node.copied","user":"u"}`,
+		string(b), "incorrect json")
+}
+
+func TestClaimExpiredError(t *testing.T) {
+	assert.Equal(t, "foo", NewClaimExpiredError("foo").Error(), "incorrect error")
+}
+
+func TestSign(t *testing.T) {
+	// generated with python hmac.new(b'secret', b'body', hashlib.sha256).hexdigest()
+	assert.Equal(t, "dc46983557fea127b43af721467eb9b3fde2338fe3e14f51952aa8478c13d355",
+		Sign("secret", []byte("body")), "incorrect signature")
+}
+
+func TestNewDispatcherFail(t *testing.T) {
+	s := newFakeStore()
+	good := hook("h", "https://example.com/hook")
+	rel := hook("r", "/hook")
+	nosec := hook("s", "https://example.com/hook")
+	nosec.Secret = ""
+
+	tc := []struct {
+		store Store
+		hooks []Webhook
+		opts  []func(*Dispatcher) error
+		err   error
+	}{
+		{nil, nil, nil, errors.New("store cannot be nil")},
+		{s, []Webhook{good, hook("  \t ", "https://example.com")}, nil,
+			errors.New("webhook names cannot be empty or whitespace only")},
+		{s, []Webhook{good, rel}, nil, errors.New("url for webhook r must be absolute")},
+		{s, []Webhook{nosec}, nil, errors.New("secret for webhook s cannot be empty")},
+		{s, nil, []func(*Dispatcher) error{Backoff(time.Microsecond, time.Second)},
+			errors.New("backoff minimum must be at least 1ms and <= the maximum")},
+		{s, nil, []func(*Dispatcher) error{Backoff(2*time.Second, time.Second)},
+			errors.New("backoff minimum must be at least 1ms and <= the maximum")},
+		{s, nil, []func(*Dispatcher) error{MaxAttempts(0)},
+			errors.New("attempts must be > 0")},
+		{s, nil, []func(*Dispatcher) error{PollInterval(time.Microsecond)},
+			errors.New("interval must be at least 1ms")},
+	}
+	for _, c := range tc {
+		d, err := NewDispatcher(c.store, c.hooks, c.opts...)
+		assert.Nil(t, d, "expected error")
+		assert.Equal(t, c.err, err, "incorrect error")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d, err := NewDispatcher(newFakeStore(), nil, Backoff(time.Second, 10*time.Second))
+	assert.Nil(t, err, "unexpected error")
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		10 * time.Second, 10 * time.Second}
+	for i, e := range expected {
+		assert.Equal(t, e, d.backoff(i), "incorrect backoff")
+	}
+	assert.Equal(t, 10*time.Second, d.backoff(1000), "incorrect backoff")
+}
+
+func TestDeliver(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer serv.Close()
+
+	dv := &Delivery{Event: testEvent(), Hook: "h", Attempts: 3}
+	s := newFakeStore(dv)
+	d, err := NewDispatcher(s, []Webhook{hook("h", serv.URL+"/hook")})
+	assert.Nil(t, err, "unexpected error")
+
+	assert.Equal(t, 1, d.deliverPending(testLogger()), "incorrect count")
+	assert.Equal(t, []*Delivery{dv}, s.completed, "incorrect completions")
+	assert.Equal(t, 0, len(s.retried), "unexpected retries")
+	assert.Equal(t, 0, len(s.abandoned), "unexpected abandons")
+
+	expectedBody, _ := testEvent().MarshalJSON()
+	assert.Equal(t, http.MethodPost, req.Method, "incorrect method")
+	assert.Equal(t, "/hook", req.URL.Path, "incorrect path")
+	assert.Equal(t, string(expectedBody), string(body), "incorrect body")
+	assert.Equal(t, "application/json", req.Header.Get("content-type"), "incorrect type")
+	assert.Equal(t, "node.acl_changed", req.Header.Get(HeaderEvent), "incorrect event")
+	assert.Equal(t, "42", req.Header.Get(HeaderDelivery), "incorrect delivery")
+	assert.Equal(t, "sha256="+Sign("sooporsekrit", expectedBody),
+		req.Header.Get(HeaderSignature), "incorrect signature")
+}
+
+func TestDeliverRetry(t *testing.T) {
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer serv.Close()
+
+	dv := &Delivery{Event: testEvent(), Hook: "h", Attempts: 2}
+	dv2 := &Delivery{Event: testEvent(), Hook: "h", Attempts: 0}
+	s := newFakeStore(dv, dv2)
+	d, err := NewDispatcher(s, []Webhook{hook("h", serv.URL)}, Backoff(time.Second, time.Hour))
+	assert.Nil(t, err, "unexpected error")
+	tme := time.Date(2019, 6, 1, 12, 30, 45, 0, time.UTC)
+	d.now = func() time.Time { return tme }
+
+	assert.Equal(t, 2, d.deliverPending(testLogger()), "incorrect count")
+	assert.Equal(t, 0, len(s.completed), "unexpected completions")
+	assert.Equal(t, map[*Delivery]time.Time{
+		dv:  tme.Add(4 * time.Second),
+		dv2: tme.Add(time.Second),
+	}, s.retried, "incorrect retries")
+	assert.Equal(t, 0, len(s.abandoned), "unexpected abandons")
+}
+
+func TestDeliverAbandon(t *testing.T) {
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer serv.Close()
+
+	maxed := &Delivery{Event: testEvent(), Hook: "h", Attempts: 4}
+	nohook := &Delivery{Event: testEvent(), Hook: "gone", Attempts: 0}
+	s := newFakeStore(maxed, nohook)
+	d, err := NewDispatcher(s, []Webhook{hook("h", serv.URL)}, MaxAttempts(5))
+	assert.Nil(t, err, "unexpected error")
+
+	assert.Equal(t, 2, d.deliverPending(testLogger()), "incorrect count")
+	assert.Equal(t, 0, len(s.completed), "unexpected completions")
+	assert.Equal(t, 0, len(s.retried), "unexpected retries")
+	assert.Equal(t, []*Delivery{maxed, nohook}, s.abandoned, "incorrect abandons")
+}
+
+func TestDeliverPendingOneAtATime(t *testing.T) {
+	count := 0
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+	}))
+	defer serv.Close()
+
+	ds := []*Delivery{}
+	for i := 0; i < 3; i++ {
+		ds = append(ds, &Delivery{Event: testEvent(), Hook: "h"})
+	}
+	s := newFakeStore(ds...)
+	d, err := NewDispatcher(s, []Webhook{hook("h", serv.URL)})
+	assert.Nil(t, err, "unexpected error")
+
+	assert.Equal(t, 3, d.deliverPending(testLogger()), "incorrect count")
+	assert.Equal(t, 3, count, "incorrect request count")
+	assert.Equal(t, ds, s.completed, "incorrect completions")
+	assert.Equal(t, []int{1, 1, 1, 1}, s.limits, "incorrect claim limits")
+	assert.True(t, defaultLease > defaultTimeout, "lease must outlast a delivery attempt")
+}
+
+func TestDeliverPendingFailClaim(t *testing.T) {
+	s := newFakeStore()
+	s.claimErr = errors.New("claim borked")
+	d, err := NewDispatcher(s, nil)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, 0, d.deliverPending(testLogger()), "incorrect count")
+}
+
+func TestStartStop(t *testing.T) {
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer serv.Close()
+
+	s := newFakeStore(&Delivery{Event: testEvent(), Hook: "h"})
+	s.done = make(chan struct{})
+	d, err := NewDispatcher(s, []Webhook{hook("h", serv.URL)}, PollInterval(time.Millisecond))
+	assert.Nil(t, err, "unexpected error")
+	d.Start()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+	d.Stop()
+	assert.Equal(t, 1, len(s.completed), "incorrect completions")
+	d.Stop() // stopping twice is a no-op
+}
+
+func TestStopDuringDelivery(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer serv.Close()
+	defer close(release)
+
+	dv := &Delivery{Event: testEvent(), Hook: "h"}
+	dv2 := &Delivery{Event: testEvent(), Hook: "h"}
+	s := newFakeStore(dv, dv2)
+	d, err := NewDispatcher(s, []Webhook{hook("h", serv.URL)}, PollInterval(time.Millisecond))
+	assert.Nil(t, err, "unexpected error")
+	d.Start()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the dispatcher to stop")
+	}
+	// the cancelled delivery is left for its claim to expire and the next is never claimed
+	assert.Equal(t, 0, len(s.completed), "unexpected completions")
+	assert.Equal(t, 0, len(s.retried), "unexpected retries")
+	assert.Equal(t, 0, len(s.abandoned), "unexpected abandons")
+	assert.Equal(t, []*Delivery{dv2}, s.pending, "incorrect pending deliveries")
+}
+
+func TestDeliverPendingStopped(t *testing.T) {
+	s := newFakeStore(&Delivery{Event: testEvent(), Hook: "h"})
+	d, err := NewDispatcher(s, nil)
+	assert.Nil(t, err, "unexpected error")
+	d.stop = make(chan struct{})
+	close(d.stop)
+	assert.Equal(t, 0, d.deliverPending(testLogger()), "incorrect count")
+	assert.Equal(t, []int(nil), s.limits, "unexpected claims")
+}
+
+func TestStopNotStarted(t *testing.T) {
+	d, err := NewDispatcher(newFakeStore(), nil)
+	assert.Nil(t, err, "unexpected error")
+	d.Stop() // expect no panic
+}
@@ -0,0 +1,157 @@
+// Package events contains notifications of changes to blobstore nodes and the means to deliver
+// them to webhooks.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Type is the type of an event.
+type Type string
+
+const (
+	// NodeCreated denotes a node was created from an uploaded file.
+	NodeCreated Type = "node.created"
+	// NodeCopied denotes a node was created by copying another node.
+	NodeCopied Type = "node.copied"
+	// NodeDeleted denotes a node was deleted.
+	NodeDeleted Type = "node.deleted"
+	// ACLChanged denotes a node's read ACL or public flag was changed.
+	ACLChanged Type = "node.acl_changed"
+	// OwnerChanged denotes a node's owner was changed.
+	OwnerChanged Type = "node.owner_changed"
+	// FileMetadataChanged denotes a node's filename or format was changed.
+	FileMetadataChanged Type = "node.file_metadata_changed"
+)
+
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// Event is a notification that a node has changed.
+type Event struct {
+	// Seq is the sequence number of the event. It is assigned by the event store and increases
+	// monotonically.
+	Seq int64
+	// Time is the time the event occurred. It is assigned by the event store.
+	Time time.Time
+	// Type is the type of the event.
+	Type Type
+	// NodeID is the ID of the node that changed.
+	NodeID uuid.UUID
+	// SourceNodeID is the ID of the node from which the node was copied. Only present for
+	// NodeCopied events.
+	SourceNodeID *uuid.UUID
+	// User is the account name of the user that made the change.
+	User string
+	// Owner is the account name of the node's owner after the change, or before the change for
+	// NodeDeleted events.
+	Owner string
+	// Readers are the account names of the users in the node's read ACL after the change, or
+	// before the change for NodeDeleted events.
+	Readers []string
+	// Public is whether the node is publicly readable after the change, or before the change
+	// for NodeDeleted events.
+	Public bool
+}
+
+// MarshalJSON marshals the event to JSON. This is the format in which events are delivered.
+func (e *Event) MarshalJSON() ([]byte, error) {
+	var source interface{}
+	if e.SourceNodeID != nil {
+		source = e.SourceNodeID.String()
+	}
+	readers := e.Readers
+	if readers == nil {
+		readers = []string{}
+	}
+	return json.Marshal(map[string]interface{}{
+		"seq":    e.Seq,
+		"time":   e.Time.UTC().Format(timeFormat),
+		"type":   string(e.Type),
+		"node":   e.NodeID.String(),
+		"source": source,
+		"user":   e.User,
+		"acl": map[string]interface{}{
+			"owner":  e.Owner,
+			"read":   readers,
+			"public": e.Public,
+		},
+	})
+}
+
+// Delivery is a pending delivery of an event to a webhook.
+type Delivery struct {
+	// Event is the event to be delivered.
+	Event *Event
+	// Hook is the name of the webhook to which the event is to be delivered.
+	Hook string
+	// Attempts is the number of prior failed attempts to deliver the event.
+	Attempts int
+	// Claim is the token identifying the claim on the delivery. It is set by the store when
+	// the delivery is claimed.
+	Claim string
+}
+
+// ClaimExpiredError is returned when a delivery is updated by a claimant whose lease on the
+// delivery has expired and which may have been claimed by another claimant.
+type ClaimExpiredError string
+
+// NewClaimExpiredError creates a new ClaimExpiredError.
+func NewClaimExpiredError(err string) *ClaimExpiredError {
+	e := ClaimExpiredError(err)
+	return &e
+}
+
+func (e *ClaimExpiredError) Error() string {
+	return string(*e)
+}
+
+// Store stores events and acts as an outbox for deliveries of the events to webhooks.
+type Store interface {
+	// AddEvent stores an event and queues it for delivery to each of the webhooks configured
+	// for the store. The event's sequence number and time are set by the store.
+	AddEvent(ev *Event) error
+	// GetEvents gets up to limit events with sequence numbers greater than after, in sequence
+	// order. Events following a sequence number whose event has not yet been stored are not
+	// returned until the event is stored or the store assumes it has been lost, so that
+	// callers paging through events by sequence number don't skip events.
+	GetEvents(after int64, limit int) ([]*Event, error)
+	// GetLastSeq gets the sequence number of the most recently added event, or 0 if there are
+	// no events.
+	GetLastSeq() (int64, error)
+	// ClaimDeliveries claims up to limit deliveries that are due for an attempt, oldest first.
+	// A claimed delivery cannot be claimed again until the lease expires, at which point it is
+	// assumed that the claimant failed. Each claim is given a new claim token.
+	ClaimDeliveries(lease time.Duration, limit int) ([]*Delivery, error)
+	// CompleteDelivery removes a successful delivery from the outbox.
+	// Returns ClaimExpiredError if the delivery has been claimed again since it was claimed.
+	CompleteDelivery(d *Delivery) error
+	// RetryDelivery reschedules a failed delivery for another attempt at the given time and
+	// increments the number of attempts.
+	// Returns ClaimExpiredError if the delivery has been claimed again since it was claimed.
+	RetryDelivery(d *Delivery, next time.Time) error
+	// AbandonDelivery marks a delivery as permanently failed. It will not be claimed again,
+	// but remains in the outbox for inspection.
+	// Returns ClaimExpiredError if the delivery has been claimed again since it was claimed.
+	AbandonDelivery(d *Delivery) error
+}
+
+func checkEvent(ev *Event) error {
+	if ev == nil {
+		return errors.New("event cannot be nil")
+	}
+	if ev.Type == "" {
+		return errors.New("event type cannot be empty")
+	}
+	return nil
+}
+
+func checkDelivery(d *Delivery) error {
+	if d == nil || d.Event == nil {
+		return errors.New("delivery and delivery event cannot be nil")
+	}
+	return nil
+}
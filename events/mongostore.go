@@ -0,0 +1,377 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	colSequence    = "eventseq"
+	keySequenceID  = "_id"
+	valSequenceID  = "events"
+	keySequenceSeq = "seq"
+
+	colEvents       = "events"
+	keyEventSeq     = "seq"
+	keyEventTime    = "time"
+	keyEventType    = "type"
+	keyEventNode    = "node"
+	keyEventSource  = "src"
+	keyEventUser    = "user"
+	keyEventOwner   = "own"
+	keyEventReaders = "read"
+	keyEventPublic  = "pub"
+
+	colOutbox         = "outbox"
+	keyOutboxSeq      = "seq"
+	keyOutboxHook     = "hook"
+	keyOutboxAttempts = "att"
+	keyOutboxNext     = "next"
+	keyOutboxFailed   = "fail"
+	keyOutboxEvent    = "ev"
+	keyOutboxClaim    = "claim"
+
+	// how long to wait for an event with a missing sequence number to be stored before
+	// assuming the writer failed and returning later events.
+	seqGapTimeout = 30 * time.Second
+)
+
+// MongoStore is an event store and outbox using Mongo as the underlying database.
+type MongoStore struct {
+	db    *mongo.Database
+	hooks []string
+	now   func() time.Time
+}
+
+// NewMongoStore creates a new event store given a MongoDB database for storing events and the
+// names of the webhooks to which events should be delivered. The webhook list may be empty, in
+// which case events are stored but not queued for delivery.
+func NewMongoStore(db *mongo.Database, hooks ...string) (*MongoStore, error) {
+	if db == nil {
+		return nil, errors.New("db cannot be nil")
+	}
+	for _, h := range hooks {
+		if strings.TrimSpace(h) == "" {
+			return nil, errors.New("webhook names cannot be empty or whitespace only")
+		}
+	}
+	err := addIndex(db.Collection(colEvents), bson.D{{Key: keyEventSeq, Value: 1}}, true)
+	if err != nil {
+		return nil, err
+	}
+	err = addIndex(db.Collection(colOutbox),
+		bson.D{{Key: keyOutboxSeq, Value: 1}, {Key: keyOutboxHook, Value: 1}}, true)
+	if err != nil {
+		return nil, err // hard to test
+	}
+	err = addIndex(db.Collection(colOutbox), bson.D{{Key: keyOutboxNext, Value: 1}}, false)
+	if err != nil {
+		return nil, err // hard to test
+	}
+	return &MongoStore{db: db, hooks: hooks, now: time.Now}, nil
+}
+
+func addIndex(col *mongo.Collection, keys bson.D, unique bool) error {
+	mdl := mongo.IndexModel{Keys: keys, Options: &options.IndexOptions{Unique: &unique}}
+	_, err := col.Indexes().CreateOne(context.Background(), mdl, nil)
+	if err != nil {
+		return errors.New("mongo create index: " + err.Error())
+	}
+	return nil
+}
+
+// AddEvent stores an event and queues it for delivery to each of the webhooks configured
+// for the store. The event's sequence number and time are set by the store.
+// The deliveries are queued before the event is stored, so a failure between the two writes
+// can't lose the deliveries. Instead the event is missing from the event stream, which treats
+// it as lost once the sequence gap times out.
+func (s *MongoStore) AddEvent(ev *Event) error {
+	if err := checkEvent(ev); err != nil {
+		return err
+	}
+	seq, err := s.nextSeq()
+	if err != nil {
+		return err
+	}
+	ev.Seq = seq
+	// mongo only stores milliseconds
+	ev.Time = s.now().UTC().Truncate(time.Millisecond)
+	evdoc := toEventDoc(ev)
+	if len(s.hooks) > 0 {
+		deliveries := []interface{}{}
+		for _, h := range s.hooks {
+			deliveries = append(deliveries, map[string]interface{}{
+				keyOutboxSeq:      ev.Seq,
+				keyOutboxHook:     h,
+				keyOutboxAttempts: int64(0),
+				keyOutboxNext:     ev.Time,
+				keyOutboxFailed:   false,
+				keyOutboxEvent:    evdoc,
+			})
+		}
+		_, err = s.db.Collection(colOutbox).InsertMany(nil, deliveries)
+		if err != nil {
+			// dunno how to test this
+			return errors.New("mongo events queue deliveries: " + err.Error())
+		}
+	}
+	_, err = s.db.Collection(colEvents).InsertOne(nil, evdoc)
+	if err != nil {
+		return errors.New("mongo events add event: " + err.Error())
+	}
+	return nil
+}
+
+func (s *MongoStore) nextSeq() (int64, error) {
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	res := s.db.Collection(colSequence).FindOneAndUpdate(nil,
+		map[string]interface{}{keySequenceID: valSequenceID},
+		map[string]interface{}{"$inc": map[string]interface{}{keySequenceSeq: int64(1)}},
+		opts)
+	var doc map[string]interface{}
+	if err := res.Decode(&doc); err != nil {
+		// dunno how to test this
+		return -1, errors.New("mongo events increment sequence: " + err.Error())
+	}
+	return toInt64(doc[keySequenceSeq]), nil
+}
+
+// GetEvents gets up to limit events with sequence numbers greater than after, in sequence
+// order. Since sequence numbers are assigned before events are stored, an event may become
+// visible after an event with a greater sequence number. To avoid skipping such events, events
+// after a missing sequence number are not returned until the missing event is stored or
+// a timeout elapses, at which point the event is assumed to have been lost.
+func (s *MongoStore) GetEvents(after int64, limit int) ([]*Event, error) {
+	if limit < 1 {
+		return nil, errors.New("limit must be > 0")
+	}
+	opts := options.Find().SetSort(map[string]int{keyEventSeq: 1}).SetLimit(int64(limit))
+	cur, err := s.db.Collection(colEvents).Find(nil,
+		map[string]interface{}{keyEventSeq: map[string]interface{}{"$gt": after}}, opts)
+	if err != nil {
+		return nil, errors.New("mongo events get events: " + err.Error()) // dunno how to test this
+	}
+	defer cur.Close(context.Background())
+	evs := []*Event{}
+	for cur.Next(context.Background()) {
+		var doc map[string]interface{}
+		if err := cur.Decode(&doc); err != nil {
+			// dunno how to test this
+			return nil, errors.New("mongo events decode event: " + err.Error())
+		}
+		evs = append(evs, toEvent(doc))
+	}
+	if err := cur.Err(); err != nil {
+		return nil, errors.New("mongo events iterate events: " + err.Error()) // or this
+	}
+	return s.truncateAtGap(after, evs), nil
+}
+
+// truncateAtGap removes events following a missing sequence number that may not yet be stored.
+func (s *MongoStore) truncateAtGap(after int64, evs []*Event) []*Event {
+	cutoff := s.now().Add(-seqGapTimeout)
+	for i, ev := range evs {
+		// the event time is set after the sequence number is assigned, so if the writer of the
+		// missing event hasn't stored it by now it never will
+		if ev.Seq != after+1 && ev.Time.After(cutoff) {
+			return evs[:i]
+		}
+		after = ev.Seq
+	}
+	return evs
+}
+
+// GetLastSeq gets the sequence number of the most recently added event, or 0 if there are
+// no events.
+func (s *MongoStore) GetLastSeq() (int64, error) {
+	res := s.db.Collection(colSequence).FindOne(nil,
+		map[string]interface{}{keySequenceID: valSequenceID})
+	var doc map[string]interface{}
+	if err := res.Decode(&doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		// dunno how to test this
+		return -1, errors.New("mongo events get sequence: " + err.Error())
+	}
+	return toInt64(doc[keySequenceSeq]), nil
+}
+
+func toEventDoc(ev *Event) bson.D {
+	readers := ev.Readers
+	if readers == nil {
+		readers = []string{}
+	}
+	var src interface{}
+	if ev.SourceNodeID != nil {
+		src = ev.SourceNodeID.String()
+	}
+	return bson.D{
+		{Key: keyEventSeq, Value: ev.Seq},
+		{Key: keyEventTime, Value: ev.Time},
+		{Key: keyEventType, Value: string(ev.Type)},
+		{Key: keyEventNode, Value: ev.NodeID.String()},
+		{Key: keyEventSource, Value: src},
+		{Key: keyEventUser, Value: ev.User},
+		{Key: keyEventOwner, Value: ev.Owner},
+		{Key: keyEventReaders, Value: readers},
+		{Key: keyEventPublic, Value: ev.Public},
+	}
+}
+
+func toEvent(doc map[string]interface{}) *Event {
+	// errors must be nil unless the db is corrupt
+	nid, _ := uuid.Parse(doc[keyEventNode].(string))
+	readers := []string{}
+	for _, r := range []interface{}(doc[keyEventReaders].(primitive.A)) {
+		readers = append(readers, r.(string))
+	}
+	ev := &Event{
+		Seq:     toInt64(doc[keyEventSeq]),
+		Time:    toTime(doc[keyEventTime].(primitive.DateTime)),
+		Type:    Type(doc[keyEventType].(string)),
+		NodeID:  nid,
+		User:    doc[keyEventUser].(string),
+		Owner:   doc[keyEventOwner].(string),
+		Readers: readers,
+		Public:  doc[keyEventPublic].(bool),
+	}
+	if src, ok := doc[keyEventSource].(string); ok {
+		sid, _ := uuid.Parse(src)
+		ev.SourceNodeID = &sid
+	}
+	return ev
+}
+
+// mongo may return 32 or 64 bit integers depending on the value.
+func toInt64(i interface{}) int64 {
+	if i32, ok := i.(int32); ok {
+		return int64(i32)
+	}
+	return i.(int64)
+}
+
+// see the equivalent function in the nodestore package.
+func toTime(d primitive.DateTime) time.Time {
+	return time.Unix(int64(d)/1000, int64(d)%1000*1000000).UTC()
+}
+
+// ClaimDeliveries claims up to limit deliveries that are due for an attempt, oldest first.
+// A claimed delivery cannot be claimed again until the lease expires, at which point it is
+// assumed that the claimant failed. Each claim is given a new claim token.
+func (s *MongoStore) ClaimDeliveries(lease time.Duration, limit int) ([]*Delivery, error) {
+	if lease < time.Millisecond {
+		return nil, errors.New("lease must be at least 1ms")
+	}
+	ds := []*Delivery{}
+	// claim one at a time so that other servers can't claim the same delivery
+	for i := 0; i < limit; i++ {
+		now := s.now()
+		claim := uuid.New().String()
+		opts := options.FindOneAndUpdate().
+			SetSort(map[string]int{keyOutboxNext: 1}).
+			SetReturnDocument(options.After)
+		res := s.db.Collection(colOutbox).FindOneAndUpdate(nil,
+			map[string]interface{}{
+				keyOutboxFailed: false,
+				keyOutboxNext:   map[string]interface{}{"$lte": now},
+			},
+			map[string]interface{}{
+				"$set": map[string]interface{}{
+					keyOutboxNext:  now.Add(lease),
+					keyOutboxClaim: claim,
+				},
+			},
+			opts)
+		var doc map[string]interface{}
+		if err := res.Decode(&doc); err != nil {
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			// dunno how to test this
+			return nil, errors.New("mongo events claim delivery: " + err.Error())
+		}
+		ds = append(ds, &Delivery{
+			Event:    toEvent(doc[keyOutboxEvent].(map[string]interface{})),
+			Hook:     doc[keyOutboxHook].(string),
+			Attempts: int(toInt64(doc[keyOutboxAttempts])),
+			Claim:    claim,
+		})
+	}
+	return ds, nil
+}
+
+// the claim token fences off claimants whose lease has expired.
+func deliveryFilter(d *Delivery) map[string]interface{} {
+	return map[string]interface{}{
+		keyOutboxSeq:   d.Event.Seq,
+		keyOutboxHook:  d.Hook,
+		keyOutboxClaim: d.Claim,
+	}
+}
+
+func claimExpired(d *Delivery) error {
+	return NewClaimExpiredError(fmt.Sprintf(
+		"Claim on delivery of event %d to webhook %s has expired", d.Event.Seq, d.Hook))
+}
+
+// CompleteDelivery removes a successful delivery from the outbox.
+// Returns ClaimExpiredError if the delivery has been claimed again since it was claimed.
+func (s *MongoStore) CompleteDelivery(d *Delivery) error {
+	if err := checkDelivery(d); err != nil {
+		return err
+	}
+	res, err := s.db.Collection(colOutbox).DeleteOne(nil, deliveryFilter(d))
+	if err != nil {
+		return errors.New("mongo events complete delivery: " + err.Error()) // dunno how to test
+	}
+	if res.DeletedCount < 1 {
+		return claimExpired(d)
+	}
+	return nil
+}
+
+// RetryDelivery reschedules a failed delivery for another attempt at the given time and
+// increments the number of attempts.
+// Returns ClaimExpiredError if the delivery has been claimed again since it was claimed.
+func (s *MongoStore) RetryDelivery(d *Delivery, next time.Time) error {
+	return s.updateDelivery(d, map[string]interface{}{
+		"$set": map[string]interface{}{keyOutboxNext: next},
+		"$inc": map[string]interface{}{keyOutboxAttempts: int64(1)},
+	}, "retry delivery")
+}
+
+// AbandonDelivery marks a delivery as permanently failed. It will not be claimed again,
+// but remains in the outbox for inspection.
+// Returns ClaimExpiredError if the delivery has been claimed again since it was claimed.
+func (s *MongoStore) AbandonDelivery(d *Delivery) error {
+	return s.updateDelivery(d, map[string]interface{}{
+		"$set": map[string]interface{}{keyOutboxFailed: true},
+		"$inc": map[string]interface{}{keyOutboxAttempts: int64(1)},
+	}, "abandon delivery")
+}
+
+func (s *MongoStore) updateDelivery(d *Delivery, update map[string]interface{}, op string,
+) error {
+	if err := checkDelivery(d); err != nil {
+		return err
+	}
+	res, err := s.db.Collection(colOutbox).UpdateOne(nil, deliveryFilter(d), update)
+	if err != nil {
+		return errors.New("mongo events " + op + ": " + err.Error()) // dunno how to test this
+	}
+	if res.MatchedCount < 1 {
+		return claimExpired(d)
+	}
+	return nil
+}
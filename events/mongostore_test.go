@@ -0,0 +1,283 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kbase/blobstore/test/mongocontroller"
+	"github.com/kbase/blobstore/test/testhelpers"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	testDB = "test_events"
+)
+
+type TestSuite struct {
+	suite.Suite
+	mongo         *mongocontroller.Controller
+	deleteTempDir bool
+	client        *mongo.Client
+}
+
+func (t *TestSuite) SetupSuite() {
+	tcfg, err := testhelpers.GetConfig()
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+
+	mongoctl, err := mongocontroller.New(mongocontroller.Params{
+		ExecutablePath: tcfg.MongoExePath,
+		UseWiredTiger:  tcfg.UseWiredTiger,
+		RootTempDir:    tcfg.TempDir,
+	})
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	t.mongo = mongoctl
+	t.deleteTempDir = tcfg.DeleteTempDir
+	copts := options.ClientOptions{Hosts: []string{
+		"localhost:" + strconv.Itoa(mongoctl.GetPort())}}
+	err = copts.Validate()
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	client, err := mongo.NewClient(&copts)
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	err = client.Connect(context.Background())
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	t.client = client
+}
+
+func (t *TestSuite) TearDownSuite() {
+	if t.mongo != nil {
+		t.mongo.Destroy(t.deleteTempDir)
+	}
+}
+
+func (t *TestSuite) SetupTest() {
+	t.client.Database(testDB).Drop(context.Background())
+}
+
+func TestRunSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (t *TestSuite) TestConstructFail() {
+	s, err := NewMongoStore(nil)
+	t.Nil(s, "expected error")
+	t.Equal(errors.New("db cannot be nil"), err, "incorrect error")
+
+	s, err = NewMongoStore(t.client.Database(testDB), "h1", "   \t  ")
+	t.Nil(s, "expected error")
+	t.Equal(errors.New("webhook names cannot be empty or whitespace only"), err,
+		"incorrect error")
+}
+
+func (t *TestSuite) TestBadInput() {
+	s, err := NewMongoStore(t.client.Database(testDB), "h1")
+	t.Nil(err, "unexpected error")
+
+	t.Equal(errors.New("event cannot be nil"), s.AddEvent(nil), "incorrect error")
+	t.Equal(errors.New("event type cannot be empty"), s.AddEvent(&Event{}), "incorrect error")
+
+	derr := errors.New("delivery and delivery event cannot be nil")
+	t.Equal(derr, s.CompleteDelivery(nil), "incorrect error")
+	t.Equal(derr, s.RetryDelivery(&Delivery{}, time.Now()), "incorrect error")
+	t.Equal(derr, s.AbandonDelivery(nil), "incorrect error")
+
+	ds, err := s.ClaimDeliveries(time.Microsecond, 10)
+	t.Nil(ds, "expected error")
+	t.Equal(errors.New("lease must be at least 1ms"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestAddEventNoHooks() {
+	s, err := NewMongoStore(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+	tme := time.Date(2019, 6, 1, 12, 30, 45, 123456789, time.UTC)
+	s.now = func() time.Time { return tme }
+
+	ev := &Event{Type: NodeCreated, NodeID: uuid.New(), User: "u", Owner: "u",
+		Readers: []string{"u"}}
+	t.Nil(s.AddEvent(ev), "unexpected error")
+	t.Equal(int64(1), ev.Seq, "incorrect seq")
+	t.Equal(time.Date(2019, 6, 1, 12, 30, 45, 123000000, time.UTC), ev.Time, "incorrect time")
+
+	ds, err := s.ClaimDeliveries(time.Minute, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Delivery{}, ds, "incorrect deliveries")
+}
+
+func (t *TestSuite) TestDeliveryLifecycle() {
+	s, err := NewMongoStore(t.client.Database(testDB), "h1", "h2")
+	t.Nil(err, "unexpected error")
+	tme := time.Date(2019, 6, 1, 12, 30, 45, 123000000, time.UTC)
+	s.now = func() time.Time { return tme }
+
+	nid := uuid.New()
+	src := uuid.New()
+	ev1 := &Event{Type: NodeCopied, NodeID: nid, SourceNodeID: &src, User: "u", Owner: "u",
+		Readers: []string{"u"}}
+	t.Nil(s.AddEvent(ev1), "unexpected error")
+	tme = tme.Add(time.Second)
+	ev2 := &Event{Type: ACLChanged, NodeID: nid, User: "u", Owner: "u",
+		Readers: []string{"u", "r"}, Public: true}
+	t.Nil(s.AddEvent(ev2), "unexpected error")
+	t.Equal(int64(1), ev1.Seq, "incorrect seq")
+	t.Equal(int64(2), ev2.Seq, "incorrect seq")
+
+	ds, err := s.ClaimDeliveries(time.Minute, 3)
+	t.Nil(err, "unexpected error")
+	t.Equal(3, len(ds), "incorrect delivery count")
+	t.Equal(ev1, ds[0].Event, "incorrect event")
+	t.Equal(ev1, ds[1].Event, "incorrect event")
+	t.Equal(ev2, ds[2].Event, "incorrect event")
+	t.ElementsMatch([]string{"h1", "h2"}, []string{ds[0].Hook, ds[1].Hook}, "incorrect hooks")
+	t.Equal(0, ds[0].Attempts, "incorrect attempts")
+
+	// claimed deliveries are leased
+	last, err := s.ClaimDeliveries(time.Minute, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal(1, len(last), "incorrect delivery count")
+	t.Equal(&Delivery{Event: ev2, Hook: ds[2].Hook, Claim: last[0].Claim}, last[0],
+		"incorrect delivery")
+	claims := map[string]bool{}
+	for _, d := range append(ds, last...) {
+		_, err := uuid.Parse(d.Claim)
+		t.Nil(err, "expected uuid claim")
+		claims[d.Claim] = true
+	}
+	t.Equal(4, len(claims), "expected unique claims")
+	empty, err := s.ClaimDeliveries(time.Minute, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Delivery{}, empty, "incorrect deliveries")
+
+	t.Nil(s.CompleteDelivery(ds[0]), "unexpected error")
+	t.Nil(s.RetryDelivery(ds[1], tme.Add(10*time.Second)), "unexpected error")
+	t.Nil(s.AbandonDelivery(ds[2]), "unexpected error")
+
+	// the retry is due but the lease on the last delivery hasn't expired
+	tme = tme.Add(11 * time.Second)
+	ds2, err := s.ClaimDeliveries(time.Minute, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Delivery{{Event: ev1, Hook: ds[1].Hook, Attempts: 1, Claim: ds2[0].Claim}},
+		ds2, "incorrect deliveries")
+	t.Nil(s.CompleteDelivery(ds2[0]), "unexpected error")
+
+	// the lease on the last delivery expires
+	tme = tme.Add(time.Minute)
+	ds3, err := s.ClaimDeliveries(time.Minute, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Delivery{{Event: ev2, Hook: last[0].Hook, Claim: ds3[0].Claim}}, ds3,
+		"incorrect deliveries")
+	t.NotEqual(last[0].Claim, ds3[0].Claim, "expected new claim")
+
+	// the previous claimant can no longer update the delivery
+	cerr := NewClaimExpiredError(fmt.Sprintf(
+		"Claim on delivery of event 2 to webhook %s has expired", last[0].Hook))
+	t.Equal(cerr, s.CompleteDelivery(last[0]), "incorrect error")
+	t.Equal(cerr, s.RetryDelivery(last[0], tme), "incorrect error")
+	t.Equal(cerr, s.AbandonDelivery(last[0]), "incorrect error")
+	t.Nil(s.CompleteDelivery(ds3[0]), "unexpected error")
+}
+
+func (t *TestSuite) TestAddEventFailStoreEvent() {
+	db := t.client.Database(testDB)
+	s, err := NewMongoStore(db, "h1")
+	t.Nil(err, "unexpected error")
+	tme := time.Date(2019, 6, 1, 12, 30, 45, 123000000, time.UTC)
+	s.now = func() time.Time { return tme }
+
+	// the next sequence number is already in use, so storing the event fails after the
+	// delivery is queued
+	_, err = db.Collection(colEvents).InsertOne(nil, map[string]interface{}{keyEventSeq: 1})
+	t.Nil(err, "unexpected error")
+	ev := &Event{Type: NodeCreated, NodeID: uuid.New(), User: "u", Owner: "u",
+		Readers: []string{"u"}}
+	err = s.AddEvent(ev)
+	t.NotNil(err, "expected error")
+	t.True(strings.HasPrefix(err.Error(), "mongo events add event: "), "incorrect error")
+
+	// the event is still delivered
+	ds, err := s.ClaimDeliveries(time.Minute, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Delivery{{Event: ev, Hook: "h1", Claim: ds[0].Claim}}, ds,
+		"incorrect deliveries")
+}
+
+func (t *TestSuite) TestGetEvents() {
+	s, err := NewMongoStore(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+
+	seq, err := s.GetLastSeq()
+	t.Nil(err, "unexpected error")
+	t.Equal(int64(0), seq, "incorrect seq")
+
+	evs := []*Event{}
+	for i := 0; i < 4; i++ {
+		ev := &Event{Type: NodeCreated, NodeID: uuid.New(), User: "u", Owner: "u",
+			Readers: []string{"u"}}
+		t.Nil(s.AddEvent(ev), "unexpected error")
+		evs = append(evs, ev)
+	}
+	seq, err = s.GetLastSeq()
+	t.Nil(err, "unexpected error")
+	t.Equal(int64(4), seq, "incorrect seq")
+
+	got, err := s.GetEvents(0, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal(evs, got, "incorrect events")
+
+	got, err = s.GetEvents(1, 2)
+	t.Nil(err, "unexpected error")
+	t.Equal(evs[1:3], got, "incorrect events")
+
+	got, err = s.GetEvents(4, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Event{}, got, "incorrect events")
+
+	got, err = s.GetEvents(0, 0)
+	t.Nil(got, "expected error")
+	t.Equal(errors.New("limit must be > 0"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestGetEventsWaitsForMissingSeq() {
+	s, err := NewMongoStore(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+	tme := time.Date(2019, 6, 1, 12, 30, 45, 123000000, time.UTC)
+	s.now = func() time.Time { return tme }
+
+	ev1 := &Event{Type: NodeCreated, NodeID: uuid.New(), User: "u", Owner: "u"}
+	t.Nil(s.AddEvent(ev1), "unexpected error")
+	// simulate a writer that has taken a sequence number but not yet stored its event
+	seq, err := s.nextSeq()
+	t.Nil(err, "unexpected error")
+	t.Equal(int64(2), seq, "incorrect seq")
+	ev3 := &Event{Type: NodeCreated, NodeID: uuid.New(), User: "u", Owner: "u"}
+	t.Nil(s.AddEvent(ev3), "unexpected error")
+
+	got, err := s.GetEvents(0, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Event{ev1}, got, "incorrect events")
+	got, err = s.GetEvents(1, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Event{}, got, "incorrect events")
+
+	// events after the missing event are returned once the timeout elapses
+	tme = tme.Add(seqGapTimeout + time.Millisecond)
+	got, err = s.GetEvents(1, 10)
+	t.Nil(err, "unexpected error")
+	t.Equal([]*Event{ev3}, got, "incorrect events")
+}
@@ -84,6 +84,9 @@ type FileInfo struct {
 	// The MD5 of the file. May be nil if the backend service does not provide an MD5 - for
 	// example many S3 upload methods. Always provided for a store file operation.
 	MD5 *values.MD5
+	// Checksums of the file for all the algorithms in values.ChecksumAlgorithms. Only provided
+	// for a store file operation, where they are calculated as the file is stored.
+	Checksums *values.Checksums
 	// The time the file was stored.
 	Stored time.Time
 }
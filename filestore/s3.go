@@ -1,8 +1,10 @@
 package filestore
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/url"
@@ -123,7 +125,14 @@ func (fs *S3FileStore) StoreFile(le *logrus.Entry, p *StoreFileParams) (out *Fil
 		return nil, errors.New("s3 store presign: " + err.Error()) //not sure how to test
 	}
 	// could split the stream here to count the size and confirm content-length
-	req, _ := http.NewRequest("PUT", presignedurl, p.data)
+	hashes := map[string]hash.Hash{}
+	writers := []io.Writer{}
+	for alg, newHash := range values.ChecksumAlgorithms {
+		hashes[alg] = newHash()
+		writers = append(writers, hashes[alg])
+	}
+	req, _ := http.NewRequest(
+		"PUT", presignedurl, io.TeeReader(p.data, io.MultiWriter(writers...)))
 	req.ContentLength = p.size
 	req.Header.Set("x-amz-meta-Filename", p.filename)
 	req.Header.Set("x-amz-meta-Format", p.format)
@@ -154,7 +163,16 @@ func (fs *S3FileStore) StoreFile(le *logrus.Entry, p *StoreFileParams) (out *Fil
 	}
 	// tried parsing the date from the returned headers, but wasn't always the same as what's
 	// returned by head. Head should be cheap compared to a write
-	return fs.getFileInfo(p.id, true)
+	info, err := fs.getFileInfo(p.id, true)
+	if err != nil {
+		return nil, err
+	}
+	checksums := map[string]string{}
+	for alg, h := range hashes {
+		checksums[alg] = hex.EncodeToString(h.Sum(nil))
+	}
+	info.Checksums, _ = values.NewChecksums(checksums)
+	return info, nil
 }
 
 func (fs *S3FileStore) getFileInfo(id string, strictMD5 bool) (*FileInfo, error) {
@@ -179,13 +179,19 @@ func (t *TestSuite) storeAndGet(filename string, format string) {
 	// it's flipped over to the next second and the test fails.
 	testhelpers.AssertCloseToNow(t.T(), stored, 2*time.Second)
 	md5, _ := values.NewMD5("5d838d477ddf355fc15df1db90bee0aa")
+	checksums, _ := values.NewChecksums(map[string]string{
+		"sha1":   "36a27136f3015f5ed0e1fe268ad7a93a985196cf",
+		"sha256": "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29",
+		"crc32c": "8412e281",
+	})
 	expected := &FileInfo{
-		ID:       "myid",
-		Size:     12,
-		Stored:   stored, // fake
-		Filename: filename,
-		Format:   format,
-		MD5:      md5,
+		ID:        "myid",
+		Size:      12,
+		Stored:    stored, // fake
+		Filename:  filename,
+		Format:    format,
+		MD5:       md5,
+		Checksums: checksums,
 	}
 
 	t.Equal(expected, res, "unexpected output")
@@ -13,7 +13,6 @@ require (
 	github.com/gorilla/mux v1.7.1
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/minio/minio-go v0.0.0-20190430232750-10b3660b8f09
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
 	github.com/sirupsen/logrus v1.4.1
 	github.com/stretchr/testify v1.3.0
@@ -2,6 +2,7 @@ package nodestore
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -40,15 +41,19 @@ func (u *User) GetAccountName() string {
 
 // Node is a collection of data about a file, including ACLs.
 type Node struct {
-	id       uuid.UUID
-	owner    User
-	readers  *[]User
-	filename string
-	format   string
-	size     int64
-	md5      values.MD5
-	stored   time.Time
-	public   bool
+	id        uuid.UUID
+	owner     User
+	readers   *[]User
+	filename  string
+	format    string
+	size      int64
+	md5       values.MD5
+	stored    time.Time
+	modified  time.Time
+	public    bool
+	version   int64
+	checksums *values.Checksums
+	fileID    string
 }
 
 // Format provides an arbitrary file format (e.g. json, txt) to the NewStoreFileParams() method.
@@ -84,6 +89,41 @@ func Public(public bool) func(*Node) error {
 	}
 }
 
+// Version sets the node's version. The version is incremented by the node store whenever the
+// node is changed. If not provided, the version is 1.
+func Version(version int64) func(*Node) error {
+	return func(n *Node) error {
+		n.version = version
+		return nil
+	}
+}
+
+// Checksums sets the checksums, other than the MD5, of the file associated with the node.
+func Checksums(checksums values.Checksums) func(*Node) error {
+	return func(n *Node) error {
+		n.checksums = &checksums
+		return nil
+	}
+}
+
+// FileID sets the ID of the file associated with the node in the file store. Multiple nodes may
+// share a file.
+func FileID(id string) func(*Node) error {
+	return func(n *Node) error {
+		n.fileID = strings.TrimSpace(id)
+		return nil
+	}
+}
+
+// Modified sets the time the node's filename or format was last changed. If not provided, the
+// modified time is the stored time.
+func Modified(modified time.Time) func(*Node) error {
+	return func(n *Node) error {
+		n.modified = modified
+		return nil
+	}
+}
+
 // NewNode creates a new node. The owner is automatically added to the reader list.
 func NewNode(
 	id uuid.UUID,
@@ -97,7 +137,8 @@ func NewNode(
 		return nil, errors.New("size must be > 0")
 	}
 	r := []User{}
-	n := &Node{id: id, owner: owner, size: size, md5: md5, stored: stored, readers: &r}
+	n := &Node{id: id, owner: owner, size: size, md5: md5, stored: stored, readers: &r,
+		version: 1}
 
 	for _, option := range options {
 		option(n) // currently no option funcs return nil
@@ -116,6 +157,9 @@ func NewNode(
 		seen[u] = struct{}{}
 	}
 	n.readers = &rclean
+	if n.modified.IsZero() {
+		n.modified = stored
+	}
 	return n, nil
 }
 
@@ -138,7 +182,8 @@ func (n *Node) WithOwner(user User) *Node {
 			readers = append(readers, r)
 		}
 	}
-	return &Node{n.id, user, &readers, n.filename, n.format, n.size, n.md5, n.stored, n.public}
+	return &Node{n.id, user, &readers, n.filename, n.format, n.size, n.md5, n.stored, n.modified,
+		n.public, n.version, n.checksums, n.fileID}
 
 }
 
@@ -152,11 +197,30 @@ func (n *Node) GetMD5() values.MD5 {
 	return n.md5
 }
 
+// GetChecksums returns the checksums, other than the MD5, of the file associated with the node.
+// Returns nil if the node has no such checksums.
+func (n *Node) GetChecksums() *values.Checksums {
+	return n.checksums
+}
+
+// GetFileID returns the ID of the file associated with the node in the file store. Returns the
+// empty string for nodes stored before files could be shared between nodes, in which case the
+// file ID is determined by the node ID.
+func (n *Node) GetFileID() string {
+	return n.fileID
+}
+
 // GetStoredTime returns the time the file associated with the node was stored.
 func (n *Node) GetStoredTime() time.Time {
 	return n.stored
 }
 
+// GetModifiedTime returns the time the node's filename or format was last changed, or the
+// stored time if they have never been changed.
+func (n *Node) GetModifiedTime() time.Time {
+	return n.modified
+}
+
 // GetFileName gets the name of the file associated with the node, if any.
 func (n *Node) GetFileName() string {
 	return n.filename
@@ -195,7 +259,8 @@ func (n *Node) WithReaders(readers ...User) *Node {
 			rdrs = append(rdrs, r)
 		}
 	}
-	return &Node{n.id, n.owner, &rdrs, n.filename, n.format, n.size, n.md5, n.stored, n.public}
+	return &Node{n.id, n.owner, &rdrs, n.filename, n.format, n.size, n.md5, n.stored, n.modified,
+		n.public, n.version, n.checksums, n.fileID}
 }
 
 // WithoutReaders returns a copy of the node without the sepecified readers.
@@ -213,7 +278,13 @@ func (n *Node) WithoutReaders(readers ...User) *Node {
 			clean = append(clean, r)
 		}
 	}
-	return &Node{n.id, n.owner, &clean, n.filename, n.format, n.size, n.md5, n.stored, n.public}
+	return &Node{n.id, n.owner, &clean, n.filename, n.format, n.size, n.md5, n.stored, n.modified,
+		n.public, n.version, n.checksums, n.fileID}
+}
+
+// GetVersion gets the node's version.
+func (n *Node) GetVersion() int64 {
+	return n.version
 }
 
 // GetPublic gets whether the node is publicly readable or not.
@@ -230,7 +301,7 @@ func (n *Node) copyReaders() *[]User {
 // WithPublic returns a copy of the node with the public flag set as specified.
 func (n *Node) WithPublic(public bool) *Node {
 	return &Node{n.id, n.owner, n.copyReaders(), n.filename, n.format, n.size, n.md5, n.stored,
-		public}
+		n.modified, public, n.version, n.checksums, n.fileID}
 }
 
 // NoNodeError is returned when a node doesn't exist.
@@ -246,6 +317,46 @@ func (e *NoNodeError) Error() string {
 	return string(*e)
 }
 
+// VersionMismatchError is returned when a node's version does not match the expected version.
+type VersionMismatchError string
+
+// NewVersionMismatchError creates a new VersionMismatchError.
+func NewVersionMismatchError(id uuid.UUID, expected int64, actual int64) *VersionMismatchError {
+	e := VersionMismatchError(fmt.Sprintf("Node %s is at version %d, not %d",
+		id.String(), actual, expected))
+	return &e
+}
+
+func (e *VersionMismatchError) Error() string {
+	return string(*e)
+}
+
+// NoUserError is returned when a user doesn't exist.
+type NoUserError string
+
+// NewNoUserError creates a new NoUserError.
+func NewNoUserError(err string) *NoUserError {
+	e := NoUserError(err)
+	return &e
+}
+
+func (e *NoUserError) Error() string {
+	return string(*e)
+}
+
+// UserExistsError is returned when a user unexpectedly already exists.
+type UserExistsError string
+
+// NewUserExistsError creates a new UserExistsError.
+func NewUserExistsError(err string) *UserExistsError {
+	e := UserExistsError(err)
+	return &e
+}
+
+func (e *UserExistsError) Error() string {
+	return string(*e)
+}
+
 // NodeStore stores node information.
 type NodeStore interface {
 
@@ -253,6 +364,21 @@ type NodeStore interface {
 	// to the user.
 	GetUser(accountName string) (*User, error)
 
+	// GetUsers gets multiple users, assigning new IDs to any users that do not exist in the
+	// system. The users are returned in the same order as the account names. Duplicate account
+	// names are returned once.
+	GetUsers(accountNames []string) ([]User, error)
+
+	// GetExistingUser gets a user without assigning a new ID to the user.
+	// Returns NoUserError if the user does not exist.
+	GetExistingUser(accountName string) (*User, error)
+
+	// RenameUser changes a user's account name. The user's ID is unchanged, and the user's name
+	// is updated in the owner and read ACL of every node in which the user appears.
+	// Returns NoUserError if the user does not exist and UserExistsError if a user with the new
+	// account name already exists.
+	RenameUser(accountName string, newAccountName string) (*User, error)
+
 	// StoreNode stores a node.
 	// The caller is responsible for ensuring any users are valid - retrieving users via
 	// GetUser() is the proper way to do so.
@@ -262,27 +388,67 @@ type NodeStore interface {
 	// GetNode gets a node. Returns NoNodeError if the node does not exist.
 	GetNode(id uuid.UUID) (*Node, error)
 
+	// GetNodes gets multiple nodes. Nodes that do not exist are omitted from the results, and
+	// the results are in no particular order.
+	GetNodes(ids []uuid.UUID) ([]*Node, error)
+
+	// GetNodesByOwner gets the nodes owned by a user, in no particular order.
+	GetNodesByOwner(user User) ([]*Node, error)
+
+	// GetNodesByReader gets the nodes with a user in their read ACL, including the nodes the
+	// user owns, in no particular order.
+	GetNodesByReader(user User) ([]*Node, error)
+
 	// DeleteNode deletes a node. Returns NoNodeError if the node does not exist.
 	DeleteNode(id uuid.UUID) error
 
+	// The following methods track the number of nodes referencing each file in the file store,
+	// allowing nodes to share files. Files that have not been recorded via AddFile, such as
+	// those stored before files could be shared, are assumed to have a single reference.
+
+	// AddFile records a newly stored file with the given size and SHA-256 and a single
+	// reference, and returns the file ID. If a file with the same size and SHA-256 has already
+	// been recorded, a reference is added to that file and its ID is returned instead, in which
+	// case the caller is responsible for deleting the new file.
+	AddFile(id string, size int64, sha256 string) (string, error)
+
+	// AddFileReference adds a reference to a file, for example when a node is copied. node is
+	// the ID of a node using the file. If the file has not been recorded, NoNodeError is
+	// returned if the node does not exist.
+	AddFileReference(id string, node uuid.UUID) error
+
+	// RemoveFileReference removes a reference to a file. If no references remain, the file
+	// record is deleted and true is returned, in which case the caller is responsible for
+	// deleting the file.
+	RemoveFileReference(id string) (bool, error)
+
+	// The following methods alter a node. If version is not nil, the node is only altered if it
+	// is at the given version, and VersionMismatchError is returned otherwise. The node's
+	// version is incremented if the node changes. The node as stored after the alteration is
+	// returned.
+
 	// SetNodePublic sets whether a node can be read by anyone, including anonymous users.
 	// Returns NoNodeError if the node does not exist.
-	SetNodePublic(id uuid.UUID, public bool) error
+	SetNodePublic(id uuid.UUID, public bool, version *int64) (*Node, error)
 
-	// adding and removing readers one at a time isn't efficient, but that's by far the most
-	// common use case so that's all we support for now. Optimize later.
+	// AddReaders adds users to a node's read ACL. Either all the users are added or none are.
+	// The caller is responsible for ensuring the users are valid - retrieving users via
+	// GetUser() or GetUsers() is the proper way to do so.
+	// Has no effect for users that are already in the read ACL.
+	// Returns NoNodeError if the node does not exist.
+	AddReaders(id uuid.UUID, users []User, version *int64) (*Node, error)
 
-	// AddReader adds a user to a node's read ACL.
-	// The caller is responsible for ensuring the user is valid - retrieving the user via
-	// GetUser() is the proper way to do so.
-	// Has no effect if the user is already in the read ACL.
+	// RemoveReaders removes users from the node's read ACL. Either all the users are removed or
+	// none are.
+	// Has no effect for users that are not in the read ACL or are the node owner.
 	// Returns NoNodeError if the node does not exist.
-	AddReader(id uuid.UUID, user User) error
+	RemoveReaders(id uuid.UUID, users []User, version *int64) (*Node, error)
 
-	// RemoveReader removes a user from the node's read ACL.
-	// Has no effect if the user is not in the read ACL or is the node owner.
+	// SetFileMetadata sets the filename and / or format of a node. A nil filename or format is
+	// not changed. If the node changes, its modified time is set to the given time.
 	// Returns NoNodeError if the node does not exist.
-	RemoveReader(id uuid.UUID, user User) error
+	SetFileMetadata(id uuid.UUID, filename *string, format *string, modified time.Time,
+		version *int64) (*Node, error)
 
 	// ChangeOwner changes the owner of a node.
 	// The caller is responsible for ensuring the user is valid - retrieving the user via
@@ -290,5 +456,5 @@ type NodeStore interface {
 	// Adds the new owner to the the read acl.
 	// Setting the new owner to the current owner has no effect.
 	// Returns NoNodeError if the node does not exist.
-	ChangeOwner(id uuid.UUID, user User) error
+	ChangeOwner(id uuid.UUID, user User, version *int64) (*Node, error)
 }
@@ -45,10 +45,13 @@ func TestNewNodeMin(t *testing.T) {
 	assert.Equal(t, int64(67), n.GetSize(), "incorrect size")
 	assert.Equal(t, *md5, n.GetMD5(), "incorrect MD5")
 	assert.Equal(t, tm, n.GetStoredTime(), "incorrect store time")
+	assert.Equal(t, tm, n.GetModifiedTime(), "incorrect modified time")
 	assert.Equal(t, "", n.GetFormat(), "incorrect format")
 	assert.Equal(t, "", n.GetFileName(), "incorrect filename")
 	assert.Equal(t, false, n.GetPublic(), "incorrect public")
 	assert.Equal(t, &readers, n.GetReaders(), "incorrect readers")
+	assert.Nil(t, n.GetChecksums(), "incorrect checksums")
+	assert.Equal(t, "", n.GetFileID(), "incorrect file ID")
 }
 
 func TestNewNodeFull(t *testing.T) {
@@ -57,7 +60,9 @@ func TestNewNodeFull(t *testing.T) {
 	r1, _ := NewUser(uuid.New(), " r1 ")
 	r2, _ := NewUser(uuid.New(), " r2")
 	tm := time.Now()
+	mod := tm.Add(time.Hour)
 	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	sums, _ := values.NewChecksums(map[string]string{"crc32c": "8636640e"})
 	n, err := NewNode(
 		id,
 		*owner,
@@ -68,6 +73,9 @@ func TestNewNodeFull(t *testing.T) {
 		FileName("   file.txt   "),
 		Public(true),
 		Reader(*r1), Reader(*r2), Reader(*r1), Reader(*owner), // test duplicates are removed
+		Checksums(*sums),
+		FileID("   f6/02/9a/f6029a11   "),
+		Modified(mod),
 	)
 	assert.Nil(t, err, "unexpected error")
 
@@ -77,10 +85,19 @@ func TestNewNodeFull(t *testing.T) {
 	assert.Equal(t, int64(67), n.GetSize(), "incorrect size")
 	assert.Equal(t, *md5, n.GetMD5(), "incorrect MD5")
 	assert.Equal(t, tm, n.GetStoredTime(), "incorrect store time")
+	assert.Equal(t, mod, n.GetModifiedTime(), "incorrect modified time")
 	assert.Equal(t, "txt", n.GetFormat(), "incorrect format")
 	assert.Equal(t, "file.txt", n.GetFileName(), "incorrect filename")
 	assert.Equal(t, true, n.GetPublic(), "incorrect public")
 	assert.Equal(t, &readers, n.GetReaders(), "incorrect readers")
+	assert.Equal(t, sums, n.GetChecksums(), "incorrect checksums")
+	assert.Equal(t, "f6/02/9a/f6029a11", n.GetFileID(), "incorrect file ID")
+	// check the checksums survive copies
+	assert.Equal(t, sums, n.WithPublic(false).GetChecksums(), "incorrect checksums")
+	assert.Equal(t, sums, n.WithOwner(*r1).GetChecksums(), "incorrect checksums")
+	assert.Equal(t, sums, n.WithoutReaders(*r2).GetChecksums(), "incorrect checksums")
+	assert.Equal(t, "f6/02/9a/f6029a11", n.WithReaders(*r2).GetFileID(), "incorrect file ID")
+	assert.Equal(t, mod, n.WithPublic(false).GetModifiedTime(), "incorrect modified time")
 }
 
 func TestNodeImmutable(t *testing.T) {
@@ -296,3 +313,13 @@ func TestNoNodeError(t *testing.T) {
 	e := NewNoNodeError("err")
 	assert.Equal(t, "err", e.Error(), "incorrect error")
 }
+
+func TestNoUserError(t *testing.T) {
+	e := NewNoUserError("err")
+	assert.Equal(t, "err", e.Error(), "incorrect error")
+}
+
+func TestUserExistsError(t *testing.T) {
+	e := NewUserExistsError("err")
+	assert.Equal(t, "err", e.Error(), "incorrect error")
+}
@@ -4,6 +4,7 @@ package mocks
 
 import mock "github.com/stretchr/testify/mock"
 import nodestore "github.com/kbase/blobstore/nodestore"
+import time "time"
 import uuid "github.com/google/uuid"
 
 // NodeStore is an autogenerated mock type for the NodeStore type
@@ -11,27 +12,34 @@ type NodeStore struct {
 	mock.Mock
 }
 
-// AddReader provides a mock function with given fields: id, user
-func (_m *NodeStore) AddReader(id uuid.UUID, user nodestore.User) error {
-	ret := _m.Called(id, user)
+// AddFile provides a mock function with given fields: id, size, sha256
+func (_m *NodeStore) AddFile(id string, size int64, sha256 string) (string, error) {
+	ret := _m.Called(id, size, sha256)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(uuid.UUID, nodestore.User) error); ok {
-		r0 = rf(id, user)
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, int64, string) string); ok {
+		r0 = rf(id, size, sha256)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(string)
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, int64, string) error); ok {
+		r1 = rf(id, size, sha256)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
-// ChangeOwner provides a mock function with given fields: id, user
-func (_m *NodeStore) ChangeOwner(id uuid.UUID, user nodestore.User) error {
-	ret := _m.Called(id, user)
+// AddFileReference provides a mock function with given fields: id, node
+func (_m *NodeStore) AddFileReference(id string, node uuid.UUID) error {
+	ret := _m.Called(id, node)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(uuid.UUID, nodestore.User) error); ok {
-		r0 = rf(id, user)
+	if rf, ok := ret.Get(0).(func(string, uuid.UUID) error); ok {
+		r0 = rf(id, node)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -39,6 +47,52 @@ func (_m *NodeStore) ChangeOwner(id uuid.UUID, user nodestore.User) error {
 	return r0
 }
 
+// AddReaders provides a mock function with given fields: id, users, version
+func (_m *NodeStore) AddReaders(id uuid.UUID, users []nodestore.User, version *int64) (*nodestore.Node, error) {
+	ret := _m.Called(id, users, version)
+
+	var r0 *nodestore.Node
+	if rf, ok := ret.Get(0).(func(uuid.UUID, []nodestore.User, *int64) *nodestore.Node); ok {
+		r0 = rf(id, users, version)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*nodestore.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(uuid.UUID, []nodestore.User, *int64) error); ok {
+		r1 = rf(id, users, version)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ChangeOwner provides a mock function with given fields: id, user, version
+func (_m *NodeStore) ChangeOwner(id uuid.UUID, user nodestore.User, version *int64) (*nodestore.Node, error) {
+	ret := _m.Called(id, user, version)
+
+	var r0 *nodestore.Node
+	if rf, ok := ret.Get(0).(func(uuid.UUID, nodestore.User, *int64) *nodestore.Node); ok {
+		r0 = rf(id, user, version)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*nodestore.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(uuid.UUID, nodestore.User, *int64) error); ok {
+		r1 = rf(id, user, version)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // DeleteNode provides a mock function with given fields: id
 func (_m *NodeStore) DeleteNode(id uuid.UUID) error {
 	ret := _m.Called(id)
@@ -53,6 +107,29 @@ func (_m *NodeStore) DeleteNode(id uuid.UUID) error {
 	return r0
 }
 
+// GetExistingUser provides a mock function with given fields: accountName
+func (_m *NodeStore) GetExistingUser(accountName string) (*nodestore.User, error) {
+	ret := _m.Called(accountName)
+
+	var r0 *nodestore.User
+	if rf, ok := ret.Get(0).(func(string) *nodestore.User); ok {
+		r0 = rf(accountName)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*nodestore.User)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(accountName)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetNode provides a mock function with given fields: id
 func (_m *NodeStore) GetNode(id uuid.UUID) (*nodestore.Node, error) {
 	ret := _m.Called(id)
@@ -76,6 +153,75 @@ func (_m *NodeStore) GetNode(id uuid.UUID) (*nodestore.Node, error) {
 	return r0, r1
 }
 
+// GetNodes provides a mock function with given fields: ids
+func (_m *NodeStore) GetNodes(ids []uuid.UUID) ([]*nodestore.Node, error) {
+	ret := _m.Called(ids)
+
+	var r0 []*nodestore.Node
+	if rf, ok := ret.Get(0).(func([]uuid.UUID) []*nodestore.Node); ok {
+		r0 = rf(ids)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*nodestore.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func([]uuid.UUID) error); ok {
+		r1 = rf(ids)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetNodesByOwner provides a mock function with given fields: user
+func (_m *NodeStore) GetNodesByOwner(user nodestore.User) ([]*nodestore.Node, error) {
+	ret := _m.Called(user)
+
+	var r0 []*nodestore.Node
+	if rf, ok := ret.Get(0).(func(nodestore.User) []*nodestore.Node); ok {
+		r0 = rf(user)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*nodestore.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(nodestore.User) error); ok {
+		r1 = rf(user)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetNodesByReader provides a mock function with given fields: user
+func (_m *NodeStore) GetNodesByReader(user nodestore.User) ([]*nodestore.Node, error) {
+	ret := _m.Called(user)
+
+	var r0 []*nodestore.Node
+	if rf, ok := ret.Get(0).(func(nodestore.User) []*nodestore.Node); ok {
+		r0 = rf(user)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*nodestore.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(nodestore.User) error); ok {
+		r1 = rf(user)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetUser provides a mock function with given fields: accountName
 func (_m *NodeStore) GetUser(accountName string) (*nodestore.User, error) {
 	ret := _m.Called(accountName)
@@ -99,32 +245,140 @@ func (_m *NodeStore) GetUser(accountName string) (*nodestore.User, error) {
 	return r0, r1
 }
 
-// RemoveReader provides a mock function with given fields: id, user
-func (_m *NodeStore) RemoveReader(id uuid.UUID, user nodestore.User) error {
-	ret := _m.Called(id, user)
+// GetUsers provides a mock function with given fields: accountNames
+func (_m *NodeStore) GetUsers(accountNames []string) ([]nodestore.User, error) {
+	ret := _m.Called(accountNames)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(uuid.UUID, nodestore.User) error); ok {
-		r0 = rf(id, user)
+	var r0 []nodestore.User
+	if rf, ok := ret.Get(0).(func([]string) []nodestore.User); ok {
+		r0 = rf(accountNames)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]nodestore.User)
+		}
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func([]string) error); ok {
+		r1 = rf(accountNames)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
-// SetNodePublic provides a mock function with given fields: id, public
-func (_m *NodeStore) SetNodePublic(id uuid.UUID, public bool) error {
-	ret := _m.Called(id, public)
+// RemoveFileReference provides a mock function with given fields: id
+func (_m *NodeStore) RemoveFileReference(id string) (bool, error) {
+	ret := _m.Called(id)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(uuid.UUID, bool) error); ok {
-		r0 = rf(id, public)
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string) bool); ok {
+		r0 = rf(id)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(bool)
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RemoveReaders provides a mock function with given fields: id, users, version
+func (_m *NodeStore) RemoveReaders(id uuid.UUID, users []nodestore.User, version *int64) (*nodestore.Node, error) {
+	ret := _m.Called(id, users, version)
+
+	var r0 *nodestore.Node
+	if rf, ok := ret.Get(0).(func(uuid.UUID, []nodestore.User, *int64) *nodestore.Node); ok {
+		r0 = rf(id, users, version)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*nodestore.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(uuid.UUID, []nodestore.User, *int64) error); ok {
+		r1 = rf(id, users, version)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RenameUser provides a mock function with given fields: accountName, newAccountName
+func (_m *NodeStore) RenameUser(accountName string, newAccountName string) (*nodestore.User, error) {
+	ret := _m.Called(accountName, newAccountName)
+
+	var r0 *nodestore.User
+	if rf, ok := ret.Get(0).(func(string, string) *nodestore.User); ok {
+		r0 = rf(accountName, newAccountName)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*nodestore.User)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+		r1 = rf(accountName, newAccountName)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetFileMetadata provides a mock function with given fields: id, filename, format, modified, version
+func (_m *NodeStore) SetFileMetadata(id uuid.UUID, filename *string, format *string, modified time.Time, version *int64) (*nodestore.Node, error) {
+	ret := _m.Called(id, filename, format, modified, version)
+
+	var r0 *nodestore.Node
+	if rf, ok := ret.Get(0).(func(uuid.UUID, *string, *string, time.Time, *int64) *nodestore.Node); ok {
+		r0 = rf(id, filename, format, modified, version)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*nodestore.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(uuid.UUID, *string, *string, time.Time, *int64) error); ok {
+		r1 = rf(id, filename, format, modified, version)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetNodePublic provides a mock function with given fields: id, public, version
+func (_m *NodeStore) SetNodePublic(id uuid.UUID, public bool, version *int64) (*nodestore.Node, error) {
+	ret := _m.Called(id, public, version)
+
+	var r0 *nodestore.Node
+	if rf, ok := ret.Get(0).(func(uuid.UUID, bool, *int64) *nodestore.Node); ok {
+		r0 = rf(id, public, version)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*nodestore.Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(uuid.UUID, bool, *int64) error); ok {
+		r1 = rf(id, public, version)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 // StoreNode provides a mock function with given fields: node
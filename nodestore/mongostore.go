@@ -41,7 +41,17 @@ const (
 	keyNodesSize     = "size"
 	keyNodesMD5      = "md5"
 	keyNodesStored   = "time"
+	keyNodesModified = "mod"
 	keyNodesPublic   = "pub"
+	keyNodesVersion  = "ver"
+	keyNodesSums     = "sums"
+	keyNodesFileID   = "file"
+
+	colFiles     = "files"
+	keyFilesID   = "id"
+	keyFilesSize = "size"
+	keyFilesSHA  = "sha256"
+	keyFilesRefs = "refs"
 
 	mongoDuplicateKeyCode = 11000
 )
@@ -80,6 +90,22 @@ func createIndexes(db *mongo.Database) error {
 	if err != nil {
 		return err // hard to test
 	}
+	err = addIndex(db.Collection(colNodes), keyNodesOwner+"."+keyUserUUID, 1, false)
+	if err != nil {
+		return err // hard to test
+	}
+	err = addIndex(db.Collection(colNodes), keyNodesReaders+"."+keyUserUUID, 1, false)
+	if err != nil {
+		return err // hard to test
+	}
+	err = addIndex(db.Collection(colFiles), keyFilesID, 1, true)
+	if err != nil {
+		return err // hard to test
+	}
+	err = addContentIndex(db.Collection(colFiles))
+	if err != nil {
+		return err // hard to test
+	}
 	err = addIndex(db.Collection(colConfig), keyConfigSchema, 1, true)
 	if err != nil {
 		return err
@@ -99,6 +125,25 @@ func addIndex(col *mongo.Collection, key string, asc int, unique bool) error {
 	return nil
 }
 
+// addContentIndex ensures at most one file record exists for any given content. Records for
+// unshared files stored before files could be shared have no SHA-256 and are not indexed.
+func addContentIndex(col *mongo.Collection) error {
+	unique := true
+	mdl := mongo.IndexModel{
+		Keys: bson.D{{Key: keyFilesSHA, Value: 1}, {Key: keyFilesSize, Value: 1}},
+		Options: &options.IndexOptions{
+			Unique: &unique,
+			PartialFilterExpression: map[string]interface{}{
+				keyFilesSHA: map[string]interface{}{"$exists": true}},
+		},
+	}
+	_, err := col.Indexes().CreateOne(context.Background(), mdl, nil)
+	if err != nil {
+		return errors.New("mongo create index: " + err.Error())
+	}
+	return nil
+}
+
 func checkConfig(db *mongo.Database) error {
 	col := db.Collection(colConfig)
 	doc := map[string]interface{}{
@@ -164,6 +209,24 @@ func (s *MongoNodeStore) GetUser(accountName string) (*User, error) {
 	return s.createUser(accountName)
 }
 
+// GetExistingUser gets a user without assigning a new ID to the user.
+// Returns NoUserError if the user does not exist.
+func (s *MongoNodeStore) GetExistingUser(accountName string) (*User, error) {
+	accountName = strings.TrimSpace(accountName)
+	if accountName == "" {
+		return nil, errors.New("accountName cannot be empty or whitespace only")
+	}
+	u, err := toUser(s.db.Collection(colUsers).FindOne(
+		nil, map[string]string{keyUserUser: accountName}))
+	if err != nil {
+		return nil, err // don't know how to test this
+	}
+	if u == nil {
+		return nil, NewNoUserError("No such user " + accountName)
+	}
+	return u, nil
+}
+
 // we split this method out for readability and so we can test a race condition where
 // between the read in GetUser and the InsertOne call here the same user is already inserted
 // Consider this method part of GetUser though
@@ -191,6 +254,162 @@ func (s *MongoNodeStore) createUser(accountName string) (*User, error) {
 	return nil, errors.New("mongostore create user: " + err.Error()) // dunno how to test
 }
 
+// GetUsers gets multiple users, assigning new IDs to any users that do not exist in the system.
+// The users are returned in the same order as the account names. Duplicate account names are
+// returned once.
+func (s *MongoNodeStore) GetUsers(accountNames []string) ([]User, error) {
+	names := []string{}
+	seen := map[string]struct{}{}
+	for _, an := range accountNames {
+		an = strings.TrimSpace(an)
+		if an == "" {
+			return nil, errors.New("accountNames cannot be empty or whitespace only")
+		}
+		if _, ok := seen[an]; !ok {
+			seen[an] = struct{}{}
+			names = append(names, an)
+		}
+	}
+	users, err := s.findUsers(names)
+	if err != nil {
+		return nil, err
+	}
+	newusers := []interface{}{}
+	for _, an := range names {
+		if _, ok := users[an]; !ok {
+			newusers = append(newusers, toUserDocCreate(uuid.New(), an))
+		}
+	}
+	if len(newusers) > 0 {
+		_, err := s.db.Collection(colUsers).InsertMany(
+			context.Background(), newusers, options.InsertMany().SetOrdered(false))
+		// duplicate keys mean another process created the user since we looked
+		if err != nil && !isMongoBulkDuplicateKey(err) {
+			return nil, errors.New("mongostore create users: " + err.Error()) // dunno how to test
+		}
+		users, err = s.findUsers(names)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret := []User{}
+	for _, an := range names {
+		u, ok := users[an]
+		if !ok {
+			// should be impossible since users are never deleted
+			return nil, errors.New("mongostore get users: missing user " + an)
+		}
+		ret = append(ret, *u)
+	}
+	return ret, nil
+}
+
+func (s *MongoNodeStore) findUsers(accountNames []string) (map[string]*User, error) {
+	users := map[string]*User{}
+	if len(accountNames) < 1 {
+		return users, nil
+	}
+	cur, err := s.db.Collection(colUsers).Find(context.Background(),
+		map[string]interface{}{keyUserUser: map[string]interface{}{"$in": accountNames}})
+	if err != nil {
+		return nil, errors.New("mongostore find users: " + err.Error()) // dunno how to test
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(context.Background()) {
+		var udoc map[string]interface{}
+		err := cur.Decode(&udoc)
+		if err != nil {
+			// dunno how to test this either
+			return nil, errors.New("mongostore users decode: " + err.Error())
+		}
+		u := toUserFromDoc(udoc)
+		users[u.accountName] = u
+	}
+	if cur.Err() != nil {
+		return nil, errors.New("mongostore find users: " + cur.Err().Error()) // dunno how to test
+	}
+	return users, nil
+}
+
+// RenameUser changes a user's account name. The user's ID is unchanged, and the user's name is
+// updated in the owner and read ACL of every node in which the user appears. The version of
+// each altered node is incremented.
+// If an error occurs after the user is renamed, renaming the user to the new account name
+// again will complete the update of the user's nodes.
+// Returns NoUserError if the user does not exist and UserExistsError if a user with the new
+// account name already exists.
+func (s *MongoNodeStore) RenameUser(accountName string, newAccountName string) (*User, error) {
+	accountName = strings.TrimSpace(accountName)
+	newAccountName = strings.TrimSpace(newAccountName)
+	if accountName == "" || newAccountName == "" {
+		return nil, errors.New("account names cannot be empty or whitespace only")
+	}
+	col := s.db.Collection(colUsers)
+	res, err := col.UpdateOne(nil, map[string]string{keyUserUser: accountName},
+		map[string]interface{}{"$set": map[string]string{keyUserUser: newAccountName}})
+	if err != nil {
+		if isMongoDuplicateKey(err) {
+			return nil, NewUserExistsError("User " + newAccountName + " already exists")
+		}
+		return nil, errors.New("mongostore rename user: " + err.Error()) // dunno how to test
+	}
+	if res.MatchedCount < 1 {
+		return nil, NewNoUserError("No such user " + accountName)
+	}
+	u, err := toUser(col.FindOne(nil, map[string]string{keyUserUser: newAccountName}))
+	if err != nil {
+		return nil, err // don't know how to test this
+	}
+	if u == nil {
+		// the user was renamed again in the meantime
+		return nil, NewNoUserError("No such user " + newAccountName)
+	}
+	uid := u.id.String()
+	notNew := map[string]interface{}{"$ne": newAccountName}
+	inc := map[string]interface{}{keyNodesVersion: int64(1)}
+	_, err = s.db.Collection(colNodes).UpdateMany(nil,
+		map[string]interface{}{
+			keyNodesOwner + "." + keyUserUUID: uid,
+			keyNodesOwner + "." + keyUserUser: notNew,
+		},
+		map[string]interface{}{
+			"$set": map[string]interface{}{keyNodesOwner + "." + keyUserUser: newAccountName},
+			"$inc": inc,
+		})
+	if err != nil {
+		return nil, errors.New("mongostore rename user: " + err.Error()) // dunno how to test
+	}
+	_, err = s.db.Collection(colNodes).UpdateMany(nil,
+		map[string]interface{}{keyNodesReaders: map[string]interface{}{
+			"$elemMatch": map[string]interface{}{keyUserUUID: uid, keyUserUser: notNew}}},
+		map[string]interface{}{
+			"$set": map[string]interface{}{keyNodesReaders + ".$." + keyUserUser: newAccountName},
+			"$inc": inc,
+		})
+	if err != nil {
+		return nil, errors.New("mongostore rename user: " + err.Error()) // dunno how to test
+	}
+	return u, nil
+}
+
+// returns true if the error has no WriteConcernError and all the WriteErrors are Duplicate Key
+// errors.
+func isMongoBulkDuplicateKey(err error) bool {
+	bwex, ok := err.(mongo.BulkWriteException)
+	if !ok {
+		return false
+	}
+	if bwex.WriteConcernError != nil {
+		return false
+	}
+	for _, we := range bwex.WriteErrors {
+		if we.Code != mongoDuplicateKeyCode {
+			return false
+		}
+	}
+	return true
+}
+
 // returns true if the error has one WriteError, has no WriteConcernError, and the
 // WriteError is a Duplicate Key error.
 func isMongoDuplicateKey(err error) bool {
@@ -221,9 +440,13 @@ func toUser(sr *mongo.SingleResult) (*User, error) {
 		// dunno how to test this either
 		return nil, errors.New("mongostore user decode: " + err.Error())
 	}
+	return toUserFromDoc(udoc), nil
+}
+
+func toUserFromDoc(udoc map[string]interface{}) *User {
 	// err should always be nil unless db is corrupt
 	uid, _ := uuid.Parse(udoc[keyUserUUID].(string))
-	return &User{accountName: udoc[keyUserUser].(string), id: uid}, nil
+	return &User{accountName: udoc[keyUserUser].(string), id: uid}
 }
 
 // MUST use these functions to make users, since bson.D is ordered and
@@ -259,11 +482,19 @@ func (s *MongoNodeStore) StoreNode(node *Node) error {
 		keyNodesPublic:   node.public,
 		keyNodesSize:     node.size,
 		keyNodesStored:   node.stored,
+		keyNodesModified: node.modified,
+		keyNodesVersion:  node.version,
 	}
 	for _, u := range *node.readers {
 		readers = append(readers, toUserDoc(u))
 	}
 	nodemap[keyNodesReaders] = readers
+	if node.checksums != nil {
+		nodemap[keyNodesSums] = node.checksums.GetAll()
+	}
+	if node.fileID != "" {
+		nodemap[keyNodesFileID] = node.fileID
+	}
 	_, err := s.db.Collection(colNodes).InsertOne(nil, nodemap)
 	if err != nil {
 		if isMongoDuplicateKey(err) {
@@ -290,10 +521,87 @@ func (s *MongoNodeStore) GetNode(id uuid.UUID) (*Node, error) {
 		// dunno how to test this either
 		return nil, errors.New("mongostore decode node: " + err.Error())
 	}
+	return toNode(ndoc)
+}
+
+// GetNodes gets multiple nodes. Nodes that do not exist are omitted from the results, and the
+// results are in no particular order.
+func (s *MongoNodeStore) GetNodes(ids []uuid.UUID) ([]*Node, error) {
+	if len(ids) < 1 {
+		return []*Node{}, nil
+	}
+	idstrs := []string{}
+	for _, id := range ids {
+		idstrs = append(idstrs, id.String())
+	}
+	return s.findNodes(
+		map[string]interface{}{keyNodesID: map[string]interface{}{"$in": idstrs}}, "get nodes")
+}
+
+// GetNodesByOwner gets the nodes owned by a user, in no particular order.
+func (s *MongoNodeStore) GetNodesByOwner(user User) ([]*Node, error) {
+	return s.findNodes(map[string]interface{}{keyNodesOwner + "." + keyUserUUID: user.id.String()},
+		"get nodes by owner")
+}
+
+// GetNodesByReader gets the nodes with a user in their read ACL, including the nodes the user
+// owns, in no particular order.
+func (s *MongoNodeStore) GetNodesByReader(user User) ([]*Node, error) {
+	return s.findNodes(
+		map[string]interface{}{keyNodesReaders + "." + keyUserUUID: user.id.String()},
+		"get nodes by reader")
+}
+
+func (s *MongoNodeStore) findNodes(filter map[string]interface{}, op string) ([]*Node, error) {
+	nodes := []*Node{}
+	cur, err := s.db.Collection(colNodes).Find(context.Background(), filter)
+	if err != nil {
+		return nil, errors.New("mongostore " + op + ": " + err.Error()) // dunno how to test
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(context.Background()) {
+		var ndoc map[string]interface{}
+		err := cur.Decode(&ndoc)
+		if err != nil {
+			// dunno how to test this either
+			return nil, errors.New("mongostore decode nodes: " + err.Error())
+		}
+		node, err := toNode(ndoc)
+		if err != nil {
+			return nil, err // only possible if the db is corrupt
+		}
+		nodes = append(nodes, node)
+	}
+	if cur.Err() != nil {
+		return nil, errors.New("mongostore " + op + ": " + cur.Err().Error()) // dunno how to test
+	}
+	return nodes, nil
+}
+
+func toNode(ndoc map[string]interface{}) (*Node, error) {
 	opts := []func(*Node) error{}
 	opts = append(opts, Format(ndoc[keyNodesFormat].(string)))
 	opts = append(opts, FileName(ndoc[keyNodesFileName].(string)))
 	opts = append(opts, Public(ndoc[keyNodesPublic].(bool)))
+	opts = append(opts, Version(toVersion(ndoc[keyNodesVersion])))
+	// nodes stored prior to the addition of checksums have no checksum field.
+	if sdoc, ok := ndoc[keyNodesSums].(map[string]interface{}); ok {
+		sums := map[string]string{}
+		for alg, cs := range sdoc {
+			sums[alg] = cs.(string)
+		}
+		c, _ := values.NewChecksums(sums) // err must be nil unless db is corrupt
+		opts = append(opts, Checksums(*c))
+	}
+	// nodes stored prior to the addition of modified times have no modified time, in which case
+	// the modified time is the stored time.
+	if mod, ok := ndoc[keyNodesModified].(primitive.DateTime); ok {
+		opts = append(opts, Modified(toTime(mod)))
+	}
+	// nodes stored prior to files being shared have no file ID.
+	if fid, ok := ndoc[keyNodesFileID].(string); ok {
+		opts = append(opts, FileID(fid))
+	}
 	// I feel like I'm doing something wrong here, this seems nuts
 	for _, uinter := range []interface{}(ndoc[keyNodesReaders].(primitive.A)) {
 		u := uinter.(map[string]interface{})
@@ -316,6 +624,18 @@ func (s *MongoNodeStore) GetNode(id uuid.UUID) (*Node, error) {
 	)
 }
 
+// nodes stored prior to the addition of versions have no version field.
+func toVersion(v interface{}) int64 {
+	switch ver := v.(type) {
+	case int64:
+		return ver
+	case int32:
+		return int64(ver)
+	default:
+		return 0
+	}
+}
+
 // go driver 1.1.0 will have a DateTime.Time() method, this is copied from the prerelease code
 // https://github.com/mongodb/mongo-go-driver/blob/229a9c94a4735eccfc431ea183e0942de7569f58/bson/primitive/primitive.go#L45
 func toTime(d primitive.DateTime) time.Time {
@@ -338,64 +658,297 @@ func (s *MongoNodeStore) DeleteNode(id uuid.UUID) error {
 	return nil
 }
 
+// AddFile records a newly stored file with the given size and SHA-256 and a single reference,
+// and returns the file ID. If a file with the same size and SHA-256 has already been recorded,
+// a reference is added to that file and its ID is returned instead, in which case the caller is
+// responsible for deleting the new file.
+func (s *MongoNodeStore) AddFile(id string, size int64, sha256 string) (string, error) {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return "", errors.New("id cannot be empty")
+	}
+	if size < 1 {
+		return "", errors.New("size must be > 0")
+	}
+	sha256 = strings.ToLower(strings.TrimSpace(sha256))
+	if sha256 == "" {
+		return "", errors.New("sha256 cannot be empty")
+	}
+	filter := map[string]interface{}{keyFilesSHA: sha256, keyFilesSize: size}
+	update := map[string]interface{}{
+		"$inc":         map[string]interface{}{keyFilesRefs: int64(1)},
+		"$setOnInsert": map[string]interface{}{keyFilesID: id},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	for retry := false; ; retry = true {
+		res := s.db.Collection(colFiles).FindOneAndUpdate(nil, filter, update, opts)
+		var fdoc map[string]interface{}
+		err := res.Decode(&fdoc)
+		if err == nil {
+			return fdoc[keyFilesID].(string), nil
+		}
+		// if two identical files are added simultaneously, one upsert may fail. The record
+		// exists now, so try again.
+		if retry || !isMongoDuplicateKey(err) {
+			return "", errors.New("mongostore add file: " + err.Error()) // dunno how to test
+		}
+	}
+}
+
+// AddFileReference adds a reference to a file, for example when a node is copied. node is the ID
+// of a node using the file. Files that have not been recorded via AddFile are assumed to have a
+// single reference, held by that node, and NoNodeError is returned if the node does not exist.
+func (s *MongoNodeStore) AddFileReference(id string, node uuid.UUID) error {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return errors.New("id cannot be empty")
+	}
+	col := s.db.Collection(colFiles)
+	for retry := false; ; retry = true {
+		res, err := col.UpdateOne(nil, map[string]interface{}{keyFilesID: id},
+			map[string]interface{}{"$inc": map[string]interface{}{keyFilesRefs: int64(1)}})
+		if err != nil {
+			return errors.New("mongostore add file reference: " + err.Error()) // dunno how to test
+		}
+		if res.MatchedCount > 0 {
+			return nil
+		}
+		// the file has not been recorded, so it has a single reference if the node exists.
+		// Otherwise the reference may have been removed and the file deleted.
+		n, err := s.db.Collection(colNodes).CountDocuments(nil, nodeFilter(node))
+		if err != nil {
+			return errors.New("mongostore add file reference: " + err.Error()) // dunno how to test
+		}
+		if n < 1 {
+			return NewNoNodeError("No such node " + node.String())
+		}
+		_, err = col.InsertOne(nil, map[string]interface{}{keyFilesID: id, keyFilesRefs: int64(2)})
+		if err == nil {
+			return nil
+		}
+		// if a reference was added simultaneously the record exists now, so try again
+		if retry || !isMongoDuplicateKey(err) {
+			return errors.New("mongostore add file reference: " + err.Error()) // dunno how to test
+		}
+	}
+}
+
+// RemoveFileReference removes a reference to a file. If no references remain, the file record is
+// deleted and true is returned, in which case the caller is responsible for deleting the file.
+// Files that have not been recorded via AddFile are assumed to have a single reference.
+func (s *MongoNodeStore) RemoveFileReference(id string) (bool, error) {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return false, errors.New("id cannot be empty")
+	}
+	col := s.db.Collection(colFiles)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := col.FindOneAndUpdate(nil, map[string]interface{}{keyFilesID: id},
+		map[string]interface{}{"$inc": map[string]interface{}{keyFilesRefs: int64(-1)}}, opts)
+	var fdoc map[string]interface{}
+	err := res.Decode(&fdoc)
+	if err == mongo.ErrNoDocuments {
+		return true, nil // the file has not been recorded, so that was the only reference
+	}
+	if err != nil {
+		// dunno how to test
+		return false, errors.New("mongostore remove file reference: " + err.Error())
+	}
+	if fdoc[keyFilesRefs].(int64) > 0 {
+		return false, nil
+	}
+	// only delete the record if no references were added since it was decremented
+	dres, err := col.DeleteOne(nil, map[string]interface{}{
+		keyFilesID: id, keyFilesRefs: map[string]interface{}{"$lte": int64(0)}})
+	if err != nil {
+		// dunno how to test
+		return false, errors.New("mongostore remove file reference: " + err.Error())
+	}
+	return dres.DeletedCount > 0, nil
+}
+
 // SetNodePublic sets whether a node can be read by anyone, including anonymous users.
-// Returns NoNodeError if the node does not exist.
-func (s *MongoNodeStore) SetNodePublic(id uuid.UUID, public bool) error {
+// If version is not nil, the node is only altered if it is at the given version.
+// Returns the altered node.
+// Returns NoNodeError if the node does not exist and VersionMismatchError if the version does
+// not match.
+func (s *MongoNodeStore) SetNodePublic(id uuid.UUID, public bool, version *int64,
+) (*Node, error) {
+	cond := map[string]interface{}{keyNodesPublic: map[string]interface{}{"$ne": public}}
 	update := map[string]interface{}{"$set": map[string]interface{}{keyNodesPublic: public}}
-	return s.updateNode(id, update, "set node public")
+	return s.updateNode(id, version, cond, update, "set node public")
 }
 
-func (s *MongoNodeStore) updateNode(id uuid.UUID, update map[string]interface{}, op string) error {
-	res, err := s.db.Collection(colNodes).UpdateOne(nil, nodeFilter(id), update)
+// updateNode updates a node if the node matches the condition, which should match only if the
+// update would change the node, and increments the node's version. Returns the updated node,
+// or the unchanged node if the condition did not match.
+func (s *MongoNodeStore) updateNode(
+	id uuid.UUID,
+	version *int64,
+	cond map[string]interface{},
+	update map[string]interface{},
+	op string,
+) (*Node, error) {
+	filter := map[string]interface{}{keyNodesID: id.String()}
+	for k, v := range cond {
+		filter[k] = v
+	}
+	if version != nil {
+		if *version == 0 {
+			// nodes stored prior to the addition of versions have no version field
+			filter[keyNodesVersion] = map[string]interface{}{"$in": []interface{}{int64(0), nil}}
+		} else {
+			filter[keyNodesVersion] = *version
+		}
+	}
+	update["$inc"] = map[string]interface{}{keyNodesVersion: int64(1)}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := s.db.Collection(colNodes).FindOneAndUpdate(nil, filter, update, opts)
+	var ndoc map[string]interface{}
+	err := res.Decode(&ndoc)
+	if err == nil {
+		return toNode(ndoc)
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, errors.New("mongostore " + op + ": " + err.Error()) // dunno how to test this
+	}
+	// either the node doesn't exist, the version doesn't match, or the update would have no
+	// effect
+	node, err := s.GetNode(id)
 	if err != nil {
-		return errors.New("mongostore " + op + ": " + err.Error()) // dunno how to test this
+		return nil, err
 	}
-	if res.MatchedCount < 1 {
-		return NewNoNodeError("No such node " + id.String())
+	if version != nil && node.version != *version {
+		return nil, NewVersionMismatchError(id, *version, node.version)
 	}
-	return nil
+	return node, nil
 }
 
-// AddReader adds a user to a node's read ACL.
-// The caller is responsible for ensuring the user is valid - retrieving the user via
-// GetUser() is the proper way to do so.
-// Has no effect if the user is already in the read ACL.
-// Returns NoNodeError if the node does not exist.
-func (s *MongoNodeStore) AddReader(id uuid.UUID, user User) error {
+// AddReaders adds users to a node's read ACL.
+// The caller is responsible for ensuring the users are valid - retrieving users via
+// GetUser() or GetUsers() is the proper way to do so.
+// Has no effect for users that are already in the read ACL.
+// If version is not nil, the node is only altered if it is at the given version.
+// Returns the altered node.
+// Returns NoNodeError if the node does not exist and VersionMismatchError if the version does
+// not match.
+func (s *MongoNodeStore) AddReaders(id uuid.UUID, users []User, version *int64,
+) (*Node, error) {
+	if len(users) < 1 {
+		return nil, errors.New("users cannot be empty")
+	}
+	userdocs := []bson.D{}
+	missing := []interface{}{}
+	for _, u := range users {
+		userdoc := toUserDoc(u)
+		userdocs = append(userdocs, userdoc)
+		missing = append(missing,
+			map[string]interface{}{keyNodesReaders: map[string]interface{}{"$ne": userdoc}})
+	}
+	cond := map[string]interface{}{"$or": missing}
 	updatedoc := map[string]interface{}{
-		"$addToSet": map[string]interface{}{keyNodesReaders: toUserDoc(user)},
+		"$addToSet": map[string]interface{}{
+			keyNodesReaders: map[string]interface{}{"$each": userdocs},
+		},
 	}
-	return s.updateNode(id, updatedoc, "add reader")
+	return s.updateNode(id, version, cond, updatedoc, "add readers")
 }
 
-// RemoveReader removes a user from the node's read ACL.
-// Has no effect if the user is not in the read ACL or is the node owner.
-// Returns NoNodeError if the node does not exist.
-func (s *MongoNodeStore) RemoveReader(id uuid.UUID, user User) error {
-	userdoc := toUserDoc(user)
-	updatedoc := map[string]interface{}{
-		"$pull": map[string]interface{}{keyNodesReaders: userdoc},
+// RemoveReaders removes users from the node's read ACL.
+// Has no effect for users that are not in the read ACL or are the node owner.
+// If version is not nil, the node is only altered if it is at the given version.
+// Returns the altered node.
+// Returns NoNodeError if the node does not exist and VersionMismatchError if the version does
+// not match or the owner changed while the readers were being removed.
+func (s *MongoNodeStore) RemoveReaders(id uuid.UUID, users []User, version *int64,
+) (*Node, error) {
+	if len(users) < 1 {
+		return nil, errors.New("users cannot be empty")
+	}
+	// $pull conditions can't refer to other fields in the document, so the stored owner is
+	// needed to exclude the owner from the $pull.
+	node, err := s.GetNode(id)
+	if err != nil {
+		return nil, err
 	}
-	filterdoc := map[string]interface{}{
-		keyNodesID:    id.String(),
-		keyNodesOwner: map[string]interface{}{"$ne": userdoc},
+	return s.removeReaders(node, users, version)
+}
+
+// we split this method out so we can test a race condition where the owner changes between
+// the read in RemoveReaders and the update here. Consider this method part of RemoveReaders.
+func (s *MongoNodeStore) removeReaders(node *Node, users []User, version *int64,
+) (*Node, error) {
+	ownerid := node.owner.id.String()
+	ids := []string{}
+	for _, u := range users {
+		ids = append(ids, u.id.String())
+	}
+	removable := map[string]interface{}{"$in": ids, "$ne": ownerid}
+	cond := map[string]interface{}{
+		keyNodesOwner + "." + keyUserUUID: ownerid,
+		// don't alter the node if there are no readers to remove
+		keyNodesReaders: map[string]interface{}{
+			"$elemMatch": map[string]interface{}{keyUserUUID: removable},
+		},
 	}
-	res, err := s.db.Collection(colNodes).UpdateOne(nil, filterdoc, updatedoc)
+	updatedoc := map[string]interface{}{
+		"$pull": map[string]interface{}{
+			keyNodesReaders: map[string]interface{}{keyUserUUID: removable},
+		},
+	}
+	updated, err := s.updateNode(node.id, version, cond, updatedoc, "remove readers")
 	if err != nil {
-		return errors.New("mongostore remove reader: " + err.Error()) // dunno how to test this
+		return nil, err
 	}
-	if res.MatchedCount < 1 {
-		c, err := s.db.Collection(colNodes).CountDocuments(nil, nodeFilter(id))
-		if err != nil {
-			// dunno how to test this
-			return errors.New("mongostore remove reader count: " + err.Error())
-		}
-		if c < 1 {
-			return NewNoNodeError("No such node " + id.String())
+	if updated.owner.id != node.owner.id && hasRemovableReaders(updated, users) {
+		// the update wasn't applied because the owner changed
+		return nil, NewVersionMismatchError(node.id, node.version, updated.version)
+	}
+	return updated, nil
+}
+
+// hasRemovableReaders returns true if any of the users are readers of the node other than
+// the owner.
+func hasRemovableReaders(node *Node, users []User) bool {
+	for _, u := range users {
+		if u.id != node.owner.id && node.HasReader(u) {
+			return true
 		}
-		// otherwise we didn't match becauser the reader is the owner, so shit's cool
 	}
-	return nil
+	return false
+}
+
+// SetFileMetadata sets the filename and / or format of a node. A nil filename or format is not
+// changed. If the node changes, its modified time is set to the given time.
+// If version is not nil, the node is only altered if it is at the given version.
+// Returns the altered node.
+// Returns NoNodeError if the node does not exist and VersionMismatchError if the version does
+// not match.
+func (s *MongoNodeStore) SetFileMetadata(
+	id uuid.UUID,
+	filename *string,
+	format *string,
+	modified time.Time,
+	version *int64,
+) (*Node, error) {
+	set := map[string]interface{}{}
+	if filename != nil {
+		set[keyNodesFileName] = strings.TrimSpace(*filename)
+	}
+	if format != nil {
+		set[keyNodesFormat] = strings.TrimSpace(*format)
+	}
+	if len(set) < 1 {
+		return nil, errors.New("at least one of filename or format must be provided")
+	}
+	changed := []interface{}{}
+	for k, v := range set {
+		changed = append(changed, map[string]interface{}{k: map[string]interface{}{"$ne": v}})
+	}
+	cond := map[string]interface{}{"$or": changed}
+	set[keyNodesModified] = modified
+	update := map[string]interface{}{"$set": set}
+	return s.updateNode(id, version, cond, update, "set file metadata")
 }
 
 // ChangeOwner changes the owner of a node.
@@ -403,13 +956,16 @@ func (s *MongoNodeStore) RemoveReader(id uuid.UUID, user User) error {
 // GetUser() is the proper way to do so.
 // Adds the new owner the the read acl.
 // Setting the new owner to the current owner has no effect.
-// Returns NoNodeError if the node does not exist.
-func (s *MongoNodeStore) ChangeOwner(id uuid.UUID, user User) error {
+// If version is not nil, the node is only altered if it is at the given version.
+// Returns the altered node.
+// Returns NoNodeError if the node does not exist and VersionMismatchError if the version does
+// not match.
+func (s *MongoNodeStore) ChangeOwner(id uuid.UUID, user User, version *int64) (*Node, error) {
 	userdoc := toUserDoc(user)
+	cond := map[string]interface{}{keyNodesOwner: map[string]interface{}{"$ne": userdoc}}
 	updatedoc := map[string]interface{}{
 		"$set":      map[string]interface{}{keyNodesOwner: userdoc},
 		"$addToSet": map[string]interface{}{keyNodesReaders: userdoc},
 	}
-	return s.updateNode(id, updatedoc, "change owner")
-
+	return s.updateNode(id, version, cond, updatedoc, "change owner")
 }
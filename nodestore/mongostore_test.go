@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -201,6 +202,140 @@ func (t *TestSuite) TestGetUserFailBadInput() {
 	t.Equal(errors.New("accountName cannot be empty or whitespace only"), err, "incorrect error")
 }
 
+func (t *TestSuite) TestGetExistingUser() {
+	ns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+	u, err := ns.GetExistingUser("  nouser  ")
+	t.Nil(u, "expected nil user")
+	t.Equal(NewNoUserError("No such user nouser"), err, "incorrect error")
+
+	// check the user wasn't created
+	u, err = ns.GetExistingUser("nouser")
+	t.Nil(u, "expected nil user")
+	t.Equal(NewNoUserError("No such user nouser"), err, "incorrect error")
+
+	expected, err := ns.GetUser("nouser")
+	t.Nil(err, "unexpected error")
+	u, err = ns.GetExistingUser("  nouser  ")
+	t.Nil(err, "unexpected error")
+	t.Equal(expected, u, "incorrect user")
+
+	u, err = ns.GetExistingUser("  \t \n   ")
+	t.Nil(u, "expected nil user")
+	t.Equal(errors.New("accountName cannot be empty or whitespace only"), err, "incorrect error")
+}
+
+func (t *TestSuite) TestGetUsers() {
+	ns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+	u1, err := ns.GetUser("u1")
+	t.Nil(err, "unexpected error")
+
+	users, err := ns.GetUsers([]string{"  u2 ", "u1", "u3", "u2"})
+	t.Nil(err, "unexpected error")
+	t.Equal(3, len(users), "incorrect user count")
+	t.Equal(*u1, users[1], "incorrect user")
+	t.Equal("u2", users[0].GetAccountName(), "incorrect account name")
+	t.Equal("u3", users[2].GetAccountName(), "incorrect account name")
+
+	// check the new users were saved
+	for _, u := range []User{users[0], users[2]} {
+		got, err := ns.GetUser(u.GetAccountName())
+		t.Nil(err, "unexpected error")
+		t.Equal(u, *got, "incorrect user")
+	}
+
+	users2, err := ns.GetUsers([]string{"u3", "u2", "u1"})
+	t.Nil(err, "unexpected error")
+	t.Equal([]User{users[2], users[0], users[1]}, users2, "incorrect users")
+
+	users2, err = ns.GetUsers([]string{})
+	t.Nil(err, "unexpected error")
+	t.Equal([]User{}, users2, "incorrect users")
+}
+
+func (t *TestSuite) TestGetUsersFailBadInput() {
+	ns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+	users, err := ns.GetUsers([]string{"u1", "  \t \n   "})
+	t.Nil(users, "expected error")
+	t.Equal(errors.New("accountNames cannot be empty or whitespace only"), err,
+		"incorrect error")
+}
+
+func (t *TestSuite) TestRenameUser() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+	own, err := mns.GetUser("owner")
+	t.Nil(err, "unexpected error")
+	r, err := mns.GetUser("r")
+	t.Nil(err, "unexpected error")
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	tme := time.Now().UTC().Truncate(time.Millisecond)
+	n1, _ := NewNode(uuid.New(), *own, 78, *md5, tme)
+	n2, _ := NewNode(uuid.New(), *r, 42, *md5, tme, Reader(*own))
+	n3, _ := NewNode(uuid.New(), *r, 1, *md5, tme)
+	for _, n := range []*Node{n1, n2, n3} {
+		t.Nil(mns.StoreNode(n), "expected no error")
+	}
+
+	u, err := mns.RenameUser("  owner  ", "  newowner  ")
+	t.Nil(err, "unexpected error")
+	newown, _ := NewUser(own.GetID(), "newowner")
+	t.Equal(newown, u, "incorrect user")
+
+	got, err := mns.GetUser("newowner")
+	t.Nil(err, "unexpected error")
+	t.Equal(newown, got, "incorrect user")
+
+	// the old name is available for a new user
+	got, err = mns.GetUser("owner")
+	t.Nil(err, "unexpected error")
+	t.NotEqual(own.GetID(), got.GetID(), "expected new ID")
+
+	expected1, _ := NewNode(n1.GetID(), *newown, 78, *md5, tme, Version(3))
+	expected2, _ := NewNode(n2.GetID(), *r, 42, *md5, tme, Reader(*newown), Version(2))
+	nodes, err := mns.GetNodes([]uuid.UUID{n1.GetID(), n2.GetID(), n3.GetID()})
+	t.Nil(err, "unexpected error")
+	t.ElementsMatch([]*Node{expected1, expected2, n3}, nodes, "incorrect nodes")
+
+	// renaming to the current name has no effect
+	u, err = mns.RenameUser("newowner", "newowner")
+	t.Nil(err, "unexpected error")
+	t.Equal(newown, u, "incorrect user")
+	nodes, err = mns.GetNodes([]uuid.UUID{n1.GetID(), n2.GetID(), n3.GetID()})
+	t.Nil(err, "unexpected error")
+	t.ElementsMatch([]*Node{expected1, expected2, n3}, nodes, "incorrect nodes")
+}
+
+func (t *TestSuite) TestRenameUserFail() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "unexpected error")
+	_, err = mns.GetUser("u1")
+	t.Nil(err, "unexpected error")
+	_, err = mns.GetUser("u2")
+	t.Nil(err, "unexpected error")
+
+	type testcase struct {
+		name     string
+		newname  string
+		expected error
+	}
+
+	testcases := []testcase{
+		testcase{"  \t ", "u3", errors.New("account names cannot be empty or whitespace only")},
+		testcase{"u1", "   ", errors.New("account names cannot be empty or whitespace only")},
+		testcase{"u3", "u4", NewNoUserError("No such user u3")},
+		testcase{"u1", "u2", NewUserExistsError("User u2 already exists")},
+	}
+
+	for _, tc := range testcases {
+		u, err := mns.RenameUser(tc.name, tc.newname)
+		t.Nil(u, "expected error")
+		t.Equal(tc.expected, err, "incorrect error")
+	}
+}
+
 type mDup struct {
 	err   error
 	isDup bool
@@ -263,6 +398,32 @@ func (t *TestSuite) TestInternalsIsMongoDuplicateKey() {
 	}
 }
 
+func (t *TestSuite) TestInternalsIsMongoBulkDuplicateKey() {
+	// testing internals is often considered naughty
+	dup := mongo.BulkWriteError{WriteError: mongo.WriteError{Code: 11000}}
+	tests := []mDup{
+		mDup{err: errors.New("some error"), isDup: false},
+		mDup{
+			err: mongo.BulkWriteException{
+				WriteConcernError: &mongo.WriteConcernError{Code: 1},
+				WriteErrors:       []mongo.BulkWriteError{dup},
+			},
+			isDup: false},
+		mDup{
+			err: mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+				dup,
+				mongo.BulkWriteError{WriteError: mongo.WriteError{Code: 10000}},
+			}},
+			isDup: false},
+		mDup{
+			err:   mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{dup, dup}},
+			isDup: true},
+	}
+	for _, d := range tests {
+		t.Equal(d.isDup, isMongoBulkDuplicateKey(d.err), "incorrect duplicate detection")
+	}
+}
+
 func (t *TestSuite) TestStoreAndGetNodeMinimal() {
 	mns, err := NewMongoNodeStore(t.client.Database(testDB))
 	if err != nil {
@@ -302,6 +463,10 @@ func (t *TestSuite) TestStoreAndGetNodeMaximal() {
 	r2, _ := NewUser(rid2, "reader2")
 	tme := time.Now()
 	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	sums, _ := values.NewChecksums(map[string]string{
+		"sha1":   "5f5513f8822fdbe5145af33b64d8d970dcf95c6e",
+		"crc32c": "8636640e",
+	})
 	n, _ := NewNode(
 		nid,
 		*own,
@@ -313,6 +478,9 @@ func (t *TestSuite) TestStoreAndGetNodeMaximal() {
 		Public(true),
 		Reader(*r1),
 		Reader(*r2),
+		Checksums(*sums),
+		FileID("f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"),
+		Modified(tme.Add(time.Hour)),
 	)
 	err = mns.StoreNode(n)
 	if err != nil {
@@ -324,6 +492,7 @@ func (t *TestSuite) TestStoreAndGetNodeMaximal() {
 	}
 	// time loses precision when stored in mongo
 	testhelpers.AssertWithin1MS(t.T(), tme, ngot.GetStoredTime())
+	testhelpers.AssertWithin1MS(t.T(), tme.Add(time.Hour), ngot.GetModifiedTime())
 	nexpected, _ := NewNode(
 		nid,
 		*own,
@@ -335,6 +504,9 @@ func (t *TestSuite) TestStoreAndGetNodeMaximal() {
 		Public(true),
 		Reader(*r1),
 		Reader(*r2),
+		Checksums(*sums),
+		FileID("f6/02/9a/f6029a11-0914-42b3-beea-fed420f75d7d"),
+		Modified(ngot.GetModifiedTime()),
 	)
 	t.Equal(nexpected, ngot, "incorrect node")
 }
@@ -386,6 +558,72 @@ func (t *TestSuite) TestGetNodeFailNoNode() {
 	t.Equal(NewNoNodeError("No such node "+nid2.String()), err, "incorrect error")
 }
 
+func (t *TestSuite) TestGetNodes() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	r, _ := NewUser(uuid.New(), "r")
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	tme := time.Now().UTC().Truncate(time.Millisecond)
+	n1, _ := NewNode(uuid.New(), *own, 78, *md5, tme, FileName("f"))
+	n2, _ := NewNode(uuid.New(), *own, 42, *md5, tme, Reader(*r), Public(true))
+	n3, _ := NewNode(uuid.New(), *own, 1, *md5, tme)
+	for _, n := range []*Node{n1, n2, n3} {
+		t.Nil(mns.StoreNode(n), "expected no error")
+	}
+
+	nodes, err := mns.GetNodes([]uuid.UUID{n2.GetID(), uuid.New(), n1.GetID()})
+	t.Nil(err, "expected no error")
+	t.ElementsMatch([]*Node{n1, n2}, nodes, "incorrect nodes")
+
+	nodes, err = mns.GetNodes([]uuid.UUID{uuid.New()})
+	t.Nil(err, "expected no error")
+	t.Equal([]*Node{}, nodes, "incorrect nodes")
+
+	nodes, err = mns.GetNodes(nil)
+	t.Nil(err, "expected no error")
+	t.Equal([]*Node{}, nodes, "incorrect nodes")
+}
+
+func (t *TestSuite) TestGetNodesByOwnerAndReader() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	r, _ := NewUser(uuid.New(), "r")
+	other, _ := NewUser(uuid.New(), "other")
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	tme := time.Now().UTC().Truncate(time.Millisecond)
+	n1, _ := NewNode(uuid.New(), *own, 78, *md5, tme, Reader(*r))
+	n2, _ := NewNode(uuid.New(), *own, 42, *md5, tme)
+	n3, _ := NewNode(uuid.New(), *other, 1, *md5, tme, Reader(*r))
+	n4, _ := NewNode(uuid.New(), *other, 1, *md5, tme)
+	for _, n := range []*Node{n1, n2, n3, n4} {
+		t.Nil(mns.StoreNode(n), "expected no error")
+	}
+
+	nodes, err := mns.GetNodesByOwner(*own)
+	t.Nil(err, "expected no error")
+	t.ElementsMatch([]*Node{n1, n2}, nodes, "incorrect nodes")
+
+	nodes, err = mns.GetNodesByOwner(*r)
+	t.Nil(err, "expected no error")
+	t.Equal([]*Node{}, nodes, "incorrect nodes")
+
+	nodes, err = mns.GetNodesByReader(*own)
+	t.Nil(err, "expected no error")
+	t.ElementsMatch([]*Node{n1, n2}, nodes, "incorrect nodes")
+
+	nodes, err = mns.GetNodesByReader(*r)
+	t.Nil(err, "expected no error")
+	t.ElementsMatch([]*Node{n1, n3}, nodes, "incorrect nodes")
+
+	// users are matched by ID, not account name
+	r2, _ := NewUser(uuid.New(), "r")
+	nodes, err = mns.GetNodesByReader(*r2)
+	t.Nil(err, "expected no error")
+	t.Equal([]*Node{}, nodes, "incorrect nodes")
+}
+
 func (t *TestSuite) TestDeleteNode() {
 	mns, err := NewMongoNodeStore(t.client.Database(testDB))
 	t.Nil(err, "expected no error")
@@ -428,7 +666,7 @@ func (t *TestSuite) TestSetNodePublic() {
 	err = mns.StoreNode(n)
 	t.Nil(err, "expected no error")
 
-	err = mns.SetNodePublic(nid, true)
+	nret, err := mns.SetNodePublic(nid, true, nil)
 	t.Nil(err, "expected no error")
 
 	ngot, err := mns.GetNode(nid)
@@ -441,10 +679,12 @@ func (t *TestSuite) TestSetNodePublic() {
 		*md5,
 		ngot.GetStoredTime(),
 		Public(true),
+		Version(2),
 	)
 	t.Equal(nexpected, ngot, "incorrect node")
+	t.Equal(nexpected, nret, "incorrect node")
 
-	err = mns.SetNodePublic(nid, false)
+	nret, err = mns.SetNodePublic(nid, false, nil)
 	t.Nil(err, "expected no error")
 
 	ngot, err = mns.GetNode(nid)
@@ -457,8 +697,15 @@ func (t *TestSuite) TestSetNodePublic() {
 		*md5,
 		ngot.GetStoredTime(),
 		Public(false),
+		Version(3),
 	)
 	t.Equal(nexpected, ngot, "incorrect node")
+	t.Equal(nexpected, nret, "incorrect node")
+
+	// no change, so no version increment
+	nret, err = mns.SetNodePublic(nid, false, nil)
+	t.Nil(err, "expected no error")
+	t.Equal(nexpected, nret, "incorrect node")
 }
 
 func (t *TestSuite) TestSetNodePublicFailNoNode() {
@@ -471,11 +718,15 @@ func (t *TestSuite) TestSetNodePublicFailNoNode() {
 	t.Nil(err, "expected no error")
 
 	nid := uuid.New()
-	err = mns.SetNodePublic(nid, true)
-	t.Equal(NewNoNodeError("No such node "+nid.String()), err, "incorrect error")
+	ver := int64(1)
+	for _, v := range []*int64{nil, &ver} {
+		node, err := mns.SetNodePublic(nid, true, v)
+		t.Nil(node, "expected error")
+		t.Equal(NewNoNodeError("No such node "+nid.String()), err, "incorrect error")
+	}
 }
 
-func (t *TestSuite) TestAddAndRemoveReader() {
+func (t *TestSuite) TestAddAndRemoveReaders() {
 	mns, err := NewMongoNodeStore(t.client.Database(testDB))
 	t.Nil(err, "expected no error")
 	own, _ := NewUser(uuid.New(), "owner")
@@ -488,41 +739,77 @@ func (t *TestSuite) TestAddAndRemoveReader() {
 
 	r1, _ := NewUser(uuid.New(), "r1")
 	r2, _ := NewUser(uuid.New(), "r2")
+	r3, _ := NewUser(uuid.New(), "r3")
 
-	err = mns.AddReader(nid, *r1)
+	nret, err := mns.AddReaders(nid, []User{*r1}, nil)
 	t.Nil(err, "expected no error")
 	node, err := mns.GetNode(nid)
 	t.Nil(err, "expected no error")
 
 	tme := node.GetStoredTime()
 
-	expected, _ := NewNode(nid, *own, 78, *md5, tme, Reader(*r1))
+	expected, _ := NewNode(nid, *own, 78, *md5, tme, Reader(*r1), Version(2))
 	t.Equal(expected, node, "incorrect node")
+	t.Equal(expected, nret, "incorrect node")
 
-	err = mns.AddReader(nid, *r2)
+	// users already in the acl are ignored
+	nret, err = mns.AddReaders(nid, []User{*r2, *r1, *own, *r3}, nil)
 	t.Nil(err, "expected no error")
 	node, err = mns.GetNode(nid)
 	t.Nil(err, "expected no error")
 
 	expected, _ = NewNode(nid, *own, 78, *md5, tme,
-		Reader(*r1), Reader(*r2))
+		Reader(*r1), Reader(*r2), Reader(*r3), Version(3))
 	t.Equal(expected, node, "incorrect node")
+	t.Equal(expected, nret, "incorrect node")
 
-	err = mns.RemoveReader(nid, *r1)
+	nret, err = mns.RemoveReaders(nid, []User{*r1, *r3}, nil)
 	t.Nil(err, "expected no error")
 	node, err = mns.GetNode(nid)
 	t.Nil(err, "expected no error")
 
-	expected, _ = NewNode(nid, *own, 78, *md5, tme, Reader(*r2))
+	expected, _ = NewNode(nid, *own, 78, *md5, tme, Reader(*r2), Version(4))
 	t.Equal(expected, node, "incorrect node")
+	t.Equal(expected, nret, "incorrect node")
 
-	err = mns.RemoveReader(nid, *r2)
+	// users not in the acl and the owner are ignored
+	nret, err = mns.RemoveReaders(nid, []User{*r1, *own, *r2}, nil)
 	t.Nil(err, "expected no error")
 	node, err = mns.GetNode(nid)
 	t.Nil(err, "expected no error")
 
-	expected, _ = NewNode(nid, *own, 78, *md5, tme)
+	expected, _ = NewNode(nid, *own, 78, *md5, tme, Version(5))
 	t.Equal(expected, node, "incorrect node")
+	t.Equal(expected, nret, "incorrect node")
+}
+
+func (t *TestSuite) TestAddManyReaders() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	nid := uuid.New()
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	n, _ := NewNode(nid, *own, 78, *md5, time.Now())
+
+	err = mns.StoreNode(n)
+	t.Nil(err, "expected no error")
+
+	names := []string{}
+	for i := 0; i < 200; i++ {
+		names = append(names, fmt.Sprintf("user%v", i))
+	}
+	users, err := mns.GetUsers(names)
+	t.Nil(err, "expected no error")
+
+	node, err := mns.AddReaders(nid, users, nil)
+	t.Nil(err, "expected no error")
+	t.Equal(201, len(*node.GetReaders()), "incorrect reader count")
+	t.Equal(int64(2), node.GetVersion(), "incorrect version")
+
+	node, err = mns.RemoveReaders(nid, users, nil)
+	t.Nil(err, "expected no error")
+	t.Equal(&[]User{*own}, node.GetReaders(), "incorrect readers")
+	t.Equal(int64(3), node.GetVersion(), "incorrect version")
 }
 
 func (t *TestSuite) TestAddOwnerAsReader() {
@@ -537,7 +824,7 @@ func (t *TestSuite) TestAddOwnerAsReader() {
 	err = mns.StoreNode(n)
 	t.Nil(err, "expected no error")
 
-	err = mns.AddReader(nid, *own)
+	nret, err := mns.AddReaders(nid, []User{*own}, nil)
 	t.Nil(err, "expected no error")
 
 	node, err := mns.GetNode(nid)
@@ -545,6 +832,7 @@ func (t *TestSuite) TestAddOwnerAsReader() {
 
 	expected, _ := NewNode(nid, *own, 78, *md5, node.GetStoredTime())
 	t.Equal(expected, node, "incorrect node")
+	t.Equal(expected, nret, "incorrect node")
 }
 
 func (t *TestSuite) TestRemoveOwnerAsReader() {
@@ -559,7 +847,7 @@ func (t *TestSuite) TestRemoveOwnerAsReader() {
 	err = mns.StoreNode(n)
 	t.Nil(err, "expected no error")
 
-	err = mns.RemoveReader(nid, *own)
+	nret, err := mns.RemoveReaders(nid, []User{*own}, nil)
 	t.Nil(err, "expected no error")
 
 	node, err := mns.GetNode(nid)
@@ -567,6 +855,7 @@ func (t *TestSuite) TestRemoveOwnerAsReader() {
 
 	expected, _ := NewNode(nid, *own, 78, *md5, node.GetStoredTime())
 	t.Equal(expected, node, "incorrect node")
+	t.Equal(expected, nret, "incorrect node")
 }
 
 func (t *TestSuite) TestAddReaderTwice() {
@@ -583,17 +872,18 @@ func (t *TestSuite) TestAddReaderTwice() {
 
 	r, _ := NewUser(uuid.New(), "r")
 
-	err = mns.AddReader(nid, *r)
+	_, err = mns.AddReaders(nid, []User{*r}, nil)
 	t.Nil(err, "expected no error")
 
 	node, err := mns.GetNode(nid)
 	expected, _ := NewNode(nid, *own, 78, *md5, node.GetStoredTime(),
-		Reader(*r))
+		Reader(*r), Version(2))
 	t.Nil(err, "expected no error")
 	t.Equal(expected, node, "incorrect node")
 
-	err = mns.AddReader(nid, *r)
+	nret, err := mns.AddReaders(nid, []User{*r, *own, *r}, nil)
 	t.Nil(err, "expected no error")
+	t.Equal(expected, nret, "incorrect node")
 
 	node, err = mns.GetNode(nid)
 	t.Nil(err, "expected no error")
@@ -623,16 +913,31 @@ func (t *TestSuite) TestRemoveNonReader() {
 		Reader(*r1))
 	t.Equal(expected, node, "incorrect node")
 
-	for _, r := range []User{*r2, *r3, *r4} {
-		err = mns.RemoveReader(nid, r)
+	for _, r := range [][]User{{*r2}, {*r3}, {*r4}, {*r2, *r3, *r4}} {
+		nret, err := mns.RemoveReaders(nid, r, nil)
 		t.Nil(err, "expected no error")
+		t.Equal(expected, nret, "incorrect node")
 		node, err := mns.GetNode(nid)
 		t.Nil(err, "expected no error")
 		t.Equal(expected, node, "incorrect node")
 	}
 }
 
-func (t *TestSuite) TestAddReaderFailNoNode() {
+func (t *TestSuite) TestAddAndRemoveReadersFailNoUsers() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	nid := uuid.New()
+	for _, u := range [][]User{nil, {}} {
+		node, err := mns.AddReaders(nid, u, nil)
+		t.Nil(node, "expected error")
+		t.Equal(errors.New("users cannot be empty"), err, "incorrect error")
+		node, err = mns.RemoveReaders(nid, u, nil)
+		t.Nil(node, "expected error")
+		t.Equal(errors.New("users cannot be empty"), err, "incorrect error")
+	}
+}
+
+func (t *TestSuite) TestAddReadersFailNoNode() {
 	mns, err := NewMongoNodeStore(t.client.Database(testDB))
 	t.Nil(err, "expected no error")
 	own, _ := NewUser(uuid.New(), "owner")
@@ -643,11 +948,12 @@ func (t *TestSuite) TestAddReaderFailNoNode() {
 	t.Nil(err, "expected no error")
 
 	nid := uuid.New()
-	err = mns.AddReader(nid, *own)
+	node, err := mns.AddReaders(nid, []User{*own}, nil)
+	t.Nil(node, "expected error")
 	t.Equal(NewNoNodeError("No such node "+nid.String()), err, "incorrect error")
 }
 
-func (t *TestSuite) TestRemoveReaderFailNoNode() {
+func (t *TestSuite) TestRemoveReadersFailNoNode() {
 	mns, err := NewMongoNodeStore(t.client.Database(testDB))
 	t.Nil(err, "expected no error")
 	own, _ := NewUser(uuid.New(), "owner")
@@ -658,10 +964,171 @@ func (t *TestSuite) TestRemoveReaderFailNoNode() {
 	t.Nil(err, "expected no error")
 
 	nid := uuid.New()
-	err = mns.RemoveReader(nid, *own)
+	node, err := mns.RemoveReaders(nid, []User{*own}, nil)
+	t.Nil(node, "expected error")
 	t.Equal(NewNoNodeError("No such node "+nid.String()), err, "incorrect error")
 }
 
+func (t *TestSuite) TestRemoveReadersIncludingOwnerWithVersion() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	r1, _ := NewUser(uuid.New(), "r1")
+	r2, _ := NewUser(uuid.New(), "r2")
+	nid := uuid.New()
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	n, _ := NewNode(nid, *own, 78, *md5, time.Now(), Reader(*r1), Reader(*r2))
+	err = mns.StoreNode(n)
+	t.Nil(err, "expected no error")
+
+	// the owner is never removed and removing only the owner has no effect
+	v1 := int64(1)
+	node, err := mns.RemoveReaders(nid, []User{*own}, &v1)
+	t.Nil(err, "expected no error")
+	t.Equal(int64(1), node.GetVersion(), "incorrect version")
+	t.Equal(&[]User{*own, *r1, *r2}, node.GetReaders(), "incorrect readers")
+
+	node, err = mns.RemoveReaders(nid, []User{*r1, *own}, &v1)
+	t.Nil(err, "expected no error")
+	t.Equal(int64(2), node.GetVersion(), "incorrect version")
+	t.Equal(&[]User{*own, *r2}, node.GetReaders(), "incorrect readers")
+
+	node, err = mns.RemoveReaders(nid, []User{*own, *r2}, &v1)
+	t.Nil(node, "expected error")
+	t.Equal(NewVersionMismatchError(nid, 1, 2), err, "incorrect error")
+}
+
+func (t *TestSuite) TestRemoveReadersOwnerChanged() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	r1, _ := NewUser(uuid.New(), "r1")
+	r2, _ := NewUser(uuid.New(), "r2")
+	nid := uuid.New()
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	n, _ := NewNode(nid, *own, 78, *md5, time.Now(), Reader(*r1), Reader(*r2))
+	err = mns.StoreNode(n)
+	t.Nil(err, "expected no error")
+	stale, err := mns.GetNode(nid)
+	t.Nil(err, "expected no error")
+
+	// the owner changes after the node is read in RemoveReaders
+	_, err = mns.ChangeOwner(nid, *r1, nil)
+	t.Nil(err, "expected no error")
+
+	node, err := mns.removeReaders(stale, []User{*own, *r1, *r2}, nil)
+	t.Nil(node, "expected error")
+	t.Equal(NewVersionMismatchError(nid, 1, 2), err, "incorrect error")
+
+	// the node is unchanged
+	node, err = mns.GetNode(nid)
+	t.Nil(err, "expected no error")
+	t.Equal(*r1, node.GetOwner(), "incorrect owner")
+	t.Equal(&[]User{*own, *r1, *r2}, node.GetReaders(), "incorrect readers")
+
+	// removing readers that aren't present has no effect, even if the owner changed
+	r3, _ := NewUser(uuid.New(), "r3")
+	node, err = mns.removeReaders(stale, []User{*r3}, nil)
+	t.Nil(err, "expected no error")
+	t.Equal(int64(2), node.GetVersion(), "incorrect version")
+}
+
+func (t *TestSuite) TestSetFileMetadata() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	nid := uuid.New()
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	n, _ := NewNode(nid, *own, 78, *md5, time.Now(), FileName("fn"), Format("fmt"))
+	err = mns.StoreNode(n)
+	t.Nil(err, "expected no error")
+	stored := n.GetStoredTime().UTC().Truncate(time.Millisecond)
+
+	type testcase struct {
+		filename     *string
+		format       *string
+		expfilename  string
+		expformat    string
+		expversion   int64
+		expmodchange bool
+	}
+
+	ptr := func(s string) *string { return &s }
+
+	testcases := []testcase{
+		testcase{ptr("  fn2  "), nil, "fn2", "fmt", 2, true},
+		testcase{nil, ptr("fmt2"), "fn2", "fmt2", 3, true},
+		testcase{ptr("fn3"), ptr(""), "fn3", "", 4, true},
+		// no change, so no version increment or modified time change
+		testcase{ptr("fn3"), ptr("  "), "fn3", "", 4, false},
+		testcase{ptr("fn3"), nil, "fn3", "", 4, false},
+	}
+
+	mod := stored
+	for i, tc := range testcases {
+		newmod := stored.Add(time.Duration(i+1) * time.Hour)
+		if tc.expmodchange {
+			mod = newmod
+		}
+		nret, err := mns.SetFileMetadata(nid, tc.filename, tc.format, newmod, nil)
+		t.Nil(err, "expected no error")
+
+		ngot, err := mns.GetNode(nid)
+		t.Nil(err, "expected no error")
+
+		testhelpers.AssertWithin1MS(t.T(), stored, ngot.GetStoredTime())
+		nexpected, _ := NewNode(nid, *own, 78, *md5, ngot.GetStoredTime(),
+			FileName(tc.expfilename), Format(tc.expformat), Version(tc.expversion),
+			Modified(mod))
+		t.Equal(nexpected, ngot, "incorrect node")
+		t.Equal(nexpected, nret, "incorrect node")
+	}
+}
+
+func (t *TestSuite) TestGetNodeWithoutModifiedTime() {
+	// nodes stored prior to the addition of modified times have no modified time field
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	nid := uuid.New()
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	n, _ := NewNode(nid, *own, 78, *md5, time.Now(), Modified(time.Now().Add(time.Hour)))
+	err = mns.StoreNode(n)
+	t.Nil(err, "expected no error")
+	_, err = t.client.Database(testDB).Collection("nodes").UpdateOne(nil,
+		map[string]interface{}{"id": nid.String()},
+		map[string]interface{}{"$unset": map[string]interface{}{"mod": ""}})
+	t.Nil(err, "expected no error")
+
+	node, err := mns.GetNode(nid)
+	t.Nil(err, "expected no error")
+	t.Equal(node.GetStoredTime(), node.GetModifiedTime(), "incorrect modified time")
+}
+
+func (t *TestSuite) TestSetFileMetadataFailBadInput() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+
+	node, err := mns.SetFileMetadata(uuid.New(), nil, nil, time.Now(), nil)
+	t.Nil(node, "expected error")
+	t.Equal(errors.New("at least one of filename or format must be provided"), err,
+		"incorrect error")
+}
+
+func (t *TestSuite) TestSetFileMetadataFailNoNode() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+
+	nid := uuid.New()
+	fn := "fn"
+	ver := int64(1)
+	for _, v := range []*int64{nil, &ver} {
+		node, err := mns.SetFileMetadata(nid, &fn, nil, time.Now(), v)
+		t.Nil(node, "expected error")
+		t.Equal(NewNoNodeError("No such node "+nid.String()), err, "incorrect error")
+	}
+}
+
 func (t *TestSuite) TestChangeOwner() {
 	// tests that user is added to the read acl if made owner
 	mns, err := NewMongoNodeStore(t.client.Database(testDB))
@@ -684,19 +1151,22 @@ func (t *TestSuite) TestChangeOwner() {
 	t.Equal(expected, node, "incorrect node")
 
 	// test that changing to the current owner has no effect
-	err = mns.ChangeOwner(nid, *own)
+	nret, err := mns.ChangeOwner(nid, *own, nil)
+	t.Nil(err, "expected no error")
+	t.Equal(expected, nret, "incorrect node")
 	node, err = mns.GetNode(nid)
 	t.Nil(err, "expected no error")
 	t.Equal(expected, node, "incorrect node")
 
 	// actually change the owner
-	err = mns.ChangeOwner(nid, *newown)
+	nret, err = mns.ChangeOwner(nid, *newown, nil)
 	t.Nil(err, "expected no error")
 	node, err = mns.GetNode(nid)
 	t.Nil(err, "expected no error")
 
-	expected, _ = NewNode(nid, *newown, 78, *md5, tme, Reader(*own))
+	expected, _ = NewNode(nid, *newown, 78, *md5, tme, Reader(*own), Version(2))
 	t.Equal(expected, node, "incorrect node")
+	t.Equal(expected, nret, "incorrect node")
 }
 
 func (t *TestSuite) TestChangeOwnerFailNoNode() {
@@ -711,10 +1181,110 @@ func (t *TestSuite) TestChangeOwnerFailNoNode() {
 
 	nid := uuid.New()
 	newown, _ := NewUser(uuid.New(), "newowner")
-	err = mns.ChangeOwner(nid, *newown)
+	node, err := mns.ChangeOwner(nid, *newown, nil)
+	t.Nil(node, "expected error")
 	t.Equal(NewNoNodeError("No such node "+nid.String()), err, "incorrect error")
 }
 
+func (t *TestSuite) TestUpdateWithVersion() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	r, _ := NewUser(uuid.New(), "r")
+	nid := uuid.New()
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	n, _ := NewNode(nid, *own, 78, *md5, time.Now())
+
+	err = mns.StoreNode(n)
+	t.Nil(err, "expected no error")
+	tme := n.GetStoredTime().UTC().Truncate(time.Millisecond)
+
+	v1 := int64(1)
+	v2 := int64(2)
+	v3 := int64(3)
+	v4 := int64(4)
+	node, err := mns.AddReaders(nid, []User{*r}, &v1)
+	t.Nil(err, "expected no error")
+	t.Equal(int64(2), node.GetVersion(), "incorrect version")
+	node, err = mns.SetNodePublic(nid, true, &v2)
+	t.Nil(err, "expected no error")
+	t.Equal(int64(3), node.GetVersion(), "incorrect version")
+	node, err = mns.RemoveReaders(nid, []User{*r}, &v3)
+	t.Nil(err, "expected no error")
+	t.Equal(int64(4), node.GetVersion(), "incorrect version")
+	node, err = mns.ChangeOwner(nid, *r, &v4)
+	t.Nil(err, "expected no error")
+	testhelpers.AssertWithin1MS(t.T(), tme, node.GetStoredTime())
+	expected, _ := NewNode(nid, *r, 78, *md5, node.GetStoredTime(), Reader(*own), Public(true),
+		Version(5))
+	t.Equal(expected, node, "incorrect node")
+
+	// no op updates succeed if the version matches
+	v5 := int64(5)
+	node, err = mns.ChangeOwner(nid, *r, &v5)
+	t.Nil(err, "expected no error")
+	t.Equal(expected, node, "incorrect node")
+
+	// mismatched versions fail, whether or not the update would change the node
+	for _, v := range []int64{0, 1, 4, 6} {
+		ver := v
+		verr := NewVersionMismatchError(nid, v, 5)
+		node, err = mns.SetNodePublic(nid, false, &ver)
+		t.Nil(node, "expected error")
+		t.Equal(verr, err, "incorrect error")
+		node, err = mns.SetNodePublic(nid, true, &ver)
+		t.Nil(node, "expected error")
+		t.Equal(verr, err, "incorrect error")
+		node, err = mns.AddReaders(nid, []User{*own}, &ver)
+		t.Nil(node, "expected error")
+		t.Equal(verr, err, "incorrect error")
+		node, err = mns.RemoveReaders(nid, []User{*own}, &ver)
+		t.Nil(node, "expected error")
+		t.Equal(verr, err, "incorrect error")
+		node, err = mns.ChangeOwner(nid, *own, &ver)
+		t.Nil(node, "expected error")
+		t.Equal(verr, err, "incorrect error")
+		fn := "fn"
+		node, err = mns.SetFileMetadata(nid, &fn, nil, time.Now(), &ver)
+		t.Nil(node, "expected error")
+		t.Equal(verr, err, "incorrect error")
+	}
+	node, err = mns.GetNode(nid)
+	t.Nil(err, "expected no error")
+	t.Equal(expected, node, "incorrect node")
+}
+
+func (t *TestSuite) TestUpdateUnversionedNode() {
+	// nodes stored prior to the addition of versions have no version field
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	own, _ := NewUser(uuid.New(), "owner")
+	nid := uuid.New()
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	n, _ := NewNode(nid, *own, 78, *md5, time.Now())
+	err = mns.StoreNode(n)
+	t.Nil(err, "expected no error")
+	_, err = t.client.Database(testDB).Collection("nodes").UpdateOne(nil,
+		map[string]interface{}{"id": nid.String()},
+		map[string]interface{}{"$unset": map[string]interface{}{"ver": ""}})
+	t.Nil(err, "expected no error")
+
+	node, err := mns.GetNode(nid)
+	t.Nil(err, "expected no error")
+	t.Equal(int64(0), node.GetVersion(), "incorrect version")
+
+	v1 := int64(1)
+	node, err = mns.SetNodePublic(nid, true, &v1)
+	t.Nil(node, "expected error")
+	t.Equal(NewVersionMismatchError(nid, 1, 0), err, "incorrect error")
+
+	v0 := int64(0)
+	node, err = mns.SetNodePublic(nid, true, &v0)
+	t.Nil(err, "expected no error")
+	t.Equal(int64(1), node.GetVersion(), "incorrect version")
+	t.Equal(true, node.GetPublic(), "incorrect public")
+}
+
 func (t *TestSuite) TestCollections() {
 	// for some reason that's beyond me the mongo go client returns the collection names and
 	// the index names in the same list for mongo 2.X...
@@ -787,8 +1357,10 @@ func (t *TestSuite) TestUserIndexes() {
 
 func (t *TestSuite) TestNodeIndexes() {
 	expected := map[string]bool{
-		"_id_": false,
-		"id_1": true,
+		"_id_":      false,
+		"id_1":      true,
+		"own.id_1":  false,
+		"read.id_1": false,
 	}
 	t.checkIndexes("nodes", testDB+".nodes", expected)
 }
@@ -827,3 +1399,124 @@ func (t *TestSuite) checkIndexes(
 	}
 	t.Equal(expectedIndexes, names, "incorrect indexes")
 }
+
+func (t *TestSuite) TestAddFile() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	sha := "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29"
+
+	id, err := mns.AddFile("  fid1  ", 12, sha)
+	t.Nil(err, "expected no error")
+	t.Equal("fid1", id, "incorrect id")
+
+	// identical content shares the first file
+	id, err = mns.AddFile("fid2", 12, "  "+strings.ToUpper(sha)+"  ")
+	t.Nil(err, "expected no error")
+	t.Equal("fid1", id, "incorrect id")
+
+	// different sizes or checksums are different files
+	id, err = mns.AddFile("fid3", 13, sha)
+	t.Nil(err, "expected no error")
+	t.Equal("fid3", id, "incorrect id")
+	id, err = mns.AddFile("fid4", 12, "dd"+sha[2:])
+	t.Nil(err, "expected no error")
+	t.Equal("fid4", id, "incorrect id")
+
+	// fid1 has two references
+	last, err := mns.RemoveFileReference("fid1")
+	t.Nil(err, "expected no error")
+	t.False(last, "expected references to remain")
+	last, err = mns.RemoveFileReference("fid1")
+	t.Nil(err, "expected no error")
+	t.True(last, "expected no references to remain")
+
+	// once all references are gone, new identical content is stored anew
+	id, err = mns.AddFile("fid5", 12, sha)
+	t.Nil(err, "expected no error")
+	t.Equal("fid5", id, "incorrect id")
+}
+
+func (t *TestSuite) TestAddFileFailBadInput() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+	sha := "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29"
+
+	type testcase struct {
+		id   string
+		size int64
+		sha  string
+		err  error
+	}
+
+	testcases := []testcase{
+		testcase{"  \t  ", 12, sha, errors.New("id cannot be empty")},
+		testcase{"fid", 0, sha, errors.New("size must be > 0")},
+		testcase{"fid", 12, "   ", errors.New("sha256 cannot be empty")},
+	}
+	for _, tc := range testcases {
+		id, err := mns.AddFile(tc.id, tc.size, tc.sha)
+		t.Equal("", id, "expected error")
+		t.Equal(tc.err, err, "incorrect error")
+	}
+}
+
+func (t *TestSuite) TestFileReferences() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+
+	_, err = mns.AddFile(
+		"fid1", 12, "cc57129a45495196afb880a3861aabf218b4028cfd3717816f93d8c5d998ec29")
+	t.Nil(err, "expected no error")
+	// the node is not checked for recorded files
+	t.Nil(mns.AddFileReference("  fid1  ", uuid.New()), "expected no error")
+	t.Nil(mns.AddFileReference("fid1", uuid.New()), "expected no error")
+
+	for _, expected := range []bool{false, false, true} {
+		last, err := mns.RemoveFileReference("  fid1  ")
+		t.Nil(err, "expected no error")
+		t.Equal(expected, last, "incorrect last reference")
+	}
+}
+
+func (t *TestSuite) TestFileReferencesUnrecordedFile() {
+	// files stored before files could be shared have no record and a single reference
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+
+	last, err := mns.RemoveFileReference("fid1")
+	t.Nil(err, "expected no error")
+	t.True(last, "expected no references to remain")
+
+	own, err := mns.GetUser("owner")
+	t.Nil(err, "unexpected error")
+	md5, _ := values.NewMD5("1b9554867d35f0d59e4705f6b2712cd1")
+	n, _ := NewNode(uuid.New(), *own, 78, *md5, time.Now())
+	t.Nil(mns.StoreNode(n), "expected no error")
+
+	t.Nil(mns.AddFileReference("fid2", n.GetID()), "expected no error")
+	t.Nil(mns.AddFileReference("fid2", n.GetID()), "expected no error")
+	for _, expected := range []bool{false, false, true} {
+		last, err := mns.RemoveFileReference("fid2")
+		t.Nil(err, "expected no error")
+		t.Equal(expected, last, "incorrect last reference")
+	}
+
+	// the node's reference may have been removed and the file deleted, so no record is made
+	nid := uuid.New()
+	t.Equal(NewNoNodeError("No such node "+nid.String()), mns.AddFileReference("fid3", nid),
+		"incorrect error")
+	last, err = mns.RemoveFileReference("fid3")
+	t.Nil(err, "expected no error")
+	t.True(last, "expected no references to remain")
+}
+
+func (t *TestSuite) TestFileReferencesFailBadInput() {
+	mns, err := NewMongoNodeStore(t.client.Database(testDB))
+	t.Nil(err, "expected no error")
+
+	t.Equal(errors.New("id cannot be empty"), mns.AddFileReference("   ", uuid.New()),
+		"incorrect error")
+	last, err := mns.RemoveFileReference("  \t  ")
+	t.False(last, "expected error")
+	t.Equal(errors.New("id cannot be empty"), err, "incorrect error")
+}
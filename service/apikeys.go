@@ -0,0 +1,252 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/kbase/blobstore/apikey"
+	"github.com/kbase/blobstore/auth"
+	"github.com/kbase/blobstore/core"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	apiKeyForbidden    = "API key scope does not permit this request"
+	apiKeyManageForbid = "API keys cannot be used to manage API keys"
+	apiKeyActAsForbid  = "API keys cannot be managed while acting as another user"
+	invalidAPIKey      = "Invalid API key"
+	apiKeyNodeRoute    = "/node/{id}"
+
+	day = 24 * time.Hour
+)
+
+var invalidAPIKeyDays = fmt.Sprintf("days must be an integer from 1 to %d",
+	apikey.MaxLifetime/day)
+
+// POST endpoints other than these modify data and so are forbidden to read only keys.
+var apiKeyReadOnlyPosts = map[string]bool{
+	"/bulk/node/get":     true,
+	"/bulk/node/archive": true,
+}
+
+// Bulk endpoints that operate on existing nodes, which node restricted keys may use if all the
+// node IDs in the request are permitted by the key. The IDs are checked by readBulkRequest.
+var apiKeyBulkNodeRoutes = map[string]bool{
+	"/bulk/node/get":             true,
+	"/bulk/node/delete":          true,
+	"/bulk/node/copy":            true,
+	"/bulk/node/archive":         true,
+	"/bulk/node/acl/public_read": true,
+	"/bulk/node/acl/read":        true,
+}
+
+func getAPIKey(r *http.Request) *apikey.Key {
+	if key, ok := r.Context().Value(servkey{"apikey"}).(*apikey.Key); ok {
+		return key
+	}
+	return nil
+}
+
+// getAPIKeyUser returns the user and key for an API key. The user isn't checked with the auth
+// provider, as the key was created with a valid token for the user, and the user's keys are
+// revoked when the user is purged and moved when the user is renamed.
+func (s *Server) getAPIKeyUser(token string) (*auth.User, *apikey.Key, error) {
+	key, err := s.apikeys.GetKey(token)
+	if err != nil {
+		if _, ok := err.(*apikey.NoKeyError); ok {
+			return nil, nil, auth.NewInvalidTokenError(invalidAPIKey)
+		}
+		return nil, nil, err
+	}
+	// API keys never carry admin privileges, even if their user is an admin.
+	user, err := auth.NewUser(key.User, false)
+	if err != nil {
+		return nil, nil, err // can't happen, the store doesn't allow empty users
+	}
+	return user, key, nil
+}
+
+// apiKeyPermits returns whether the API key's scope and node restrictions allow the request.
+// Must be called after the request is matched to a route.
+func apiKeyPermits(key *apikey.Key, r *http.Request) bool {
+	if key.Scope == apikey.ScopeRead &&
+		r.Method != http.MethodGet && r.Method != http.MethodHead {
+		tmpl, _ := mux.CurrentRoute(r).GetPathTemplate()
+		if r.Method != http.MethodPost || !apiKeyReadOnlyPosts[strings.TrimSuffix(tmpl, "/")] {
+			return false
+		}
+	}
+	if len(key.Nodes) > 0 {
+		// node restricted keys may only be used with endpoints for existing nodes.
+		tmpl, _ := mux.CurrentRoute(r).GetPathTemplate()
+		tmpl = strings.TrimSuffix(tmpl, "/")
+		if apiKeyBulkNodeRoutes[tmpl] {
+			return true
+		}
+		if tmpl != apiKeyNodeRoute && !strings.HasPrefix(tmpl, apiKeyNodeRoute+"/") {
+			return false
+		}
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		return err == nil && key.AllowsNode(id)
+	}
+	return true
+}
+
+// apiKeyPermitsNodes returns whether the request's API key, if any, allows access to all the
+// given node IDs. Invalid IDs are ignored.
+func apiKeyPermitsNodes(r *http.Request, ids []string) bool {
+	key := getAPIKey(r)
+	if key == nil {
+		return true
+	}
+	for _, id := range ids {
+		if uid, err := uuid.Parse(id); err == nil && !key.AllowsNode(uid) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateUserNames checks user names with the auth providers. API keys are not auth provider
+// tokens, so for requests authenticated with API keys the names can only be validated by
+// providers with a lookup token.
+func (s *Server) validateUserNames(le *logrus.Entry, r *http.Request, names *[]string) error {
+	token := getToken(r)
+	if getAPIKey(r) != nil {
+		token = ""
+	}
+	return s.auth.ValidateUserNames(le, names, token)
+}
+
+func getAPIKeyManager(le *logrus.Entry, w http.ResponseWriter, r *http.Request,
+) (*auth.User, error) {
+	user, err := getUserRequired(le, w, r)
+	if err != nil {
+		return nil, err
+	}
+	// otherwise a leaked key could be used to mint more keys or revoke the user's other keys.
+	if getAPIKey(r) != nil {
+		writeErrorWithCode(le, apiKeyManageForbid, http.StatusForbidden, w)
+		return nil, errors.New(apiKeyManageForbid)
+	}
+	// otherwise an admin could mint a key that acts as the user without the act as header, and
+	// so without the admin's name in logs and audit records.
+	if _, ok := le.Data[core.LogFieldImpersonator]; ok {
+		writeErrorWithCode(le, apiKeyActAsForbid, http.StatusForbidden, w)
+		return nil, errors.New(apiKeyActAsForbid)
+	}
+	return user, nil
+}
+
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getAPIKeyManager(le, w, r)
+	if err != nil {
+		return
+	}
+	nodes := []uuid.UUID{}
+	for _, n := range strings.Split(getQuery(r.URL, "nodes"), ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		id, err := uuid.Parse(n)
+		if err != nil {
+			writeErrorWithCode(le, "Invalid node ID: "+n, 400, w)
+			return
+		}
+		nodes = append(nodes, id)
+	}
+	lifetime := apikey.MaxLifetime
+	if d := getQuery(r.URL, "days"); d != "" {
+		days, err := strconv.Atoi(d)
+		if err != nil || days < 1 || time.Duration(days) > apikey.MaxLifetime/day {
+			writeErrorWithCode(le, invalidAPIKeyDays, 400, w)
+			return
+		}
+		lifetime = time.Duration(days) * day
+	}
+	key, secret, err := s.apikeys.CreateKey(user.GetUserName(), getQuery(r.URL, "name"),
+		apikey.Scope(getQuery(r.URL, "scope")), nodes, lifetime)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	data := fromAPIKey(key)
+	data["key"] = secret
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   data,
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+func (s *Server) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getAPIKeyManager(le, w, r)
+	if err != nil {
+		return
+	}
+	keys, err := s.apikeys.GetKeys(user.GetUserName())
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	data := []interface{}{}
+	for _, k := range keys {
+		data = append(data, fromAPIKey(k))
+	}
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   data,
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+func (s *Server) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getAPIKeyManager(le, w, r)
+	if err != nil {
+		return
+	}
+	keyid := mux.Vars(r)["keyid"]
+	id, err := uuid.Parse(keyid)
+	if err != nil {
+		writeError(le, apikey.NewNoKeyError("No such API key: "+keyid), w)
+		return
+	}
+	if err := s.apikeys.DeleteKey(user.GetUserName(), id); err != nil {
+		writeError(le, err, w)
+		return
+	}
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   nil,
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+func fromAPIKey(key *apikey.Key) map[string]interface{} {
+	nodes := []string{}
+	for _, n := range key.Nodes {
+		nodes = append(nodes, n.String())
+	}
+	return map[string]interface{}{
+		"id":      key.ID.String(),
+		"user":    key.User,
+		"name":    key.Name,
+		"scope":   string(key.Scope),
+		"nodes":   nodes,
+		"created": formatTime(key.Created),
+		"expires": formatTime(key.Expires),
+	}
+}
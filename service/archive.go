@@ -0,0 +1,393 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kbase/blobstore/core"
+	"github.com/kbase/blobstore/core/values"
+)
+
+// maxArchiveSize is the maximum size of an archive that may be unpacked, and separately the
+// maximum total size of the files in the archive after decompression. Zip archives are written
+// to a temporary file before unpacking, so the former limits the temporary disk space used, and
+// the latter limits the data written to the file store.
+const maxArchiveSize = int64(5) << 30
+
+var tooManyArchiveFiles = fmt.Sprintf("Archives may contain at most %d files", maxBulkNodes)
+var archiveTooLarge = fmt.Sprintf(
+	"Archives and the files they contain may each be at most %d bytes", maxArchiveSize)
+
+// archiveWriter writes files to an archive.
+type archiveWriter interface {
+	// add adds a file to the archive.
+	add(name string, size int64, modtime time.Time, data io.Reader) error
+	// Close finishes writing the archive. It does not close the underlying writer.
+	Close() error
+}
+
+type archiveFormat struct {
+	contentType string
+	newWriter   func(w io.Writer) archiveWriter
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip": archiveFormat{"application/zip", newZipWriter},
+	"tar": archiveFormat{"application/x-tar", newTarWriter},
+}
+
+type zipWriter struct {
+	*zip.Writer
+}
+
+func newZipWriter(w io.Writer) archiveWriter {
+	return &zipWriter{zip.NewWriter(w)}
+}
+
+func (zw *zipWriter) add(name string, size int64, modtime time.Time, data io.Reader) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, data)
+	return err
+}
+
+type tarWriter struct {
+	*tar.Writer
+}
+
+func newTarWriter(w io.Writer) archiveWriter {
+	return &tarWriter{tar.NewWriter(w)}
+}
+
+func (tw *tarWriter) add(name string, size int64, modtime time.Time, data io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, data)
+	return err
+}
+
+// archiveNames generates unique, safe names for the files in an archive.
+type archiveNames struct {
+	used map[string]struct{}
+}
+
+func newArchiveNames() *archiveNames {
+	return &archiveNames{map[string]struct{}{}}
+}
+
+// get returns the name for a node's file in the archive. The node's filename is used if
+// possible, with any path separators replaced. If the node has no filename, the node ID is used.
+// If the name is already in use, a number is added before the extension, e.g. foo (1).txt.
+func (an *archiveNames) get(node *core.BlobNode) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(node.Filename)
+	if name == "" || name == "." || name == ".." {
+		name = node.ID.String()
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" { // e.g. .bashrc
+		base, ext = name, ""
+	}
+	for i := 1; ; i++ {
+		if _, ok := an.used[name]; !ok {
+			break
+		}
+		name = base + " (" + strconv.Itoa(i) + ")" + ext
+	}
+	an.used[name] = struct{}{}
+	return name
+}
+
+func (s *Server) bulkArchiveNodes(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	format := getQuery(r.URL, "format")
+	if format == "" {
+		format = "zip"
+	}
+	af, ok := archiveFormats[format]
+	if !ok {
+		writeErrorWithCode(le, "Invalid archive format: "+format, 400, w)
+		return
+	}
+	req, err := readBulkRequest(le, w, r)
+	if err != nil {
+		return
+	}
+	ids := []uuid.UUID{}
+	for _, id := range req.IDs {
+		uid, err := uuid.Parse(id)
+		if err != nil {
+			// crappy error message, but compatible with the single node endpoints
+			writeErrorWithCode(le, "Node not found", 404, w)
+			return
+		}
+		ids = append(ids, uid)
+	}
+	names := newArchiveNames()
+	var aw archiveWriter
+	err = s.store.GetFiles(getUser(r), ids, func(node *core.BlobNode, data io.Reader) error {
+		if aw == nil {
+			// all the nodes are readable, so start the response
+			w.Header().Set("content-type", af.contentType)
+			w.Header().Set("content-disposition", "attachment; filename=nodes."+format)
+			aw = af.newWriter(w)
+		}
+		return aw.add(names.get(node), node.Size, node.Stored, data)
+	})
+	if err != nil {
+		if aw == nil {
+			writeError(le, err, w)
+		} else {
+			// too late to send an error to the client. Leave the archive unterminated so the
+			// client can tell it's incomplete.
+			le.WithField("error", err.Error()).Error("archive download failed")
+		}
+		return
+	}
+	aw.Close()
+}
+
+// archiveEntryHandler handles a regular file in an archive. The handler must not retain the
+// reader.
+type archiveEntryHandler func(name string, size int64, data io.Reader) error
+
+// sizeLimitReader returns an IllegalInputError if more than a maximum number of bytes are read.
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+	err       string
+}
+
+func (lr *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+	n, err := lr.r.Read(p)
+	if int64(n) > lr.remaining {
+		lr.remaining = 0
+		return 0, values.NewIllegalInputError(lr.err)
+	}
+	lr.remaining -= int64(n)
+	return n, err
+}
+
+// unpackLimit limits the total uncompressed size of the entries in an archive.
+type unpackLimit struct {
+	remaining uint64
+}
+
+// add adds the size of an entry to the total, returning an IllegalInputError if the total
+// exceeds the limit.
+func (l *unpackLimit) add(size uint64) error {
+	if size > l.remaining {
+		l.remaining = 0
+		return values.NewIllegalInputError(archiveTooLarge)
+	}
+	l.remaining -= size
+	return nil
+}
+
+// entryReader records the first error, other than io.EOF, that occurs while reading an archive
+// entry, so that errors caused by an invalid archive can be distinguished from handler errors.
+type entryReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *entryReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err != nil && err != io.EOF && er.err == nil {
+		er.err = err
+	}
+	return n, err
+}
+
+// handleEntry calls the handler for an archive entry. If reading the entry failed the read
+// error is returned as an IllegalInputError, otherwise handler errors are returned as is.
+func handleEntry(
+	archiveType string,
+	handler archiveEntryHandler,
+	name string,
+	size int64,
+	data io.Reader,
+) error {
+	er := &entryReader{r: data}
+	err := handler(name, size, er)
+	if err == nil || er.err == nil {
+		return err
+	}
+	return archiveError(archiveType, er.err)
+}
+
+// archiveError returns an IllegalInputError for an error reading an archive.
+func archiveError(archiveType string, err error) error {
+	if _, ok := err.(*values.IllegalInputError); ok {
+		return err
+	}
+	return values.NewIllegalInputError("Invalid " + archiveType + " archive: " + err.Error())
+}
+
+// unpackTar calls the handler for each regular file in a tar archive, in archive order.
+// Errors reading the archive, including the total size of the entries exceeding limit, are
+// returned as IllegalInputErrors. Handler errors are returned as is.
+func unpackTar(r io.Reader, limit int64, handler archiveEntryHandler) error {
+	tr := tar.NewReader(r)
+	ul := &unpackLimit{remaining: uint64(limit)}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return archiveError("tar", err)
+		}
+		// the data for skipped entries is decompressed too, so count all entries. The tar
+		// reader never returns more data than the entry's size.
+		if err := ul.add(uint64(h.Size)); err != nil {
+			return err
+		}
+		if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+			if err := handleEntry("tar", handler, h.Name, h.Size, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// unpackTarGz calls the handler for each regular file in a gzipped tar archive, in archive
+// order.
+func unpackTarGz(r io.Reader, limit int64, handler archiveEntryHandler) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return values.NewIllegalInputError("Invalid gzip stream: " + err.Error())
+	}
+	defer gr.Close()
+	return unpackTar(gr, limit, handler)
+}
+
+// unpackZip calls the handler for each regular file in a zip archive, in archive order.
+// Since the zip index is at the end of the archive, the archive is first written to a
+// temporary file. The total uncompressed size of the files is limited as for unpackTar.
+func unpackZip(r io.Reader, limit int64, handler archiveEntryHandler) error {
+	tmp, err := ioutil.TempFile("", "blobstore_unpack_")
+	if err != nil {
+		return err // errors should only occur for unusual situations here
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err // the archive is too large or, most likely, the client went away
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return archiveError("zip", err)
+	}
+	ul := &unpackLimit{remaining: uint64(limit)}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		// check the size in the index before decompressing anything. Data past the size in the
+		// index is a format error.
+		if err := ul.add(f.UncompressedSize64); err != nil {
+			return err
+		}
+		data, err := f.Open()
+		if err != nil {
+			return archiveError("zip", err)
+		}
+		// checksum and size mismatches are only detected as the data is read
+		err = handleEntry("zip", handler, f.Name, int64(f.UncompressedSize64), data)
+		data.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var archiveUnpackers = map[string]func(io.Reader, int64, archiveEntryHandler) error{
+	"zip":    unpackZip,
+	"tar":    unpackTar,
+	"tar.gz": unpackTarGz,
+}
+
+func (s *Server) unpackArchive(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getUserRequired(le, w, r)
+	if err != nil {
+		return
+	}
+	af := getQuery(r.URL, "archive_format")
+	unpack, ok := archiveUnpackers[af]
+	if !ok {
+		writeErrorWithCode(le, "Invalid archive_format: "+af, 400, w)
+		return
+	}
+	format, err := values.NewFileFormat(getQuery(r.URL, "format"))
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	nodes := []*core.BlobNode{}
+	body := &sizeLimitReader{r: r.Body, remaining: maxArchiveSize, err: archiveTooLarge}
+	err = unpack(body, maxArchiveSize, func(name string, size int64, data io.Reader) error {
+		if size < 1 {
+			return nil // the blobstore doesn't support empty files
+		}
+		if len(nodes) >= maxBulkNodes {
+			return values.NewIllegalInputError(tooManyArchiveFiles)
+		}
+		filename, err := values.NewFileName(strings.TrimPrefix(name, "./"))
+		if err != nil {
+			return err
+		}
+		node, err := s.store.Store(le, *user, data, size, *filename, *format)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+		return nil
+	})
+	if err != nil {
+		s.deleteCreatedNodes(le, *user, nodes)
+		writeError(le, err, w)
+		return
+	}
+	data := []interface{}{}
+	for _, n := range nodes {
+		data = append(data, fromNodeToNode(n))
+	}
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   data,
+	}
+	encodeToJSON(w, 200, &ret)
+}
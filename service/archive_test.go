@@ -0,0 +1,271 @@
+package service
+
+// tests the archive readers, writers, and file naming. The integration tests test the archive
+// endpoints.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kbase/blobstore/core"
+	"github.com/kbase/blobstore/core/values"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveNames(t *testing.T) {
+	id := uuid.New()
+	an := newArchiveNames()
+	names := []string{}
+	for _, fn := range []string{"foo.txt", "foo.txt", "foo (1).txt", "foo.txt", "", "", ".",
+		"..", "a/b\\c", ".bashrc", ".bashrc", "foo", "foo", "x.tar.gz", "x.tar.gz"} {
+		names = append(names, an.get(&core.BlobNode{ID: id, Filename: fn}))
+	}
+	ids := id.String()
+	assert.Equal(t, []string{"foo.txt", "foo (1).txt", "foo (1) (1).txt", "foo (2).txt", ids,
+		ids + " (1)", ids + " (2)", ids + " (3)", "a_b_c", ".bashrc", ".bashrc (1)", "foo",
+		"foo (1)", "x.tar.gz", "x.tar (1).gz"}, names, "incorrect names")
+}
+
+func TestZipWriter(t *testing.T) {
+	b := new(bytes.Buffer)
+	aw := newZipWriter(b)
+	tme := time.Date(2019, 5, 6, 7, 8, 10, 0, time.UTC)
+	assert.Nil(t, aw.add("f1", 3, tme, strings.NewReader("foo")), "unexpected error")
+	assert.Nil(t, aw.add("f2", 6, tme, strings.NewReader("barbaz")), "unexpected error")
+	assert.Nil(t, aw.Close(), "unexpected error")
+
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, 2, len(zr.File), "incorrect file count")
+	for i, exp := range [][]string{{"f1", "foo"}, {"f2", "barbaz"}} {
+		f := zr.File[i]
+		assert.Equal(t, exp[0], f.Name, "incorrect name")
+		assert.Equal(t, tme, f.Modified.UTC(), "incorrect time")
+		rd, err := f.Open()
+		assert.Nil(t, err, "unexpected error")
+		data, _ := ioutil.ReadAll(rd)
+		assert.Equal(t, exp[1], string(data), "incorrect data")
+	}
+}
+
+func TestTarWriter(t *testing.T) {
+	b := new(bytes.Buffer)
+	aw := newTarWriter(b)
+	tme := time.Date(2019, 5, 6, 7, 8, 10, 0, time.UTC)
+	assert.Nil(t, aw.add("f1", 3, tme, strings.NewReader("foo")), "unexpected error")
+	assert.Nil(t, aw.add("f2", 6, tme, strings.NewReader("barbaz")), "unexpected error")
+	assert.Nil(t, aw.Close(), "unexpected error")
+
+	tr := tar.NewReader(b)
+	for _, exp := range [][]string{{"f1", "foo"}, {"f2", "barbaz"}} {
+		h, err := tr.Next()
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, exp[0], h.Name, "incorrect name")
+		assert.Equal(t, tme, h.ModTime.UTC(), "incorrect time")
+		data, _ := ioutil.ReadAll(tr)
+		assert.Equal(t, exp[1], string(data), "incorrect data")
+	}
+	_, err := tr.Next()
+	assert.NotNil(t, err, "expected end of archive")
+
+	// size mismatches are errors
+	aw = newTarWriter(new(bytes.Buffer))
+	err = aw.add("f1", 2, tme, strings.NewReader("foo"))
+	assert.Equal(t, tar.ErrWriteTooLong, err, "incorrect error")
+}
+
+type entry struct {
+	name string
+	size int64
+	data string
+}
+
+func collectEntries(unpack func(io.Reader, int64, archiveEntryHandler) error, r io.Reader,
+) ([]entry, error) {
+	return collectEntriesWithLimit(unpack, r, maxArchiveSize)
+}
+
+func collectEntriesWithLimit(
+	unpack func(io.Reader, int64, archiveEntryHandler) error,
+	r io.Reader,
+	limit int64,
+) ([]entry, error) {
+	entries := []entry{}
+	err := unpack(r, limit, func(name string, size int64, data io.Reader) error {
+		b, err := ioutil.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{name, size, string(b)})
+		return nil
+	})
+	return entries, err
+}
+
+func makeTar(t *testing.T, w io.Writer) {
+	tw := tar.NewWriter(w)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, e := range []entry{{"d/f1", 3, "foo"}, {"f2", 0, ""}, {"./f3", 6, "barbaz"}} {
+		assert.Nil(t, tw.WriteHeader(&tar.Header{
+			Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: e.size}))
+		tw.Write([]byte(e.data))
+	}
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "l", Typeflag: tar.TypeSymlink,
+		Linkname: "f2"}))
+	assert.Nil(t, tw.Close())
+}
+
+var expectedEntries = []entry{{"d/f1", 3, "foo"}, {"f2", 0, ""}, {"./f3", 6, "barbaz"}}
+
+func TestUnpackTar(t *testing.T) {
+	b := new(bytes.Buffer)
+	makeTar(t, b)
+	entries, err := collectEntries(unpackTar, b)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, expectedEntries, entries, "incorrect entries")
+}
+
+func TestUnpackTarGz(t *testing.T) {
+	b := new(bytes.Buffer)
+	gw := gzip.NewWriter(b)
+	makeTar(t, gw)
+	assert.Nil(t, gw.Close())
+	entries, err := collectEntries(unpackTarGz, b)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, expectedEntries, entries, "incorrect entries")
+}
+
+func TestUnpackZip(t *testing.T) {
+	b := new(bytes.Buffer)
+	zw := zip.NewWriter(b)
+	_, err := zw.Create("d/")
+	assert.Nil(t, err)
+	for _, e := range expectedEntries {
+		f, err := zw.Create(e.name)
+		assert.Nil(t, err)
+		f.Write([]byte(e.data))
+	}
+	assert.Nil(t, zw.Close())
+	entries, err := collectEntries(unpackZip, b)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, expectedEntries, entries, "incorrect entries")
+}
+
+func TestUnpackFail(t *testing.T) {
+	type testcase struct {
+		unpack func(io.Reader, int64, archiveEntryHandler) error
+		err    string
+	}
+	testcases := []testcase{
+		testcase{unpackTar, "Invalid tar archive: unexpected EOF"},
+		testcase{unpackTarGz, "Invalid gzip stream: gzip: invalid header"},
+		testcase{unpackZip, "Invalid zip archive: zip: not a valid zip file"},
+	}
+	for _, tc := range testcases {
+		_, err := collectEntries(tc.unpack, strings.NewReader("this is not an archive"))
+		assert.Equal(t, values.NewIllegalInputError(tc.err), err, "incorrect error")
+	}
+
+	// errors reading entries are input errors, even if returned by the handler
+	zb := new(bytes.Buffer)
+	zw := zip.NewWriter(zb)
+	f, err := zw.Create("f1")
+	assert.Nil(t, err)
+	f.Write([]byte("foo"))
+	assert.Nil(t, zw.Close())
+	zbytes := zb.Bytes()
+	zbytes[bytes.Index(zbytes, []byte("foo"))] = 'g' // fails the checksum
+	_, err = collectEntries(unpackZip, bytes.NewReader(zbytes))
+	assert.Equal(t, values.NewIllegalInputError("Invalid zip archive: zip: checksum error"), err,
+		"incorrect error")
+
+	tb := new(bytes.Buffer)
+	makeTar(t, tb)
+	_, err = collectEntries(unpackTar, bytes.NewReader(tb.Bytes()[:515]))
+	assert.Equal(t, values.NewIllegalInputError("Invalid tar archive: unexpected EOF"), err,
+		"incorrect error")
+
+	// handler errors are returned as is
+	b := new(bytes.Buffer)
+	makeTar(t, b)
+	err = unpackTar(b, maxArchiveSize, func(name string, size int64, data io.Reader) error {
+		return errors.New("whoops")
+	})
+	assert.Equal(t, errors.New("whoops"), err, "incorrect error")
+}
+
+func TestUnpackLimit(t *testing.T) {
+	tb := new(bytes.Buffer)
+	makeTar(t, tb)
+	gb := new(bytes.Buffer)
+	gw := gzip.NewWriter(gb)
+	makeTar(t, gw)
+	assert.Nil(t, gw.Close())
+	zb := new(bytes.Buffer)
+	zw := zip.NewWriter(zb)
+	for _, e := range expectedEntries {
+		f, err := zw.Create(e.name)
+		assert.Nil(t, err)
+		f.Write([]byte(e.data))
+	}
+	assert.Nil(t, zw.Close())
+
+	toolarge := values.NewIllegalInputError(archiveTooLarge)
+	for _, tc := range []struct {
+		unpack func(io.Reader, int64, archiveEntryHandler) error
+		data   []byte
+	}{{unpackTar, tb.Bytes()}, {unpackTarGz, gb.Bytes()}, {unpackZip, zb.Bytes()}} {
+		// the files total 9 bytes
+		entries, err := collectEntriesWithLimit(tc.unpack, bytes.NewReader(tc.data), 9)
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, expectedEntries, entries, "incorrect entries")
+
+		// files before the limit is exceeded are unpacked
+		entries, err = collectEntriesWithLimit(tc.unpack, bytes.NewReader(tc.data), 8)
+		assert.Equal(t, toolarge, err, "incorrect error")
+		assert.Equal(t, expectedEntries[:2], entries, "incorrect entries")
+
+		entries, err = collectEntriesWithLimit(tc.unpack, bytes.NewReader(tc.data), 2)
+		assert.Equal(t, toolarge, err, "incorrect error")
+		assert.Equal(t, []entry{}, entries, "incorrect entries")
+	}
+
+	// zip entries that are larger than the index says fail when read
+	zb = new(bytes.Buffer)
+	zw = zip.NewWriter(zb)
+	f, err := zw.Create("f1")
+	assert.Nil(t, err)
+	f.Write([]byte("foo"))
+	assert.Nil(t, zw.Close())
+	zbytes := zb.Bytes()
+	// the uncompressed size is at offset 24 in the central directory header, which is followed
+	// by the file name and the 22 byte end of central directory record
+	zbytes[len(zbytes)-22-len("f1")-46+24] = 2
+	_, err = collectEntriesWithLimit(unpackZip, bytes.NewReader(zbytes), 2)
+	assert.Equal(t, values.NewIllegalInputError("Invalid zip archive: zip: not a valid zip file"),
+		err, "incorrect error")
+}
+
+func TestSizeLimitReader(t *testing.T) {
+	lr := &sizeLimitReader{r: strings.NewReader("foobar"), remaining: 6, err: "too big"}
+	b, err := ioutil.ReadAll(lr)
+	assert.Nil(t, err, "unexpected error")
+	assert.Equal(t, "foobar", string(b), "incorrect data")
+
+	lr = &sizeLimitReader{r: strings.NewReader("foobar"), remaining: 5, err: "too big"}
+	_, err = ioutil.ReadAll(lr)
+	assert.Equal(t, values.NewIllegalInputError("too big"), err, "incorrect error")
+
+	lr = &sizeLimitReader{r: strings.NewReader("foobar"), remaining: 5, err: "too big"}
+	_, err = collectEntries(unpackZip, lr)
+	assert.Equal(t, values.NewIllegalInputError("too big"), err, "incorrect error")
+}
@@ -11,7 +11,10 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws/session"
 
+	"github.com/kbase/blobstore/apikey"
+	"github.com/kbase/blobstore/audit"
 	"github.com/kbase/blobstore/core"
+	"github.com/kbase/blobstore/events"
 	"github.com/kbase/blobstore/filestore"
 
 	"github.com/kbase/blobstore/nodestore"
@@ -27,10 +30,15 @@ import (
 
 // Most of the error conditions are a real pain to test.
 
+const defaultNegativeCacheSize = 10000
+
 // Dependencies contain the built dependencies of the blobstore service.
 type Dependencies struct {
 	AuthCache *authcache.Cache
 	BlobStore *core.BlobStore
+	APIKeys   *apikey.MongoStore
+	// Dispatcher is the running webhook event dispatcher, or nil if no webhooks are configured.
+	Dispatcher *events.Dispatcher
 }
 
 // ConstructDependencies builds the blobstore dependencies from a configuration.
@@ -41,7 +49,23 @@ func constructDependencies(cfg *config.Config) (*Dependencies, error) {
 		return nil, err
 	}
 	d.AuthCache = auth
-	ns, err := buildNodeStore(cfg)
+	db, err := buildMongo(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := nodestore.NewMongoNodeStore(db)
+	if err != nil {
+		return nil, err
+	}
+	al, err := audit.NewMongoLog(db)
+	if err != nil {
+		return nil, err
+	}
+	d.APIKeys, err = apikey.NewMongoStore(db)
+	if err != nil {
+		return nil, err
+	}
+	es, err := buildEvents(cfg, db, &d)
 	if err != nil {
 		return nil, err
 	}
@@ -49,10 +73,35 @@ func constructDependencies(cfg *config.Config) (*Dependencies, error) {
 	if err != nil {
 		return nil, err
 	}
-	d.BlobStore = core.New(fs, ns)
+	d.BlobStore = core.New(fs, ns, core.AuditLog(al), core.EventStore(es),
+		core.APIKeyStore(d.APIKeys))
+	if d.Dispatcher != nil {
+		d.Dispatcher.Start()
+	}
 	return &d, nil
 }
 
+func buildEvents(cfg *config.Config, db *mongo.Database, d *Dependencies,
+) (*events.MongoStore, error) {
+	names := []string{}
+	hooks := []events.Webhook{}
+	for _, h := range *cfg.Webhooks {
+		names = append(names, h.Name)
+		hooks = append(hooks, events.Webhook{Name: h.Name, URL: *h.URL, Secret: h.Secret})
+	}
+	es, err := events.NewMongoStore(db, names...)
+	if err != nil {
+		return nil, err
+	}
+	if len(hooks) > 0 {
+		d.Dispatcher, err = events.NewDispatcher(es, hooks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return es, nil
+}
+
 func buildFileStore(cfg *config.Config) (filestore.FileStore, error) {
 	trueref := true
 
@@ -73,7 +122,7 @@ func buildFileStore(cfg *config.Config) (filestore.FileStore, error) {
 	return filestore.NewS3FileStore(awscli, minioClient, cfg.S3Bucket)
 }
 
-func buildNodeStore(cfg *config.Config) (nodestore.NodeStore, error) {
+func buildMongo(cfg *config.Config) (*mongo.Database, error) {
 	copts := options.ClientOptions{Hosts: []string{cfg.MongoHost}}
 	if cfg.MongoUser != "" {
 		creds := options.Credential{
@@ -90,18 +139,86 @@ func buildNodeStore(cfg *config.Config) (nodestore.NodeStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	db := client.Database(cfg.MongoDatabase)
-	return nodestore.NewMongoNodeStore(db)
+	return client.Database(cfg.MongoDatabase), nil
+}
+
+func buildJWTProvider(cfg *config.Config) (*auth.JWTProvider, error) {
+	opts := []func(*auth.JWTProvider) error{}
+	if cfg.JWTAudience != "" {
+		opts = append(opts, auth.JWTAudience(cfg.JWTAudience))
+	}
+	if cfg.JWTUserClaim != "" {
+		opts = append(opts, auth.JWTUserClaim(cfg.JWTUserClaim))
+	}
+	if cfg.JWTRolesClaim != "" {
+		opts = append(opts, auth.JWTRolesClaim(cfg.JWTRolesClaim))
+	}
+	for _, r := range *cfg.JWTAdminRoles {
+		opts = append(opts, auth.JWTAdminRole(r))
+	}
+	for _, r := range *cfg.JWTReadAdminRoles {
+		opts = append(opts, auth.JWTReadAdminRole(r))
+	}
+	return auth.NewJWTProvider(cfg.JWTIssuer, cfg.JWTKeyFile, opts...)
 }
 
 func buildAuth(cfg *config.Config) (*authcache.Cache, error) {
-	roles := []func(*auth.KBaseProvider) error{}
-	for _, r := range *cfg.AuthAdminRoles {
-		roles = append(roles, auth.AdminRole(r))
+	provs := []authcache.ChainedProvider{}
+	for _, ap := range *cfg.AuthProviders {
+		prov, err := buildAuthProvider(cfg, ap.Type)
+		if err != nil {
+			return nil, err
+		}
+		provs = append(provs, authcache.ChainedProvider{
+			Provider:    prov,
+			Namespace:   ap.Namespace,
+			LookupToken: ap.LookupToken,
+		})
 	}
-	prov, err := auth.NewKBaseProvider(*cfg.AuthURL, roles...)
-	if err != nil {
-		return nil, err
+	opts := []func(*authcache.Cache) error{}
+	if cfg.AuthCacheSize > 0 {
+		opts = append(opts, authcache.Size(cfg.AuthCacheSize))
+	}
+	if cfg.AuthNegativeCacheTime > 0 {
+		size := cfg.AuthNegativeCacheSize
+		if size < 1 {
+			size = defaultNegativeCacheSize
+		}
+		opts = append(opts, authcache.NegativeCache(cfg.AuthNegativeCacheTime, size))
+	}
+	if cfg.AuthGracePeriod > 0 {
+		opts = append(opts, authcache.GracePeriod(cfg.AuthGracePeriod))
+	}
+	return authcache.NewChainedCache(provs, opts...)
+}
+
+// avoids returning a typed nil in the interface on errors.
+func buildAuthProvider(cfg *config.Config, provtype string) (auth.Provider, error) {
+	switch provtype {
+	case config.AuthProviderFile:
+		prov, err := auth.NewFileProvider(cfg.AuthTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return prov, nil
+	case config.AuthProviderJWT:
+		prov, err := buildJWTProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return prov, nil
+	default:
+		roles := []func(*auth.KBaseProvider) error{}
+		for _, r := range *cfg.AuthAdminRoles {
+			roles = append(roles, auth.AdminRole(r))
+		}
+		for _, r := range *cfg.AuthReadAdminRoles {
+			roles = append(roles, auth.ReadAdminRole(r))
+		}
+		prov, err := auth.NewKBaseProvider(*cfg.AuthURL, roles...)
+		if err != nil {
+			return nil, err
+		}
+		return prov, nil
 	}
-	return authcache.NewCache(prov), nil
 }
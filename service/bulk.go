@@ -0,0 +1,257 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/kbase/blobstore/auth"
+	"github.com/kbase/blobstore/core"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxBulkNodes    = 1000
+	maxBulkBodySize = 1024 * 1024
+
+	invalidBulkBody = "Request body must be a JSON object with an ids list"
+	noBulkIDs       = "At least one node ID is required"
+	noBulkUsers     = "Action requires a list of usernames in the users field"
+)
+
+var tooManyBulkIDs = fmt.Sprintf("At most %d node IDs may be provided", maxBulkNodes)
+var tooManyFormUploads = fmt.Sprintf("Forms may contain at most %d uploads", maxBulkNodes)
+
+// bulkRequest is the request body for all bulk operations.
+type bulkRequest struct {
+	IDs   []string `json:"ids"`
+	Users []string `json:"users"`
+}
+
+func readBulkRequest(le *logrus.Entry, w http.ResponseWriter, r *http.Request,
+) (*bulkRequest, error) {
+	var req bulkRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBulkBodySize))
+	if err := dec.Decode(&req); err != nil {
+		writeErrorWithCode(le, invalidBulkBody, 400, w)
+		return nil, err
+	}
+	if len(req.IDs) < 1 {
+		writeErrorWithCode(le, noBulkIDs, 400, w)
+		return nil, errors.New(noBulkIDs)
+	}
+	if len(req.IDs) > maxBulkNodes {
+		writeErrorWithCode(le, tooManyBulkIDs, 400, w)
+		return nil, errors.New(tooManyBulkIDs)
+	}
+	if !apiKeyPermitsNodes(r, req.IDs) {
+		writeErrorWithCode(le, apiKeyForbidden, http.StatusForbidden, w)
+		return nil, errors.New(apiKeyForbidden)
+	}
+	return &req, nil
+}
+
+// parses the node IDs, returning only the valid IDs.
+func parseBulkIDs(ids []string) []uuid.UUID {
+	uids := []uuid.UUID{}
+	for _, id := range ids {
+		if uid, err := uuid.Parse(id); err == nil {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// writeBulkResults calls op for each node ID in the request and writes the per-node results.
+// Each result has the same structure as the response for the equivalent single node request,
+// with the addition of the node ID.
+func writeBulkResults(
+	w http.ResponseWriter,
+	ids []string,
+	op func(id uuid.UUID) (interface{}, error),
+) {
+	results := []interface{}{}
+	for _, id := range ids {
+		res := map[string]interface{}{"id": id, "status": 200, "error": nil, "data": nil}
+		uid, err := uuid.Parse(id)
+		if err != nil {
+			// compatible with the single node endpoints
+			err = core.NewNoBlobError("Node not found")
+		} else {
+			res["data"], err = op(uid)
+		}
+		if err != nil {
+			code, errstr := translateError(err)
+			res["status"] = code
+			res["error"] = [1]string{errstr}
+			res["data"] = nil
+		}
+		results = append(results, res)
+	}
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   results,
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+func (s *Server) bulkGetNodes(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	req, err := readBulkRequest(le, w, r)
+	if err != nil {
+		return
+	}
+	results, err := s.store.GetMany(getUser(r), parseBulkIDs(req.IDs))
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	writeBulkNodeResults(w, req.IDs, results, fromNodeToNode)
+}
+
+// writeBulkNodeResults writes the results of a bulk operation, converting each node with the
+// format function. The results must be in the order of the IDs returned by parseBulkIDs.
+func writeBulkNodeResults(
+	w http.ResponseWriter,
+	ids []string,
+	results []*core.NodeResult,
+	format func(node *core.BlobNode) map[string]interface{},
+) {
+	// op is called for each valid ID in order, so results are matched by position, which
+	// keeps the results for repeated IDs separate
+	i := 0
+	writeBulkResults(w, ids, func(id uuid.UUID) (interface{}, error) {
+		res := results[i]
+		i++
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.Node == nil {
+			return nil, nil
+		}
+		return format(res.Node), nil
+	})
+}
+
+func (s *Server) bulkDeleteNodes(w http.ResponseWriter, r *http.Request) {
+	s.bulkAlterNodes(w, r, false, fromNodeToNode,
+		func(le *logrus.Entry, user *auth.User, ids []uuid.UUID, _ []string,
+		) ([]*core.NodeResult, error) {
+			return s.store.DeleteNodes(le, *user, ids)
+		})
+}
+
+func (s *Server) bulkCopyNodes(w http.ResponseWriter, r *http.Request) {
+	opts, err := s.getCopyOptions(getLogger(r), r)
+	if err != nil {
+		writeError(getLogger(r), err, w)
+		return
+	}
+	s.bulkAlterNodes(w, r, false, fromNodeToNode,
+		func(le *logrus.Entry, user *auth.User, ids []uuid.UUID, _ []string,
+		) ([]*core.NodeResult, error) {
+			return s.store.CopyNodes(le, *user, ids, opts...)
+		})
+}
+
+func (s *Server) bulkAddPublic(w http.ResponseWriter, r *http.Request) {
+	s.bulkSetPublic(w, r, true)
+}
+
+func (s *Server) bulkRemovePublic(w http.ResponseWriter, r *http.Request) {
+	s.bulkSetPublic(w, r, false)
+}
+
+func (s *Server) bulkSetPublic(w http.ResponseWriter, r *http.Request, public bool) {
+	s.bulkAlterNodes(w, r, false, aclFormatter(r),
+		func(le *logrus.Entry, user *auth.User, ids []uuid.UUID, _ []string,
+		) ([]*core.NodeResult, error) {
+			return s.store.SetNodesPublic(le, *user, ids, public)
+		})
+}
+
+func (s *Server) bulkAddReaders(w http.ResponseWriter, r *http.Request) {
+	s.bulkAlterReaders(w, r, true)
+}
+
+func (s *Server) bulkRemoveReaders(w http.ResponseWriter, r *http.Request) {
+	s.bulkAlterReaders(w, r, false)
+}
+
+func (s *Server) bulkAlterReaders(w http.ResponseWriter, r *http.Request, add bool) {
+	s.bulkAlterNodes(w, r, true, aclFormatter(r),
+		func(le *logrus.Entry, user *auth.User, ids []uuid.UUID, users []string,
+		) ([]*core.NodeResult, error) {
+			if add {
+				return s.store.AddReadersToNodes(le, *user, ids, users)
+			}
+			return s.store.RemoveReadersFromNodes(le, *user, ids, users)
+		})
+}
+
+func aclFormatter(r *http.Request) func(node *core.BlobNode) map[string]interface{} {
+	verbose := getQuery(r.URL, "verbosity") == "full"
+	return func(node *core.BlobNode) map[string]interface{} {
+		return fromNodeToACL(node, verbose)
+	}
+}
+
+// bulkAlterNodes applies an alteration to the nodes in the request. The alterations are
+// independent - a failure for one node does not affect the others.
+func (s *Server) bulkAlterNodes(
+	w http.ResponseWriter,
+	r *http.Request,
+	requireUsers bool,
+	format func(node *core.BlobNode) map[string]interface{},
+	op func(le *logrus.Entry, user *auth.User, ids []uuid.UUID, users []string,
+	) ([]*core.NodeResult, error),
+) {
+	le := getLogger(r)
+	user, err := getUserRequired(le, w, r)
+	if err != nil {
+		return
+	}
+	req, err := readBulkRequest(le, w, r)
+	if err != nil {
+		return
+	}
+	users := []string{}
+	if requireUsers {
+		for _, u := range req.Users {
+			if u = strings.TrimSpace(u); u != "" {
+				users = append(users, u)
+			}
+		}
+		if len(users) < 1 {
+			writeErrorWithCode(le, noBulkUsers, 400, w)
+			return
+		}
+		err := s.validateUserNames(le, r, &users)
+		if err != nil {
+			writeError(le, err, w)
+			return
+		}
+	}
+	results, err := op(le, user, parseBulkIDs(req.IDs), users)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	writeBulkNodeResults(w, req.IDs, results, format)
+}
+
+// deletes nodes created earlier in a request before an error occurred, so that requests that
+// create multiple nodes either create all the nodes or none of them.
+func (s *Server) deleteCreatedNodes(le *logrus.Entry, user auth.User, nodes []*core.BlobNode) {
+	for _, n := range nodes {
+		if err := s.store.DeleteNode(le, user, n.ID); err != nil {
+			le.WithField("error", err.Error()).Error(
+				"could not delete node " + n.ID.String() + " after failed request")
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/kbase/blobstore/core"
+	"github.com/kbase/blobstore/core/values"
+)
+
+const (
+	checksumMD5    = "md5"
+	checksumSHA256 = "sha256"
+)
+
+// the size of each checksum type in bytes.
+var checksumSizes = map[string]int{checksumMD5: md5.Size, checksumSHA256: sha256.Size}
+
+// expectedChecksums collects the checksums a client expects for an uploaded file from
+// the various places they may be provided.
+type expectedChecksums struct {
+	md5    *values.MD5
+	sha256 *values.SHA256
+}
+
+// add adds a hex encoded checksum of the given type. source is used in error messages.
+func (ec *expectedChecksums) add(checksumType string, checksum string, source string) error {
+	checksum = strings.TrimSpace(checksum)
+	if checksumType == checksumMD5 {
+		m, err := values.NewMD5(checksum)
+		if err != nil {
+			return values.NewIllegalInputError("Invalid " + source + ": " + err.Error())
+		}
+		if ec.md5 != nil && !strings.EqualFold(ec.md5.GetMD5(), m.GetMD5()) {
+			return values.NewIllegalInputError("Conflicting MD5 checksums provided")
+		}
+		ec.md5 = m
+	} else {
+		sha, err := values.NewSHA256(checksum)
+		if err != nil {
+			return values.NewIllegalInputError("Invalid " + source + ": " + err.Error())
+		}
+		if ec.sha256 != nil && !strings.EqualFold(ec.sha256.GetSHA256(), sha.GetSHA256()) {
+			return values.NewIllegalInputError("Conflicting SHA-256 checksums provided")
+		}
+		ec.sha256 = sha
+	}
+	return nil
+}
+
+// addBase64 adds a base64 encoded checksum of the given type, as provided in the Content-MD5
+// and Digest headers.
+func (ec *expectedChecksums) addBase64(checksumType string, checksum string, source string,
+) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(checksum))
+	if err != nil {
+		return values.NewIllegalInputError("Invalid " + source + ": " + err.Error())
+	}
+	if len(b) != checksumSizes[checksumType] {
+		return values.NewIllegalInputError(fmt.Sprintf("Invalid %s: expected %d bytes, got %d",
+			source, checksumSizes[checksumType], len(b)))
+	}
+	return ec.add(checksumType, hex.EncodeToString(b), source)
+}
+
+// options returns the Store options for the checksums.
+func (ec *expectedChecksums) options() []func(*core.StoreOptions) {
+	opts := []func(*core.StoreOptions){}
+	if ec.md5 != nil {
+		opts = append(opts, core.ExpectedMD5(*ec.md5))
+	}
+	if ec.sha256 != nil {
+		opts = append(opts, core.ExpectedSHA256(*ec.sha256))
+	}
+	return opts
+}
+
+// getExpectedChecksums gets the checksums a client expects for a file uploaded in the request
+// body from the Content-MD5 and Digest headers and the md5 and sha256 query parameters.
+// Unsupported Digest algorithms are ignored.
+func getExpectedChecksums(r *http.Request) (*expectedChecksums, error) {
+	ec := &expectedChecksums{}
+	if cmd5 := r.Header.Get("Content-MD5"); cmd5 != "" {
+		if err := ec.addBase64(checksumMD5, cmd5, "Content-MD5 header"); err != nil {
+			return nil, err
+		}
+	}
+	// see RFC 3230
+	for _, d := range strings.Split(r.Header.Get("Digest"), ",") {
+		parts := strings.SplitN(d, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var err error
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "md5":
+			err = ec.addBase64(checksumMD5, parts[1], "Digest header")
+		case "sha-256":
+			err = ec.addBase64(checksumSHA256, parts[1], "Digest header")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ct := range []string{checksumMD5, checksumSHA256} {
+		if cs := getQuery(r.URL, ct); cs != "" {
+			if err := ec.add(ct, cs, ct+" parameter"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ec, nil
+}
+
+// the RFC 3230 Digest header algorithm names for the node checksum algorithms.
+var digestAlgorithms = map[string]string{
+	checksumMD5:           "MD5",
+	values.ChecksumSHA1:   "SHA",
+	values.ChecksumSHA256: "SHA-256",
+	values.ChecksumCRC32C: "CRC32c",
+}
+
+// getChecksums returns all the checksums for a node, keyed by algorithm.
+func getChecksums(node *core.BlobNode) map[string]string {
+	sums := map[string]string{checksumMD5: node.MD5.GetMD5()}
+	if node.Checksums != nil {
+		for alg, cs := range node.Checksums.GetAll() {
+			sums[alg] = cs
+		}
+	}
+	return sums
+}
+
+// getDigest returns an RFC 3230 Digest header value containing all the checksums for a node,
+// allowing clients to verify downloads.
+func getDigest(node *core.BlobNode) string {
+	digests := []string{}
+	for alg, cs := range getChecksums(node) {
+		name, ok := digestAlgorithms[alg]
+		if !ok {
+			continue // no registered Digest algorithm name
+		}
+		b, _ := hex.DecodeString(cs) // checksums are always valid hex
+		digests = append(digests, name+"="+base64.StdEncoding.EncodeToString(b))
+	}
+	sort.Strings(digests)
+	return strings.Join(digests, ",")
+}
@@ -0,0 +1,108 @@
+package service
+
+// tests parsing expected checksums from requests and building Digest headers. The integration
+// tests test checksum verification.
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kbase/blobstore/core"
+	"github.com/kbase/blobstore/core/values"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	md5hex    = "6df23dc03f9b54cc38a0fc1483df6e21"
+	md5b64    = "bfI9wD+bVMw4oPwUg99uIQ=="
+	sha256hex = "97df3588b5a3f24babc3851b372f0ba71a9dcdded43b14b9d06961bfc1707d9d"
+	sha256b64 = "l981iLWj8kurw4UbNy8Lpxqdzd7UOxS50Glhv8FwfZ0="
+)
+
+func checksumRequest(params string, headers map[string]string) *http.Request {
+	r, _ := http.NewRequest("POST", "http://localhost/node"+params, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestGetExpectedChecksums(t *testing.T) {
+	md5, _ := values.NewMD5(md5hex)
+	sha, _ := values.NewSHA256(sha256hex)
+
+	type testcase struct {
+		params   string
+		headers  map[string]string
+		expected *expectedChecksums
+	}
+
+	testcases := []testcase{
+		testcase{"", nil, &expectedChecksums{}},
+		testcase{"?md5=" + md5hex, nil, &expectedChecksums{md5: md5}},
+		testcase{"?sha256=" + sha256hex, nil, &expectedChecksums{sha256: sha}},
+		testcase{"", map[string]string{"Content-MD5": md5b64}, &expectedChecksums{md5: md5}},
+		testcase{"", map[string]string{"Digest": "SHA-256=" + sha256b64},
+			&expectedChecksums{sha256: sha}},
+		testcase{"", map[string]string{"Digest": "unixsum=30637, md5=" + md5b64 + ",sha-256=" +
+			sha256b64}, &expectedChecksums{md5: md5, sha256: sha}},
+		// the same checksum may be provided more than once
+		testcase{"?md5=" + md5hex + "&sha256=" + sha256hex, map[string]string{
+			"Content-MD5": md5b64, "Digest": "md5=" + md5b64 + ", sha-256=" + sha256b64},
+			&expectedChecksums{md5: md5, sha256: sha}},
+	}
+
+	for _, tc := range testcases {
+		ec, err := getExpectedChecksums(checksumRequest(tc.params, tc.headers))
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, tc.expected, ec, "incorrect checksums")
+		assert.Equal(t, len(tc.expected.options()), len(ec.options()), "incorrect options")
+	}
+}
+
+func TestGetExpectedChecksumsFail(t *testing.T) {
+	type testcase struct {
+		params  string
+		headers map[string]string
+		err     string
+	}
+
+	othermd5 := "6df23dc03f9b54cc38a0fc1483df6e22"
+	testcases := []testcase{
+		testcase{"?md5=foo", nil, "Invalid md5 parameter: foo is not an MD5 string"},
+		testcase{"?sha256=" + md5hex, nil, "Invalid sha256 parameter: " + md5hex +
+			" is not a SHA-256 string"},
+		testcase{"", map[string]string{"Content-MD5": md5hex},
+			"Invalid Content-MD5 header: expected 16 bytes, got 24"},
+		testcase{"", map[string]string{"Content-MD5": "bfI9wD+bVMw4oPwUg99uIQ"},
+			"Invalid Content-MD5 header: illegal base64 data at input byte 20"},
+		testcase{"", map[string]string{"Digest": "sha-256=" + md5b64},
+			"Invalid Digest header: expected 32 bytes, got 16"},
+		testcase{"?md5=" + othermd5, map[string]string{"Content-MD5": md5b64},
+			"Conflicting MD5 checksums provided"},
+		testcase{"?sha256=" + sha256hex[:63] + "e", map[string]string{
+			"Digest": "sha-256=" + sha256b64}, "Conflicting SHA-256 checksums provided"},
+	}
+
+	for _, tc := range testcases {
+		ec, err := getExpectedChecksums(checksumRequest(tc.params, tc.headers))
+		assert.Nil(t, ec, "expected error")
+		assert.Equal(t, values.NewIllegalInputError(tc.err), err, "incorrect error")
+	}
+}
+
+func TestGetDigest(t *testing.T) {
+	md5, _ := values.NewMD5(md5hex)
+	sums, _ := values.NewChecksums(map[string]string{
+		"sha1":   "5f5513f8822fdbe5145af33b64d8d970dcf95c6e",
+		"sha256": sha256hex,
+		"crc32c": "8636640e",
+	})
+
+	// nodes stored before checksums other than the MD5 were calculated have no checksums
+	assert.Equal(t, "MD5="+md5b64, getDigest(&core.BlobNode{MD5: *md5}), "incorrect digest")
+	assert.Equal(t, "CRC32c=hjZkDg==,MD5="+md5b64+",SHA-256="+sha256b64+
+		",SHA=X1UT+IIv2+UUWvM7ZNjZcNz5XG4=",
+		getDigest(&core.BlobNode{MD5: *md5, Checksums: sums}),
+		"incorrect digest")
+}
@@ -0,0 +1,64 @@
+package service
+
+// tests getting tokens from cookies and CSRF protection. The integration tests just do basic
+// tests.
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cookieRequest(method string, cookie string, csrf string) *http.Request {
+	r := httptest.NewRequest(method, "/node/foo", nil)
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: "kbase_session", Value: cookie})
+	}
+	if csrf != "" {
+		r.Header.Set(csrfHeader, csrf)
+	}
+	return r
+}
+
+func TestGetTokenFromCookie(t *testing.T) {
+	type testcase struct {
+		r          *http.Request
+		cookieName string
+		expected   string
+	}
+
+	testcases := []testcase{
+		testcase{cookieRequest("GET", "tok", ""), "", ""},
+		testcase{cookieRequest("GET", "tok", ""), "other_cookie", ""},
+		testcase{cookieRequest("GET", "", ""), "kbase_session", ""},
+		testcase{cookieRequest("POST", "", ""), "kbase_session", ""},
+		testcase{cookieRequest("GET", "tok", ""), "kbase_session", "tok"},
+		testcase{cookieRequest("HEAD", "tok", ""), "kbase_session", "tok"},
+		testcase{cookieRequest("OPTIONS", "tok", ""), "kbase_session", "tok"},
+		testcase{cookieRequest("POST", "tok", "tok"), "kbase_session", "tok"},
+		testcase{cookieRequest("PUT", "tok", "  tok  "), "kbase_session", "tok"},
+		testcase{cookieRequest("DELETE", "tok", "tok"), "kbase_session", "tok"},
+	}
+
+	for _, tc := range testcases {
+		token, err := getTokenFromCookie(tc.r, tc.cookieName)
+		assert.Nil(t, err, "unexpected error")
+		assert.Equal(t, tc.expected, token, "incorrect token")
+	}
+}
+
+func TestGetTokenFromCookieFailCSRF(t *testing.T) {
+	for _, r := range []*http.Request{
+		cookieRequest("POST", "tok", ""),
+		cookieRequest("PUT", "tok", "tok2"),
+		cookieRequest("DELETE", "tok", "to"),
+		cookieRequest("PATCH", "tok", "   "),
+	} {
+		token, err := getTokenFromCookie(r, "kbase_session")
+		assert.Equal(t, "", token, "expected error")
+		assert.Equal(t, errors.New(csrfError), err, "incorrect error")
+	}
+}
@@ -3,6 +3,8 @@ package service
 import (
 	"net/http"
 
+	"github.com/kbase/blobstore/apikey"
+
 	"github.com/kbase/blobstore/core/values"
 
 	"github.com/kbase/blobstore/core"
@@ -30,11 +32,21 @@ func translateError(err error) (code int, errstr string) {
 		// Shock compatibility, really should be 403 forbidden
 		return http.StatusBadRequest, "Users that are not node owners can only delete " +
 			"themselves from ACLs."
+	case *auth.NoTokenError:
+		return http.StatusForbidden, t.Error()
 	case *auth.InvalidUserError:
 		// no equivalent shock error, it accepts any string as a username
 		return http.StatusBadRequest, t.Error()
 	case *values.IllegalInputError:
 		return http.StatusBadRequest, t.Error()
+	case *core.VersionMismatchError:
+		return http.StatusPreconditionFailed, t.Error()
+	case *core.NoUserError:
+		return http.StatusNotFound, t.Error()
+	case *core.UserExistsError:
+		return http.StatusConflict, t.Error()
+	case *apikey.NoKeyError:
+		return http.StatusNotFound, t.Error()
 	default:
 		return 500, t.Error()
 	}
@@ -1,16 +1,28 @@
 package service
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"testing"
@@ -38,6 +50,7 @@ const (
 	testBucket    = "mybukkit"
 	blobstoreRole = "BLOBSTORE_ADMIN"
 	adminRole     = "KBASE_ADMIN"
+	readAdminRole = "BLOBSTORE_READ_ADMIN"
 )
 
 type User struct {
@@ -61,6 +74,8 @@ type TestSuite struct {
 	noRole3       User
 	stdRole       User
 	kBaseAdmin    User
+	readAdmin     User
+	lookup        User
 }
 
 func (t *TestSuite) SetupSuite() {
@@ -81,19 +96,25 @@ func (t *TestSuite) SetupSuite() {
 	t.loggerhook = logrust.NewGlobal()
 
 	roles := []string{adminRole, blobstoreRole}
+	// requests made with API keys require a lookup token to validate user names
+	provs := []config.AuthProvider{config.AuthProvider{Type: "kbase", LookupToken: t.lookup.token}}
 	serv, err := New(
 		&config.Config{
-			Host:           "foo", // not used
-			MongoHost:      "localhost:" + strconv.Itoa(t.mongo.GetPort()),
-			MongoDatabase:  testDB,
-			S3Host:         "localhost:" + strconv.Itoa(t.minio.GetPort()),
-			S3Bucket:       testBucket,
-			S3AccessKey:    "ackey",
-			S3AccessSecret: "sooporsecret",
-			S3Region:       "us-west-1",
-			S3DisableSSL:   true,
-			AuthURL:        &authurl,
-			AuthAdminRoles: &roles,
+			Host:               "foo", // not used
+			MongoHost:          "localhost:" + strconv.Itoa(t.mongo.GetPort()),
+			MongoDatabase:      testDB,
+			S3Host:             "localhost:" + strconv.Itoa(t.minio.GetPort()),
+			S3Bucket:           testBucket,
+			S3AccessKey:        "ackey",
+			S3AccessSecret:     "sooporsecret",
+			S3Region:           "us-west-1",
+			S3DisableSSL:       true,
+			AuthProviders:      &provs,
+			AuthURL:            &authurl,
+			AuthAdminRoles:     &roles,
+			AuthReadAdminRoles: &[]string{readAdminRole},
+			AuthCookieName:     "kbase_session",
+			Webhooks:           &[]config.Webhook{},
 		},
 		ServerStaticConf{
 			ServerName:          "servn",
@@ -147,18 +168,24 @@ func (t *TestSuite) setUpUsersAndRoles() {
 	t.createTestUser("noroles3")
 	t.createTestUser("admin_std_role")
 	t.createTestUser("admin_kbase")
+	t.createTestUser("admin_read")
+	t.createTestUser("lookup_user")
 
 	t.noRole = User{"noroles", t.createTestToken("noroles")}
 	t.noRole2 = User{"noroles2", t.createTestToken("noroles2")}
 	t.noRole3 = User{"noroles3", t.createTestToken("noroles3")}
 	t.stdRole = User{"admin_std_role", t.createTestToken("admin_std_role")}
 	t.kBaseAdmin = User{"admin_kbase", t.createTestToken("admin_kbase")}
+	t.readAdmin = User{"admin_read", t.createTestToken("admin_read")}
+	t.lookup = User{"lookup_user", t.createTestToken("lookup_user")}
 
 	t.createTestRole(blobstoreRole)
 	t.createTestRole(adminRole)
+	t.createTestRole(readAdminRole)
 
 	t.addTestRole("admin_std_role", blobstoreRole)
 	t.addTestRole("admin_kbase", adminRole)
+	t.addTestRole("admin_read", readAdminRole)
 }
 
 func (t *TestSuite) createTestUser(username string) {
@@ -446,7 +473,7 @@ func (t *TestSuite) checkXIPLogs(xFF, xRIP, ip string) {
 func (t *TestSuite) TestStoreAndGetWithFilename() {
 	// check whitespace
 	body := t.req("POST", t.url+"/node?filename=%20%20myfile%20%20",
-		strings.NewReader("foobarbaz"), "     OAuth    "+t.noRole.token+"      ", 380, 200)
+		strings.NewReader("foobarbaz"), "     OAuth    "+t.noRole.token+"      ", 556, 200)
 
 	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/node", 200, &t.noRole.user,
 		"request complete", mtmap(), false},
@@ -466,7 +493,7 @@ func (t *TestSuite) TestStoreAndGetWithFilename() {
 			"attributes": nil,
 			"format":     "",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "myfile",
 				"size":     float64(9),
 			},
@@ -484,7 +511,7 @@ func (t *TestSuite) TestStoreAndGetWithFilename() {
 			"id":            id,
 			"format":        "",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "myfile",
 				"size":     float64(9),
 			},
@@ -492,7 +519,7 @@ func (t *TestSuite) TestStoreAndGetWithFilename() {
 		"error":  nil,
 		"status": float64(200),
 	}
-	t.checkNode(id, &t.noRole, 380, expected2)
+	t.checkNode(id, &t.noRole, 556, expected2)
 
 	path1 := "/node/" + id
 	path2 := path1 + "/"
@@ -504,7 +531,7 @@ func (t *TestSuite) TestStoreAndGetWithFilename() {
 
 func (t *TestSuite) TestStoreAndGetNodeAsAdminWithFormatAndTrailingSlash() {
 	body := t.req("POST", t.url+"/node/?format=JSON", strings.NewReader("foobarbaz"),
-		"oauth "+t.noRole.token, 378, 200)
+		"oauth "+t.noRole.token, 554, 200)
 	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/node/", 200, ptr("noroles"),
 		"request complete", mtmap(), false},
 	)
@@ -521,7 +548,7 @@ func (t *TestSuite) TestStoreAndGetNodeAsAdminWithFormatAndTrailingSlash() {
 			"id":            id,
 			"format":        "JSON",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "",
 				"size":     float64(9),
 			},
@@ -530,10 +557,10 @@ func (t *TestSuite) TestStoreAndGetNodeAsAdminWithFormatAndTrailingSlash() {
 		"status": float64(200),
 	}
 	path := "/node/" + id
-	t.checkNode(id, &t.stdRole, 378, expected)
+	t.checkNode(id, &t.stdRole, 554, expected)
 	t.checkFile(t.url+path+"?download", path, &t.stdRole, 9, id, []byte("foobarbaz"))
 	t.checkFile(t.url+path+"?download_raw", path, &t.stdRole, 9, "", []byte("foobarbaz"))
-	t.checkNode(id, &t.kBaseAdmin, 378, expected)
+	t.checkNode(id, &t.kBaseAdmin, 554, expected)
 	t.checkFile(t.url+path+"?download", path, &t.kBaseAdmin, 9, id, []byte("foobarbaz"))
 	t.checkFile(t.url+path+"?download_raw", path, &t.kBaseAdmin, 9, "", []byte("foobarbaz"))
 }
@@ -541,16 +568,16 @@ func (t *TestSuite) TestStoreAndGetNodeAsAdminWithFormatAndTrailingSlash() {
 func (t *TestSuite) TestStoreMIMEMultipartFilenameFormat() {
 	partsuffix := ` filename="myfile.txt"`
 	format := "gasbomb"
-	t.storeMIMEMultipart(partsuffix, &format, "myfile.txt", 392)
+	t.storeMIMEMultipart(partsuffix, &format, "myfile.txt", 568)
 }
 
 func (t *TestSuite) TestStoreMIMEMultipartWhitespaceFileNameFormat() {
 	partsuffix := ` filename=""`
 	format := ""
-	t.storeMIMEMultipart(partsuffix, &format, "", 375)
+	t.storeMIMEMultipart(partsuffix, &format, "", 551)
 }
 func (t *TestSuite) TestStoreMIMEMultipartNoFileNameOrFormat() {
-	t.storeMIMEMultipart("", nil, "", 375)
+	t.storeMIMEMultipart("", nil, "", 551)
 }
 
 // don't load MIME this way, sticks everything in memory
@@ -608,7 +635,7 @@ func (t *TestSuite) storeMIMEMultipart(
 			"attributes": nil,
 			"format":     f,
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "f681bb7c4fe38d8917e96518e10d760c"},
+				"checksum": checksumsFor("foobarbazba"),
 				"name":     filename,
 				"size":     float64(11),
 			},
@@ -626,7 +653,7 @@ func (t *TestSuite) storeMIMEMultipart(
 			"id":            id,
 			"format":        f,
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "f681bb7c4fe38d8917e96518e10d760c"},
+				"checksum": checksumsFor("foobarbazba"),
 				"name":     filename,
 				"size":     float64(11),
 			},
@@ -647,6 +674,229 @@ func (t *TestSuite) storeMIMEMultipart(
 	t.checkFile(t.url+path2+"?download_raw", path2, &t.noRole, 11, "", []byte("foobarbazba"))
 }
 
+// adds an upload part to a multipart form.
+func addUploadPart(mpw *multipart.Writer, filename string, contents string) {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Length", strconv.Itoa(len(contents)))
+	h.Set("Content-Disposition", `form-data; name="upload"; filename="`+filename+`"`)
+	w, _ := mpw.CreatePart(h)
+	io.Copy(w, strings.NewReader(contents))
+}
+
+func (t *TestSuite) TestStoreMIMEMultipartMultipleUploads() {
+	// don't load MIME this way, sticks everything in memory
+	b := new(bytes.Buffer)
+	mpw := multipart.NewWriter(b)
+	_ = mpw.WriteField("format", "text")
+	addUploadPart(mpw, "f1", "foo")
+	addUploadPart(mpw, "f2", "barbaz")
+	_ = mpw.WriteField("format", "json")
+	addUploadPart(mpw, "f3", "whee")
+	_ = mpw.Close()
+
+	req, err := http.NewRequest("POST", t.url+"/node", b)
+	t.Nil(err, "unexpected error")
+	req.Header.Set("authorization", "oauth "+t.noRole.token)
+	req.Header.Set("content-type", mpw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	t.Nil(err, "unexpected error")
+	t.Equal(200, resp.StatusCode, "incorrect statuscode")
+	var got map[string]interface{}
+	t.Nil(json.NewDecoder(resp.Body).Decode(&got), "unexpected error")
+	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/node", 200, &t.noRole.user,
+		"request complete", mtmap(), false},
+	)
+
+	files := [][]string{
+		{"f1", "text", "foo"},
+		{"f2", "", "barbaz"},
+		{"f3", "json", "whee"},
+	}
+	// IDs and times are generated, so pull them from the response
+	nodes := got["data"].([]interface{})
+	t.Equal(len(files), len(nodes), "incorrect node count")
+	expected := []interface{}{}
+	for i, f := range files {
+		n := nodes[i].(map[string]interface{})
+		expected = append(expected, map[string]interface{}{
+			"attributes":    nil,
+			"created_on":    n["created_on"],
+			"last_modified": n["created_on"],
+			"id":            n["id"],
+			"format":        f[1],
+			"file": map[string]interface{}{
+				"checksum": checksumsFor(f[2]),
+				"name":     f[0],
+				"size":     float64(len(f[2])),
+			},
+		})
+	}
+	ret, conlen := getBulkResponse(expected)
+	t.Equal(ret, got, "incorrect response")
+	t.Equal(conlen, resp.ContentLength, "incorrect content length")
+
+	for i, f := range files {
+		id := expected[i].(map[string]interface{})["id"].(string)
+		t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, &t.noRole, int64(len(f[2])),
+			f[0], []byte(f[2]))
+	}
+}
+
+func (t *TestSuite) TestStoreMIMEMultipartMultipleUploadsFail() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"Oauth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	nodes := t.countNodes()
+	t.loggerhook.Reset()
+
+	type testcase struct {
+		form      func(mpw *multipart.Writer)
+		errstring string
+		conlen    int64
+	}
+
+	testcases := []testcase{
+		testcase{func(mpw *multipart.Writer) {
+			addUploadPart(mpw, "f1", "foo")
+			addUploadPart(mpw, strings.Repeat("a", 257), "bar")
+		}, "File name is > 256 bytes", 85},
+		testcase{func(mpw *multipart.Writer) {
+			addUploadPart(mpw, "f1", "foo")
+			_ = mpw.WriteField("copy_data", id)
+		}, "Unexpected form name: copy_data", 92},
+		testcase{func(mpw *multipart.Writer) {
+			addUploadPart(mpw, "f1", "foo")
+			_ = mpw.WriteField("format", "json")
+		}, "Expected form part, early EOF", 90},
+		testcase{func(mpw *multipart.Writer) {
+			addUploadPart(mpw, "f1", "foo")
+			addUploadPart(mpw, "f2", "")
+		}, "file size must be > 0", 82},
+	}
+
+	for _, tc := range testcases {
+		b := new(bytes.Buffer)
+		mpw := multipart.NewWriter(b)
+		tc.form(mpw)
+		_ = mpw.Close()
+		req, err := http.NewRequest("POST", t.url+"/node", b)
+		t.Nil(err, "unexpected error")
+		req.Header.Set("authorization", "oauth "+t.noRole.token)
+		req.Header.Set("content-type", mpw.FormDataContentType())
+		body := t.requestToJSON(req, tc.conlen, 400)
+		t.checkError(body, 400, tc.errstring)
+		// the first node is deleted when the request fails
+		t.Equal(nodes, t.countNodes(), "nodes were created")
+	}
+}
+
+func (t *TestSuite) TestStoreWithChecksums() {
+	md5 := "6df23dc03f9b54cc38a0fc1483df6e21"
+	sha := "97df3588b5a3f24babc3851b372f0ba71a9dcdded43b14b9d06961bfc1707d9d"
+	type testcase struct {
+		params  string
+		headers map[string]string
+	}
+
+	testcases := []testcase{
+		testcase{"?md5=" + md5 + "&sha256=" + sha, nil},
+		testcase{"", map[string]string{"Content-MD5": "bfI9wD+bVMw4oPwUg99uIQ=="}},
+		testcase{"", map[string]string{"Digest": "MD5=bfI9wD+bVMw4oPwUg99uIQ==, " +
+			"SHA-256=l981iLWj8kurw4UbNy8Lpxqdzd7UOxS50Glhv8FwfZ0="}},
+	}
+
+	for _, tc := range testcases {
+		t.loggerhook.Reset()
+		req, err := http.NewRequest("POST", t.url+"/node"+tc.params,
+			strings.NewReader("foobarbaz"))
+		t.Nil(err, "unexpected error")
+		req.Header.Set("authorization", "oauth "+t.noRole.token)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		body := t.requestToJSON(req, 550, 200)
+		t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/node", 200, &t.noRole.user,
+			"request complete", mtmap(), false},
+		)
+		data := body["data"].(map[string]interface{})
+		file := data["file"].(map[string]interface{})
+		t.Equal(checksumsFor("foobarbaz"), file["checksum"], "incorrect checksum")
+	}
+
+	// form uploads
+	b := new(bytes.Buffer)
+	mpw := multipart.NewWriter(b)
+	_ = mpw.WriteField("sha256", sha)
+	_ = mpw.WriteField("format", "text")
+	_ = mpw.WriteField("md5", strings.ToUpper(md5))
+	addUploadPart(mpw, "f1", "foobarbaz")
+	_ = mpw.Close()
+	req, err := http.NewRequest("POST", t.url+"/node", b)
+	t.Nil(err, "unexpected error")
+	req.Header.Set("authorization", "oauth "+t.noRole.token)
+	req.Header.Set("content-type", mpw.FormDataContentType())
+	body := t.requestToJSON(req, 556, 200)
+	data := body["data"].(map[string]interface{})
+	t.Equal("text", data["format"], "incorrect format")
+}
+
+func (t *TestSuite) TestStoreFailChecksumMismatch() {
+	md5 := "6df23dc03f9b54cc38a0fc1483df6e22"
+	sha := "97df3588b5a3f24babc3851b372f0ba71a9dcdded43b14b9d06961bfc1707d9e"
+	md5err := "MD5 checksum mismatch: expected " + md5 +
+		", got 6df23dc03f9b54cc38a0fc1483df6e21"
+	shaerr := "SHA-256 checksum mismatch: expected " + sha +
+		", got 97df3588b5a3f24babc3851b372f0ba71a9dcdded43b14b9d06961bfc1707d9d"
+	nodes := t.countNodes()
+
+	type testcase struct {
+		params    string
+		headers   map[string]string
+		errstring string
+		conlen    int64
+	}
+
+	testcases := []testcase{
+		testcase{"?md5=" + md5, nil, md5err, 163},
+		testcase{"?sha256=" + sha, nil, shaerr, 231},
+		testcase{"", map[string]string{"Content-MD5": "bfI9wD+bVMw4oPwUg99uIg=="}, md5err, 163},
+		testcase{"?md5=foo", nil, "Invalid md5 parameter: foo is not an MD5 string", 108},
+		testcase{"", map[string]string{"Digest": "sha-256=bfI9wD+bVMw4oPwUg99uIg=="},
+			"Invalid Digest header: expected 32 bytes, got 16", 109},
+	}
+
+	for _, tc := range testcases {
+		t.loggerhook.Reset()
+		req, err := http.NewRequest("POST", t.url+"/node"+tc.params,
+			strings.NewReader("foobarbaz"))
+		t.Nil(err, "unexpected error")
+		req.Header.Set("authorization", "oauth "+t.noRole.token)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		body := t.requestToJSON(req, tc.conlen, 400)
+		t.checkError(body, 400, tc.errstring)
+		t.checkLogs(logEvent{logrus.ErrorLevel, "POST", "/node", 400, &t.noRole.user,
+			tc.errstring, mtmap(), false},
+		)
+		t.Equal(nodes, t.countNodes(), "node was created")
+	}
+
+	// form uploads
+	b := new(bytes.Buffer)
+	mpw := multipart.NewWriter(b)
+	_ = mpw.WriteField("md5", md5)
+	addUploadPart(mpw, "f1", "foobarbaz")
+	_ = mpw.Close()
+	req, err := http.NewRequest("POST", t.url+"/node", b)
+	t.Nil(err, "unexpected error")
+	req.Header.Set("authorization", "oauth "+t.noRole.token)
+	req.Header.Set("content-type", mpw.FormDataContentType())
+	body := t.requestToJSON(req, 163, 400)
+	t.checkError(body, 400, md5err)
+	t.Equal(nodes, t.countNodes(), "node was created")
+}
+
 func (t *TestSuite) TestStoreMIMEMultipartFailContentLength() {
 	// don't load MIME this way, sticks everything in memory
 	for _, cl := range []string{"", "not a number", "-1"} {
@@ -770,7 +1020,7 @@ func (t *TestSuite) TestStoreMIMEMultipartFailNoFile() {
 func (t *TestSuite) TestGetNodeFileACLPublic() {
 	// not testing logging here, tested elsewhere
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.kBaseAdmin.token, 374, 200)
+		"OAuth "+t.kBaseAdmin.token, 550, 200)
 	uid := t.getUserIDFromMongo(t.kBaseAdmin.user)
 
 	data := body["data"].(map[string]interface{})
@@ -785,7 +1035,7 @@ func (t *TestSuite) TestGetNodeFileACLPublic() {
 			"id":            id,
 			"format":        "",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "",
 				"size":     float64(9),
 			},
@@ -817,7 +1067,7 @@ func (t *TestSuite) TestGetNodeFileACLPublic() {
 	t.loggerhook.Reset()
 
 	for _, u := range []*User{&t.noRole, nil} {
-		t.checkNode(id, u, 374, expected)
+		t.checkNode(id, u, 550, expected)
 		t.checkACL(id, "", "", u, 394, expectedacl)
 		t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, u, 9, id,
 			[]byte("foobarbaz"))
@@ -899,6 +1149,13 @@ func (t *TestSuite) checkFile(url string, path string, user *User, size int64, f
 			"incorrect content-disposition")
 	}
 	t.Equal(200, resp.StatusCode, "incorrect statuscode")
+	sums := checksumsFor(string(expected))
+	b64 := func(alg string) string {
+		b, _ := hex.DecodeString(sums[alg].(string))
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	t.Equal(fmt.Sprintf("CRC32c=%s,MD5=%s,SHA-256=%s,SHA=%s", b64("crc32c"), b64("md5"),
+		b64("sha256"), b64("sha1")), resp.Header.Get("digest"), "incorrect digest")
 	b, err := ioutil.ReadAll(resp.Body)
 	t.Nil(err, "unexpected error")
 	t.Equal(expected, b, "incorrect file")
@@ -1026,7 +1283,7 @@ func (t *TestSuite) TestGetNodeBadID() {
 
 func (t *TestSuite) TestGetNodeFailPerms() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.kBaseAdmin.token, 374, 200)
+		"OAuth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/node", 200, &t.kBaseAdmin.user,
 		"request complete", mtmap(), false},
@@ -1057,7 +1314,7 @@ func (t *TestSuite) TestGetNodeFailPerms() {
 func (t *TestSuite) TestUnexpectedError() {
 	defer t.createTestBucket()
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.kBaseAdmin.token, 374, 200)
+		"OAuth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/node", 200, &t.kBaseAdmin.user,
 		"request complete", mtmap(), false},
@@ -1089,7 +1346,7 @@ func (t *TestSuite) createTestBucket() {
 
 func (t *TestSuite) TestDeleteNode() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.noRole.token, 374, 200)
+		"OAuth "+t.noRole.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1103,7 +1360,7 @@ func (t *TestSuite) TestDeleteNode() {
 
 	// test delete as admin and with trailing slash
 	body = t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.noRole.token, 374, 200)
+		"OAuth "+t.noRole.token, 550, 200)
 	id = (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1116,9 +1373,46 @@ func (t *TestSuite) TestDeleteNode() {
 	)
 }
 
+// counts the files in the file store.
+func (t *TestSuite) countFiles() int {
+	cli := t.minio.CreateS3Client()
+	res, err := cli.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(testBucket)})
+	if err != nil {
+		t.FailNow(err.Error())
+	}
+	return len(res.Contents)
+}
+
+func (t *TestSuite) TestSharedFiles() {
+	// identical uploads and copies share a single file
+	ids := []string{}
+	for _, u := range []User{t.noRole, t.noRole2} {
+		body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+			"OAuth "+u.token, 550, 200)
+		ids = append(ids, (body["data"].(map[string]interface{}))["id"].(string))
+	}
+	body := t.req("POST", t.url+"/node/"+ids[0]+"/copy", nil, "OAuth "+t.noRole.token, 550, 200)
+	ids = append(ids, (body["data"].(map[string]interface{}))["id"].(string))
+	t.req("POST", t.url+"/node", strings.NewReader("foobarbazba"), "OAuth "+t.noRole.token,
+		550, 200)
+	t.Equal(2, t.countFiles(), "incorrect file count")
+
+	// the file is only deleted when the last node using it is deleted
+	users := []User{t.noRole, t.noRole2, t.noRole}
+	for i, id := range ids {
+		t.req("DELETE", t.url+"/node/"+id, nil, "OAuth "+users[i].token, 53, 200)
+		for j := i + 1; j < len(ids); j++ {
+			t.loggerhook.Reset()
+			t.checkFile(t.url+"/node/"+ids[j]+"?download_raw", "/node/"+ids[j], &users[j], 9, "",
+				[]byte("foobarbaz"))
+		}
+	}
+	t.Equal(1, t.countFiles(), "incorrect file count")
+}
+
 func (t *TestSuite) TestDeleteNodeFail() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.kBaseAdmin.token, 374, 200)
+		"Oauth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1143,6 +1437,7 @@ func (t *TestSuite) TestDeleteNodeFail() {
 		testcase{badid, "oauth " + t.kBaseAdmin.token, &t.kBaseAdmin.user, 404, "Node not found",
 			75},
 		testcase{id, "oauth " + t.noRole.token, &t.noRole.user, 401, "User Unauthorized", 78},
+		testcase{id, "Bearer " + t.noRole.token, &t.noRole.user, 401, "User Unauthorized", 78},
 	}
 
 	for _, tc := range testcases {
@@ -1155,6 +1450,116 @@ func (t *TestSuite) TestDeleteNodeFail() {
 	}
 }
 
+func (t *TestSuite) TestSetFileMetadata() {
+	body := t.req("POST", t.url+"/node?filename=fn&format=fmt", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 555, 200)
+	data := body["data"].(map[string]interface{})
+	id := data["id"].(string)
+	created := data["created_on"].(string)
+	t.req("PUT", t.url+"/node/"+id+"/acl/read?users="+t.noRole2.user, nil,
+		"OAuth "+t.noRole.token, 441, 200)
+	t.loggerhook.Reset()
+
+	expected := func(modified string, filename string, format string) map[string]interface{} {
+		return map[string]interface{}{
+			"data": map[string]interface{}{
+				"attributes":    nil,
+				"created_on":    created,
+				"last_modified": modified,
+				"id":            id,
+				"format":        format,
+				"file": map[string]interface{}{
+					"checksum": checksumsFor("foobarbaz"),
+					"name":     filename,
+					"size":     float64(9),
+				},
+			},
+			"error":  nil,
+			"status": float64(200),
+		}
+	}
+
+	time.Sleep(2 * time.Millisecond) // ensure the modified time differs from the created time
+	body = t.req("PUT", t.url+"/node/"+id+"?filename=newname", nil, "OAuth "+t.noRole.token,
+		560, 200)
+	t.checkLogs(logEvent{logrus.InfoLevel, "PUT", "/node/" + id, 200, &t.noRole.user,
+		"request complete", mtmap(), false},
+	)
+	modified := body["data"].(map[string]interface{})["last_modified"].(string)
+	t.NotEqual(created, modified, "expected modified time to change")
+	t.Equal(expected(modified, "newname", "fmt"), body, "incorrect node")
+	t.checkNode(id, &t.noRole, 560, expected(modified, "newname", "fmt"))
+
+	// admins can change the metadata, and the version can be specified
+	body = t.reqWithHeaders("PUT", t.url+"/node/"+id+"/?format=", nil,
+		"OAuth "+t.kBaseAdmin.token,
+		map[string]string{"If-Match": `"3"`, "X-Forwarded-For": "1.2.3.4"}, 557, 200)
+	modified = body["data"].(map[string]interface{})["last_modified"].(string)
+	t.Equal(expected(modified, "newname", ""), body, "incorrect node")
+	t.checkNode(id, &t.noRole, 557, expected(modified, "newname", ""))
+
+	// the change is recorded in the audit log
+	body = t.get(t.url+"/node/"+id+"/audit?limit=1", &t.noRole, 766, 200)
+	r2 := []interface{}{"noroles", "noroles2"}
+	t.Equal([]interface{}{map[string]interface{}{
+		"action": "setfilemetadata", "node": id, "source": nil, "user": "admin_kbase",
+		"admin": true, "impersonator": nil, "ip": "1.2.3.4",
+		"before": map[string]interface{}{"owner": "noroles", "read": r2, "public": false,
+			"filename": "newname", "format": "fmt"},
+		"after": map[string]interface{}{"owner": "noroles", "read": r2, "public": false,
+			"filename": "newname", "format": ""},
+	}}, t.checkAuditRecords(body), "incorrect records")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) TestSetFileMetadataFail() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.req("PUT", t.url+"/node/"+id+"/acl/read?users="+t.noRole2.user, nil,
+		"OAuth "+t.noRole.token, 441, 200)
+	t.loggerhook.Reset()
+
+	type testcase struct {
+		path      string
+		token     string
+		headers   map[string]string
+		user      *string
+		status    int
+		errstring string
+	}
+
+	badid := uuid.New().String()
+	testcases := []testcase{
+		testcase{"badid?filename=f", t.noRole.token, nil, &t.noRole.user, 404,
+			"Node not found"},
+		testcase{badid + "?filename=f", t.noRole.token, nil, &t.noRole.user, 404,
+			"Node not found"},
+		testcase{id + "?filename=f", "", nil, nil, 401, "No Authorization"},
+		testcase{id + "?filename=f", t.noRole2.token, nil, &t.noRole2.user, 401,
+			"User Unauthorized"},
+		testcase{id, t.noRole.token, nil, &t.noRole.user, 400,
+			"At least one of filename or format must be provided"},
+		testcase{id + "?filename=f", t.noRole.token, map[string]string{"If-Match": `"1"`},
+			&t.noRole.user, 412, "Node " + id + " is at version 2, not 1"},
+		testcase{id + "?filename=f", t.noRole.token, map[string]string{"If-Match": "2"},
+			&t.noRole.user, 400, "Invalid If-Match header: 2"},
+	}
+
+	for _, tc := range testcases {
+		token := ""
+		if tc.token != "" {
+			token = "OAuth " + tc.token
+		}
+		body := t.reqWithHeaders("PUT", t.url+"/node/"+tc.path, nil, token, tc.headers,
+			int64(61+len(tc.errstring)), tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		t.checkLogs(logEvent{logrus.ErrorLevel, "PUT", "/node/" + strings.Split(tc.path, "?")[0],
+			tc.status, tc.user, tc.errstring, mtmap(), false},
+		)
+	}
+}
+
 func (t *TestSuite) TestCopyNode() {
 	t.testCopyNode("/copy")
 	t.testCopyNode("/copy/")
@@ -1162,7 +1567,7 @@ func (t *TestSuite) TestCopyNode() {
 
 func (t *TestSuite) testCopyNode(endpath string) {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.noRole.token, 374, 200)
+		"Oauth "+t.noRole.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 
 	// add public read
@@ -1177,7 +1582,7 @@ func (t *TestSuite) testCopyNode(endpath string) {
 	req, err := http.NewRequest("POST", t.url+"/node/"+id+endpath, nil)
 	t.Nil(err, "unexpected error")
 	req.Header.Set("authorization", "oauth "+t.noRole2.token)
-	body2 := t.requestToJSON(req, 374, 200)
+	body2 := t.requestToJSON(req, 550, 200)
 	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/node/" + id + endpath, 200, &t.noRole2.user,
 		"request complete", mtmap(), false},
 	)
@@ -1195,7 +1600,7 @@ func (t *TestSuite) testCopyNode(endpath string) {
 			"id":            id2,
 			"format":        "",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "",
 				"size":     float64(9),
 			},
@@ -1208,15 +1613,125 @@ func (t *TestSuite) testCopyNode(endpath string) {
 	norole2User := map[string]interface{}{"uuid": norole2ID, "username": t.noRole2.user}
 	expectedacl := getExpectedACL(norole2User, []map[string]interface{}{}, false)
 
-	t.checkNode(id2, &t.noRole2, 374, expected)
+	t.checkNode(id2, &t.noRole2, 550, expected)
 	t.checkACL(id2, "", "", &t.noRole2, 395, expectedacl)
 	t.checkFile(t.url+"/node/"+id2+"?download", "/node/"+id2, &t.noRole2, 9, id2,
 		[]byte("foobarbaz"))
 }
 
+func (t *TestSuite) TestCopyNodeWithOptions() {
+	body := t.req("POST", t.url+"/node?filename=fn&format=fmt", strings.NewReader("foobarbaz"),
+		"Oauth "+t.noRole.token, 555, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+
+	t.req("PUT", t.url+"/node/"+id+"/acl/public_read", nil, "OAuth "+t.noRole.token, 394,
+		200)
+	t.req("PUT", t.url+"/node/"+id+"/acl/read?users="+t.noRole2.user, nil,
+		"Oauth "+t.noRole.token, 440, 200)
+
+	norole1ID := t.getUserIDFromMongo(t.noRole.user)
+	norole1User := map[string]interface{}{"uuid": norole1ID, "username": t.noRole.user}
+	norole2ID := t.getUserIDFromMongo(t.noRole2.user)
+	norole2User := map[string]interface{}{"uuid": norole2ID, "username": t.noRole2.user}
+
+	// copy the ACLs and change the filename
+	body2 := t.req("POST",
+		t.url+"/node/"+id+"/copy?copy_readers=true&copy_public=true&filename=newfn",
+		nil, "oauth "+t.noRole2.token, 558, 200)
+	data2 := body2["data"].(map[string]interface{})
+	time := data2["created_on"].(string)
+	id2 := data2["id"].(string)
+
+	expected := map[string]interface{}{
+		"data": map[string]interface{}{
+			"attributes":    nil,
+			"created_on":    time,
+			"last_modified": time,
+			"id":            id2,
+			"format":        "fmt",
+			"file": map[string]interface{}{
+				"checksum": checksumsFor("foobarbaz"),
+				"name":     "newfn",
+				"size":     float64(9),
+			},
+		},
+		"error":  nil,
+		"status": float64(200),
+	}
+	t.checkNode(id2, &t.noRole2, 558, expected)
+	expectedacl := getExpectedACL(
+		norole2User, []map[string]interface{}{norole1User}, false)
+	expectedacl["data"].(map[string]interface{})["public"].(map[string]interface{})["read"] =
+		true
+	t.checkACL(id2, "", "", &t.noRole2, 440, expectedacl)
+
+	// admin sets the owner and clears the format
+	body3 := t.req("POST", t.url+"/node/"+id+"/copy?owner="+t.noRole2.user+"&format=",
+		nil, "oauth "+t.kBaseAdmin.token, 552, 200)
+	data3 := body3["data"].(map[string]interface{})
+	time = data3["created_on"].(string)
+	id3 := data3["id"].(string)
+
+	expected = map[string]interface{}{
+		"data": map[string]interface{}{
+			"attributes":    nil,
+			"created_on":    time,
+			"last_modified": time,
+			"id":            id3,
+			"format":        "",
+			"file": map[string]interface{}{
+				"checksum": checksumsFor("foobarbaz"),
+				"name":     "fn",
+				"size":     float64(9),
+			},
+		},
+		"error":  nil,
+		"status": float64(200),
+	}
+	t.checkNode(id3, &t.noRole2, 552, expected)
+	expectedacl = getExpectedACL(norole2User, []map[string]interface{}{}, false)
+	t.checkACL(id3, "", "", &t.noRole2, 395, expectedacl)
+}
+
+func (t *TestSuite) TestCopyNodeWithOptionsFail() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"Oauth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+
+	type testcase struct {
+		query     string
+		token     string
+		user      *string
+		status    int
+		errstring string
+	}
+
+	testcases := []testcase{
+		testcase{"copy_readers=yes", t.noRole.token, &t.noRole.user, 400,
+			"Invalid copy_readers parameter: yes"},
+		testcase{"copy_public=2", t.noRole.token, &t.noRole.user, 400,
+			"Invalid copy_public parameter: 2"},
+		testcase{"owner=" + t.noRole2.user, t.noRole.token, &t.noRole.user, 401,
+			"User Unauthorized"},
+		testcase{"owner=superfakeuserfoo", t.kBaseAdmin.token, &t.kBaseAdmin.user, 400,
+			"Invalid users: superfakeuserfoo"},
+	}
+
+	for _, tc := range testcases {
+		path := "/node/" + id + "/copy"
+		body := t.req("POST", t.url+path+"?"+tc.query, nil, "oauth "+tc.token,
+			int64(61+len(tc.errstring)), tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		t.checkLogs(logEvent{logrus.ErrorLevel, "POST", path, tc.status, tc.user,
+			tc.errstring, mtmap(), false},
+		)
+	}
+}
+
 func (t *TestSuite) TestCopyNodeFail() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.kBaseAdmin.token, 374, 200)
+		"Oauth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1261,7 +1776,7 @@ func (t *TestSuite) TestCopyNodeViaForm() {
 
 func (t *TestSuite) testCopyNodeViaForm(path string) {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.noRole.token, 374, 200)
+		"Oauth "+t.noRole.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 
 	// add public read
@@ -1283,7 +1798,7 @@ func (t *TestSuite) testCopyNodeViaForm(path string) {
 	t.Nil(err, "unexpected error")
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 	req.Header.Set("authorization", "oauth "+t.noRole2.token)
-	body2 := t.requestToJSON(req, 374, 200)
+	body2 := t.requestToJSON(req, 550, 200)
 	t.checkLogs(logEvent{logrus.InfoLevel, "POST", path, 200, &t.noRole2.user,
 		"request complete", mtmap(), false},
 	)
@@ -1301,7 +1816,7 @@ func (t *TestSuite) testCopyNodeViaForm(path string) {
 			"id":            id2,
 			"format":        "",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "",
 				"size":     float64(9),
 			},
@@ -1314,7 +1829,7 @@ func (t *TestSuite) testCopyNodeViaForm(path string) {
 	norole2User := map[string]interface{}{"uuid": norole2ID, "username": t.noRole2.user}
 	expectedacl := getExpectedACL(norole2User, []map[string]interface{}{}, false)
 
-	t.checkNode(id2, &t.noRole2, 374, expected)
+	t.checkNode(id2, &t.noRole2, 550, expected)
 	t.checkACL(id2, "", "", &t.noRole2, 395, expectedacl)
 	t.checkFile(t.url+"/node/"+id2+"?download", "/node/"+id2, &t.noRole2, 9, id2,
 		[]byte("foobarbaz"))
@@ -1322,7 +1837,7 @@ func (t *TestSuite) testCopyNodeViaForm(path string) {
 
 func (t *TestSuite) TestFormNodeFailCorruptFormHeader() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.noRole.token, 374, 200)
+		"Oauth "+t.noRole.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1379,7 +1894,7 @@ func (t *TestSuite) TestFormNodeFailEarlyEOF() {
 
 func (t *TestSuite) TestFormNodeFailBadFormName() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.noRole.token, 374, 200)
+		"Oauth "+t.noRole.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1404,7 +1919,7 @@ func (t *TestSuite) TestCopyNodeViaFormFail() {
 	// tests the more standard cases where form mangling isn't required
 
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.kBaseAdmin.token, 374, 200)
+		"Oauth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1480,7 +1995,7 @@ func (t *TestSuite) TestNotAllowed() {
 
 func (t *TestSuite) TestGetACLs() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.noRole.token, 374, 200)
+		"OAuth "+t.noRole.token, 550, 200)
 	t.loggerhook.Reset() // tested this enough already
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	// ID gen is random, so we'll just fetch the generated ID from the DB.
@@ -1526,7 +2041,7 @@ func (t *TestSuite) getUserIDFromMongo(name string) string {
 
 func (t *TestSuite) TestGetACLAsAdminVerbose() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.noRole.token, 374, 200)
+		"OAuth "+t.noRole.token, 550, 200)
 	t.loggerhook.Reset() // tested this enough already
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	// ID gen is random, so we'll just fetch the generated ID from the DB.
@@ -1570,7 +2085,7 @@ func (t *TestSuite) checkACL(id string, urlsuffix string, params string, user *U
 
 func (t *TestSuite) TestGetACLsBadType() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.noRole.token, 374, 200)
+		"OAuth "+t.noRole.token, 550, 200)
 	t.loggerhook.Reset() // tested this enough already
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	body2 := t.get(t.url+"/node/"+id+"/acl/pubwic_wead", &t.noRole, 77, 400)
@@ -1597,7 +2112,7 @@ func (t *TestSuite) TestGetACLsBadID() {
 
 func (t *TestSuite) TestGetACLsFailPerms() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.kBaseAdmin.token, 374, 200)
+		"OAuth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1616,7 +2131,7 @@ func (t *TestSuite) TestGetACLsFailPerms() {
 
 func (t *TestSuite) TestSetGlobalACLs() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.noRole.token, 374, 200)
+		"OAuth "+t.noRole.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 	uid := t.getUserIDFromMongo(t.noRole.user)
@@ -1688,7 +2203,7 @@ func (t *TestSuite) TestSetGlobalACLs() {
 
 func (t *TestSuite) TestSetGlobalACLsFail() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"OAuth "+t.kBaseAdmin.token, 374, 200)
+		"OAuth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -1738,7 +2253,7 @@ func (t *TestSuite) TestSetIgnoredACLs() {
 	// write and delete acl change requests are silently ignored, since we don't support
 	// those acls
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.noRole.token, 374, 200)
+		"Oauth "+t.noRole.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 	uid := t.getUserIDFromMongo(t.noRole.user)
@@ -1806,7 +2321,7 @@ func (t *TestSuite) TestSetIgnoredACLs() {
 
 func (t *TestSuite) TestSetReadACL() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.noRole.token, 374, 200)
+		"Oauth "+t.noRole.token, 550, 200)
 	uid := t.getUserIDFromMongo(t.noRole.user)
 	t.loggerhook.Reset()
 
@@ -1822,7 +2337,7 @@ func (t *TestSuite) TestSetReadACL() {
 			"id":            id,
 			"format":        "",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "",
 				"size":     float64(9),
 			},
@@ -1860,7 +2375,7 @@ func (t *TestSuite) TestSetReadACL() {
 	t.Equal(expectedACL, body, "incorrect acls")
 
 	for _, u := range []*User{&t.noRole2, &t.noRole3} {
-		t.checkNode(id, u, 374, expected)
+		t.checkNode(id, u, 550, expected)
 		t.checkACL(id, "", "", u, 487, expectedACL)
 		t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, u, 9, id,
 			[]byte("foobarbaz"))
@@ -1876,7 +2391,7 @@ func (t *TestSuite) TestSetReadACL() {
 	expectedACL = getExpectedACL(owner, []map[string]interface{}{u3}, true)
 	t.Equal(expectedACL, body, "incorrect acls")
 	t.getNodeFailUnauth(id, &t.noRole2)
-	t.checkNode(id, &t.noRole3, 374, expected)
+	t.checkNode(id, &t.noRole3, 550, expected)
 	t.checkACL(id, "", "?verbosity=full", &t.noRole3, 721, expectedACL)
 	t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, &t.noRole3, 9, id,
 		[]byte("foobarbaz"))
@@ -1892,7 +2407,7 @@ func (t *TestSuite) TestSetReadACL() {
 	t.Equal(expectedACL, body, "incorrect acls")
 
 	for _, u := range []*User{&t.noRole2, &t.noRole3} {
-		t.checkNode(id, u, 374, expected)
+		t.checkNode(id, u, 550, expected)
 		t.checkACL(id, "", "?verbosity=full", u, 825, expectedACL)
 		t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, u, 9, id,
 			[]byte("foobarbaz"))
@@ -1913,7 +2428,7 @@ func (t *TestSuite) TestSetReadACL() {
 
 func (t *TestSuite) TestRemoveSelfFromReadACL() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.noRole.token, 374, 200)
+		"Oauth "+t.noRole.token, 550, 200)
 	uid := t.getUserIDFromMongo(t.noRole.user)
 	t.loggerhook.Reset()
 
@@ -1929,7 +2444,7 @@ func (t *TestSuite) TestRemoveSelfFromReadACL() {
 			"id":            id,
 			"format":        "",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "",
 				"size":     float64(9),
 			},
@@ -1959,7 +2474,7 @@ func (t *TestSuite) TestRemoveSelfFromReadACL() {
 	expectedACL := getExpectedACL(owner, []map[string]interface{}{u2}, false)
 	t.Equal(expectedACL, body, "incorrect acls")
 
-	t.checkNode(id, &t.noRole2, 374, expected)
+	t.checkNode(id, &t.noRole2, 550, expected)
 	t.checkACL(id, "", "", &t.noRole2, 441, expectedACL)
 	t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, &t.noRole2, 9, id,
 		[]byte("foobarbaz"))
@@ -2015,7 +2530,7 @@ func getExpectedACL(owner map[string]interface{}, readers []map[string]interface
 
 func (t *TestSuite) TestSetReadACLsFail() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.kBaseAdmin.token, 374, 200)
+		"Oauth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -2077,7 +2592,7 @@ func (t *TestSuite) TestSetReadACLsFail() {
 
 func (t *TestSuite) TestChangeOwner() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.noRole.token, 374, 200)
+		"Oauth "+t.noRole.token, 550, 200)
 	uid := t.getUserIDFromMongo(t.noRole.user)
 	t.loggerhook.Reset()
 
@@ -2093,7 +2608,7 @@ func (t *TestSuite) TestChangeOwner() {
 			"id":            id,
 			"format":        "",
 			"file": map[string]interface{}{
-				"checksum": map[string]interface{}{"md5": "6df23dc03f9b54cc38a0fc1483df6e21"},
+				"checksum": checksumsFor("foobarbaz"),
 				"name":     "",
 				"size":     float64(9),
 			},
@@ -2124,7 +2639,7 @@ func (t *TestSuite) TestChangeOwner() {
 	expectedACL := getExpectedACL(u2, []map[string]interface{}{owner}, false)
 	t.Equal(expectedACL, body, "incorrect acls")
 
-	t.checkNode(id, &t.noRole2, 374, expected)
+	t.checkNode(id, &t.noRole2, 550, expected)
 	t.checkACL(id, "", "", &t.noRole2, 441, expectedACL)
 	t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, &t.noRole2, 9, id,
 		[]byte("foobarbaz"))
@@ -2139,7 +2654,7 @@ func (t *TestSuite) TestChangeOwner() {
 	expectedACL = getExpectedACL(owner, []map[string]interface{}{u2}, true)
 	t.Equal(expectedACL, body, "incorrect acls")
 
-	t.checkNode(id, &t.noRole, 374, expected)
+	t.checkNode(id, &t.noRole, 550, expected)
 	t.checkACL(id, "", "?verbosity=full", &t.noRole, 721, expectedACL)
 	t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, &t.noRole, 9, id,
 		[]byte("foobarbaz"))
@@ -2147,7 +2662,7 @@ func (t *TestSuite) TestChangeOwner() {
 
 func (t *TestSuite) TestChangeOwnerFail() {
 	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
-		"Oauth "+t.kBaseAdmin.token, 374, 200)
+		"Oauth "+t.kBaseAdmin.token, 550, 200)
 	id := (body["data"].(map[string]interface{}))["id"].(string)
 	t.loggerhook.Reset()
 
@@ -2200,3 +2715,1521 @@ func (t *TestSuite) TestChangeOwnerFail() {
 		)
 	}
 }
+
+func bulkOK(id string, data interface{}) map[string]interface{} {
+	return map[string]interface{}{"id": id, "status": float64(200), "error": nil, "data": data}
+}
+
+func bulkErr(id string, code int, err string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":     id,
+		"status": float64(code),
+		"error":  []interface{}{err},
+		"data":   nil,
+	}
+}
+
+// returns the bulk response for a set of per node results and the length of the encoded
+// response.
+// checksumsFor returns the checksums the blobstore should report for a file's contents.
+func checksumsFor(contents string) map[string]interface{} {
+	m := md5.Sum([]byte(contents))
+	s1 := sha1.Sum([]byte(contents))
+	s256 := sha256.Sum256([]byte(contents))
+	c := make([]byte, 4)
+	binary.BigEndian.PutUint32(c, crc32.Checksum([]byte(contents),
+		crc32.MakeTable(crc32.Castagnoli)))
+	return map[string]interface{}{
+		"md5":    hex.EncodeToString(m[:]),
+		"sha1":   hex.EncodeToString(s1[:]),
+		"sha256": hex.EncodeToString(s256[:]),
+		"crc32c": hex.EncodeToString(c),
+	}
+}
+
+func getBulkResponse(results []interface{}) (map[string]interface{}, int64) {
+	ret := map[string]interface{}{"status": float64(200), "error": nil, "data": results}
+	b := new(bytes.Buffer)
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(ret)
+	return ret, int64(b.Len())
+}
+
+// makes a bulk request and checks the per node results against the expected results.
+func (t *TestSuite) bulkReq(method string, path string, user *User, body string,
+	expected []interface{}) {
+	ret, conlen := getBulkResponse(expected)
+	token := ""
+	if user != nil {
+		token = "OAuth " + user.token
+	}
+	got := t.req(method, t.url+path, strings.NewReader(body), token, conlen, 200)
+	t.Equal(ret, got, "incorrect bulk results")
+	t.checkLogs(logEvent{logrus.InfoLevel, method, path, 200, getUserName(user),
+		"request complete", mtmap(), false},
+	)
+}
+
+func (t *TestSuite) TestBulkNodes() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	node1 := body["data"].(map[string]interface{})
+	id1 := node1["id"].(string)
+	body = t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	node2 := body["data"].(map[string]interface{})
+	id2 := node2["id"].(string)
+	body = t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole2.token, 550, 200)
+	id3 := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+
+	missing := uuid.New().String()
+	ids := fmt.Sprintf(`{"ids": ["%s", "badid", "%s", "%s", "%s"]}`, id1, id3, missing, id2)
+
+	t.bulkReq("POST", "/bulk/node/get", &t.noRole, ids, []interface{}{
+		bulkOK(id1, node1),
+		bulkErr("badid", 404, "Node not found"),
+		bulkErr(id3, 401, "User Unauthorized"),
+		bulkErr(missing, 404, "Node not found"),
+		bulkOK(id2, node2),
+	})
+
+	owner := map[string]interface{}{
+		"uuid":     t.getUserIDFromMongo(t.noRole.user),
+		"username": t.noRole.user,
+	}
+	u2 := map[string]interface{}{
+		"uuid":     t.getUserIDFromMongo(t.noRole2.user),
+		"username": t.noRole2.user,
+	}
+	pubacl := getExpectedACL(owner, []map[string]interface{}{}, false)["data"]
+	pubacl.(map[string]interface{})["public"].(map[string]interface{})["read"] = true
+	longun := "Users that are not node owners can only delete themselves from ACLs."
+	t.bulkReq("PUT", "/bulk/node/acl/public_read", &t.noRole,
+		fmt.Sprintf(`{"ids": ["%s", "%s"]}`, id1, id3), []interface{}{
+			bulkOK(id1, pubacl),
+			bulkErr(id3, 400, longun),
+		})
+
+	// anonymous users can see public nodes
+	t.bulkReq("POST", "/bulk/node/get/", nil, ids, []interface{}{
+		bulkOK(id1, node1),
+		bulkErr("badid", 404, "Node not found"),
+		bulkErr(id3, 401, "User Unauthorized"),
+		bulkErr(missing, 404, "Node not found"),
+		bulkErr(id2, 401, "User Unauthorized"),
+	})
+
+	t.bulkReq("DELETE", "/bulk/node/acl/public_read/", &t.noRole,
+		fmt.Sprintf(`{"ids": ["%s"]}`, id1), []interface{}{
+			bulkOK(id1, getExpectedACL(owner, []map[string]interface{}{}, false)["data"]),
+		})
+
+	t.bulkReq("PUT", "/bulk/node/acl/read?verbosity=full", &t.noRole,
+		fmt.Sprintf(`{"ids": ["%s", "%s"], "users": ["  ", "%s"]}`, id1, id2, t.noRole2.user),
+		[]interface{}{
+			bulkOK(id1, getExpectedACL(owner, []map[string]interface{}{u2}, true)["data"]),
+			bulkOK(id2, getExpectedACL(owner, []map[string]interface{}{u2}, true)["data"]),
+		})
+
+	t.bulkReq("DELETE", "/bulk/node/acl/read/", &t.noRole,
+		fmt.Sprintf(`{"ids": ["%s"], "users": ["%s"]}`, id2, t.noRole2.user),
+		[]interface{}{
+			bulkOK(id2, getExpectedACL(owner, []map[string]interface{}{}, false)["data"]),
+		})
+
+	// noRole2 can read node1 but not node2
+	t.bulkReq("POST", "/bulk/node/get", &t.noRole2,
+		fmt.Sprintf(`{"ids": ["%s", "%s"]}`, id1, id2), []interface{}{
+			bulkOK(id1, node1),
+			bulkErr(id2, 401, "User Unauthorized"),
+		})
+
+	// copies have random IDs and times, but the same response length as the original node
+	_, conlen := getBulkResponse([]interface{}{
+		bulkOK(id1, node1),
+		bulkErr(missing, 404, "Node not found"),
+	})
+	got := t.req("POST", t.url+"/bulk/node/copy", strings.NewReader(
+		fmt.Sprintf(`{"ids": ["%s", "%s"]}`, id1, missing)), "OAuth "+t.noRole2.token, conlen,
+		200)
+	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/bulk/node/copy", 200, &t.noRole2.user,
+		"request complete", mtmap(), false},
+	)
+	res := got["data"].([]interface{})
+	t.Equal(2, len(res), "incorrect result count")
+	t.Equal(bulkErr(missing, 404, "Node not found"), res[1], "incorrect result")
+	cp := res[0].(map[string]interface{})
+	t.Equal(id1, cp["id"], "incorrect id")
+	t.Equal(float64(200), cp["status"], "incorrect status")
+	cpnode := cp["data"].(map[string]interface{})
+	t.NotEqual(id1, cpnode["id"], "expected new id")
+	t.Equal(node1["file"], cpnode["file"], "incorrect file")
+	t.checkACL(cpnode["id"].(string), "", "", &t.noRole2, 395,
+		getExpectedACL(u2, []map[string]interface{}{}, false))
+
+	t.bulkReq("POST", "/bulk/node/delete/", &t.noRole,
+		fmt.Sprintf(`{"ids": ["%s", "%s"]}`, id1, id3), []interface{}{
+			bulkOK(id1, nil),
+			bulkErr(id3, 401, "User Unauthorized"),
+		})
+	t.bulkReq("POST", "/bulk/node/get", &t.noRole,
+		fmt.Sprintf(`{"ids": ["%s", "%s"]}`, id1, id2), []interface{}{
+			bulkErr(id1, 404, "Node not found"),
+			bulkOK(id2, node2),
+		})
+}
+
+func (t *TestSuite) TestBulkNodesFail() {
+	ids := []string{}
+	for i := 0; i < 1001; i++ {
+		ids = append(ids, `"`+uuid.New().String()+`"`)
+	}
+	toomany := `{"ids": [` + strings.Join(ids, ",") + `]}`
+	invbody := "Request body must be a JSON object with an ids list"
+	noids := "At least one node ID is required"
+	id := `{"ids": ["` + uuid.New().String() + `"]}`
+
+	type testcase struct {
+		method    string
+		path      string
+		user      *User
+		body      string
+		status    int
+		errstring string
+		conlen    int64
+	}
+
+	testcases := []testcase{
+		testcase{"POST", "/bulk/node/get", nil, "", 400, invbody, 112},
+		testcase{"POST", "/bulk/node/get", nil, `["foo"]`, 400, invbody, 112},
+		testcase{"POST", "/bulk/node/get", nil, `{"ids": "foo"}`, 400, invbody, 112},
+		testcase{"POST", "/bulk/node/get", nil, `{"ids": []}`, 400, noids, 93},
+		testcase{"POST", "/bulk/node/get", nil, toomany, 400,
+			"At most 1000 node IDs may be provided", 98},
+		testcase{"POST", "/bulk/node/delete", nil, id, 401, "No Authorization", 77},
+		testcase{"POST", "/bulk/node/copy", nil, id, 401, "No Authorization", 77},
+		testcase{"PUT", "/bulk/node/acl/public_read", nil, id, 401, "No Authorization", 77},
+		testcase{"DELETE", "/bulk/node/acl/read", nil, id, 401, "No Authorization", 77},
+		testcase{"POST", "/bulk/node/delete", &t.noRole, "{}", 400, noids, 93},
+		testcase{"PUT", "/bulk/node/acl/read", &t.noRole, id, 400,
+			"Action requires a list of usernames in the users field", 115},
+		testcase{"DELETE", "/bulk/node/acl/read", &t.noRole,
+			`{"ids": ["foo"], "users": [" ", "\t"]}`, 400,
+			"Action requires a list of usernames in the users field", 115},
+		testcase{"PUT", "/bulk/node/acl/read", &t.noRole,
+			`{"ids": ["foo"], "users": ["superfakeuserimprettysure"]}`, 400,
+			"Invalid users: superfakeuserimprettysure", 101},
+	}
+
+	for _, tc := range testcases {
+		token := ""
+		if tc.user != nil {
+			token = "OAuth " + tc.user.token
+		}
+		body := t.req(tc.method, t.url+tc.path, strings.NewReader(tc.body), token, tc.conlen,
+			tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		t.checkLogs(logEvent{logrus.ErrorLevel, tc.method, tc.path, tc.status,
+			getUserName(tc.user), tc.errstring, mtmap(), false},
+		)
+	}
+}
+
+func (t *TestSuite) TestBulkArchive() {
+	body := t.req("POST", t.url+"/node?filename=f.txt", strings.NewReader("foo"),
+		"OAuth "+t.noRole.token, 555, 200)
+	id1 := (body["data"].(map[string]interface{}))["id"].(string)
+	body = t.req("POST", t.url+"/node?filename=f.txt", strings.NewReader("barbaz"),
+		"OAuth "+t.noRole.token, 555, 200)
+	id2 := (body["data"].(map[string]interface{}))["id"].(string)
+	body = t.req("POST", t.url+"/node", strings.NewReader("whee"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id3 := (body["data"].(map[string]interface{}))["id"].(string)
+	ids := fmt.Sprintf(`{"ids": ["%s", "%s", "%s"]}`, id1, id2, id3)
+	expected := [][]string{{"f.txt", "foo"}, {"f (1).txt", "barbaz"}, {id3, "whee"}}
+
+	for _, format := range []string{"", "?format=zip", "?format=tar"} {
+		t.loggerhook.Reset()
+		req, err := http.NewRequest("POST", t.url+"/bulk/node/archive"+format,
+			strings.NewReader(ids))
+		t.Nil(err, "unexpected error")
+		req.Header.Set("authorization", "oauth "+t.noRole.token)
+		resp, err := http.DefaultClient.Do(req)
+		t.Nil(err, "unexpected error")
+		t.Equal(200, resp.StatusCode, "incorrect statuscode")
+		b, err := ioutil.ReadAll(resp.Body)
+		t.Nil(err, "unexpected error")
+		t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/bulk/node/archive", 200, &t.noRole.user,
+			"request complete", mtmap(), false},
+		)
+		if format == "?format=tar" {
+			t.Equal("application/x-tar", resp.Header.Get("content-type"), "incorrect type")
+			t.Equal("attachment; filename=nodes.tar", resp.Header.Get("content-disposition"),
+				"incorrect content-disposition")
+			tr := tar.NewReader(bytes.NewReader(b))
+			for _, exp := range expected {
+				h, err := tr.Next()
+				t.Nil(err, "unexpected error")
+				t.Equal(exp[0], h.Name, "incorrect name")
+				data, _ := ioutil.ReadAll(tr)
+				t.Equal(exp[1], string(data), "incorrect data")
+			}
+			_, err = tr.Next()
+			t.Equal(io.EOF, err, "expected end of archive")
+		} else {
+			t.Equal("application/zip", resp.Header.Get("content-type"), "incorrect type")
+			t.Equal("attachment; filename=nodes.zip", resp.Header.Get("content-disposition"),
+				"incorrect content-disposition")
+			zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+			t.Nil(err, "unexpected error")
+			t.Equal(len(expected), len(zr.File), "incorrect file count")
+			for i, exp := range expected {
+				t.Equal(exp[0], zr.File[i].Name, "incorrect name")
+				rd, err := zr.File[i].Open()
+				t.Nil(err, "unexpected error")
+				data, _ := ioutil.ReadAll(rd)
+				t.Equal(exp[1], string(data), "incorrect data")
+			}
+		}
+	}
+}
+
+func (t *TestSuite) TestBulkArchiveFail() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id1 := (body["data"].(map[string]interface{}))["id"].(string)
+	body = t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole2.token, 550, 200)
+	id2 := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+
+	type testcase struct {
+		params    string
+		user      *User
+		body      string
+		status    int
+		errstring string
+		conlen    int64
+	}
+
+	testcases := []testcase{
+		testcase{"?format=rar", &t.noRole, `{"ids": ["` + id1 + `"]}`, 400,
+			"Invalid archive format: rar", 88},
+		testcase{"", &t.noRole, `{"ids": []}`, 400, "At least one node ID is required", 93},
+		testcase{"", &t.noRole, `{"ids": ["` + id1 + `", "foo"]}`, 404, "Node not found", 75},
+		testcase{"", &t.noRole, `{"ids": ["` + id1 + `", "` + uuid.New().String() + `"]}`, 404,
+			"Node not found", 75},
+		testcase{"", &t.noRole, `{"ids": ["` + id1 + `", "` + id2 + `"]}`, 401,
+			"User Unauthorized", 78},
+		testcase{"", nil, `{"ids": ["` + id1 + `"]}`, 401, "User Unauthorized", 78},
+	}
+
+	for _, tc := range testcases {
+		token := ""
+		if tc.user != nil {
+			token = "OAuth " + tc.user.token
+		}
+		body := t.req("POST", t.url+"/bulk/node/archive"+tc.params, strings.NewReader(tc.body),
+			token, tc.conlen, tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		t.checkLogs(logEvent{logrus.ErrorLevel, "POST", "/bulk/node/archive", tc.status,
+			getUserName(tc.user), tc.errstring, mtmap(), false},
+		)
+	}
+}
+
+func (t *TestSuite) countNodes() int64 {
+	count, err := t.mongoclient.Database(testDB).Collection("nodes").CountDocuments(
+		context.Background(), map[string]interface{}{})
+	t.Nil(err, "unexpected error")
+	return count
+}
+
+func (t *TestSuite) makeTarGz(files [][]string) io.Reader {
+	b := new(bytes.Buffer)
+	gw := gzip.NewWriter(b)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		tw.WriteHeader(&tar.Header{
+			Name: f[0], Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f[1]))})
+		tw.Write([]byte(f[1]))
+	}
+	t.Nil(tw.Close(), "unexpected error")
+	t.Nil(gw.Close(), "unexpected error")
+	return b
+}
+
+func (t *TestSuite) TestUnpackArchive() {
+	tgz := t.makeTarGz([][]string{{"./d/f1", "foo"}, {"empty", ""}, {"f2", "barbaz"}})
+	b := new(bytes.Buffer)
+	zw := zip.NewWriter(b)
+	f, _ := zw.Create("whee.txt")
+	f.Write([]byte("whee"))
+	t.Nil(zw.Close(), "unexpected error")
+
+	type testcase struct {
+		params   string
+		body     io.Reader
+		expected [][]string
+	}
+
+	testcases := []testcase{
+		testcase{"?archive_format=tar.gz&format=text", tgz, [][]string{
+			{"d/f1", "text", "foo"},
+			{"f2", "text", "barbaz"},
+		}},
+		testcase{"?archive_format=zip", b, [][]string{
+			{"whee.txt", "", "whee"},
+		}},
+	}
+
+	for _, tc := range testcases {
+		t.loggerhook.Reset()
+		req, err := http.NewRequest("POST", t.url+"/bulk/node/unpack"+tc.params, tc.body)
+		t.Nil(err, "unexpected error")
+		req.Header.Set("authorization", "oauth "+t.noRole.token)
+		resp, err := http.DefaultClient.Do(req)
+		t.Nil(err, "unexpected error")
+		t.Equal(200, resp.StatusCode, "incorrect statuscode")
+		var got map[string]interface{}
+		t.Nil(json.NewDecoder(resp.Body).Decode(&got), "unexpected error")
+		t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/bulk/node/unpack", 200, &t.noRole.user,
+			"request complete", mtmap(), false},
+		)
+
+		// IDs and times are generated, so pull them from the response
+		nodes := got["data"].([]interface{})
+		t.Equal(len(tc.expected), len(nodes), "incorrect node count")
+		expected := []interface{}{}
+		for i, e := range tc.expected {
+			n := nodes[i].(map[string]interface{})
+			expected = append(expected, map[string]interface{}{
+				"attributes":    nil,
+				"created_on":    n["created_on"],
+				"last_modified": n["created_on"],
+				"id":            n["id"],
+				"format":        e[1],
+				"file": map[string]interface{}{
+					"checksum": checksumsFor(e[2]),
+					"name":     e[0],
+					"size":     float64(len(e[2])),
+				},
+			})
+		}
+		ret, conlen := getBulkResponse(expected)
+		t.Equal(ret, got, "incorrect response")
+		t.Equal(conlen, resp.ContentLength, "incorrect content length")
+
+		for i, e := range tc.expected {
+			id := expected[i].(map[string]interface{})["id"].(string)
+			t.checkFile(t.url+"/node/"+id+"?download", "/node/"+id, &t.noRole,
+				int64(len(e[2])), path.Base(e[0]), []byte(e[2]))
+		}
+	}
+}
+
+func (t *TestSuite) TestUnpackArchiveFail() {
+	longname := strings.Repeat("a", 257)
+	nodes := t.countNodes()
+
+	type testcase struct {
+		params    string
+		user      *User
+		body      io.Reader
+		status    int
+		errstring string
+		conlen    int64
+	}
+
+	testcases := []testcase{
+		testcase{"?archive_format=tar", nil, strings.NewReader("foo"), 401,
+			"No Authorization", 77},
+		testcase{"?archive_format=rar", &t.noRole, strings.NewReader("foo"), 400,
+			"Invalid archive_format: rar", 88},
+		testcase{"", &t.noRole, strings.NewReader("foo"), 400, "Invalid archive_format: ", 85},
+		testcase{"?archive_format=zip", &t.noRole, strings.NewReader("foo"), 400,
+			"Invalid zip archive: zip: not a valid zip file", 107},
+		testcase{"?archive_format=tar.gz", &t.noRole, strings.NewReader("foo"), 400,
+			"Invalid gzip stream: unexpected EOF", 96},
+		// the first node is deleted when the second fails
+		testcase{"?archive_format=tar.gz", &t.noRole,
+			t.makeTarGz([][]string{{"f1", "foo"}, {longname, "bar"}}), 400,
+			"File name is > 256 bytes", 85},
+	}
+
+	for _, tc := range testcases {
+		t.loggerhook.Reset()
+		token := ""
+		if tc.user != nil {
+			token = "OAuth " + tc.user.token
+		}
+		body := t.req("POST", t.url+"/bulk/node/unpack"+tc.params, tc.body, token, tc.conlen,
+			tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		t.Equal(nodes, t.countNodes(), "nodes were created")
+	}
+}
+
+func (t *TestSuite) getACLETag(id string, user *User) string {
+	req, err := http.NewRequest(http.MethodGet, t.url+"/node/"+id+"/acl", nil)
+	t.Nil(err, "unexpected error")
+	req.Header.Set("authorization", "oauth "+user.token)
+	resp, err := http.DefaultClient.Do(req)
+	t.Nil(err, "unexpected error")
+	resp.Body.Close()
+	t.Equal(200, resp.StatusCode, "incorrect status code")
+	return resp.Header.Get("ETag")
+}
+
+func (t *TestSuite) nodeETag(method string, urell string, user *User) string {
+	req, err := http.NewRequest(method, urell, nil)
+	t.Nil(err, "unexpected error")
+	req.Header.Set("authorization", "oauth "+user.token)
+	resp, err := http.DefaultClient.Do(req)
+	t.Nil(err, "unexpected error")
+	resp.Body.Close()
+	t.Equal(200, resp.StatusCode, "incorrect status code")
+	return resp.Header.Get("ETag")
+}
+
+func (t *TestSuite) TestNodeETags() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+
+	t.Equal(`"1"`, t.nodeETag("GET", t.url+"/node/"+id, &t.noRole), "incorrect etag")
+	t.Equal(`"2"`, t.nodeETag("PUT", t.url+"/node/"+id+"?filename=f", &t.noRole),
+		"incorrect etag")
+	t.Equal(`"2"`, t.nodeETag("GET", t.url+"/node/"+id+"/", &t.noRole), "incorrect etag")
+	t.Equal(`"1"`, t.nodeETag("POST", t.url+"/node/"+id+"/copy", &t.noRole),
+		"incorrect etag")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) TestACLVersions() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.Equal(`"1"`, t.getACLETag(id, &t.noRole), "incorrect etag")
+	t.loggerhook.Reset()
+
+	type testcase struct {
+		method    string
+		urlsuffix string
+		ifmatch   string
+		status    int
+		errstring string
+		conlen    int64
+		etag      string
+	}
+
+	mismatch := "Node " + id + " is at version 2, not 1"
+	nomatch := "Node " + id + " is at version 2, which does not match "
+	readers := "read?users=" + t.noRole2.user + "," + t.stdRole.user
+	testcases := []testcase{
+		testcase{"PUT", "public_read", `"1"`, 200, "", 394, `"2"`},
+		testcase{"PUT", readers, `"1"`, 412, mismatch, 125, `"2"`},
+		testcase{"DELETE", "public_read", `"1"`, 412, mismatch, 125, `"2"`},
+		// no op changes still require a matching version
+		testcase{"PUT", "public_read", `"1"`, 412, mismatch, 125, `"2"`},
+		testcase{"PUT", "owner?users=" + t.noRole.user, `"1"`, 412, mismatch, 125, `"2"`},
+		testcase{"PUT", "read", "foo", 400, "Invalid If-Match header: foo", 89, `"2"`},
+		testcase{"PUT", "read", `"-1"`, 400, `Invalid If-Match header: "-1"`, 92, `"2"`},
+		testcase{"PUT", "read", `"2", foo`, 400, `Invalid If-Match header: "2", foo`, 96,
+			`"2"`},
+		// weak ETags never match
+		testcase{"PUT", readers, `W/"2"`, 412, nomatch + `W/"2"`, 148, `"2"`},
+		testcase{"PUT", readers, `"7", "8"`, 412, nomatch + `"7", "8"`, 153, `"2"`},
+		// each reader increments the version
+		testcase{"PUT", readers, `"7", W/"3", "2"`, 200, "", 486, `"4"`},
+		testcase{"DELETE", "public_read", "*", 200, "", 487, `"5"`},
+		testcase{"PUT", "public_read", `"4"`, 412, "Node " + id + " is at version 5, not 4",
+			125, `"5"`},
+	}
+
+	for _, tc := range testcases {
+		path := "/node/" + id + "/acl/" + tc.urlsuffix
+		body := t.reqWithHeaders(tc.method, t.url+path, nil, "OAuth "+t.noRole.token,
+			map[string]string{"If-Match": tc.ifmatch}, tc.conlen, tc.status)
+		logpath := strings.Split(path, "?")[0]
+		if tc.status == 200 {
+			t.checkLogs(logEvent{logrus.InfoLevel, tc.method, logpath, 200, &t.noRole.user,
+				"request complete", mtmap(), false},
+			)
+		} else {
+			t.checkError(body, tc.status, tc.errstring)
+			t.checkLogs(logEvent{logrus.ErrorLevel, tc.method, logpath, tc.status,
+				&t.noRole.user, tc.errstring, mtmap(), false},
+			)
+		}
+		t.Equal(tc.etag, t.getACLETag(id, &t.noRole), fmt.Sprintf("incorrect etag for %v", tc))
+		t.loggerhook.Reset()
+	}
+}
+
+func (t *TestSuite) reqWithHeaders(
+	method string,
+	urell string,
+	data io.Reader,
+	token string,
+	headers map[string]string,
+	contentLength int64,
+	statuscode int,
+) map[string]interface{} {
+	req, err := http.NewRequest(method, urell, data)
+	t.Nil(err, "unexpected error")
+	if token != "" {
+		req.Header.Set("authorization", token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return t.requestToJSON(req, contentLength, statuscode)
+}
+
+// checks and removes the time and request ID from audit records
+func (t *TestSuite) checkAuditRecords(body map[string]interface{}) []interface{} {
+	recs := body["data"].([]interface{})
+	for _, r := range recs {
+		rec := r.(map[string]interface{})
+		_, err := time.Parse(timeFormat, rec["time"].(string))
+		t.Nil(err, "unexpected error parsing time")
+		t.Equal(16, len(rec["requestid"].(string)), "incorrect request id length")
+		delete(rec, "time")
+		delete(rec, "requestid")
+	}
+	return recs
+}
+
+func (t *TestSuite) TestAuditLog() {
+	xff := map[string]string{"X-Forwarded-For": "1.2.3.4"}
+	body := t.reqWithHeaders("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, xff, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.reqWithHeaders("PUT", t.url+"/node/"+id+"/acl/read?users="+t.noRole2.user, nil,
+		"OAuth "+t.noRole.token, xff, 441, 200)
+	t.reqWithHeaders("PUT", t.url+"/node/"+id+"/acl/public_read", nil,
+		"OAuth "+t.kBaseAdmin.token, xff, 440, 200)
+	t.loggerhook.Reset()
+
+	state := func(readers []interface{}, public bool) map[string]interface{} {
+		return map[string]interface{}{"owner": "noroles", "read": readers, "public": public,
+			"filename": "", "format": ""}
+	}
+	r1 := []interface{}{"noroles"}
+	r2 := []interface{}{"noroles", "noroles2"}
+	create := map[string]interface{}{
+		"action": "create", "node": id, "source": nil, "user": "noroles", "admin": false,
+		"impersonator": nil, "ip": "1.2.3.4", "before": nil, "after": state(r1, false),
+	}
+	share := map[string]interface{}{
+		"action": "addreaders", "node": id, "source": nil, "user": "noroles", "admin": false,
+		"impersonator": nil, "ip": "1.2.3.4", "before": state(r1, false),
+		"after": state(r2, false),
+	}
+	pub := map[string]interface{}{
+		"action": "setpublic", "node": id, "source": nil, "user": "admin_kbase", "admin": true,
+		"impersonator": nil, "ip": "1.2.3.4", "before": state(r2, false),
+		"after": state(r2, true),
+	}
+
+	body = t.get(t.url+"/node/"+id+"/audit", &t.noRole, 1896, 200)
+	t.Equal([]interface{}{pub, share, create}, t.checkAuditRecords(body), "incorrect records")
+	t.checkLogs(logEvent{logrus.InfoLevel, "GET", "/node/" + id + "/audit", 200,
+		&t.noRole.user, "request complete", mtmap(), false},
+	)
+
+	body = t.get(t.url+"/node/"+id+"/audit/?limit=1", &t.kBaseAdmin, 742, 200)
+	t.Equal([]interface{}{pub}, t.checkAuditRecords(body), "incorrect records")
+	t.checkLogs(logEvent{logrus.InfoLevel, "GET", "/node/" + id + "/audit/", 200,
+		&t.kBaseAdmin.user, "request complete", mtmap(), false},
+	)
+
+	body = t.get(t.url+"/admin/audit?user=admin_kbase&node="+id, &t.stdRole, 742, 200)
+	t.Equal([]interface{}{pub}, t.checkAuditRecords(body), "incorrect records")
+	t.checkLogs(logEvent{logrus.InfoLevel, "GET", "/admin/audit", 200,
+		&t.stdRole.user, "request complete", mtmap(), false},
+	)
+
+	body = t.get(t.url+"/admin/audit/?user=noroles3", &t.stdRole, 51, 200)
+	t.Equal([]interface{}{}, t.checkAuditRecords(body), "incorrect records")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) TestAuditLogFail() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.req("PUT", t.url+"/node/"+id+"/acl/read?users="+t.noRole2.user, nil,
+		"OAuth "+t.noRole.token, 441, 200)
+	t.loggerhook.Reset()
+
+	type testcase struct {
+		path      string
+		user      *User
+		status    int
+		errstring string
+		conlen    int64
+	}
+
+	badlimit := "limit must be an integer > 0"
+	testcases := []testcase{
+		testcase{"/node/badid/audit", &t.noRole, 404, "Node not found", 75},
+		testcase{"/node/" + uuid.New().String() + "/audit", &t.noRole, 404, "Node not found",
+			75},
+		testcase{"/node/" + id + "/audit", nil, 401, "No Authorization", 77},
+		testcase{"/node/" + id + "/audit", &t.noRole2, 401, "User Unauthorized", 78},
+		testcase{"/node/" + id + "/audit?limit=0", &t.noRole, 400, badlimit, 89},
+		testcase{"/admin/audit", nil, 401, "No Authorization", 77},
+		testcase{"/admin/audit", &t.noRole, 401, "User Unauthorized", 78},
+		testcase{"/admin/audit?limit=foo", &t.stdRole, 400, badlimit, 89},
+		testcase{"/admin/audit?node=foo", &t.stdRole, 400, "Invalid node ID: foo", 81},
+	}
+
+	for _, tc := range testcases {
+		body := t.get(t.url+tc.path, tc.user, tc.conlen, tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		path := strings.Split(tc.path, "?")[0]
+		t.checkLogs(logEvent{logrus.ErrorLevel, "GET", path, tc.status, getUserName(tc.user),
+			tc.errstring, mtmap(), false},
+		)
+	}
+}
+
+func (t *TestSuite) TestCookieAuth() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+	cookie := func(user *User) string {
+		return "kbase_session=" + user.token
+	}
+
+	// the token is read from the cookie if there's no authorization header
+	body = t.reqWithHeaders("GET", t.url+"/node/"+id, nil, "",
+		map[string]string{"Cookie": cookie(&t.noRole)}, 550, 200)
+	t.Equal(id, body["data"].(map[string]interface{})["id"], "incorrect node")
+	t.checkLogs(logEvent{logrus.InfoLevel, "GET", "/node/" + id, 200, &t.noRole.user,
+		"request complete", mtmap(), false},
+	)
+
+	// the authorization header takes precedence
+	body = t.reqWithHeaders("GET", t.url+"/node/"+id, nil, "OAuth "+t.noRole2.token,
+		map[string]string{"Cookie": cookie(&t.noRole)}, 78, 401)
+	t.checkError(body, 401, "User Unauthorized")
+	t.checkLogs(logEvent{logrus.ErrorLevel, "GET", "/node/" + id, 401, &t.noRole2.user,
+		"User Unauthorized", mtmap(), false},
+	)
+
+	// requests that may alter data require the token in the CSRF header
+	for _, csrf := range []string{"", t.noRole2.token} {
+		headers := map[string]string{"Cookie": cookie(&t.noRole)}
+		if csrf != "" {
+			headers["X-CSRF-Token"] = csrf
+		}
+		body = t.reqWithHeaders("DELETE", t.url+"/node/"+id, nil, "", headers, 167, 403)
+		t.checkError(body, 403, csrfError)
+		t.checkLogs(logEvent{logrus.ErrorLevel, "DELETE", "/node/" + id, 403, nil,
+			csrfError, mtmap(), false},
+		)
+	}
+
+	body = t.reqWithHeaders("DELETE", t.url+"/node/"+id, nil, "",
+		map[string]string{"Cookie": cookie(&t.noRole), "X-CSRF-Token": t.noRole.token}, 53,
+		200)
+	t.Equal(map[string]interface{}{"status": float64(200), "data": nil, "error": nil}, body,
+		"incorrect response")
+	t.checkLogs(logEvent{logrus.InfoLevel, "DELETE", "/node/" + id, 200, &t.noRole.user,
+		"request complete", mtmap(), true},
+	)
+}
+
+func (t *TestSuite) TestReadAdmin() {
+	body := t.reqWithHeaders("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, map[string]string{"X-Forwarded-For": "1.2.3.4"}, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+
+	// read admins may read any node and audit record
+	body = t.get(t.url+"/node/"+id, &t.readAdmin, 550, 200)
+	t.Equal(id, body["data"].(map[string]interface{})["id"], "incorrect node")
+	t.checkLogs(logEvent{logrus.InfoLevel, "GET", "/node/" + id, 200, &t.readAdmin.user,
+		"request complete", mtmap(), false},
+	)
+
+	create := map[string]interface{}{
+		"action": "create", "node": id, "source": nil, "user": "noroles", "admin": false,
+		"impersonator": nil, "ip": "1.2.3.4", "before": nil,
+		"after": map[string]interface{}{"owner": "noroles", "read": []interface{}{"noroles"},
+			"public": false, "filename": "", "format": ""},
+	}
+	body = t.get(t.url+"/node/"+id+"/audit", &t.readAdmin, 541, 200)
+	t.Equal([]interface{}{create}, t.checkAuditRecords(body), "incorrect records")
+	body = t.get(t.url+"/admin/audit?node="+id, &t.readAdmin, 541, 200)
+	t.Equal([]interface{}{create}, t.checkAuditRecords(body), "incorrect records")
+	t.loggerhook.Reset()
+
+	// but may not alter or delete nodes they don't own
+	body = t.req("DELETE", t.url+"/node/"+id, nil, "OAuth "+t.readAdmin.token, 78, 401)
+	t.checkError(body, 401, "User Unauthorized")
+	t.checkLogs(logEvent{logrus.ErrorLevel, "DELETE", "/node/" + id, 401, &t.readAdmin.user,
+		"User Unauthorized", mtmap(), false},
+	)
+	body = t.req("PUT", t.url+"/node/"+id+"?filename=foo", nil, "OAuth "+t.readAdmin.token,
+		78, 401)
+	t.checkError(body, 401, "User Unauthorized")
+	t.loggerhook.Reset()
+	// or copy them, which creates a node
+	body = t.req("POST", t.url+"/node/"+id+"/copy", nil, "OAuth "+t.readAdmin.token, 78, 401)
+	t.checkError(body, 401, "User Unauthorized")
+	t.checkLogs(logEvent{logrus.ErrorLevel, "POST", "/node/" + id + "/copy", 401,
+		&t.readAdmin.user, "User Unauthorized", mtmap(), false},
+	)
+
+	body = t.get(t.url+"/node/"+id, &t.noRole, 550, 200)
+	t.Equal(id, body["data"].(map[string]interface{})["id"], "incorrect node")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) TestActAs() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+	actAs := func(user string) map[string]string {
+		return map[string]string{"X-Act-As": user, "X-Forwarded-For": "1.2.3.4"}
+	}
+	imp := map[string]interface{}{"impersonator": t.kBaseAdmin.user}
+
+	// the admin is treated exactly as the user would be
+	body = t.reqWithHeaders("GET", t.url+"/node/"+id, nil, "OAuth "+t.kBaseAdmin.token,
+		actAs(t.noRole.user), 550, 200)
+	t.Equal(id, body["data"].(map[string]interface{})["id"], "incorrect node")
+	t.checkLogs(logEvent{logrus.InfoLevel, "GET", "/node/" + id, 200, &t.noRole.user,
+		"request complete", imp, false},
+	)
+
+	body = t.reqWithHeaders("GET", t.url+"/node/"+id, nil, "OAuth "+t.kBaseAdmin.token,
+		actAs(t.noRole2.user), 78, 401)
+	t.checkError(body, 401, "User Unauthorized")
+	t.checkLogs(logEvent{logrus.ErrorLevel, "GET", "/node/" + id, 401, &t.noRole2.user,
+		"User Unauthorized", imp, false},
+	)
+
+	// changes made while acting as a user are flagged in the audit log
+	t.reqWithHeaders("PUT", t.url+"/node/"+id+"/acl/public_read", nil,
+		"OAuth "+t.kBaseAdmin.token, actAs(t.noRole.user), 394, 200)
+	t.loggerhook.Reset()
+	r1 := []interface{}{"noroles"}
+	body = t.get(t.url+"/node/"+id+"/audit?limit=1", &t.noRole, 704, 200)
+	t.Equal([]interface{}{map[string]interface{}{
+		"action": "setpublic", "node": id, "source": nil, "user": "noroles", "admin": false,
+		"impersonator": "admin_kbase", "ip": "1.2.3.4",
+		"before": map[string]interface{}{"owner": "noroles", "read": r1, "public": false,
+			"filename": "", "format": ""},
+		"after": map[string]interface{}{"owner": "noroles", "read": r1, "public": true,
+			"filename": "", "format": ""},
+	}}, t.checkAuditRecords(body), "incorrect records")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) TestActAsFail() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+
+	type testcase struct {
+		user      *User
+		actas     string
+		status    int
+		errstring string
+		conlen    int64
+	}
+
+	testcases := []testcase{
+		testcase{nil, t.noRole.user, 401, "No Authorization", 77},
+		testcase{&t.noRole2, t.noRole.user, 401, "User Unauthorized", 78},
+		testcase{&t.readAdmin, t.noRole.user, 401, "User Unauthorized", 78},
+		testcase{&t.kBaseAdmin, "fakename", 400, "Invalid users: fakename", 84},
+	}
+
+	for _, tc := range testcases {
+		token := ""
+		if tc.user != nil {
+			token = "OAuth " + tc.user.token
+		}
+		body := t.reqWithHeaders("GET", t.url+"/node/"+id, nil, token,
+			map[string]string{"X-Act-As": tc.actas}, tc.conlen, tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		t.checkLogs(logEvent{logrus.ErrorLevel, "GET", "/node/" + id, tc.status,
+			getUserName(tc.user), tc.errstring, mtmap(), false},
+		)
+	}
+}
+
+func (t *TestSuite) TestActAsAPIKeysFail() {
+	body := t.req("POST", t.url+"/apikey?scope=read", nil, "OAuth "+t.noRole.token, 328, 200)
+	kid, _ := t.checkAPIKey(body["data"], map[string]interface{}{"user": "noroles",
+		"name": "", "scope": "read", "nodes": []interface{}{}})
+	t.loggerhook.Reset()
+
+	actas := "API keys cannot be managed while acting as another user"
+	imp := map[string]interface{}{"impersonator": t.kBaseAdmin.user}
+	for _, tc := range [][]string{
+		{"POST", "/apikey?scope=read"},
+		{"GET", "/apikey"},
+		{"DELETE", "/apikey/" + kid},
+	} {
+		body := t.reqWithHeaders(tc[0], t.url+tc[1], nil, "OAuth "+t.kBaseAdmin.token,
+			map[string]string{"X-Act-As": t.noRole.user}, 116, 403)
+		t.checkError(body, 403, actas)
+		t.checkLogs(logEvent{logrus.ErrorLevel, tc[0], strings.Split(tc[1], "?")[0], 403,
+			&t.noRole.user, actas, imp, false},
+		)
+	}
+
+	// the key was not revoked
+	body = t.get(t.url+"/apikey", &t.noRole, 292, 200)
+	keys := body["data"].([]interface{})
+	t.Equal(1, len(keys), "incorrect key count")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) openEventStream(user *User, lastEventID string,
+) (*bufio.Reader, func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	req, err := http.NewRequest(http.MethodGet, t.url+"/events", nil)
+	t.Nil(err, "unexpected error")
+	req = req.WithContext(ctx)
+	req.Header.Set("authorization", "oauth "+user.token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		t.FailNow(err.Error())
+	}
+	t.Equal(200, resp.StatusCode, "incorrect status code")
+	t.Equal("text/event-stream", resp.Header.Get("content-type"), "incorrect content-type")
+	t.Equal("no-cache", resp.Header.Get("cache-control"), "incorrect cache-control")
+	return bufio.NewReader(resp.Body), func() {
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+// reads the next event from the stream and checks and removes the event time.
+func (t *TestSuite) readEvent(r *bufio.Reader) map[string]interface{} {
+	ev := map[string]interface{}{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.FailNow("error reading event stream: " + err.Error())
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(ev) == 0 {
+				continue
+			}
+			break
+		}
+		if strings.HasPrefix(line, ":") {
+			continue // comment
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if parts[0] == "data" {
+			var data map[string]interface{}
+			t.Nil(json.Unmarshal([]byte(parts[1]), &data), "unexpected error")
+			_, err := time.Parse(timeFormat, data["time"].(string))
+			t.Nil(err, "unexpected error")
+			delete(data, "time")
+			ev[parts[0]] = data
+		} else {
+			ev[parts[0]] = parts[1]
+		}
+	}
+	return ev
+}
+
+func (t *TestSuite) TestEventStream() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id1 := (body["data"].(map[string]interface{}))["id"].(string)
+	body = t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole2.token, 550, 200)
+	id2 := (body["data"].(map[string]interface{}))["id"].(string)
+	t.req("PUT", t.url+"/node/"+id1+"/acl/read?users="+t.noRole2.user, nil,
+		"OAuth "+t.noRole.token, 441, 200)
+	t.loggerhook.Reset()
+
+	event := func(seq int, typ string, id string, user string, owner string,
+		readers []interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"id":    strconv.Itoa(seq),
+			"event": typ,
+			"data": map[string]interface{}{
+				"seq":    float64(seq),
+				"type":   typ,
+				"node":   id,
+				"source": nil,
+				"user":   user,
+				"acl": map[string]interface{}{
+					"owner":  owner,
+					"read":   readers,
+					"public": false,
+				},
+			},
+		}
+	}
+	r2 := []interface{}{"noroles", "noroles2"}
+
+	// the creation of the first node isn't visible to noroles2
+	stream, cancel := t.openEventStream(&t.noRole2, "0")
+	t.Equal(event(2, "node.created", id2, "noroles2", "noroles2",
+		[]interface{}{"noroles2"}), t.readEvent(stream), "incorrect event")
+	t.Equal(event(3, "node.acl_changed", id1, "noroles", "noroles", r2),
+		t.readEvent(stream), "incorrect event")
+	cancel()
+
+	// resume after the last event
+	stream, cancel = t.openEventStream(&t.kBaseAdmin, "2")
+	t.Equal(event(3, "node.acl_changed", id1, "noroles", "noroles", r2),
+		t.readEvent(stream), "incorrect event")
+	cancel()
+
+	// live events
+	stream, cancel = t.openEventStream(&t.noRole, "")
+	defer cancel()
+	t.req("DELETE", t.url+"/node/"+id1, nil, "OAuth "+t.noRole.token, 53, 200)
+	t.Equal(event(4, "node.deleted", id1, "noroles", "noroles", r2),
+		t.readEvent(stream), "incorrect event")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) TestEventStreamFail() {
+	body := t.get(t.url+"/events", nil, 77, 401)
+	t.checkError(body, 401, "No Authorization")
+	t.checkLogs(logEvent{logrus.ErrorLevel, "GET", "/events", 401, nil,
+		"No Authorization", mtmap(), false},
+	)
+
+	body = t.reqWithHeaders("GET", t.url+"/events/", nil, "OAuth "+t.noRole.token,
+		map[string]string{"Last-Event-ID": "abc"}, 94, 400)
+	t.checkError(body, 400, "Invalid Last-Event-ID header: abc")
+	t.checkLogs(logEvent{logrus.ErrorLevel, "GET", "/events/", 400, &t.noRole.user,
+		"Invalid Last-Event-ID header: abc", mtmap(), false},
+	)
+}
+
+// checks and removes the ID, creation and expiration times, and key, if present, from an API
+// key, returning the ID and key. The key is expected to expire after 365 days unless the
+// expected map includes the number of days, which is not compared with the key.
+func (t *TestSuite) checkAPIKey(data interface{}, expected map[string]interface{},
+) (string, string) {
+	k := data.(map[string]interface{})
+	id := k["id"].(string)
+	_, err := uuid.Parse(id)
+	t.Nil(err, "unexpected error parsing id")
+	created, err := time.Parse(timeFormat, k["created"].(string))
+	t.Nil(err, "unexpected error parsing time")
+	expires, err := time.Parse(timeFormat, k["expires"].(string))
+	t.Nil(err, "unexpected error parsing time")
+	days := 365
+	exp := map[string]interface{}{}
+	for name, v := range expected {
+		if name == "days" {
+			days = v.(int)
+		} else {
+			exp[name] = v
+		}
+	}
+	t.Equal(time.Duration(days)*24*time.Hour, expires.Sub(created), "incorrect expiry")
+	delete(k, "id")
+	delete(k, "created")
+	delete(k, "expires")
+	key := ""
+	if sec, ok := k["key"]; ok {
+		key = sec.(string)
+		t.True(strings.HasPrefix(key, "bsk_"), "incorrect key prefix")
+		t.Equal(47, len(key), "incorrect key length")
+		delete(k, "key")
+	}
+	t.Equal(exp, k, "incorrect key")
+	return id, key
+}
+
+func (t *TestSuite) TestAPIKeys() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	node := body["data"].(map[string]interface{})
+	id := node["id"].(string)
+	body = t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id2 := (body["data"].(map[string]interface{}))["id"].(string)
+	t.loggerhook.Reset()
+
+	rkey := map[string]interface{}{"user": "noroles", "name": "cron job", "scope": "read",
+		"nodes": []interface{}{}}
+	body = t.req("POST", t.url+"/apikey?name=cron%20job&scope=read", nil,
+		"OAuth "+t.noRole.token, 336, 200)
+	rid, rsec := t.checkAPIKey(body["data"], rkey)
+	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/apikey", 200, &t.noRole.user,
+		"request complete", mtmap(), false},
+	)
+
+	wkey := map[string]interface{}{"user": "noroles", "name": "", "scope": "write",
+		"nodes": []interface{}{id}, "days": 30}
+	body = t.req("POST", t.url+"/apikey/?scope=write&days=30&nodes="+id+",%20"+id, nil,
+		"OAuth "+t.noRole.token, 379, 200)
+	wid, wsec := t.checkAPIKey(body["data"], wkey)
+	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/apikey/", 200, &t.noRole.user,
+		"request complete", mtmap(), false},
+	)
+
+	body = t.get(t.url+"/apikey", &t.noRole, 594, 200)
+	keys := body["data"].([]interface{})
+	t.Equal(2, len(keys), "incorrect key count")
+	gotrid, _ := t.checkAPIKey(keys[0], rkey)
+	gotwid, _ := t.checkAPIKey(keys[1], wkey)
+	t.Equal(rid, gotrid, "incorrect id")
+	t.Equal(wid, gotwid, "incorrect id")
+
+	body = t.get(t.url+"/apikey/", &t.noRole2, 51, 200)
+	t.Equal([]interface{}{}, body["data"], "incorrect keys")
+	t.loggerhook.Reset()
+
+	ruser := User{t.noRole.user, rsec}
+
+	// read only key
+	body = t.get(t.url+"/node/"+id, &ruser, 550, 200)
+	t.Equal(node, body["data"], "incorrect node")
+	t.checkLogs(logEvent{logrus.InfoLevel, "GET", "/node/" + id, 200, &t.noRole.user,
+		"request complete", map[string]interface{}{"apikey": rid}, false},
+	)
+	expected, conlen := getBulkResponse([]interface{}{bulkOK(id, node)})
+	got := t.req("POST", t.url+"/bulk/node/get", strings.NewReader(`{"ids": ["`+id+`"]}`),
+		"Bearer "+rsec, conlen, 200)
+	t.Equal(expected, got, "incorrect bulk results")
+	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/bulk/node/get", 200, &t.noRole.user,
+		"request complete", map[string]interface{}{"apikey": rid}, false},
+	)
+
+	// node restricted key
+	got = t.req("POST", t.url+"/bulk/node/get", strings.NewReader(`{"ids": ["`+id+`"]}`),
+		"Bearer "+wsec, conlen, 200)
+	t.Equal(expected, got, "incorrect bulk results")
+	t.checkLogs(logEvent{logrus.InfoLevel, "POST", "/bulk/node/get", 200, &t.noRole.user,
+		"request complete", map[string]interface{}{"apikey": wid}, false},
+	)
+	// user names are validated with the lookup token
+	t.req("PUT", t.url+"/node/"+id+"/acl/read?users="+t.noRole2.user, nil, "Bearer "+wsec,
+		441, 200)
+	t.checkLogs(logEvent{logrus.InfoLevel, "PUT", "/node/" + id + "/acl/read", 200,
+		&t.noRole.user, "request complete", map[string]interface{}{"apikey": wid}, false},
+	)
+	body = t.req("DELETE", t.url+"/node/"+id, nil, "Bearer "+wsec, 53, 200)
+	t.Equal(map[string]interface{}{"status": float64(200), "error": nil, "data": nil}, body,
+		"incorrect response")
+	t.checkLogs(logEvent{logrus.InfoLevel, "DELETE", "/node/" + id, 200, &t.noRole.user,
+		"request complete", map[string]interface{}{"apikey": wid}, false},
+	)
+
+	// revoke the read key
+	body = t.req("DELETE", t.url+"/apikey/"+rid, nil, "OAuth "+t.noRole.token, 53, 200)
+	t.Equal(map[string]interface{}{"status": float64(200), "error": nil, "data": nil}, body,
+		"incorrect response")
+	t.checkLogs(logEvent{logrus.InfoLevel, "DELETE", "/apikey/" + rid, 200, &t.noRole.user,
+		"request complete", mtmap(), false},
+	)
+	body = t.get(t.url+"/node/"+id2, &ruser, 100, 400)
+	t.checkError(body, 400, invalidAuthHeader)
+	t.checkLogs(logEvent{logrus.ErrorLevel, "GET", "/node/" + id2, 400, nil,
+		invalidAuthHeader, mtmap(), false},
+	)
+
+	body = t.get(t.url+"/apikey", &t.noRole, 347, 200)
+	keys = body["data"].([]interface{})
+	t.Equal(1, len(keys), "incorrect key count")
+	gotwid, _ = t.checkAPIKey(keys[0], wkey)
+	t.Equal(wid, gotwid, "incorrect id")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) TestAPIKeysFail() {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	body = t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+t.noRole.token, 550, 200)
+	id2 := (body["data"].(map[string]interface{}))["id"].(string)
+	body = t.req("POST", t.url+"/apikey?scope=read", nil, "OAuth "+t.noRole.token, 328, 200)
+	rid, rsec := t.checkAPIKey(body["data"], map[string]interface{}{"user": "noroles",
+		"name": "", "scope": "read", "nodes": []interface{}{}})
+	body = t.req("POST", t.url+"/apikey?scope=write", nil, "OAuth "+t.noRole.token, 329, 200)
+	wid, wsec := t.checkAPIKey(body["data"], map[string]interface{}{"user": "noroles",
+		"name": "", "scope": "write", "nodes": []interface{}{}})
+	body = t.req("POST", t.url+"/apikey?scope=write&nodes="+id, nil, "OAuth "+t.noRole.token,
+		379, 200)
+	nid, nsec := t.checkAPIKey(body["data"], map[string]interface{}{"user": "noroles",
+		"name": "", "scope": "write", "nodes": []interface{}{id}})
+	t.loggerhook.Reset()
+
+	type testcase struct {
+		method    string
+		path      string
+		token     string
+		keyid     string
+		status    int
+		errstring string
+		conlen    int64
+	}
+
+	forbidden := "API key scope does not permit this request"
+	noManage := "API keys cannot be used to manage API keys"
+	badScope := "API key scope must be read or write"
+	badDays := "days must be an integer from 1 to 365"
+	missing := uuid.New().String()
+	testcases := []testcase{
+		testcase{"POST", "/node", rsec, rid, 403, forbidden, 103},
+		testcase{"PUT", "/node/" + id, rsec, rid, 403, forbidden, 103},
+		testcase{"DELETE", "/node/" + id, rsec, rid, 403, forbidden, 103},
+		testcase{"PUT", "/node/" + id + "/acl/public_read", rsec, rid, 403, forbidden, 103},
+		testcase{"POST", "/node/" + id + "/copy", rsec, rid, 403, forbidden, 103},
+		testcase{"POST", "/bulk/node/delete", rsec, rid, 403, forbidden, 103},
+		testcase{"GET", "/node/" + id2, nsec, nid, 403, forbidden, 103},
+		testcase{"DELETE", "/node/" + id2 + "/", nsec, nid, 403, forbidden, 103},
+		testcase{"POST", "/node", nsec, nid, 403, forbidden, 103},
+		testcase{"POST", "/bulk/node/unpack", nsec, nid, 403, forbidden, 103},
+		testcase{"GET", "/events", nsec, nid, 403, forbidden, 103},
+		testcase{"GET", "/apikey", rsec, rid, 403, noManage, 103},
+		testcase{"POST", "/apikey?scope=read", wsec, wid, 403, noManage, 103},
+		testcase{"DELETE", "/apikey/" + wid, wsec, wid, 403, noManage, 103},
+		testcase{"GET", "/apikey", "", "", 401, "No Authorization", 77},
+		testcase{"POST", "/apikey?scope=read", "", "", 401, "No Authorization", 77},
+		testcase{"DELETE", "/apikey/" + rid, "", "", 401, "No Authorization", 77},
+		testcase{"POST", "/apikey", t.noRole.token, "", 400, badScope, 96},
+		testcase{"POST", "/apikey?scope=admin", t.noRole.token, "", 400, badScope, 96},
+		testcase{"POST", "/apikey?scope=read&nodes=foo", t.noRole.token, "", 400,
+			"Invalid node ID: foo", 81},
+		testcase{"POST", "/apikey?scope=read&days=0", t.noRole.token, "", 400, badDays, 99},
+		testcase{"POST", "/apikey?scope=read&days=366", t.noRole.token, "", 400, badDays, 99},
+		testcase{"POST", "/apikey?scope=read&days=foo", t.noRole.token, "", 400, badDays, 99},
+		testcase{"DELETE", "/apikey/foo", t.noRole.token, "", 404, "No such API key: foo", 81},
+		testcase{"DELETE", "/apikey/" + missing, t.noRole.token, "", 404,
+			"No such API key: " + missing, 114},
+		testcase{"DELETE", "/apikey/" + rid, t.noRole2.token, "", 404,
+			"No such API key: " + rid, 114},
+		testcase{"GET", "/node/" + id, "bsk_foo", "", 400, invalidAuthHeader, 100},
+	}
+
+	for _, tc := range testcases {
+		token := ""
+		if tc.token != "" {
+			token = "OAuth " + tc.token
+		}
+		body := t.req(tc.method, t.url+tc.path, nil, token, tc.conlen, tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		var user *string
+		if tc.token == t.noRole2.token {
+			user = &t.noRole2.user
+		} else if tc.token != "" && tc.token != "bsk_foo" {
+			user = &t.noRole.user
+		}
+		fields := mtmap()
+		if tc.keyid != "" {
+			fields["apikey"] = tc.keyid
+		}
+		t.checkLogs(logEvent{logrus.ErrorLevel, tc.method, strings.Split(tc.path, "?")[0],
+			tc.status, user, tc.errstring, fields, false},
+		)
+	}
+
+	// node restricted keys may only use bulk endpoints with permitted nodes
+	body = t.req("POST", t.url+"/bulk/node/get",
+		strings.NewReader(`{"ids": ["`+id+`", "`+id2+`"]}`), "OAuth "+nsec, 103, 403)
+	t.checkError(body, 403, forbidden)
+	t.checkLogs(logEvent{logrus.ErrorLevel, "POST", "/bulk/node/get", 403, &t.noRole.user,
+		forbidden, map[string]interface{}{"apikey": nid}, false},
+	)
+}
+
+func (t *TestSuite) getAuthCacheStats() map[string]interface{} {
+	req, err := http.NewRequest(http.MethodGet, t.url+"/admin/authcache", nil)
+	t.Nil(err, "unexpected error")
+	req.Header.Set("authorization", "oauth "+t.kBaseAdmin.token)
+	resp, err := http.DefaultClient.Do(req)
+	t.Nil(err, "unexpected error")
+	b, err := ioutil.ReadAll(resp.Body)
+	t.Nil(err, "unexpected error")
+	var body map[string]interface{}
+	json.Unmarshal(b, &body)
+	t.Equal(200, resp.StatusCode, "incorrect status code")
+	// the counts depend on the previous tests
+	t.checkHeaders(resp, "application/json", 158, 190, body)
+	t.loggerhook.Reset()
+	return body["data"].(map[string]interface{})
+}
+
+func (t *TestSuite) TestAuthCache() {
+	// the user may or may not be cached from earlier tests
+	t.req("DELETE", t.url+"/admin/authcache/user/noroles3", nil, "OAuth "+t.kBaseAdmin.token,
+		95, 200)
+	t.loggerhook.Reset()
+
+	s1 := t.getAuthCacheStats()
+	t.Equal(float64(10000), s1["maxsize"], "incorrect max size")
+	t.get(t.url+"/apikey", &t.noRole3, 51, 200)
+	s2 := t.getAuthCacheStats()
+	// the admin's stats request is a hit
+	t.Equal(s1["hits"].(float64)+1, s2["hits"], "incorrect hits")
+	t.Equal(s1["misses"].(float64)+1, s2["misses"], "incorrect misses")
+	t.Equal(s1["evictions"], s2["evictions"], "incorrect evictions")
+	t.Equal(s1["expirations"], s2["expirations"], "incorrect expirations")
+	t.Equal(s1["size"].(float64)+1, s2["size"], "incorrect size")
+
+	t.get(t.url+"/apikey", &t.noRole3, 51, 200)
+	s3 := t.getAuthCacheStats()
+	t.Equal(s2["hits"].(float64)+2, s3["hits"], "incorrect hits")
+	t.Equal(s2["misses"], s3["misses"], "incorrect misses")
+
+	body := t.req("DELETE", t.url+"/admin/authcache/user/noroles3/", nil,
+		"OAuth "+t.kBaseAdmin.token, 95, 200)
+	expected := map[string]interface{}{
+		"status": float64(200),
+		"error":  nil,
+		"data":   map[string]interface{}{"user": "noroles3", "flushed": float64(1)},
+	}
+	t.Equal(expected, body, "incorrect response")
+	t.checkLogs(logEvent{logrus.InfoLevel, "DELETE", "/admin/authcache/user/noroles3/", 200,
+		&t.kBaseAdmin.user, "request complete", mtmap(), false},
+	)
+	s4 := t.getAuthCacheStats()
+	t.Equal(s3["size"].(float64)-1, s4["size"], "incorrect size")
+
+	t.get(t.url+"/apikey", &t.noRole3, 51, 200)
+	s5 := t.getAuthCacheStats()
+	t.Equal(s4["misses"].(float64)+1, s5["misses"], "incorrect misses")
+}
+
+func (t *TestSuite) TestAuthCacheFail() {
+	type testcase struct {
+		method    string
+		path      string
+		user      *User
+		status    int
+		errstring string
+		conlen    int64
+	}
+
+	testcases := []testcase{
+		testcase{"GET", "/admin/authcache", nil, 401, "No Authorization", 77},
+		testcase{"GET", "/admin/authcache", &t.noRole, 401, "User Unauthorized", 78},
+		testcase{"DELETE", "/admin/authcache/user/noroles", nil, 401, "No Authorization", 77},
+		testcase{"DELETE", "/admin/authcache/user/noroles", &t.noRole, 401,
+			"User Unauthorized", 78},
+		testcase{"DELETE", "/admin/authcache/user/noroles", &t.readAdmin, 401,
+			"User Unauthorized", 78},
+	}
+
+	for _, tc := range testcases {
+		token := ""
+		if tc.user != nil {
+			token = "OAuth " + tc.user.token
+		}
+		body := t.req(tc.method, t.url+tc.path, nil, token, tc.conlen, tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		t.checkLogs(logEvent{logrus.ErrorLevel, tc.method, tc.path, tc.status,
+			getUserName(tc.user), tc.errstring, mtmap(), false},
+		)
+	}
+}
+
+func (t *TestSuite) createNodeWithReaders(user *User, readers ...*User) string {
+	body := t.req("POST", t.url+"/node", strings.NewReader("foobarbaz"),
+		"OAuth "+user.token, 550, 200)
+	id := (body["data"].(map[string]interface{}))["id"].(string)
+	for i, r := range readers {
+		t.req("PUT", t.url+"/node/"+id+"/acl/read?users="+r.user, nil, "OAuth "+user.token,
+			int64(395+46*(i+1)), 200)
+	}
+	t.loggerhook.Reset()
+	return id
+}
+
+func (t *TestSuite) TestRenameUser() {
+	id := t.createNodeWithReaders(&t.noRole)
+	uid := t.getUserIDFromMongo(t.noRole.user)
+	body := t.req("POST", t.url+"/apikey?scope=read", nil, "OAuth "+t.noRole.token, 328, 200)
+	kid, _ := t.checkAPIKey(body["data"], map[string]interface{}{"user": "noroles", "name": "",
+		"scope": "read", "nodes": []interface{}{}})
+	t.loggerhook.Reset()
+
+	body = t.reqWithHeaders("PUT", t.url+"/admin/user/noroles/rename?name=noroles3", nil,
+		"OAuth "+t.kBaseAdmin.token, map[string]string{"X-Forwarded-For": "1.2.3.4"}, 77, 200)
+	expected := map[string]interface{}{
+		"status": float64(200),
+		"error":  nil,
+		"data":   map[string]interface{}{"user": "noroles3"},
+	}
+	t.Equal(expected, body, "incorrect response")
+	t.checkLogs(logEvent{logrus.InfoLevel, "PUT", "/admin/user/noroles/rename", 200,
+		&t.kBaseAdmin.user, "request complete", mtmap(), false},
+	)
+
+	// the node now belongs to the renamed user, who keeps the same ID
+	renamed := map[string]interface{}{"uuid": uid, "username": t.noRole3.user}
+	t.checkACL(id, "", "?verbosity=full", &t.noRole3, 621,
+		getExpectedACL(renamed, []map[string]interface{}{}, true))
+	t.getNodeFailUnauth(id, &t.noRole)
+
+	// the change is recorded in the audit log
+	body = t.get(t.url+"/node/"+id+"/audit?limit=1", &t.noRole3, 702, 200)
+	t.Equal([]interface{}{map[string]interface{}{
+		"action": "renameuser", "node": id, "source": nil, "user": "admin_kbase",
+		"admin": true, "impersonator": nil, "ip": "1.2.3.4",
+		"before": map[string]interface{}{"owner": "noroles", "read": []interface{}{"noroles"},
+			"public": false, "filename": "", "format": ""},
+		"after": map[string]interface{}{"owner": "noroles3", "read": []interface{}{"noroles3"},
+			"public": false, "filename": "", "format": ""},
+	}}, t.checkAuditRecords(body), "incorrect records")
+
+	// the API key now belongs to the renamed user
+	body = t.get(t.url+"/apikey", &t.noRole3, 293, 200)
+	keys := body["data"].([]interface{})
+	t.Equal(1, len(keys), "incorrect key count")
+	gotid, _ := t.checkAPIKey(keys[0], map[string]interface{}{"user": "noroles3", "name": "",
+		"scope": "read", "nodes": []interface{}{}})
+	t.Equal(kid, gotid, "incorrect id")
+	t.loggerhook.Reset()
+
+	// the old name is now in use by a new user
+	body = t.req("PUT", t.url+"/admin/user/noroles3/rename/?name=noroles", nil,
+		"OAuth "+t.kBaseAdmin.token, 88, 409)
+	t.checkError(body, 409, "User noroles already exists")
+	t.checkLogs(logEvent{logrus.ErrorLevel, "PUT", "/admin/user/noroles3/rename/", 409,
+		&t.kBaseAdmin.user, "User noroles already exists", mtmap(), false},
+	)
+}
+
+func (t *TestSuite) TestMergeUsers() {
+	id1 := t.createNodeWithReaders(&t.noRole)
+	id2 := t.createNodeWithReaders(&t.noRole2, &t.noRole)
+	id3 := t.createNodeWithReaders(&t.noRole3, &t.noRole, &t.noRole2)
+
+	body := t.req("PUT", t.url+"/admin/user/noroles/merge?into=noroles2", nil,
+		"OAuth "+t.kBaseAdmin.token, 131, 200)
+	expected := map[string]interface{}{
+		"status": float64(200),
+		"error":  nil,
+		"data": map[string]interface{}{"user": "noroles", "into": "noroles2",
+			"owned": float64(1), "read": float64(2)},
+	}
+	t.Equal(expected, body, "incorrect response")
+	t.checkLogs(logEvent{logrus.InfoLevel, "PUT", "/admin/user/noroles/merge", 200,
+		&t.kBaseAdmin.user, "request complete", mtmap(), false},
+	)
+
+	u2 := map[string]interface{}{"uuid": t.getUserIDFromMongo(t.noRole2.user)}
+	u3 := map[string]interface{}{"uuid": t.getUserIDFromMongo(t.noRole3.user)}
+	none := []map[string]interface{}{}
+	t.checkACL(id1, "", "", &t.noRole2, 395, getExpectedACL(u2, none, false))
+	t.checkACL(id2, "", "", &t.noRole2, 395, getExpectedACL(u2, none, false))
+	t.checkACL(id3, "", "", &t.noRole2, 441,
+		getExpectedACL(u3, []map[string]interface{}{u2}, false))
+	for _, id := range []string{id1, id2, id3} {
+		t.getNodeFailUnauth(id, &t.noRole)
+	}
+}
+
+func (t *TestSuite) TestPurgeUser() {
+	id1 := t.createNodeWithReaders(&t.noRole, &t.noRole2)
+	id2 := t.createNodeWithReaders(&t.noRole2, &t.noRole)
+	t.req("POST", t.url+"/apikey?scope=read", nil, "OAuth "+t.noRole.token, 328, 200)
+	t.loggerhook.Reset()
+
+	body := t.req("DELETE", t.url+"/admin/user/noroles", nil, "OAuth "+t.kBaseAdmin.token,
+		107, 200)
+	expected := map[string]interface{}{
+		"status": float64(200),
+		"error":  nil,
+		"data": map[string]interface{}{"user": "noroles", "owned": float64(1),
+			"read": float64(1)},
+	}
+	t.Equal(expected, body, "incorrect response")
+	t.checkLogs(logEvent{logrus.InfoLevel, "DELETE", "/admin/user/noroles", 200,
+		&t.kBaseAdmin.user, "request complete", mtmap(), false},
+	)
+
+	body = t.get(t.url+"/node/"+id1, &t.noRole2, 75, 404)
+	t.checkError(body, 404, "Node not found")
+	t.loggerhook.Reset()
+	u2 := map[string]interface{}{"uuid": t.getUserIDFromMongo(t.noRole2.user)}
+	t.checkACL(id2, "", "", &t.noRole2, 395,
+		getExpectedACL(u2, []map[string]interface{}{}, false))
+	t.getNodeFailUnauth(id2, &t.noRole)
+
+	// the user's API keys are revoked
+	body = t.get(t.url+"/apikey", &t.noRole, 51, 200)
+	t.Equal([]interface{}{}, body["data"], "incorrect keys")
+	t.loggerhook.Reset()
+}
+
+func (t *TestSuite) TestUserAdminFail() {
+	type testcase struct {
+		method    string
+		path      string
+		user      *User
+		status    int
+		errstring string
+		conlen    int64
+	}
+
+	rename := "/admin/user/noroles2/rename"
+	merge := "/admin/user/noroles2/merge"
+	purge := "/admin/user/noroles2"
+	testcases := []testcase{
+		testcase{"PUT", rename, nil, 401, "No Authorization", 77},
+		testcase{"PUT", rename, &t.noRole, 401, "User Unauthorized", 78},
+		testcase{"PUT", rename, &t.readAdmin, 401, "User Unauthorized", 78},
+		testcase{"PUT", rename, &t.kBaseAdmin, 400, "Missing name parameter", 83},
+		testcase{"PUT", rename + "?name=fakename", &t.kBaseAdmin, 400,
+			"Invalid users: fakename", 84},
+		testcase{"PUT", rename + "?name=noroles3", &t.kBaseAdmin, 404,
+			"No such user noroles2", 82},
+		testcase{"PUT", merge, nil, 401, "No Authorization", 77},
+		testcase{"PUT", merge, &t.noRole, 401, "User Unauthorized", 78},
+		testcase{"PUT", merge, &t.readAdmin, 401, "User Unauthorized", 78},
+		testcase{"PUT", merge, &t.kBaseAdmin, 400, "Missing into parameter", 83},
+		testcase{"PUT", merge + "?into=fakename", &t.kBaseAdmin, 400,
+			"Invalid users: fakename", 84},
+		testcase{"PUT", merge + "?into=noroles2", &t.kBaseAdmin, 400,
+			"Cannot merge a user into itself", 92},
+		testcase{"PUT", merge + "?into=noroles", &t.kBaseAdmin, 404,
+			"No such user noroles2", 82},
+		testcase{"DELETE", purge, nil, 401, "No Authorization", 77},
+		testcase{"DELETE", purge, &t.noRole, 401, "User Unauthorized", 78},
+		testcase{"DELETE", purge, &t.readAdmin, 401, "User Unauthorized", 78},
+		// the failed merge doesn't create the user
+		testcase{"DELETE", purge, &t.kBaseAdmin, 404, "No such user noroles2", 82},
+	}
+
+	for _, tc := range testcases {
+		token := ""
+		if tc.user != nil {
+			token = "OAuth " + tc.user.token
+		}
+		body := t.req(tc.method, t.url+tc.path, nil, token, tc.conlen, tc.status)
+		t.checkError(body, tc.status, tc.errstring)
+		path := strings.Split(tc.path, "?")[0]
+		t.checkLogs(logEvent{logrus.ErrorLevel, tc.method, path, tc.status,
+			getUserName(tc.user), tc.errstring, mtmap(), false},
+		)
+	}
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,7 +16,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/kbase/blobstore/apikey"
+	"github.com/kbase/blobstore/audit"
 	"github.com/kbase/blobstore/core/values"
+	"github.com/kbase/blobstore/events"
 
 	"github.com/sirupsen/logrus"
 
@@ -36,6 +40,18 @@ const (
 	formCopyData = "copy_data"
 	formUpload   = "upload"
 	formFormat   = "format"
+
+	// actAsHeader is the header an admin uses to make a request with another user's permissions.
+	actAsHeader = "X-Act-As"
+	// csrfHeader is the header that must contain the user's token for requests that are
+	// authenticated with a cookie and may alter data.
+	csrfHeader = "X-CSRF-Token"
+	csrfError  = "Requests authenticated with a cookie that may alter data must include the " +
+		"token in the " + csrfHeader + " header"
+
+	eventPollInterval = time.Second
+	eventKeepAlive    = 15 * time.Second
+	eventBatchSize    = 100
 )
 
 // ServerStaticConf Static configuration items for the Server.
@@ -63,14 +79,17 @@ type Server struct {
 	staticconf       ServerStaticConf
 	auth             *authcache.Cache
 	store            *core.BlobStore
+	apikeys          apikey.Store
+	dispatcher       *events.Dispatcher
 	ignoreXIPheaders bool
+	authCookie       string
 }
 
 // New create a new server.
 func New(cfg *config.Config, sconf ServerStaticConf) (*Server, error) {
 	logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: "2006-01-02T15:04:05.000Z07:00"})
 	logrus.SetOutput(os.Stdout)
-	if cfg.AuthURL.Scheme != "https" {
+	if cfg.AuthURL != nil && cfg.AuthURL.Scheme != "https" {
 		logrus.Warnf("Insecure auth url " + cfg.AuthURL.String())
 	}
 	deps, err := constructDependencies(cfg)
@@ -83,7 +102,10 @@ func New(cfg *config.Config, sconf ServerStaticConf) (*Server, error) {
 		staticconf:       sconf,
 		auth:             deps.AuthCache,
 		store:            deps.BlobStore,
+		apikeys:          deps.APIKeys,
+		dispatcher:       deps.Dispatcher,
 		ignoreXIPheaders: cfg.DontTrustXIPHeaders,
+		authCookie:       cfg.AuthCookieName,
 	}
 	router.NotFoundHandler = http.HandlerFunc(s.notFoundHandler)
 	router.MethodNotAllowedHandler = http.HandlerFunc(s.notAllowedHandler)
@@ -98,6 +120,9 @@ func New(cfg *config.Config, sconf ServerStaticConf) (*Server, error) {
 	router.HandleFunc("/node/{id}", s.getNode).Methods(http.MethodGet)
 	router.HandleFunc("/node/{id}/", s.getNode).Methods(http.MethodGet)
 
+	router.HandleFunc("/node/{id}", s.setFileMetadata).Methods(http.MethodPut)
+	router.HandleFunc("/node/{id}/", s.setFileMetadata).Methods(http.MethodPut)
+
 	router.HandleFunc("/node/{id}", s.deleteNode).Methods(http.MethodDelete)
 	router.HandleFunc("/node/{id}/", s.deleteNode).Methods(http.MethodDelete)
 
@@ -112,6 +137,57 @@ func New(cfg *config.Config, sconf ServerStaticConf) (*Server, error) {
 	router.HandleFunc("/node/{id}/acl/{acltype}/", s.addNodeACL).Methods(http.MethodPut)
 	router.HandleFunc("/node/{id}/acl/{acltype}", s.removeNodeACL).Methods(http.MethodDelete)
 	router.HandleFunc("/node/{id}/acl/{acltype}/", s.removeNodeACL).Methods(http.MethodDelete)
+
+	router.HandleFunc("/bulk/node/get", s.bulkGetNodes).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/get/", s.bulkGetNodes).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/delete", s.bulkDeleteNodes).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/delete/", s.bulkDeleteNodes).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/copy", s.bulkCopyNodes).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/copy/", s.bulkCopyNodes).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/archive", s.bulkArchiveNodes).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/archive/", s.bulkArchiveNodes).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/unpack", s.unpackArchive).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/unpack/", s.unpackArchive).Methods(http.MethodPost)
+	router.HandleFunc("/bulk/node/acl/public_read", s.bulkAddPublic).Methods(http.MethodPut)
+	router.HandleFunc("/bulk/node/acl/public_read/", s.bulkAddPublic).Methods(http.MethodPut)
+	router.HandleFunc("/bulk/node/acl/public_read", s.bulkRemovePublic).
+		Methods(http.MethodDelete)
+	router.HandleFunc("/bulk/node/acl/public_read/", s.bulkRemovePublic).
+		Methods(http.MethodDelete)
+	router.HandleFunc("/bulk/node/acl/read", s.bulkAddReaders).Methods(http.MethodPut)
+	router.HandleFunc("/bulk/node/acl/read/", s.bulkAddReaders).Methods(http.MethodPut)
+	router.HandleFunc("/bulk/node/acl/read", s.bulkRemoveReaders).Methods(http.MethodDelete)
+	router.HandleFunc("/bulk/node/acl/read/", s.bulkRemoveReaders).Methods(http.MethodDelete)
+
+	router.HandleFunc("/node/{id}/audit", s.getNodeAudit).Methods(http.MethodGet)
+	router.HandleFunc("/node/{id}/audit/", s.getNodeAudit).Methods(http.MethodGet)
+
+	router.HandleFunc("/admin/audit", s.getAudit).Methods(http.MethodGet)
+	router.HandleFunc("/admin/audit/", s.getAudit).Methods(http.MethodGet)
+
+	router.HandleFunc("/admin/authcache", s.getAuthCacheStats).Methods(http.MethodGet)
+	router.HandleFunc("/admin/authcache/", s.getAuthCacheStats).Methods(http.MethodGet)
+	router.HandleFunc("/admin/authcache/user/{user}", s.flushAuthCacheUser).
+		Methods(http.MethodDelete)
+	router.HandleFunc("/admin/authcache/user/{user}/", s.flushAuthCacheUser).
+		Methods(http.MethodDelete)
+
+	router.HandleFunc("/admin/user/{user}/rename", s.renameUser).Methods(http.MethodPut)
+	router.HandleFunc("/admin/user/{user}/rename/", s.renameUser).Methods(http.MethodPut)
+	router.HandleFunc("/admin/user/{user}/merge", s.mergeUsers).Methods(http.MethodPut)
+	router.HandleFunc("/admin/user/{user}/merge/", s.mergeUsers).Methods(http.MethodPut)
+	router.HandleFunc("/admin/user/{user}", s.purgeUser).Methods(http.MethodDelete)
+	router.HandleFunc("/admin/user/{user}/", s.purgeUser).Methods(http.MethodDelete)
+
+	router.HandleFunc("/events", s.streamEvents).Methods(http.MethodGet)
+	router.HandleFunc("/events/", s.streamEvents).Methods(http.MethodGet)
+
+	router.HandleFunc("/apikey", s.createAPIKey).Methods(http.MethodPost)
+	router.HandleFunc("/apikey/", s.createAPIKey).Methods(http.MethodPost)
+	router.HandleFunc("/apikey", s.getAPIKeys).Methods(http.MethodGet)
+	router.HandleFunc("/apikey/", s.getAPIKeys).Methods(http.MethodGet)
+	router.HandleFunc("/apikey/{keyid}", s.deleteAPIKey).Methods(http.MethodDelete)
+	router.HandleFunc("/apikey/{keyid}/", s.deleteAPIKey).Methods(http.MethodDelete)
 	return s, nil
 }
 
@@ -120,6 +196,14 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
+// Close stops the server's background processes, such as webhook event delivery, waiting for
+// any in progress work to complete.
+func (s *Server) Close() {
+	if s.dispatcher != nil {
+		s.dispatcher.Stop()
+	}
+}
+
 type servkey struct {
 	k string
 }
@@ -135,13 +219,13 @@ func (s *Server) notAllowedHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) initLogger(r *http.Request) *logrus.Entry {
 	le := logrus.WithFields(logrus.Fields{
 		// at some point return rid to the user
-		"requestid": fmt.Sprintf("%016d", rand.Intn(10000000000000000)),
-		"service":   service,
-		"path":      r.URL.EscapedPath(),
-		"method":    r.Method,
-		"user":      nil,
+		core.LogFieldRequestID: fmt.Sprintf("%016d", rand.Intn(10000000000000000)),
+		"service":              service,
+		"path":                 r.URL.EscapedPath(),
+		"method":               r.Method,
+		"user":                 nil,
 	})
-	return le.WithField("ip", getIP(le, r, s.ignoreXIPheaders))
+	return le.WithField(core.LogFieldIP, getIP(le, r, s.ignoreXIPheaders))
 }
 
 func getIP(le *logrus.Entry, r *http.Request, ignoreXIPHeaders bool) string {
@@ -197,13 +281,60 @@ func getTokenFromHeader(r *http.Request) (string, error) {
 	if len(tokenparts) != 2 {
 		return "", errors.New(invalidAuthHeader)
 	}
-	if strings.ToLower(tokenparts[0]) != "oauth" {
+	scheme := strings.ToLower(tokenparts[0])
+	if scheme != "oauth" && scheme != "bearer" {
 		return "", errors.New(invalidAuthHeader)
 	}
 	return tokenparts[1], nil
 
 }
 
+// methods that never alter data and so may be authenticated with a cookie without CSRF
+// protection.
+var csrfSafeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// getTokenFromCookie returns the token from the named cookie, or the empty string if the
+// cookie name is empty or the cookie is absent. Since browsers send cookies with cross site
+// requests, requests that may alter data must also supply the token in the CSRF header, which
+// other sites cannot read or set.
+func getTokenFromCookie(r *http.Request, cookieName string) (string, error) {
+	if cookieName == "" {
+		return "", nil
+	}
+	cookie, err := r.Cookie(cookieName)
+	if err != nil { // the only possible error is no cookie
+		return "", nil
+	}
+	token := strings.TrimSpace(cookie.Value)
+	if token == "" || csrfSafeMethods[r.Method] {
+		return token, nil
+	}
+	csrf := strings.TrimSpace(r.Header.Get(csrfHeader))
+	if subtle.ConstantTimeCompare([]byte(csrf), []byte(token)) != 1 {
+		return "", errors.New(csrfError)
+	}
+	return token, nil
+}
+
+// getActAsUser returns the user a full administrator is acting as. The returned user never has
+// administration privileges, so the request is evaluated exactly as it would be for the user.
+// Read only administrators may not act as other users, as doing so would allow them to alter
+// the users' nodes.
+func (s *Server) getActAsUser(le *logrus.Entry, admin *auth.User, name string, token string,
+) (*auth.User, error) {
+	if !admin.IsAdmin() {
+		return nil, core.NewUnauthorizedError("Only admins may act as other users")
+	}
+	if err := s.auth.ValidateUserNames(le, &[]string{name}, token); err != nil {
+		return nil, err
+	}
+	return auth.NewUser(name, false)
+}
+
 func (s *Server) authLogMiddleWare(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// would like to split out the log middleware, but no way to pass the user up the stack
@@ -214,8 +345,28 @@ func (s *Server) authLogMiddleWare(next http.Handler) http.Handler {
 			writeErrorWithCode(le, err.Error(), 400, w)
 			return
 		}
+		if token == "" {
+			token, err = getTokenFromCookie(r, s.authCookie)
+			if err != nil {
+				writeErrorWithCode(le, err.Error(), http.StatusForbidden, w)
+				return
+			}
+		}
 		var user *auth.User
-		if token != "" {
+		var key *apikey.Key
+		if strings.HasPrefix(token, apikey.Prefix) {
+			user, key, err = s.getAPIKeyUser(token)
+			if err != nil {
+				writeError(le, err, w)
+				return
+			}
+			le = le.WithFields(logrus.Fields{
+				"user": user.GetUserName(), "apikey": key.ID.String()})
+			if !apiKeyPermits(key, r) {
+				writeErrorWithCode(le, apiKeyForbidden, http.StatusForbidden, w)
+				return
+			}
+		} else if token != "" {
 			var err error
 			user, err = s.auth.GetUser(le, token)
 			if err != nil {
@@ -224,6 +375,22 @@ func (s *Server) authLogMiddleWare(next http.Handler) http.Handler {
 			}
 			le = le.WithField("user", user.GetUserName())
 		}
+		if actas := strings.TrimSpace(r.Header.Get(actAsHeader)); actas != "" {
+			if user == nil {
+				// shock compatibility here
+				writeErrorWithCode(le, "No Authorization", http.StatusUnauthorized, w)
+				return
+			}
+			admin := user.GetUserName()
+			user, err = s.getActAsUser(le, user, actas, token)
+			if err != nil {
+				writeError(le, err, w)
+				return
+			}
+			le = le.WithFields(logrus.Fields{
+				"user": user.GetUserName(), core.LogFieldImpersonator: admin})
+		}
+		r = r.WithContext(context.WithValue(r.Context(), servkey{"apikey"}, key))
 		r = r.WithContext(context.WithValue(r.Context(), servkey{"user"}, user))
 		r = r.WithContext(context.WithValue(r.Context(), servkey{"log"}, le))
 		r = r.WithContext(context.WithValue(r.Context(), servkey{"token"}, token))
@@ -246,6 +413,13 @@ func (rec *statusRecorder) WriteHeader(code int) {
 	rec.ResponseWriter.WriteHeader(code)
 }
 
+// Flush implements http.Flusher, which is required for streaming responses.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func writeError(logentry *logrus.Entry, err error, w http.ResponseWriter) {
 	code, errstr := translateError(err)
 	writeErrorWithCode(logentry, errstr, code, w)
@@ -327,109 +501,144 @@ func (s *Server) createNodeFromForm(
 	form *multipart.Reader,
 	user auth.User,
 ) {
-	part := getNextFormPart(le, form, w)
-	if part == nil {
+	nodes := []*core.BlobNode{}
+	for {
+		node, copied, err := s.nodeFromFormParts(le, user, form, len(nodes) == 0)
+		if err == io.EOF {
+			break // only returned after the first node
+		}
+		if err == nil && len(nodes) >= maxBulkNodes {
+			nodes = append(nodes, node) // delete the new node as well
+			err = values.NewIllegalInputError(tooManyFormUploads)
+		}
+		if err != nil {
+			s.deleteCreatedNodes(le, user, nodes)
+			writeError(le, err, w)
+			return
+		}
+		if copied {
+			writeNode(w, node)
+			return
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 1 {
+		// Shock compatible response
+		writeNode(w, nodes[0])
 		return
 	}
+	data := []interface{}{}
+	for _, n := range nodes {
+		data = append(data, fromNodeToNode(n))
+	}
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   data,
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+// nodeFromFormParts reads optional format, md5, and sha256 parts followed by an upload or
+// copy_data part from the form and creates a node. copy_data is only allowed if first is true,
+// in which case copied is true.
+// Returns io.EOF if there are no more parts in the form and first is false.
+func (s *Server) nodeFromFormParts(
+	le *logrus.Entry,
+	user auth.User,
+	form *multipart.Reader,
+	first bool,
+) (node *core.BlobNode, copied bool, err error) {
+	part, err := form.NextPart()
+	if err == io.EOF && !first {
+		return nil, false, io.EOF
+	}
+	if err != nil {
+		return nil, false, formPartError(err)
+	}
 	defer part.Close()
 	format, _ := values.NewFileFormat("")
-	if part.FormName() == formFormat {
-		formatstr := getStringFromPart(le, part, 101, w)
-		if formatstr == nil {
-			return // dunno how to test this
+	checksums := &expectedChecksums{}
+	seen := map[string]bool{}
+	for isFormField(part.FormName()) && !seen[part.FormName()] {
+		seen[part.FormName()] = true
+		// 101 bytes for the format, and checksums are much smaller
+		value, err := getStringFromPart(part, 101)
+		if err != nil {
+			return nil, false, err // dunno how to test this
+		}
+		if part.FormName() == formFormat {
+			format, err = values.NewFileFormat(value)
+		} else {
+			err = checksums.add(part.FormName(), value, part.FormName()+" form part")
 		}
-		var err error
-		format, err = values.NewFileFormat(*formatstr)
 		if err != nil {
-			writeError(le, err, w)
-			return
+			return nil, false, err
 		}
 		part.Close()
-		part = getNextFormPart(le, form, w)
-		if part == nil {
-			return
+		part, err = form.NextPart()
+		if err != nil {
+			return nil, false, formPartError(err)
 		}
 		defer part.Close()
 	}
-	if part.FormName() == formCopyData {
-		s.copyNodeViaForm(le, user, part, w)
-		return
+	if part.FormName() == formCopyData && first {
+		node, err := s.copyNodeViaForm(le, user, part)
+		return node, true, err
 	} else if part.FormName() == formUpload {
 		cl, err := strconv.ParseInt(part.Header.Get("Content-Length"), 10, 64)
 		if err != nil || cl < 0 {
-			writeErrorWithCode(
-				le, "Valid Content-Length header >= 0 required for upload form part", 400, w)
-			return
+			return nil, false, values.NewIllegalInputError(
+				"Valid Content-Length header >= 0 required for upload form part")
 		}
 		filename, err := values.NewFileName(part.FileName())
 		if err != nil {
-			writeError(le, err, w)
-			return
-		}
-		node, err := s.store.Store(le, user, part, cl, *filename, *format)
-		if err != nil {
-			writeError(le, err, w)
-			return
+			return nil, false, err
 		}
-		writeNode(w, node)
-		return
-	} else {
-		writeErrorWithCode(le, "Unexpected form name: "+part.FormName(), 400, w)
-		return
+		node, err := s.store.Store(
+			le, user, part, cl, *filename, *format, checksums.options()...)
+		return node, false, err
 	}
+	return nil, false, values.NewIllegalInputError("Unexpected form name: " + part.FormName())
+}
+
+// isFormField returns true if the form part is a field that may precede an upload part.
+func isFormField(name string) bool {
+	return name == formFormat || name == checksumMD5 || name == checksumSHA256
 }
 
-func getStringFromPart(le *logrus.Entry, part *multipart.Part, len int, w http.ResponseWriter,
-) *string {
+func formPartError(err error) error {
+	if err == io.EOF {
+		return values.NewIllegalInputError("Expected form part, early EOF")
+	}
+	return values.NewIllegalInputError(err.Error())
+}
+
+func getStringFromPart(part *multipart.Part, len int) (string, error) {
 	buffer := make([]byte, len)
 	n, err := part.Read(buffer)
 	if err != nil && err != io.EOF {
 		// dunno how to test this
-		writeErrorWithCode(le, err.Error(), 400, w)
-		return nil
+		return "", values.NewIllegalInputError(err.Error())
 	}
-	s := string(buffer[:n])
-	return &s
-}
-
-func getNextFormPart(le *logrus.Entry, form *multipart.Reader, w http.ResponseWriter,
-) *multipart.Part {
-	part, err := form.NextPart()
-	if err != nil {
-		errstr := err.Error()
-		if err == io.EOF {
-			errstr = "Expected form part, early EOF"
-		}
-		writeErrorWithCode(le, errstr, 400, w)
-		return nil
-	}
-	return part
+	return string(buffer[:n]), nil
 }
 
 // caller must close part
-func (s *Server) copyNodeViaForm(
-	le *logrus.Entry,
-	user auth.User,
-	part *multipart.Part,
-	w http.ResponseWriter) {
+func (s *Server) copyNodeViaForm(le *logrus.Entry, user auth.User, part *multipart.Part,
+) (*core.BlobNode, error) {
 	// uuid is 36 ascii chars. We leave a few extra to throw errors if the submitted uuid is
 	// too long, rather than ignoring the extra chars.
-	uuidstr := getStringFromPart(le, part, 40, w)
-	if uuidstr == nil {
-		// dunno how to test this
-		return
-	}
-	cid, err := uuid.Parse(*uuidstr)
+	uuidstr, err := getStringFromPart(part, 40)
 	if err != nil {
-		writeErrorWithCode(le, "Invalid "+formCopyData+": "+err.Error(), 400, w)
-		return
+		// dunno how to test this
+		return nil, err
 	}
-	node, err := s.store.CopyNode(user, cid)
+	cid, err := uuid.Parse(uuidstr)
 	if err != nil {
-		writeError(le, err, w)
-		return
+		return nil, values.NewIllegalInputError("Invalid " + formCopyData + ": " + err.Error())
 	}
-	writeNode(w, node)
+	return s.store.CopyNode(le, user, cid)
 }
 
 func (s *Server) createNodeFromBody(
@@ -447,7 +656,13 @@ func (s *Server) createNodeFromBody(
 		writeError(le, err, w)
 		return
 	}
-	node, err := s.store.Store(le, user, r.Body, r.ContentLength, *filename, *format)
+	checksums, err := getExpectedChecksums(r)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	node, err := s.store.Store(le, user, r.Body, r.ContentLength, *filename, *format,
+		checksums.options()...)
 	if err != nil {
 		writeError(le, err, w)
 		return
@@ -473,7 +688,12 @@ func (s *Server) copyNode(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	node, err := s.store.CopyNode(*user, *id)
+	opts, err := s.getCopyOptions(le, r)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	node, err := s.store.CopyNode(le, *user, *id, opts...)
 	if err != nil {
 		writeError(le, err, w)
 		return
@@ -481,7 +701,54 @@ func (s *Server) copyNode(w http.ResponseWriter, r *http.Request) {
 	writeNode(w, node)
 }
 
+// getCopyOptions parses the options for a node copy from the request query parameters.
+// A filename or format parameter that is present but empty clears the value in the copy.
+func (s *Server) getCopyOptions(le *logrus.Entry, r *http.Request,
+) ([]func(*core.CopyOptions), error) {
+	opts := []func(*core.CopyOptions){}
+	for param, opt := range map[string]func() func(*core.CopyOptions){
+		"copy_readers": core.CopyReaders,
+		"copy_public":  core.CopyPublic,
+	} {
+		v := getQuery(r.URL, param)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, values.NewIllegalInputError(
+				fmt.Sprintf("Invalid %s parameter: %s", param, v))
+		}
+		if b {
+			opts = append(opts, opt())
+		}
+	}
+	if _, ok := r.URL.Query()["filename"]; ok {
+		filename, err := values.NewFileName(getQuery(r.URL, "filename"))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, core.CopyFileName(*filename))
+	}
+	if _, ok := r.URL.Query()["format"]; ok {
+		format, err := values.NewFileFormat(getQuery(r.URL, "format"))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, core.CopyFormat(*format))
+	}
+	if owner := getQuery(r.URL, "owner"); owner != "" {
+		err := s.validateUserNames(le, r, &[]string{owner})
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, core.CopyOwner(owner))
+	}
+	return opts, nil
+}
+
 func writeNode(w http.ResponseWriter, node *core.BlobNode) {
+	w.Header().Set("ETag", toETag(node.Version))
 	ret := map[string]interface{}{
 		"status": 200,
 		"error":  nil,
@@ -510,13 +777,14 @@ func (s *Server) getNode(w http.ResponseWriter, r *http.Request) {
 	user := getUser(r)
 	download := download(r.URL)
 	if download != "" {
-		datareader, size, filename, err := s.store.GetFile(user, *id)
+		datareader, size, node, err := s.store.GetFileWithNode(user, *id)
 		if err != nil {
 			writeError(le, err, w)
 			return
 		}
 		defer datareader.Close()
 		if download == "yes" {
+			filename := node.Filename
 			if filename == "" {
 				filename = id.String()
 			}
@@ -524,6 +792,7 @@ func (s *Server) getNode(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Header().Set("content-length", strconv.FormatInt(size, 10))
 		w.Header().Set("content-type", "application/octet-stream")
+		w.Header().Set("digest", getDigest(node))
 		io.Copy(w, datareader)
 	} else {
 		node, err := s.store.Get(user, *id)
@@ -551,11 +820,11 @@ func fromNodeToNode(node *core.BlobNode) map[string]interface{} {
 		"format":        node.Format,
 		"attributes":    nil, //deprecated
 		"created_on":    formatTime(node.Stored),
-		"last_modified": formatTime(node.Stored),
+		"last_modified": formatTime(node.Modified),
 		"file": map[string]interface{}{
 			"name":     node.Filename,
 			"size":     node.Size,
-			"checksum": map[string]string{"md5": node.MD5.GetMD5()},
+			"checksum": getChecksums(node),
 		},
 	}
 }
@@ -576,7 +845,7 @@ func (s *Server) deleteNode(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	err = s.store.DeleteNode(*user, *id)
+	err = s.store.DeleteNode(le, *user, *id)
 	if err != nil {
 		writeError(le, err, w)
 		return
@@ -633,6 +902,46 @@ func (s *Server) getACL(w http.ResponseWriter, r *http.Request) {
 	s.getAndWriteACL(le, w, r, user, *id)
 }
 
+// setFileMetadata sets the filename and / or format of a node from the query parameters.
+func (s *Server) setFileMetadata(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	id, err := getNodeID(le, w, r)
+	if err != nil {
+		return
+	}
+	user, err := getUserRequired(le, w, r)
+	if err != nil {
+		return
+	}
+	version, err := s.getIfMatch(r, user, *id)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	var filename *values.FileName
+	if _, ok := r.URL.Query()["filename"]; ok {
+		filename, err = values.NewFileName(getQuery(r.URL, "filename"))
+		if err != nil {
+			writeError(le, err, w)
+			return
+		}
+	}
+	var format *values.FileFormat
+	if _, ok := r.URL.Query()["format"]; ok {
+		format, err = values.NewFileFormat(getQuery(r.URL, "format"))
+		if err != nil {
+			writeError(le, err, w)
+			return
+		}
+	}
+	node, err := s.store.SetFileMetadata(le, *user, *id, filename, format, version)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	writeNode(w, node)
+}
+
 func (s *Server) addNodeACL(w http.ResponseWriter, r *http.Request) {
 	s.setNodeACL(w, r, true)
 }
@@ -652,9 +961,14 @@ func (s *Server) setNodeACL(w http.ResponseWriter, r *http.Request, add bool) {
 	if err != nil {
 		return
 	}
+	version, err := s.getIfMatch(r, user, *id)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
 	var node *core.BlobNode
 	if acltype == "public_read" {
-		node, err = s.store.SetNodePublic(*user, *id, add)
+		node, err = s.store.SetNodePublic(le, *user, *id, add, version)
 		if err != nil {
 			writeError(le, err, w)
 			return
@@ -665,9 +979,9 @@ func (s *Server) setNodeACL(w http.ResponseWriter, r *http.Request, add bool) {
 			return
 		}
 		if add {
-			node, err = s.store.AddReaders(*user, *id, *users)
+			node, err = s.store.AddReaders(le, *user, *id, *users, version)
 		} else {
-			node, err = s.store.RemoveReaders(*user, *id, *users)
+			node, err = s.store.RemoveReaders(le, *user, *id, *users, version)
 		}
 		if err != nil {
 			writeError(le, err, w)
@@ -682,7 +996,7 @@ func (s *Server) setNodeACL(w http.ResponseWriter, r *http.Request, add bool) {
 		if err != nil {
 			return
 		}
-		node, err = s.store.ChangeOwner(*user, *id, (*users)[0])
+		node, err = s.store.ChangeOwner(le, *user, *id, (*users)[0], version)
 		if err != nil {
 			writeError(le, err, w)
 			return
@@ -695,6 +1009,71 @@ func (s *Server) setNodeACL(w http.ResponseWriter, r *http.Request, add bool) {
 	}
 }
 
+func toETag(version int64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// getIfMatch returns the node version required by the If-Match header, or nil if the header
+// is absent or *. The header is parsed as a list of entity tags per RFC 7232. Versions are sent
+// as ETags, e.g. "3". If the header lists anything other than a single strong ETag, the
+// current node version is fetched and returned if it matches one of the ETags, so the change is
+// made only if the node is still at that version. Weak ETags never match, as If-Match requires
+// strong comparison.
+func (s *Server) getIfMatch(r *http.Request, user *auth.User, id uuid.UUID) (*int64, error) {
+	im := strings.TrimSpace(r.Header.Get("If-Match"))
+	if im == "" || im == "*" {
+		return nil, nil
+	}
+	tags, err := parseETags(im)
+	if err != nil {
+		return nil, err
+	}
+	versions := map[int64]bool{}
+	for _, t := range tags {
+		if !strings.HasPrefix(t, "W/") {
+			versions[parseETagVersion(t)] = true
+		}
+	}
+	if len(tags) == 1 && len(versions) == 1 {
+		ver := parseETagVersion(tags[0])
+		return &ver, nil
+	}
+	node, err := s.store.Get(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if !versions[node.Version] {
+		return nil, core.NewVersionMismatchError(fmt.Sprintf(
+			"Node %s is at version %d, which does not match %s", id, node.Version, im))
+	}
+	return &node.Version, nil
+}
+
+// parseETags splits an If-Match header into entity tags, which may be weak. Since blobstore
+// ETags are always integers, tags that are not integers are rejected.
+func parseETags(header string) ([]string, error) {
+	tags := []string{}
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		v := strings.TrimPrefix(t, "W/")
+		if len(v) < 2 || !strings.HasPrefix(v, "\"") || !strings.HasSuffix(v, "\"") {
+			return nil, values.NewIllegalInputError("Invalid If-Match header: " + header)
+		}
+		ver, err := strconv.ParseInt(v[1:len(v)-1], 10, 64)
+		if err != nil || ver < 0 {
+			return nil, values.NewIllegalInputError("Invalid If-Match header: " + header)
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// parseETagVersion returns the version from a strong ETag that has been checked by parseETags.
+func parseETagVersion(tag string) int64 {
+	ver, _ := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+	return ver
+}
+
 func getUserRequired(le *logrus.Entry, w http.ResponseWriter, r *http.Request,
 ) (*auth.User, error) {
 	user := getUser(r)
@@ -732,7 +1111,7 @@ func (s *Server) getUserList(
 		writeErrorWithCode(le, tooManyUsersError, 400, w)
 		return nil, errors.New(tooManyUsersError)
 	}
-	err := s.auth.ValidateUserNames(le, &ulst, getToken(r))
+	err := s.validateUserNames(le, r, &ulst)
 	if err != nil {
 		writeError(le, err, w)
 		return nil, err
@@ -757,6 +1136,7 @@ func (s *Server) getAndWriteACL(
 
 func (s *Server) writeACL(w http.ResponseWriter, r *http.Request, node *core.BlobNode) {
 	verbose := getQuery(r.URL, "verbosity") == "full"
+	w.Header().Set("ETag", toETag(node.Version))
 	ret := map[string]interface{}{
 		"status": 200,
 		"error":  nil,
@@ -797,3 +1177,346 @@ func toUser(user core.User, verbose bool) interface{} {
 	}
 	return user.ID.String()
 }
+
+func (s *Server) getNodeAudit(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	id, err := getNodeID(le, w, r)
+	if err != nil {
+		return
+	}
+	user, err := getUserRequired(le, w, r)
+	if err != nil {
+		return
+	}
+	limit, err := getLimit(r.URL)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	recs, err := s.store.GetNodeAuditRecords(*user, *id, limit)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	writeAuditRecords(w, recs)
+}
+
+func (s *Server) getAudit(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getUserRequired(le, w, r)
+	if err != nil {
+		return
+	}
+	limit, err := getLimit(r.URL)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	params := &audit.Params{Actor: getQuery(r.URL, "user"), Limit: limit}
+	if n := getQuery(r.URL, "node"); n != "" {
+		id, err := uuid.Parse(n)
+		if err != nil {
+			writeErrorWithCode(le, "Invalid node ID: "+n, 400, w)
+			return
+		}
+		params.NodeID = &id
+	}
+	recs, err := s.store.GetAuditRecords(*user, params)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	writeAuditRecords(w, recs)
+}
+
+// getAdminRequired returns the user if the user has at least the given level of admin
+// privileges and writes an error otherwise.
+func getAdminRequired(
+	le *logrus.Entry,
+	w http.ResponseWriter,
+	r *http.Request,
+	level auth.AdminLevel,
+) (*auth.User, error) {
+	user, err := getUserRequired(le, w, r)
+	if err != nil {
+		return nil, err
+	}
+	if user.GetAdminLevel() < level {
+		err := core.NewUnauthorizedError("Only admins may perform this action")
+		writeError(le, err, w)
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *Server) getAuthCacheStats(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	if _, err := getAdminRequired(le, w, r, auth.AdminRead); err != nil {
+		return
+	}
+	stats := s.auth.Stats()
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data": map[string]interface{}{
+			"hits":        stats.Hits,
+			"misses":      stats.Misses,
+			"evictions":   stats.Evictions,
+			"expirations": stats.Expirations,
+			"size":        stats.Size,
+			"maxsize":     stats.MaxSize,
+		},
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+// flushAuthCacheUser removes a user's tokens from the auth cache, e.g. after their admin roles
+// change.
+func (s *Server) flushAuthCacheUser(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	if _, err := getAdminRequired(le, w, r, auth.AdminFull); err != nil {
+		return
+	}
+	user := mux.Vars(r)["user"]
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   map[string]interface{}{"user": user, "flushed": s.auth.FlushUser(user)},
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+// renameUser changes a user's account name, keeping the user's nodes and read ACL entries.
+func (s *Server) renameUser(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getAdminRequired(le, w, r, auth.AdminFull)
+	if err != nil {
+		return
+	}
+	name, err := s.getValidUserParam(le, w, r, "name")
+	if err != nil {
+		return
+	}
+	err = s.store.RenameUser(le, *user, mux.Vars(r)["user"], name)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   map[string]interface{}{"user": name},
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+// mergeUsers transfers a user's nodes and read ACL entries to another user.
+func (s *Server) mergeUsers(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getAdminRequired(le, w, r, auth.AdminFull)
+	if err != nil {
+		return
+	}
+	into, err := s.getValidUserParam(le, w, r, "into")
+	if err != nil {
+		return
+	}
+	from := mux.Vars(r)["user"]
+	changes, err := s.store.MergeUsers(le, *user, from, into)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	writeUserChanges(w, map[string]interface{}{"user": from, "into": into}, changes)
+}
+
+// purgeUser deletes a user's nodes and removes the user from all read ACLs.
+func (s *Server) purgeUser(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getAdminRequired(le, w, r, auth.AdminFull)
+	if err != nil {
+		return
+	}
+	purged := mux.Vars(r)["user"]
+	changes, err := s.store.PurgeUser(le, *user, purged)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	writeUserChanges(w, map[string]interface{}{"user": purged}, changes)
+}
+
+// getValidUserParam gets a user name from a query parameter and checks it with the
+// authentication provider.
+func (s *Server) getValidUserParam(
+	le *logrus.Entry,
+	w http.ResponseWriter,
+	r *http.Request,
+	param string,
+) (string, error) {
+	name := getQuery(r.URL, param)
+	if name == "" {
+		err := values.NewIllegalInputError(fmt.Sprintf("Missing %s parameter", param))
+		writeError(le, err, w)
+		return "", err
+	}
+	err := s.validateUserNames(le, r, &[]string{name})
+	if err != nil {
+		writeError(le, err, w)
+		return "", err
+	}
+	return name, nil
+}
+
+func writeUserChanges(
+	w http.ResponseWriter,
+	data map[string]interface{},
+	changes *core.UserChanges,
+) {
+	data["owned"] = changes.Owned
+	data["read"] = changes.Read
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   data,
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+func getLimit(u *url.URL) (int, error) {
+	l := getQuery(u, "limit")
+	if l == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(l)
+	if err != nil || limit < 1 {
+		return 0, values.NewIllegalInputError("limit must be an integer > 0")
+	}
+	return limit, nil
+}
+
+func writeAuditRecords(w http.ResponseWriter, recs []*audit.Record) {
+	data := []interface{}{}
+	for _, rec := range recs {
+		data = append(data, fromAuditRecord(rec))
+	}
+	ret := map[string]interface{}{
+		"status": 200,
+		"error":  nil,
+		"data":   data,
+	}
+	encodeToJSON(w, 200, &ret)
+}
+
+func fromAuditRecord(rec *audit.Record) map[string]interface{} {
+	var source interface{}
+	if rec.SourceNodeID != nil {
+		source = rec.SourceNodeID.String()
+	}
+	var imp interface{}
+	if rec.Impersonator != "" {
+		imp = rec.Impersonator
+	}
+	return map[string]interface{}{
+		"time":         formatTime(rec.Time),
+		"action":       string(rec.Action),
+		"node":         rec.NodeID.String(),
+		"source":       source,
+		"user":         rec.Actor,
+		"admin":        rec.ActorIsAdmin,
+		"impersonator": imp,
+		"ip":           rec.IP,
+		"requestid":    rec.RequestID,
+		"before":       fromNodeState(rec.Before),
+		"after":        fromNodeState(rec.After),
+	}
+}
+
+func fromNodeState(state *audit.NodeState) interface{} {
+	if state == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"owner":    state.Owner,
+		"read":     state.Readers,
+		"public":   state.Public,
+		"filename": state.Filename,
+		"format":   state.Format,
+	}
+}
+
+// streamEvents streams events for nodes the user can read as server-sent events until the
+// client disconnects. If the Last-Event-ID header is present, the stream resumes after the
+// event with that ID, otherwise it starts with the next event.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	le := getLogger(r)
+	user, err := getUserRequired(le, w, r)
+	if err != nil {
+		return
+	}
+	after, err := s.getLastEventID(r)
+	if err != nil {
+		writeError(le, err, w)
+		return
+	}
+	notify, cancel := s.store.SubscribeEvents()
+	defer cancel()
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	keepalive := time.NewTicker(eventKeepAlive)
+	defer keepalive.Stop()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no") // prevent nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+	for {
+		evs, last, err := s.store.GetEvents(*user, after, eventBatchSize)
+		if err != nil {
+			// too late to send an error response, so close the stream. The client will
+			// reconnect with the last event ID.
+			le.WithField("error", err.Error()).Error("could not get events for stream")
+			return
+		}
+		for _, ev := range evs {
+			b, _ := ev.MarshalJSON() // can't fail
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, b)
+		}
+		if len(evs) > 0 {
+			flush(w)
+		}
+		if last != after {
+			// there may be more events
+			after = last
+			continue
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-notify:
+		case <-poll.C:
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			flush(w)
+		}
+	}
+}
+
+func (s *Server) getLastEventID(r *http.Request) (int64, error) {
+	id := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+	if id == "" {
+		return s.store.GetLastEventSeq()
+	}
+	seq, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || seq < 0 {
+		return -1, values.NewIllegalInputError("Invalid Last-Event-ID header: " + id)
+	}
+	return seq, nil
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}